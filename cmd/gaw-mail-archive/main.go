@@ -0,0 +1,242 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+/*
+Imports mbox files and Maildirs into an IMAP mailbox encrypting every message, and exports
+mailboxes, decrypted or as they are stored.
+
+	gaw-mail-archive -addr mail.example.org:993 -user alice -keyring alice.asc -mailbox Archive import old.mbox
+	gaw-mail-archive -addr mail.example.org:993 -user alice -keyring secret.asc -decrypt -maildir export backup/
+
+The convert command encrypts or decrypts files offline, without a server:
+
+	gaw-mail-archive -keyring secret.asc -decrypt convert Maildir/ plain.mbox
+
+Sources are read as Maildir if they are directories, destinations are written as Maildir if
+-maildir is given. Flags and dates are preserved. The password is read from the environment
+variable GAW_MAIL_PASSWORD, the passphrase of the secret keys from GAW_MAIL_PASSPHRASE.
+
+The imported messages are appended as they are, so -addr must be the storage server and not a
+gateway, and exported messages are only decrypted with -decrypt.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	
+	"github.com/emersion/go-imap/backend"
+	"golang.org/x/crypto/openpgp"
+	
+	"github.com/mad-day/gaw-mail/format"
+	"github.com/mad-day/gaw-mail/mailfile"
+	"github.com/mad-day/gaw-mail/ngcrypt"
+	proxy "github.com/mad-day/gaw-mail/imap-proxy"
+)
+
+var (
+	addr = flag.String("addr","","IMAP server address (host:port)")
+	security = flag.String("security","tls","none, starttls or tls")
+	username = flag.String("user","","IMAP username")
+	mailboxName = flag.String("mailbox","INBOX","the mailbox to import into or export from")
+	keyring = flag.String("keyring","","armored keyring; public keys are encrypted to, secret keys sign and decrypt")
+	recipients = flag.String("to","","armored public keyring of the recipients (default: -keyring)")
+	target = flag.String("format","ngcrypt","import and convert: plain, inline, wrap, pgp-mime or ngcrypt")
+	decrypt = flag.Bool("decrypt",false,"export and convert: decrypt the messages instead of encrypting them")
+	maildir = flag.Bool("maildir",false,"write the destination as Maildir instead of mbox")
+	cleaner = flag.String("cleaner","","ngcrypt: header cleaner spec (default: radical)")
+	compression = flag.String("compression","deflate","ngcrypt: deflate, zstd or none")
+	binary = flag.Bool("binary",false,"ngcrypt: binary blocks")
+	splitParts = flag.Bool("split",false,"ngcrypt: split the body into parts")
+)
+
+func readKeyring(path string) (openpgp.EntityList,error) {
+	f,err := os.Open(path)
+	if err!=nil { return nil,err }
+	defer f.Close()
+	return openpgp.ReadArmoredKeyRing(f)
+}
+
+func unlockKeys(kr openpgp.EntityList, passphrase []byte) error {
+	for _,e := range kr {
+		if e.PrivateKey!=nil && e.PrivateKey.Encrypted {
+			if err := e.PrivateKey.Decrypt(passphrase); err!=nil { return err }
+		}
+		for _,sk := range e.Subkeys {
+			if sk.PrivateKey!=nil && sk.PrivateKey.Encrypted {
+				if err := sk.PrivateKey.Decrypt(passphrase); err!=nil { return err }
+			}
+		}
+	}
+	return nil
+}
+
+func dial() (*proxy.Backend,error) {
+	switch *security {
+	case "none": return proxy.NewNoTLS(*addr),nil
+	case "starttls": return proxy.New(*addr),nil
+	case "tls": return proxy.NewTLS(*addr,nil),nil
+	}
+	return nil,fmt.Errorf("unknown security %q",*security)
+}
+
+func targetOf(keys openpgp.EntityList) (t format.Target,err error) {
+	if t.Format,err = format.ParseMessageFormat(*target); err!=nil { return }
+	
+	t.To = keys
+	if *recipients!="" {
+		if t.To,err = readKeyring(*recipients); err!=nil { return }
+	}
+	for _,e := range keys {
+		if e.PrivateKey!=nil { t.Signed = e; break }
+	}
+	
+	if *cleaner!="" {
+		var cc *ngcrypt.CleanerConfig
+		if cc,err = ngcrypt.ParseCleanerConfig(*cleaner); err!=nil { return }
+		cc.HashKey = []byte(os.Getenv("GAW_MAIL_HASHKEY"))
+		if t.Cleaner,err = cc.Build(); err!=nil { return }
+	}
+	o := new(ngcrypt.Options)
+	if o.Compression,err = ngcrypt.ParseCompression(*compression); err!=nil { return }
+	o.Binary = *binary
+	o.Split = *splitParts
+	t.Options = o
+	return
+}
+
+func filter(keys openpgp.EntityList, encrypt bool) (mailfile.Filter,error) {
+	if *decrypt {
+		if len(keys)==0 { return nil,fmt.Errorf("-decrypt needs -keyring") }
+		return mailfile.Decrypt(keys),nil
+	}
+	if !encrypt { return nil,nil }
+	t,err := targetOf(keys)
+	if err!=nil { return nil,err }
+	return mailfile.Encrypt(&t),nil
+}
+
+func openSource(path string) (mailfile.Reader,func(),error) {
+	fi,err := os.Stat(path)
+	if err!=nil { return nil,nil,err }
+	if fi.IsDir() {
+		r,err := mailfile.OpenMaildir(path)
+		return r,func() {},err
+	}
+	f,err := os.Open(path)
+	if err!=nil { return nil,nil,err }
+	return mailfile.NewMboxReader(f),func() { f.Close() },nil
+}
+
+func createDest(path string) (mailfile.Writer,error) {
+	if *maildir { return mailfile.CreateMaildir(path) }
+	f,err := os.OpenFile(path,os.O_WRONLY|os.O_CREATE|os.O_EXCL,0600)
+	if err!=nil { return nil,err }
+	return mailfile.NewMboxWriter(f),nil
+}
+
+func login() (backend.User,error) {
+	if *addr=="" || *username=="" { return nil,fmt.Errorf("-addr and -user are required") }
+	be,err := dial()
+	if err!=nil { return nil,err }
+	return be.Login(nil,*username,os.Getenv("GAW_MAIL_PASSWORD"))
+}
+
+func run(cmd string, args []string, keys openpgp.EntityList) (n int, err error) {
+	switch {
+	case cmd=="import" && len(args)==1:
+		r,done,err := openSource(args[0])
+		if err!=nil { return 0,err }
+		defer done()
+		f,err := filter(keys,true)
+		if err!=nil { return 0,err }
+		
+		u,err := login()
+		if err!=nil { return 0,err }
+		defer u.Logout()
+		mbox,err := u.GetMailbox(*mailboxName)
+		if err!=nil {
+			if err = u.CreateMailbox(*mailboxName); err!=nil { return 0,err }
+			if mbox,err = u.GetMailbox(*mailboxName); err!=nil { return 0,err }
+		}
+		return mailfile.Import(mbox,r,f)
+	case cmd=="export" && len(args)==1:
+		f,err := filter(keys,false)
+		if err!=nil { return 0,err }
+		
+		u,err := login()
+		if err!=nil { return 0,err }
+		defer u.Logout()
+		mbox,err := u.GetMailbox(*mailboxName)
+		if err!=nil { return 0,err }
+		
+		w,err := createDest(args[0])
+		if err!=nil { return 0,err }
+		n,err = mailfile.Export(w,mbox,f)
+		if e := w.Close(); err==nil { err = e }
+		return n,err
+	case cmd=="convert" && len(args)==2:
+		r,done,err := openSource(args[0])
+		if err!=nil { return 0,err }
+		defer done()
+		f,err := filter(keys,true)
+		if err!=nil { return 0,err }
+		
+		w,err := createDest(args[1])
+		if err!=nil { return 0,err }
+		n,err = mailfile.Copy(w,r,f)
+		if e := w.Close(); err==nil { err = e }
+		return n,err
+	}
+	flag.Usage()
+	os.Exit(2)
+	return
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(),"usage: gaw-mail-archive [flags] import SOURCE | export DEST | convert SOURCE DEST")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg()<1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	
+	/* Not needed to export messages as they are, or to import them in plain. */
+	var keys openpgp.EntityList
+	var err error
+	if *keyring!="" {
+		if keys,err = readKeyring(*keyring); err!=nil { log.Fatal(err) }
+		if err = unlockKeys(keys,[]byte(os.Getenv("GAW_MAIL_PASSPHRASE"))); err!=nil { log.Fatal(err) }
+	}
+	
+	n,err := run(flag.Arg(0),flag.Args()[1:],keys)
+	log.Printf("%d messages",n)
+	if err!=nil { log.Fatal(err) }
+}
@@ -0,0 +1,178 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+/*
+Re-encrypts the mailboxes of an IMAP account into another format.
+
+	gaw-mail-migrate -addr mail.example.org:993 -user alice -keyring secret.asc -format ngcrypt -progress alice.json
+
+To rotate the key, re-encrypting every message in it's current format:
+
+	gaw-mail-migrate -addr mail.example.org:993 -user alice -keyring old.asc -rotate -new-keyring new.asc
+
+The password is read from the environment variable GAW_MAIL_PASSWORD, the passphrase of the
+secret keys from GAW_MAIL_PASSPHRASE (GAW_MAIL_NEW_PASSPHRASE for -new-keyring).
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	
+	"golang.org/x/crypto/openpgp"
+	
+	"github.com/mad-day/gaw-mail/format"
+	"github.com/mad-day/gaw-mail/migrate"
+	"github.com/mad-day/gaw-mail/ngcrypt"
+	proxy "github.com/mad-day/gaw-mail/imap-proxy"
+)
+
+var (
+	addr = flag.String("addr","","IMAP server address (host:port)")
+	security = flag.String("security","tls","none, starttls or tls")
+	username = flag.String("user","","IMAP username")
+	keyring = flag.String("keyring","","armored secret keyring, used for decryption")
+	recipients = flag.String("to","","armored public keyring of the recipients (default: -keyring)")
+	target = flag.String("format","ngcrypt","target format: plain, inline, wrap, pgp-mime or ngcrypt")
+	mailboxes = flag.String("mailbox","","comma separated list of mailboxes (default: all)")
+	progress = flag.String("progress","","progress file, makes the migration resumable")
+	force = flag.Bool("force",false,"re-encrypt messages already in the target format")
+	cleaner = flag.String("cleaner","","ngcrypt: header cleaner spec (default: radical)")
+	compression = flag.String("compression","deflate","ngcrypt: deflate, zstd or none")
+	binary = flag.Bool("binary",false,"ngcrypt: binary blocks")
+	splitParts = flag.Bool("split",false,"ngcrypt: split the body into parts")
+	rotate = flag.Bool("rotate",false,"re-encrypt all messages to -new-keyring, keeping their format and encoding")
+	newKeyring = flag.String("new-keyring","","armored secret keyring of the new key; every message is verified to decrypt with it")
+)
+
+func readKeyring(path string) (openpgp.EntityList,error) {
+	f,err := os.Open(path)
+	if err!=nil { return nil,err }
+	defer f.Close()
+	return openpgp.ReadArmoredKeyRing(f)
+}
+
+func unlockKeys(kr openpgp.EntityList, passphrase []byte) error {
+	for _,e := range kr {
+		if e.PrivateKey!=nil && e.PrivateKey.Encrypted {
+			if err := e.PrivateKey.Decrypt(passphrase); err!=nil { return err }
+		}
+		for _,sk := range e.Subkeys {
+			if sk.PrivateKey!=nil && sk.PrivateKey.Encrypted {
+				if err := sk.PrivateKey.Decrypt(passphrase); err!=nil { return err }
+			}
+		}
+	}
+	return nil
+}
+
+func dial() (*proxy.Backend,error) {
+	switch *security {
+	case "none": return proxy.NewNoTLS(*addr),nil
+	case "starttls": return proxy.New(*addr),nil
+	case "tls": return proxy.NewTLS(*addr,nil),nil
+	}
+	return nil,fmt.Errorf("unknown security %q",*security)
+}
+
+func targetOf(keys openpgp.EntityList) (t format.Target,err error) {
+	if t.Format,err = format.ParseMessageFormat(*target); err!=nil { return }
+	
+	t.To = keys
+	if *recipients!="" {
+		if t.To,err = readKeyring(*recipients); err!=nil { return }
+	}
+	for _,e := range keys {
+		if e.PrivateKey!=nil { t.Signed = e; break }
+	}
+	
+	if *cleaner!="" {
+		var cc *ngcrypt.CleanerConfig
+		if cc,err = ngcrypt.ParseCleanerConfig(*cleaner); err!=nil { return }
+		cc.HashKey = []byte(os.Getenv("GAW_MAIL_HASHKEY"))
+		if t.Cleaner,err = cc.Build(); err!=nil { return }
+	}
+	o := new(ngcrypt.Options)
+	if o.Compression,err = ngcrypt.ParseCompression(*compression); err!=nil { return }
+	o.Binary = *binary
+	o.Split = *splitParts
+	t.Options = o
+	return
+}
+
+func run() error {
+	keys,err := readKeyring(*keyring)
+	if err!=nil { return err }
+	if err = unlockKeys(keys,[]byte(os.Getenv("GAW_MAIL_PASSPHRASE"))); err!=nil { return err }
+	
+	t,err := targetOf(keys)
+	if err!=nil { return err }
+	
+	var newKeys openpgp.EntityList
+	if *newKeyring!="" {
+		if newKeys,err = readKeyring(*newKeyring); err!=nil { return err }
+		if err = unlockKeys(newKeys,[]byte(os.Getenv("GAW_MAIL_NEW_PASSPHRASE"))); err!=nil { return err }
+	} else if *rotate {
+		return fmt.Errorf("-rotate needs -new-keyring")
+	}
+	
+	p,err := migrate.LoadProgress(*progress)
+	if err!=nil { return err }
+	
+	be,err := dial()
+	if err!=nil { return err }
+	u,err := be.Login(nil,*username,os.Getenv("GAW_MAIL_PASSWORD"))
+	if err!=nil { return err }
+	defer u.Logout()
+	
+	var m *migrate.Migrator
+	if *rotate {
+		m = migrate.NewRotation(u,keys,newKeys)
+		m.Target.Cleaner = t.Cleaner
+	} else {
+		m = &migrate.Migrator{User: u, Keys: keys, Target: t, Force: *force}
+		if newKeys!=nil { m.Verify = newKeys }
+	}
+	m.Progress = p
+	m.Log = log.New(os.Stderr,"",log.LstdFlags)
+	
+	if *mailboxes=="" { return m.MigrateAll() }
+	for _,name := range strings.Split(*mailboxes,",") {
+		if err = m.MigrateMailbox(strings.TrimSpace(name)); err!=nil { return err }
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	if *addr=="" || *username=="" || *keyring=="" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	
+	/* Errors are returned from run, so that the session is logged out. */
+	if err := run(); err!=nil { log.Fatal(err) }
+}
@@ -0,0 +1,312 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+/*
+Encrypts, decrypts and inspects single messages offline, for debugging.
+
+	gaw-mail-tool -keyring alice.asc -format pgp-mime -sign encrypt mail.eml > encrypted.eml
+	gaw-mail-tool -keyring secret.asc decrypt < encrypted.eml
+	gaw-mail-tool -keyring secret.asc inspect encrypted.eml
+
+The message is read from the file, or from stdin if none is given. encrypt supports the formats
+plain, inline, wrap, pgp-mime, ngcrypt and smime; decrypt detects the format (-format auto), or
+decrypts the one given. inspect prints the format, the key IDs of the recipients and, if the
+message can be decrypted with -keyring, the signer and whether the signature is valid.
+
+S/MIME uses -cert and -key (PEM files) for signing and decryption, -smime-to for the recipients'
+certificates and -roots to verify signers. The passphrase of the secret OpenPGP keys is read from
+the environment variable GAW_MAIL_PASSPHRASE.
+*/
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	
+	"github.com/emersion/go-message"
+	"golang.org/x/crypto/openpgp"
+	
+	"github.com/mad-day/gaw-mail/format"
+	"github.com/mad-day/gaw-mail/ngcrypt"
+	"github.com/mad-day/gaw-mail/smime"
+)
+
+var (
+	keyring = flag.String("keyring","","armored keyring; secret keys decrypt and sign")
+	recipients = flag.String("to","","armored public keyring of the recipients (default: -keyring)")
+	formatName = flag.String("format","","encrypt: plain, inline, wrap, pgp-mime, ngcrypt (default) or smime; decrypt: auto (default) or a format")
+	sign = flag.Bool("sign",false,"encrypt: sign with the secret key of -keyring, or -cert for S/MIME")
+	output = flag.String("o","","output file (default: stdout)")
+	cleaner = flag.String("cleaner","","ngcrypt: header cleaner spec (default: radical)")
+	compression = flag.String("compression","deflate","ngcrypt: deflate, zstd or none")
+	binary = flag.Bool("binary",false,"ngcrypt: binary blocks")
+	splitParts = flag.Bool("split",false,"ngcrypt: split the body into parts")
+	certFile = flag.String("cert","","S/MIME: PEM certificate of the own identity")
+	keyFile = flag.String("key","","S/MIME: PEM private key of the own identity")
+	smimeTo = flag.String("smime-to","","S/MIME: PEM certificates of the recipients")
+	rootsFile = flag.String("roots","","S/MIME: PEM CA certificates, that signers are verified against")
+)
+
+func readKeyring(path string) (openpgp.EntityList,error) {
+	f,err := os.Open(path)
+	if err!=nil { return nil,err }
+	defer f.Close()
+	return openpgp.ReadArmoredKeyRing(f)
+}
+
+func unlockKeys(kr openpgp.EntityList, passphrase []byte) error {
+	for _,e := range kr {
+		if e.PrivateKey!=nil && e.PrivateKey.Encrypted {
+			if err := e.PrivateKey.Decrypt(passphrase); err!=nil { return err }
+		}
+		for _,sk := range e.Subkeys {
+			if sk.PrivateKey!=nil && sk.PrivateKey.Encrypted {
+				if err := sk.PrivateKey.Decrypt(passphrase); err!=nil { return err }
+			}
+		}
+	}
+	return nil
+}
+
+func readCertificates(path string) ([]*x509.Certificate,error) {
+	data,err := ioutil.ReadFile(path)
+	if err!=nil { return nil,err }
+	return smime.ParseCertificates(data)
+}
+
+/* The S/MIME keyring of -cert, -key and -roots. */
+func smimeKeyRing() (*smime.KeyRing,error) {
+	kr := new(smime.KeyRing)
+	if *certFile!="" && *keyFile!="" {
+		id,err := smime.LoadIdentity(*certFile,*keyFile)
+		if err!=nil { return nil,err }
+		kr.Identities = append(kr.Identities,id)
+	}
+	if *rootsFile!="" {
+		certs,err := readCertificates(*rootsFile)
+		if err!=nil { return nil,err }
+		kr.Roots = x509.NewCertPool()
+		for _,c := range certs { kr.Roots.AddCert(c) }
+	}
+	return kr,nil
+}
+
+func target(keys openpgp.EntityList) (t format.Target,err error) {
+	name := *formatName
+	if name=="" { name = "ngcrypt" }
+	if t.Format,err = format.ParseMessageFormat(name); err!=nil { return }
+	
+	t.To = keys
+	if *recipients!="" {
+		if t.To,err = readKeyring(*recipients); err!=nil { return }
+	}
+	if *sign {
+		for _,e := range keys {
+			if e.PrivateKey!=nil { t.Signed = e; break }
+		}
+		if t.Signed==nil { return t,fmt.Errorf("-sign needs a secret key in -keyring") }
+	}
+	
+	if *cleaner!="" {
+		var cc *ngcrypt.CleanerConfig
+		if cc,err = ngcrypt.ParseCleanerConfig(*cleaner); err!=nil { return }
+		cc.HashKey = []byte(os.Getenv("GAW_MAIL_HASHKEY"))
+		if t.Cleaner,err = cc.Build(); err!=nil { return }
+	}
+	o := new(ngcrypt.Options)
+	if o.Compression,err = ngcrypt.ParseCompression(*compression); err!=nil { return }
+	o.Binary = *binary
+	o.Split = *splitParts
+	t.Options = o
+	return
+}
+
+func encrypt(w io.Writer, msg []byte, keys openpgp.EntityList) error {
+	if strings.EqualFold(*formatName,"smime") {
+		if *smimeTo=="" { return fmt.Errorf("smime needs -smime-to") }
+		to,err := readCertificates(*smimeTo)
+		if err!=nil { return err }
+		var signer *smime.Identity
+		if *sign {
+			if signer,err = smime.LoadIdentity(*certFile,*keyFile); err!=nil { return err }
+		}
+		return smime.Encrypt(w,bytes.NewReader(msg),to,signer)
+	}
+	
+	t,err := target(keys)
+	if err!=nil { return err }
+	return t.Encrypt(w,msg)
+}
+
+func isSMIME(msg []byte) bool {
+	e,err := message.Read(bytes.NewReader(msg))
+	return e!=nil && (err==nil || message.IsUnknownCharset(err)) && smime.IsSMIME(e.Header)
+}
+
+/* Decrypts the message and logs the format. */
+func decrypt(w io.Writer, msg []byte, keys openpgp.EntityList) error {
+	name := *formatName
+	if (name=="" || name=="auto") && isSMIME(msg) { name = "smime" }
+	
+	switch name {
+	case "smime":
+		kr,err := smimeKeyRing()
+		if err!=nil { return err }
+		d,err := smime.DecryptDetails(w,bytes.NewReader(msg),kr)
+		if err!=nil { return err }
+		log.Printf("format: smime, encrypted: %v, signed: %v",d.Encrypted,d.Signed)
+		switch {
+		case !d.Signed:
+		case !d.Verified: log.Printf("signature not verified (no -roots)")
+		default:
+			for _,c := range d.Signers { log.Printf("signed by: %s",c.Subject) }
+		}
+		return nil
+	case "","auto":
+		f,err := format.Decrypt(w,msg,keys)
+		log.Printf("format: %v",f)
+		return err
+	}
+	f,err := format.ParseMessageFormat(name)
+	if err!=nil { return err }
+	return format.DecryptFormat(w,msg,f,keys)
+}
+
+/* Returns the key ID, followed by the user IDs of the key, if it is known. */
+func keyName(keys openpgp.EntityList, id uint64) string {
+	s := fmt.Sprintf("%016X",id)
+	if id==0 { return s+" (hidden recipient)" }
+	if ks := keys.KeysById(id); len(ks)!=0 {
+		var names []string
+		for n := range ks[0].Entity.Identities { names = append(names,n) }
+		sort.Strings(names)
+		s += " ("+strings.Join(names,", ")+")"
+	}
+	return s
+}
+
+func inspect(w io.Writer, msg []byte, keys openpgp.EntityList) error {
+	if isSMIME(msg) {
+		fmt.Fprintln(w,"format: smime")
+		kr,err := smimeKeyRing()
+		if err!=nil { return err }
+		d,err := smime.DecryptDetails(ioutil.Discard,bytes.NewReader(msg),kr)
+		if err!=nil {
+			fmt.Fprintln(w,"not decrypted:",err)
+			return nil
+		}
+		fmt.Fprintln(w,"encrypted:",d.Encrypted)
+		fmt.Fprintln(w,"signed:",d.Signed)
+		switch {
+		case !d.Signed:
+		case !d.Verified: fmt.Fprintln(w,"signature not verified (no -roots)")
+		default:
+			for _,c := range d.Signers { fmt.Fprintln(w,"signed by:",c.Subject) }
+		}
+		return nil
+	}
+	
+	/* Without a keyring, only the recipients are known. */
+	var kr openpgp.KeyRing
+	if len(keys)!=0 { kr = keys }
+	r,err := format.Inspect(msg,kr)
+	if err!=nil { return err }
+	fmt.Fprintln(w,"format:",r.Format)
+	if r.Version!=0 { fmt.Fprintln(w,"version:",r.Version) }
+	for _,b := range r.Blocks {
+		part := b.Part
+		if part=="" { part = "body" } else { part = "part "+part }
+		for _,id := range b.Recipients { fmt.Fprintf(w,"%s: encrypted to %s\n",part,keyName(keys,id)) }
+		switch {
+		case kr==nil:
+		case b.Err!=nil:
+			fmt.Fprintf(w,"%s: not decrypted: %v\n",part,b.Err)
+		case !b.Signed:
+			fmt.Fprintf(w,"%s: decrypted, not signed\n",part)
+		case b.SignedBy==nil:
+			fmt.Fprintf(w,"%s: signed by unknown key %016X\n",part,b.SignedByKeyId)
+		case b.SignatureError!=nil:
+			fmt.Fprintf(w,"%s: signed by %s: BAD signature: %v\n",part,keyName(keys,b.SignedByKeyId),b.SignatureError)
+		default:
+			fmt.Fprintf(w,"%s: signed by %s: good signature\n",part,keyName(keys,b.SignedByKeyId))
+		}
+	}
+	return nil
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(),"usage: gaw-mail-tool [flags] encrypt|decrypt|inspect [FILE]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg()<1 || flag.NArg()>2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	log.SetFlags(0)
+	
+	var keys openpgp.EntityList
+	var err error
+	if *keyring!="" {
+		if keys,err = readKeyring(*keyring); err!=nil { log.Fatal(err) }
+		if err = unlockKeys(keys,[]byte(os.Getenv("GAW_MAIL_PASSPHRASE"))); err!=nil { log.Fatal(err) }
+	}
+	
+	var msg []byte
+	if flag.NArg()==2 {
+		msg,err = ioutil.ReadFile(flag.Arg(1))
+	} else {
+		msg,err = ioutil.ReadAll(os.Stdin)
+	}
+	if err!=nil { log.Fatal(err) }
+	
+	/* The output is buffered, so that nothing is written on failure. */
+	out := new(bytes.Buffer)
+	switch flag.Arg(0) {
+	case "encrypt": err = encrypt(out,msg,keys)
+	case "decrypt": err = decrypt(out,msg,keys)
+	case "inspect": err = inspect(out,msg,keys)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err!=nil { log.Fatal(err) }
+	
+	if *output!="" {
+		err = ioutil.WriteFile(*output,out.Bytes(),0600)
+	} else {
+		_,err = out.WriteTo(os.Stdout)
+	}
+	if err!=nil { log.Fatal(err) }
+}
@@ -0,0 +1,126 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+/*
+Drafts handling for the gateways. Mail clients save a draft again and again, each time with an
+APPEND of the new version and an EXPUNGE of the old one. Through a gateway, every version is
+encrypted anew, so the upstream server sees a churn of unrelated encrypted messages, and versions
+the client failed to expunge stay forever.
+
+Versions of the same draft share the Message-ID. The gateway adds a header with a keyed hash of
+it to the encrypted message, and removes the older versions after appending a new one. The
+upstream server can link the versions, the identifier doesn't tell it the Message-ID (but the
+unencrypted header might, depending on the format).
+*/
+package drafts
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"time"
+	
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-message/textproto"
+	
+	"golang.org/x/crypto/openpgp"
+	
+	imapexpunge "github.com/mad-day/gaw-mail/util/imap-expunge"
+)
+
+/* The header, that carries the identifier in the encrypted message. */
+const Header = "X-Gaw-Draft"
+
+/*
+Reports, whether m is the drafts mailbox: It has the SPECIAL-USE attribute \Drafts, or, if the
+server doesn't announce it, is named "Drafts".
+*/
+func IsDrafts(m backend.Mailbox) bool {
+	if info,err := m.Info(); err==nil && info!=nil {
+		for _,attr := range info.Attributes {
+			if strings.EqualFold(attr,imap.DraftsAttr) { return true }
+		}
+	}
+	name := m.Name()
+	if i := strings.LastIndexAny(name,"/."); i>=0 { name = name[i+1:] }
+	return strings.EqualFold(name,"Drafts")
+}
+
+/*
+Derives the key of the identifiers from the private key of e, so that only the key owner can
+compute them. Returns nil, if e has no decrypted private key.
+*/
+func Secret(e *openpgp.Entity) []byte {
+	if e==nil || e.PrivateKey==nil || e.PrivateKey.Encrypted { return nil }
+	h := sha256.New()
+	io.WriteString(h,"gaw-mail drafts\x00")
+	if err := e.PrivateKey.Serialize(h); err!=nil { return nil }
+	return h.Sum(nil)
+}
+
+/*
+Returns the identifier of the draft msg, or "", if it has no Message-ID or secret is nil.
+*/
+func ID(secret []byte, msg []byte) string {
+	if secret==nil { return "" }
+	h,err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(msg)))
+	if err!=nil { return "" }
+	mid := strings.TrimSpace(h.Get("Message-Id"))
+	if mid=="" { return "" }
+	mac := hmac.New(sha256.New,secret)
+	io.WriteString(mac,mid)
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+/*
+Appends a new version of the draft msg to the upstream mailbox m and removes the older ones.
+encrypt writes the encrypted message, the header is put in front of it. Drafts without an
+identifier are appended as usual.
+
+The old versions are flagged \Deleted, and expunged, unless other messages in m are flagged
+\Deleted too (the client would not expect them to go away).
+*/
+func Append(m backend.Mailbox, secret []byte, flags []string, date time.Time, msg []byte, encrypt func(w io.Writer, r imap.Literal) error) error {
+	id := ID(secret,msg)
+	b := new(bytes.Buffer)
+	if id!="" { b.WriteString(Header+": "+id+"\r\n") }
+	if err := encrypt(b,bytes.NewReader(msg)); err!=nil { return err }
+	if id=="" { return m.CreateMessage(flags,date,b) }
+	
+	criteria := imap.NewSearchCriteria()
+	criteria.Header.Add(Header,id)
+	old,err := m.SearchMessages(true,criteria)
+	if err!=nil { return err }
+	if err = m.CreateMessage(flags,date,b); err!=nil || len(old)==0 { return err }
+	
+	seq := new(imap.SeqSet)
+	seq.AddNum(old...)
+	if err = m.UpdateMessagesFlags(true,seq,imap.AddFlags,[]string{imap.DeletedFlag}); err!=nil { return err }
+	_,err = imapexpunge.Only(m,old)
+	return err
+}
@@ -38,7 +38,7 @@ const pgpMessageType = "PGP MESSAGE"
 var armorTag = []byte("-----BEGIN "+pgpMessageType+"-----")
 
 func decryptArmored(in io.Reader, kr openpgp.KeyRing) (*openpgp.MessageDetails, error) {
-	br := bufio.NewReaderSize(in, len(armorTag))
+	br := bufio.NewReader(in)
 
 	// Read all empty lines at the begining
 	var line []byte
@@ -59,8 +59,8 @@ func decryptArmored(in io.Reader, kr openpgp.KeyRing) (*openpgp.MessageDetails,
 		prefix = append(prefix, []byte("\r\n")...)
 	}
 
-	// bufio.Reader doesn't consume the newline after the armor tag
-	in = io.MultiReader(bytes.NewReader(prefix), in)
+	// Continue with the rest of the buffered input
+	in = io.MultiReader(bytes.NewReader(prefix), br)
 	if isPrefix || !bytes.Equal(line, armorTag) {
 		// Not encrypted
 		return &openpgp.MessageDetails{UnverifiedBody: in}, nil
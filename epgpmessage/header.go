@@ -41,12 +41,19 @@ func (d debugger) Read(b []byte) (i int,e error) {
 	return
 }
 
+/*
+The first error is sticky: openpgp checks the MDC of unsigned messages on every io.EOF, and fails
+the second time.
+*/
 type readerAll struct {
 	io.Reader
+	err error
 }
-func (r readerAll) Read(b []byte) (i int,e error) {
+func (r *readerAll) Read(b []byte) (i int,e error) {
+	if r.err!=nil { return 0,r.err }
 	i,e = io.ReadFull(r.Reader,b)
 	if e==io.ErrUnexpectedEOF { e = io.EOF }
+	r.err = e
 	return
 }
 
@@ -68,6 +75,13 @@ func checkIsWrap(rh message.Header) bool {
 
 
 
+/*
+Returns true, if the given message header belongs to a wrapped message (see EncryptWrap).
+*/
+func IsWrapped(h message.Header) bool {
+	return checkIsWrap(h)
+}
+
 func parseMessageHeader(r io.Reader) (message.Header,io.Reader,error) {
 	br := bufio.NewReader(r)
 	h, err := textproto.ReadHeader(br)
@@ -107,7 +107,7 @@ func DecryptWrap(w io.Writer, r io.Reader, kr openpgp.KeyRing) error {
 		md, err := decryptArmored(r2, kr)
 		if err!=nil { return err }
 		if md.SignatureError!=nil { return md.SignatureError }
-		return DecryptWrap(w, readerAll{md.UnverifiedBody}, kr)
+		return DecryptWrap(w, &readerAll{Reader: md.UnverifiedBody}, kr)
 	}
 	
 	buf := new(bytes.Buffer)
@@ -140,7 +140,7 @@ func DecryptFull(w io.Writer, r io.Reader, kr openpgp.KeyRing) error {
 		md, err := decryptArmored(r2, kr)
 		if err!=nil { return err }
 		if md.SignatureError!=nil { return md.SignatureError }
-		return DecryptFull(w, readerAll{md.UnverifiedBody}, kr)
+		return DecryptFull(w, &readerAll{Reader: md.UnverifiedBody}, kr)
 	}
 	
 	e, err := message.New(h,r2)
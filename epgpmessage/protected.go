@@ -0,0 +1,287 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package epgpmessage
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"golang.org/x/crypto/openpgp"
+)
+
+/*
+Header fields, that are copied into the protected (encrypted) header.
+*/
+var protectedFields = []string{
+	"Subject",
+	"From",
+	"Sender",
+	"To",
+	"Cc",
+	"Reply-To",
+	"Followup-To",
+	"Date",
+	"Message-Id",
+	"In-Reply-To",
+	"References",
+}
+
+/* The Subject of the outer header, as recommended by the protected headers convention. */
+const obscuredSubject = "..."
+
+func isContentField(k string) bool {
+	return strings.HasPrefix(strings.ToLower(k),"content-")
+}
+
+/*
+Deletes all fields from h, for which del returns true.
+*/
+func filterHeader(h textproto.Header, del func(k string) bool) textproto.Header {
+	h = h.Copy()
+	for i := h.Fields(); i.Next(); {
+		if del(i.Key()) { i.Del() }
+	}
+	return h
+}
+
+/*
+Appends all fields of src to dst (in order), for which sel returns true.
+Fields of dst with the same key are replaced.
+*/
+func mergeHeader(dst *textproto.Header, src textproto.Header, sel func(k string) bool) {
+	var keys, values []string
+	for i := src.Fields(); i.Next(); {
+		if !sel(i.Key()) { continue }
+		keys = append(keys,i.Key())
+		values = append(values,i.Value())
+	}
+	for _,k := range keys { dst.Del(k) }
+	/* Add() puts the field in front, so add them backwards. */
+	for i := len(keys)-1; i>=0; i-- { dst.Add(keys[i],values[i]) }
+}
+
+/*
+Encrypts a message as PGP/MIME (RFC3156) using the protected headers convention:
+The encrypted MIME entity carries a copy of the sensitive header fields (Subject, From, To...)
+and is marked with protected-headers="v1". A legacy display part shows the Subject to clients,
+that don't support protected headers. The Subject of the outer header is replaced by "...".
+
+Unlike EncryptWrap, the result can be read by other clients (such as Thunderbird).
+*/
+func EncryptProtected(w io.Writer, r io.Reader, to []*openpgp.Entity, signed *openpgp.Entity) error {
+	h,r2,err := parseMessageHeader(r)
+	if err != nil {
+		return err
+	}
+	
+	/* The body's own MIME header */
+	bh := filterHeader(h.Header,func(k string) bool { return !isContentField(k) })
+	
+	/* The protected header */
+	ph := message.Header{Header: filterHeader(h.Header,func(k string) bool {
+		for _,p := range protectedFields {
+			if strings.EqualFold(k,p) { return false }
+		}
+		return true
+	})}
+	
+	/* The outer header */
+	oh := message.Header{Header: filterHeader(h.Header,isContentField)}
+	if oh.Has("Subject") { oh.Set("Subject",obscuredSubject) }
+	oh.SetContentType("multipart/encrypted",map[string]string{"protocol":"application/pgp-encrypted"})
+	
+	mw, err := message.CreateWriter(w, oh)
+	if err != nil {
+		return err
+	}
+	
+	var vh message.Header
+	vh.SetContentType("application/pgp-encrypted",nil)
+	vh.Set("Content-Description","PGP/MIME version identification")
+	pw, err := mw.CreatePart(vh)
+	if err != nil {
+		return err
+	}
+	if _,err = io.WriteString(pw,"Version: 1\r\n"); err != nil {
+		return err
+	}
+	pw.Close()
+	
+	var eh message.Header
+	eh.SetContentType("application/octet-stream",map[string]string{"name":"encrypted.asc"})
+	eh.Set("Content-Description","OpenPGP encrypted message")
+	eh.SetContentDisposition("inline",map[string]string{"filename":"encrypted.asc"})
+	pw, err = mw.CreatePart(eh)
+	if err != nil {
+		return err
+	}
+	plaintext, err := encryptArmored(pw, to, signed)
+	if err != nil {
+		return err
+	}
+	
+	/*
+	The parts are written using textproto, because the original body is already transfer-encoded
+	and must be copied as is. message.Writer would encode it a second time.
+	*/
+	iw := textproto.NewMultipartWriter(plaintext)
+	ph.SetContentType("multipart/mixed",map[string]string{"protected-headers":"v1","boundary":iw.Boundary()})
+	if err = textproto.WriteHeader(plaintext, ph.Header); err != nil {
+		return err
+	}
+	
+	var lh message.Header
+	lh.SetContentType("text/rfc822-headers",map[string]string{"protected-headers":"v1"})
+	lh.SetContentDisposition("inline",nil)
+	lw, err := iw.CreatePart(lh.Header)
+	if err != nil {
+		return err
+	}
+	var sh textproto.Header
+	if s,err := h.Raw("Subject"); err==nil && s!=nil { sh.AddRaw(s) }
+	if err = textproto.WriteHeader(lw,sh); err != nil {
+		return err
+	}
+	
+	bw, err := iw.CreatePart(bh)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(bw, r2); err != nil {
+		return err
+	}
+	
+	if err = iw.Close(); err != nil {
+		return err
+	}
+	if err = plaintext.Close(); err != nil {
+		return err
+	}
+	pw.Close()
+	return mw.Close()
+}
+
+func isEncryptedMultipart(h message.Header) (string,bool) {
+	t,m,err := h.ContentType()
+	if err!=nil || t!="multipart/encrypted" || m["boundary"]=="" { return "",false }
+	return m["boundary"],true
+}
+
+/*
+Decrypts a PGP/MIME (RFC3156) message. If the encrypted entity carries protected headers, they
+replace the fields of the outer header, and the legacy display part is removed.
+
+Messages, that are not PGP/MIME, are handled like DecryptFull does.
+*/
+func DecryptProtected(w io.Writer, r io.Reader, kr openpgp.KeyRing) error {
+	h,r2,err := parseMessageHeader(r)
+	if err != nil {
+		return err
+	}
+	boundary,ok := isEncryptedMultipart(h)
+	if !ok {
+		return DecryptFull(w, io.MultiReader(bytes.NewReader(headerBytes(h)),r2), kr)
+	}
+	
+	/* Part 1 is the version identification, Part 2 the encrypted entity. */
+	mr := textproto.NewMultipartReader(r2,boundary)
+	var p *textproto.Part
+	for i := 0; i<2; i++ {
+		p,err = mr.NextPart()
+		if err != nil {
+			return err
+		}
+	}
+	md, err := decryptArmored(p, kr)
+	if err != nil {
+		return err
+	}
+	inner, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return err
+	}
+	if md.SignatureError != nil {
+		return md.SignatureError
+	}
+	
+	ibr := bufio.NewReader(bytes.NewReader(inner))
+	ih, err := textproto.ReadHeader(ibr)
+	if err != nil {
+		return err
+	}
+	var body io.Reader = ibr
+	
+	/* The resulting header: The outer header with the protected fields applied. */
+	rh := filterHeader(h.Header,isContentField)
+	mergeHeader(&rh,ih,func(k string) bool { return !isContentField(k) })
+	
+	ct := message.Header{Header: ih}
+	if t,m,err := ct.ContentType(); err==nil && m["protected-headers"]=="v1" && t=="multipart/mixed" {
+		if ph,pb,ok := stripLegacyDisplay(inner,m["boundary"]); ok {
+			ih,body = ph,pb
+		}
+	}
+	mergeHeader(&rh,ih,isContentField)
+	
+	if err = textproto.WriteHeader(w,rh); err != nil {
+		return err
+	}
+	_,err = io.Copy(w,body)
+	return err
+}
+
+func headerBytes(h message.Header) []byte {
+	buf := new(bytes.Buffer)
+	textproto.WriteHeader(buf,h.Header)
+	return buf.Bytes()
+}
+
+/*
+If the first part of a protected multipart/mixed entity is a legacy display part, and only
+one other part follows, that part is returned. Otherwise ok is false.
+*/
+func stripLegacyDisplay(inner []byte, boundary string) (h textproto.Header, body io.Reader, ok bool) {
+	br := bufio.NewReader(bytes.NewReader(inner))
+	if _,err := textproto.ReadHeader(br); err!=nil { return }
+	mr := textproto.NewMultipartReader(br,boundary)
+	
+	p,err := mr.NextPart()
+	if err!=nil { return }
+	t,m,err := (&message.Header{Header: p.Header}).ContentType()
+	if err!=nil || t!="text/rfc822-headers" || m["protected-headers"]!="v1" { return }
+	
+	p,err = mr.NextPart()
+	if err!=nil { return }
+	h = p.Header
+	b,err := ioutil.ReadAll(p)
+	if err!=nil { return }
+	
+	if _,err = mr.NextPart(); err!=io.EOF { return }
+	return h,bytes.NewReader(b),true
+}
@@ -0,0 +1,214 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+/*
+Detects the encryption format of stored messages and decrypts or encrypts them in any of the
+formats supported by gaw-mail.
+*/
+package format
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"golang.org/x/crypto/openpgp"
+	
+	"github.com/mad-day/gaw-mail/epgpmessage"
+	"github.com/mad-day/gaw-mail/ngcrypt"
+)
+
+type Format uint
+
+const (
+	/* No format given: The user of the value chooses it's own, like a gateway's own format. */
+	Default Format = iota
+	
+	/* Not encrypted. */
+	Plain
+	
+	/* Inline PGP in each part, as produced by epgpmessage.EncryptRegular. */
+	Inline
+	
+	/* The wrapped format, as produced by epgpmessage.EncryptWrap. */
+	Wrap
+	
+	/* PGP/MIME (multipart/encrypted), optionally with protected headers. */
+	PGPMIME
+	
+	/* The NGCRYPT format. */
+	Ngcrypt
+)
+
+var formatNames = [...]string{
+	Default: "default",
+	Plain: "plain",
+	Inline: "inline",
+	Wrap: "wrap",
+	PGPMIME: "pgp-mime",
+	Ngcrypt: "ngcrypt",
+}
+
+func (f Format) String() string {
+	if int(f)<len(formatNames) { return formatNames[f] }
+	return fmt.Sprintf("Format(%d)",uint(f))
+}
+
+func ParseFormat(s string) (Format,error) {
+	for i,n := range formatNames {
+		if strings.EqualFold(s,n) { return Format(i),nil }
+	}
+	return 0,fmt.Errorf("format: unknown format %q",s)
+}
+
+/*
+Like ParseFormat, but Default is refused: It's no format, that a message can be encrypted into.
+*/
+func ParseMessageFormat(s string) (Format,error) {
+	f,err := ParseFormat(s)
+	if err==nil && f==Default { return 0,fmt.Errorf("format: %q is not a message format",s) }
+	return f,err
+}
+
+var pgpArmorTag = []byte("-----BEGIN PGP MESSAGE-----")
+
+func split(msg []byte) (message.Header,[]byte,error) {
+	rd := bytes.NewReader(msg)
+	br := bufio.NewReader(rd)
+	h,err := textproto.ReadHeader(br)
+	if err!=nil { return message.Header{},nil,err }
+	/* Whatever is still buffered, is the beginning of the body. */
+	n := len(msg)-rd.Len()-br.Buffered()
+	return message.Header{Header: h},msg[n:],nil
+}
+
+/*
+Detects the format of a message given it's header only. If the header is not conclusive
+(the message is either Plain or Inline), ok is false.
+*/
+func DetectHeader(h message.Header) (f Format, ok bool) {
+	switch {
+	case ngcrypt.IsNgcrypt(h): return Ngcrypt,true
+	case epgpmessage.IsWrapped(h): return Wrap,true
+	}
+	if t,_,err := h.ContentType(); err==nil && t=="multipart/encrypted" { return PGPMIME,true }
+	return Plain,false
+}
+
+/*
+Detects the format of the given RFC822 message.
+*/
+func Detect(msg []byte) Format {
+	h,body,err := split(msg)
+	if err!=nil { return Plain }
+	
+	if f,ok := DetectHeader(h); ok { return f }
+	if bytes.Contains(body,pgpArmorTag) && hasInlinePart(h,body) { return Inline }
+	return Plain
+}
+
+/*
+Reports, whether a text part of the message is an inline PGP message: It's (decoded) body must
+start with the armor. A plain message, that quotes an armored block, is not encrypted.
+*/
+func hasInlinePart(h message.Header, body []byte) bool {
+	e,err := message.New(h,bytes.NewReader(body))
+	if err!=nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) { return false }
+	found := false
+	e.Walk(func(path []int, part *message.Entity, err error) error {
+		if found || part==nil || part.MultipartReader()!=nil { return nil }
+		if t,_,err := part.Header.ContentType(); err==nil && t!="" && !strings.HasPrefix(t,"text/") { return nil }
+		data,_ := ioutil.ReadAll(part.Body)
+		found = bytes.HasPrefix(bytes.TrimLeft(data," \t\r\n"),pgpArmorTag)
+		return nil
+	})
+	return found
+}
+
+/*
+Decrypts the message msg, which is in the format f, and writes the result to w.
+*/
+func DecryptFormat(w io.Writer, msg []byte, f Format, kr openpgp.KeyRing) error {
+	r := bytes.NewReader(msg)
+	switch f {
+	case Plain:
+		_,err := io.Copy(w,r)
+		return err
+	case Inline: return epgpmessage.DecryptRegular(w,r,kr)
+	case Wrap: return epgpmessage.DecryptWrap(w,r,kr)
+	case PGPMIME: return epgpmessage.DecryptProtected(w,r,kr)
+	case Ngcrypt: return ngcrypt.DecryptWholeMessage(w,r,kr)
+	}
+	return fmt.Errorf("format: can't decrypt %v",f)
+}
+
+/*
+Detects the format of msg and decrypts it. The detected format is returned.
+*/
+func Decrypt(w io.Writer, msg []byte, kr openpgp.KeyRing) (Format,error) {
+	f := Detect(msg)
+	return f,DecryptFormat(w,msg,f,kr)
+}
+
+/*
+Describes the encryption of messages.
+*/
+type Target struct {
+	Format Format
+	
+	/* The recipients. Not needed for Plain. */
+	To []*openpgp.Entity
+	
+	/* The signer. May be nil. */
+	Signed *openpgp.Entity
+	
+	/* Ngcrypt only: The header cleaner (nil means ngcrypt.Radical) and the encoding options. */
+	Cleaner ngcrypt.Cleaner
+	Options *ngcrypt.Options
+}
+
+/*
+Encrypts the (unencrypted) message msg and writes the result to w.
+*/
+func (t *Target) Encrypt(w io.Writer, msg []byte) error {
+	r := bytes.NewReader(msg)
+	if t.Format!=Plain && len(t.To)==0 { return fmt.Errorf("format: no recipients") }
+	switch t.Format {
+	case Plain:
+		_,err := io.Copy(w,r)
+		return err
+	case Inline: return epgpmessage.EncryptRegular(w,r,t.To,t.Signed)
+	case Wrap: return epgpmessage.EncryptWrap(w,r,t.To,t.Signed)
+	case PGPMIME: return epgpmessage.EncryptProtected(w,r,t.To,t.Signed)
+	case Ngcrypt:
+		c := t.Cleaner
+		if c==nil { c = ngcrypt.Radical }
+		return ngcrypt.EncryptWithOptions(w,r,t.To,t.Signed,c,t.Options)
+	}
+	return fmt.Errorf("format: can't encrypt %v",t.Format)
+}
@@ -0,0 +1,162 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package format
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	
+	"github.com/emersion/go-message"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+	
+	"github.com/mad-day/gaw-mail/ngcrypt"
+)
+
+/* One OpenPGP message found in an encrypted message. */
+type Block struct {
+	/* The MIME part, that holds the block, like "1" or "2.1". "" is the body of a single part message. */
+	Part string
+	
+	/* The key IDs of the recipients, 0 for a hidden recipient. */
+	Recipients []uint64
+	
+	/* The outcome of decrypting the block with the keyring. */
+	Decrypted bool
+	Err error
+	
+	/* Only known, if the block has been decrypted. SignedBy is nil, if the key is not in the keyring. */
+	Signed bool
+	SignedByKeyId uint64
+	SignedBy *openpgp.Key
+	SignatureError error
+}
+
+/* Describes an encrypted message, see Inspect. */
+type Report struct {
+	Format Format
+	
+	/* The NGCRYPT format version, 0 for other formats. */
+	Version int
+	
+	Blocks []*Block
+}
+
+/*
+Inspects the message for debugging: It's format, and for each OpenPGP message in it the
+recipients and, if it can be decrypted with kr (which may be nil), the signer and the validity
+of the signature.
+*/
+func Inspect(msg []byte, kr openpgp.KeyRing) (*Report,error) {
+	r := &Report{Format: Detect(msg)}
+	e,err := message.Read(bytes.NewReader(msg))
+	if e==nil { return nil,err }
+	if r.Format==Ngcrypt {
+		if r.Version,err = ngcrypt.MessageVersion(e.Header); err!=nil { return nil,err }
+	}
+	
+	err = e.Walk(func(path []int, part *message.Entity, err error) error {
+		if err!=nil || part.MultipartReader()!=nil { return err }
+		body,err := ioutil.ReadAll(part.Body)
+		if err!=nil { return err }
+		
+		name := make([]string,len(path))
+		for i,n := range path { name[i] = strconv.Itoa(n+1) }
+		for _,raw := range findBlocks(r.Format,part,body) {
+			if b := inspectBlock(raw,kr); b!=nil {
+				b.Part = strings.Join(name,".")
+				r.Blocks = append(r.Blocks,b)
+			}
+		}
+		return nil
+	})
+	return r,err
+}
+
+/* Returns the OpenPGP messages in the (transfer decoded) body of a part. */
+func findBlocks(f Format, part *message.Entity, body []byte) (blocks [][]byte) {
+	if f==Ngcrypt {
+		if b,_,err := ngcrypt.OpenBlock(bytes.NewReader(body)); err==nil {
+			if raw,err := ioutil.ReadAll(b); err==nil { blocks = append(blocks,raw) }
+		}
+		return
+	}
+	
+	for {
+		i := bytes.Index(body,pgpArmorTag)
+		if i<0 { break }
+		body = body[i:]
+		block,err := armor.Decode(bytes.NewReader(body))
+		body = body[len(pgpArmorTag):]
+		if err!=nil { continue }
+		if raw,err := ioutil.ReadAll(block.Body); err==nil { blocks = append(blocks,raw) }
+	}
+	
+	/* Binary parts of the inline format. */
+	if t,_,_ := part.Header.ContentType(); len(blocks)==0 && t=="application/pgp-encrypted" {
+		blocks = append(blocks,body)
+	}
+	return
+}
+
+/* Returns nil, if raw is not an OpenPGP message. */
+func inspectBlock(raw []byte, kr openpgp.KeyRing) *Block {
+	b := new(Block)
+	pr := packet.NewReader(bytes.NewReader(raw))
+	found := false
+	for {
+		p,err := pr.Next()
+		if err!=nil { break }
+		found = true
+		k,ok := p.(*packet.EncryptedKey)
+		if !ok { break }
+		b.Recipients = append(b.Recipients,k.KeyId)
+	}
+	if !found { return nil }
+	if kr==nil { return b }
+	
+	md,err := openpgp.ReadMessage(bytes.NewReader(raw),kr,nil,nil)
+	if err!=nil {
+		b.Err = err
+		return b
+	}
+	
+	/* The signature is checked once the body has been read. */
+	if _,err = io.Copy(ioutil.Discard,md.UnverifiedBody); err!=nil {
+		b.Err = err
+		return b
+	}
+	b.Decrypted = md.IsEncrypted
+	b.Signed = md.IsSigned
+	b.SignedByKeyId = md.SignedByKeyId
+	b.SignedBy = md.SignedBy
+	b.SignatureError = md.SignatureError
+	return b
+}
@@ -30,6 +30,9 @@ import (
 	"github.com/emersion/go-imap/backend"
 
 	pgpmail "github.com/mad-day/gaw-mail/legacy"
+	"github.com/mad-day/gaw-mail/policy"
+	"github.com/mad-day/gaw-mail/shared"
+	"github.com/mad-day/gaw-mail/smime"
 )
 
 type DecryptMode uint
@@ -39,11 +42,26 @@ const (
 	DecryptRegular DecryptMode = iota
 	DecryptWrap
 	DecryptFull
+	
+	/* PGP/MIME with protected headers, see epgpmessage.DecryptProtected. */
+	DecryptProtected
+	
+	/* Detects the format of each message, see format.Decrypt. */
+	DecryptAuto
+	
+	/*
+	Like DecryptAuto, but S/MIME messages are decrypted with the keyring from Backend.SMIME,
+	see smime.Decrypt.
+	*/
+	DecryptSMIME
 )
 
 const (
 	EncryptRegular EncryptMode = iota
 	EncryptWrap
+	
+	/* PGP/MIME with protected headers, see epgpmessage.EncryptProtected. */
+	EncryptProtected
 )
 
 type Backend struct {
@@ -53,10 +71,22 @@ type Backend struct {
 	Decrypt DecryptMode
 	
 	Unlock pgpmail.UnlockFunction
+	
+	/* Shared mailboxes, may be nil. */
+	Shared *shared.ACL
+	
+	/* Returns the S/MIME certificates and keys of the user, used by DecryptSMIME. */
+	SMIME func(username, password string) (*smime.KeyRing, error)
+	
+	/* Replaces older versions of a draft, when a new one is appended to \Drafts. See package drafts. */
+	ReplaceDrafts bool
+	
+	/* Selects the mailboxes, that are encrypted, and the format. May be nil. */
+	Policy *policy.Policy
 }
 
 func New(be backend.Backend, unlock pgpmail.UnlockFunction) *Backend {
-	return &Backend{be, EncryptWrap, DecryptWrap, unlock}
+	return &Backend{be, EncryptWrap, DecryptWrap, unlock, nil, nil, false, nil}
 }
 
 func (be *Backend) Login(conn *imap.ConnInfo,username, password string) (backend.User, error) {
@@ -65,6 +95,24 @@ func (be *Backend) Login(conn *imap.ConnInfo,username, password string) (backend
 	} else if kr, err := be.Unlock(username, password); err != nil {
 		return nil, err
 	} else {
-		return &user{u, be.Encrypt, be.Decrypt, kr}, nil
+		var skr *smime.KeyRing
+		if be.Decrypt==DecryptSMIME && be.SMIME!=nil {
+			if skr, err = be.SMIME(username, password); err != nil {
+				return nil, err
+			}
+		}
+		return &user{u, be.Encrypt, be.Decrypt, kr, skr, be.Shared, be.ReplaceDrafts, be.Policy, username}, nil
+	}
+}
+
+/*
+Passes the updates of the underlying backend through, if it is a
+backend.BackendUpdater. Unsolicited updates only carry flags and counters,
+which need no decryption.
+*/
+func (be *Backend) Updates() <-chan backend.Update {
+	if bu,ok := be.Backend.(backend.BackendUpdater); ok {
+		return bu.Updates()
 	}
+	return nil
 }
@@ -25,11 +25,19 @@ package imap
 
 import (
 	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
 	"log"
 	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend"
+
+	"github.com/mad-day/gaw-mail/drafts"
+	"github.com/mad-day/gaw-mail/format"
+	"github.com/mad-day/gaw-mail/policy"
+	"github.com/mad-day/gaw-mail/shared"
 )
 
 type mailbox struct {
@@ -53,6 +61,16 @@ func (m *mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.Fetch
 	if !needsDecryption {
 		return m.Mailbox.ListMessages(uid, seqSet, items, ch)
 	}
+	rule := m.u.p.Lookup(m.Mailbox)
+	if rule.Action == policy.Untouched {
+		return m.Mailbox.ListMessages(uid, seqSet, items, ch)
+	}
+	
+	/* Mailboxes with their own format may hold messages in any format. */
+	mode := m.u.d
+	if rule.Format != format.Default && mode != DecryptSMIME {
+		mode = DecryptAuto
+	}
 
 	messages := make(chan *imap.Message)
 	go func() {
@@ -64,7 +82,7 @@ func (m *mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.Fetch
 					continue
 				}
 
-				r, err := decryptMessage(m.u.d, m.u.kr, literal)
+				r, err := decryptMessage(mode, m.u.kr, m.u.skr, literal)
 				if err != nil {
 					log.Println("WARN: cannot decrypt part:", err)
 					continue
@@ -82,9 +100,68 @@ func (m *mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.Fetch
 }
 
 func (m *mailbox) CreateMessage(flags []string, date time.Time, r imap.Literal) error {
+	rule := m.u.p.Lookup(m.Mailbox)
+	switch rule.Action {
+	case policy.Plain, policy.Untouched:
+		return m.Mailbox.CreateMessage(flags, date, r)
+	case policy.ReadOnly:
+		return policy.ErrReadOnly
+	}
+	
 	b := new(bytes.Buffer)
-	if err := encryptMessage(m.u.e, m.u.kr, b, r); err != nil {
+	to, err := m.u.recipients(m.Name())
+	if err != nil {
+		return err
+	}
+	encrypt := func(w io.Writer, r imap.Literal) error {
+		return encryptMessage(m.u.e, to, m.u.kr[0], w, r)
+	}
+	if rule.Format != format.Default {
+		t := &format.Target{Format: rule.Format, To: to, Signed: m.u.kr[0]}
+		encrypt = func(w io.Writer, r imap.Literal) error {
+			msg, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			return t.Encrypt(w, msg)
+		}
+	}
+	if m.u.drafts && drafts.IsDrafts(m.Mailbox) {
+		msg, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return drafts.Append(m.Mailbox, drafts.Secret(m.u.kr[0]), flags, date, msg, encrypt)
+	}
+	if err := encrypt(b, r); err != nil {
 		return err
 	}
 	return m.Mailbox.CreateMessage(flags, date, b)
 }
+
+/*
+Copies are not re-encrypted, so copying into a shared mailbox doesn't make the message readable
+for the other members.
+*/
+func (m *mailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, dest string) error {
+	if !m.u.allowed(dest) {
+		return shared.ErrAccessDenied
+	}
+	if err := m.u.p.Writable(m.u.User, dest); err != nil {
+		return err
+	}
+	return m.Mailbox.CopyMessages(uid, seqSet, dest)
+}
+
+func (m *mailbox) MoveMessages(uid bool, seqSet *imap.SeqSet, dest string) error {
+	if !m.u.allowed(dest) {
+		return shared.ErrAccessDenied
+	}
+	if err := m.u.p.Writable(m.u.User, dest); err != nil {
+		return err
+	}
+	if mm, ok := m.Mailbox.(backend.MoveMailbox); ok {
+		return mm.MoveMessages(uid, seqSet, dest)
+	}
+	return errors.New("MOVE extension not supported")
+}
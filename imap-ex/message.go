@@ -25,21 +25,41 @@ SOFTWARE.
 package imap
 
 import (
+	"bufio"
 	"bytes"
 	"io"
+	"io/ioutil"
 
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
 	"golang.org/x/crypto/openpgp"
 
 	"github.com/mad-day/gaw-mail/epgpmessage"
+	"github.com/mad-day/gaw-mail/format"
+	"github.com/mad-day/gaw-mail/smime"
 )
 
-func decryptMessage(mode DecryptMode,kr openpgp.KeyRing, r io.Reader) (*bytes.Buffer, error) {
+func decryptMessage(mode DecryptMode,kr openpgp.KeyRing, skr *smime.KeyRing, r io.Reader) (*bytes.Buffer, error) {
 	b := new(bytes.Buffer)
 	var err error
 	switch mode {
 	case DecryptRegular: err = epgpmessage.DecryptRegular(b, r, kr)
 	case DecryptWrap: err = epgpmessage.DecryptWrap(b, r, kr)
 	case DecryptFull: err = epgpmessage.DecryptFull(b, r, kr)
+	case DecryptProtected: err = epgpmessage.DecryptProtected(b, r, kr)
+	case DecryptAuto:
+		var raw []byte
+		if raw,err = ioutil.ReadAll(r); err==nil {
+			_,err = format.Decrypt(b, raw, kr)
+		}
+	case DecryptSMIME:
+		var raw []byte
+		if raw,err = ioutil.ReadAll(r); err!=nil { break }
+		if isSMIME(raw) {
+			err = smime.Decrypt(b, bytes.NewReader(raw), skr)
+		} else {
+			_,err = format.Decrypt(b, raw, kr)
+		}
 	default: err = epgpmessage.DecryptRegular(b, r, kr)
 	}
 	if err != nil {
@@ -48,10 +68,16 @@ func decryptMessage(mode DecryptMode,kr openpgp.KeyRing, r io.Reader) (*bytes.Bu
 	return b, nil
 }
 
-func encryptMessage(mode EncryptMode,kr openpgp.EntityList, w io.Writer, r io.Reader) error {
+func isSMIME(raw []byte) bool {
+	h,err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(raw)))
+	return err==nil && smime.IsSMIME(message.Header{Header: h})
+}
+
+func encryptMessage(mode EncryptMode,to openpgp.EntityList, signed *openpgp.Entity, w io.Writer, r io.Reader) error {
 	switch mode {
-	case EncryptRegular: return epgpmessage.EncryptRegular(w, r, kr, kr[0])
-	case EncryptWrap: return epgpmessage.EncryptWrap(w, r, kr, kr[0])
-	default: return epgpmessage.EncryptRegular(w, r, kr, kr[0])
+	case EncryptRegular: return epgpmessage.EncryptRegular(w, r, to, signed)
+	case EncryptWrap: return epgpmessage.EncryptWrap(w, r, to, signed)
+	case EncryptProtected: return epgpmessage.EncryptProtected(w, r, to, signed)
+	default: return epgpmessage.EncryptRegular(w, r, to, signed)
 	}
 }
@@ -27,6 +27,10 @@ import (
 	"github.com/emersion/go-imap/backend"
 
 	"golang.org/x/crypto/openpgp"
+	
+	"github.com/mad-day/gaw-mail/policy"
+	"github.com/mad-day/gaw-mail/shared"
+	"github.com/mad-day/gaw-mail/smime"
 )
 
 type user struct {
@@ -35,27 +39,72 @@ type user struct {
 	e EncryptMode
 	d DecryptMode
 	kr openpgp.EntityList
+	skr *smime.KeyRing
+	
+	sh *shared.ACL
+	drafts bool
+	p *policy.Policy
+	username string
 }
 
 func (u *user) getMailbox(m backend.Mailbox) *mailbox {
 	return &mailbox{m, u}
 }
 
+func (u *user) allowed(name string) bool {
+	return u.sh==nil || u.sh.Allowed(u.username,name)
+}
+
 func (u *user) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
 	if mailboxes, err := u.User.ListMailboxes(subscribed); err != nil {
 		return nil, err
 	} else {
-		for i, m := range mailboxes {
-			mailboxes[i] = u.getMailbox(m)
+		list := mailboxes[:0]
+		for _, m := range mailboxes {
+			if !u.allowed(m.Name()) { continue }
+			list = append(list,u.getMailbox(m))
 		}
-		return mailboxes, nil
+		return list, nil
 	}
 }
 
 func (u *user) GetMailbox(name string) (backend.Mailbox, error) {
+	if !u.allowed(name) {
+		return nil, shared.ErrAccessDenied
+	}
 	if m, err := u.User.GetMailbox(name); err != nil {
 		return nil, err
 	} else {
 		return u.getMailbox(m), nil
 	}
 }
+
+/*
+Returns the keys, that messages appended to the mailbox are encrypted to: The keys of all
+members for shared mailboxes, the user's own keys otherwise.
+*/
+func (u *user) recipients(name string) (openpgp.EntityList, error) {
+	if u.sh==nil {
+		return u.kr, nil
+	}
+	if kr, err := u.sh.Recipients(u.username, name); err != nil {
+		return nil, err
+	} else if kr != nil {
+		return kr, nil
+	}
+	return u.kr, nil
+}
+
+/*
+The APPENDLIMIT of the underlying user applies to the encrypted message, the limit for the
+plain message is lowered by a quarter, the armor or Base64 expands it by a third.
+*/
+func (u *user) CreateMessageLimit() *uint32 {
+	if lu,ok := u.User.(backend.AppendLimitUser); ok {
+		if limit := lu.CreateMessageLimit(); limit!=nil {
+			l := *limit/4*3
+			return &l
+		}
+	}
+	return nil
+}
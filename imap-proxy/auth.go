@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-sasl"
+)
+
+// Auth is the way the proxy authenticates to the upstream server.
+type Auth int
+
+const (
+	// The LOGIN command.
+	AuthLogin Auth = iota
+	// AUTHENTICATE PLAIN.
+	AuthPlain
+	// AUTHENTICATE XOAUTH2, with the token from Backend.Token.
+	AuthXOAuth2
+	// AUTHENTICATE OAUTHBEARER (RFC 7628), with the token from Backend.Token.
+	AuthOAuthBearer
+	// AUTHENTICATE EXTERNAL, the server authenticates the TLS client
+	// certificate.
+	AuthExternal
+)
+
+// TokenFunc returns an OAuth 2.0 access token for the user. password is the
+// one the client logged in with.
+type TokenFunc func(username, password string) (string, error)
+
+// CertFunc returns the TLS client certificate of the user.
+type CertFunc func(username string) (*tls.Certificate, error)
+
+var errNoTLS = errors.New("proxy: client certificates require TLS")
+
+// tlsConfig returns the TLS config for connections of the user.
+func (be *Backend) tlsConfig(username string) (*tls.Config, error) {
+	if be.ClientCert == nil {
+		return be.TLSConfig, nil
+	}
+	if be.Security == SecurityNone {
+		return nil, errNoTLS
+	}
+
+	cert, err := be.ClientCert(username)
+	if err != nil {
+		return nil, err
+	}
+
+	var config *tls.Config
+	if be.TLSConfig != nil {
+		config = be.TLSConfig.Clone()
+	} else {
+		config = new(tls.Config)
+	}
+	config.Certificates = []tls.Certificate{*cert}
+	return config, nil
+}
+
+func (be *Backend) token(username, password string) (string, error) {
+	if be.Token == nil {
+		return password, nil
+	}
+	return be.Token(username, password)
+}
+
+// authenticate logs c in, as configured by be.Auth.
+func (be *Backend) authenticate(c *client.Client, username, password string) error {
+	var auth sasl.Client
+	switch be.Auth {
+	case AuthLogin:
+		return c.Login(username, password)
+	case AuthPlain:
+		auth = sasl.NewPlainClient("", username, password)
+	case AuthXOAuth2, AuthOAuthBearer:
+		token, err := be.token(username, password)
+		if err != nil {
+			return err
+		}
+		if be.Auth == AuthXOAuth2 {
+			auth = &xoauth2Client{username, token}
+		} else {
+			auth = sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{Username: username, Token: token})
+		}
+	case AuthExternal:
+		auth = sasl.NewExternalClient(username)
+	default:
+		return fmt.Errorf("proxy: unknown auth %d", be.Auth)
+	}
+
+	mech, _, _ := auth.Start()
+	if ok, err := c.SupportAuth(mech); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("proxy: server doesn't support AUTH=%s", mech)
+	}
+	return c.Authenticate(auth)
+}
+
+// xoauth2Client implements the XOAUTH2 mechanism, that Gmail and Outlook use.
+// go-sasl doesn't have it.
+type xoauth2Client struct {
+	username, token string
+}
+
+func (a *xoauth2Client) Start() (mech string, ir []byte, err error) {
+	ir = []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01")
+	return "XOAUTH2", ir, nil
+}
+
+func (a *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	// The server sends an error description and expects an empty response,
+	// before it fails the command.
+	return []byte{}, nil
+}
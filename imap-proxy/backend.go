@@ -2,6 +2,8 @@ package proxy
 
 import (
 	"crypto/tls"
+	"sync"
+	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend"
@@ -21,7 +23,37 @@ type Backend struct {
 	Security Security
 	TLSConfig *tls.Config
 
+	// How to authenticate upstream. Defaults to AuthLogin.
+	Auth Auth
+
+	// Returns the access token for AuthXOAuth2 and AuthOAuthBearer. If nil,
+	// the password, the client logged in with, is used as token.
+	Token TokenFunc
+
+	// If not nil, returns the TLS client certificate for a user, to be used
+	// together with AuthExternal. Otherwise the certificates in TLSConfig
+	// are used.
+	ClientCert CertFunc
+
+	// The maximum number of upstream connections per user. Mailboxes, that
+	// are used concurrently, get their own connection, instead of being
+	// re-selected over and over. Defaults to 1.
+	PoolSize int
+
+	// If not zero, a NOOP is sent on connections, that have been idle for
+	// this long, so that the server doesn't drop them.
+	Keepalive time.Duration
+
+	// The interval for polling with NOOP, if the server doesn't support IDLE.
+	// Defaults to one minute. Only used, if Updates has been called.
+	PollInterval time.Duration
+
 	unexported struct{}
+
+	updatesMutex sync.Mutex
+	updates chan backend.Update
+	updatesStop chan struct{}
+	leaders map[string]*conn
 }
 
 var _ backend.Backend = (*Backend)(nil)
@@ -48,11 +80,22 @@ func NewTLS(addr string, tlsConfig *tls.Config) *Backend {
 	}
 }
 
+func (be *Backend) poolSize() int {
+	if be.PoolSize < 1 {
+		return 1
+	}
+	return be.PoolSize
+}
+
 func (be *Backend) login(username, password string) (*client.Client, error) {
+	tlsConfig, err := be.tlsConfig(username)
+	if err != nil {
+		return nil, err
+	}
+
 	var c *client.Client
-	var err error
 	if be.Security == SecurityTLS {
-		if c, err = client.DialTLS(be.Addr, be.TLSConfig); err != nil {
+		if c, err = client.DialTLS(be.Addr, tlsConfig); err != nil {
 			return nil, err
 		}
 	} else {
@@ -61,13 +104,15 @@ func (be *Backend) login(username, password string) (*client.Client, error) {
 		}
 
 		if be.Security == SecuritySTARTTLS {
-			if err := c.StartTLS(be.TLSConfig); err != nil {
+			if err := c.StartTLS(tlsConfig); err != nil {
+				c.Terminate()
 				return nil, err
 			}
 		}
 	}
 
-	if err := c.Login(username, password); err != nil {
+	if err := be.authenticate(c, username, password); err != nil {
+		c.Logout()
 		return nil, err
 	}
 
@@ -80,10 +125,17 @@ func (be *Backend) Login(_ *imap.ConnInfo, username, password string) (backend.U
 		return nil, err
 	}
 
+	cn := &conn{c: c, lastUse: time.Now()}
 	u := &user{
 		be: be,
-		c: c,
 		username: username,
+		password: password,
+		conns: []*conn{cn},
+		stop: make(chan struct{}),
+	}
+	u.attach(cn, c)
+	if be.Keepalive > 0 {
+		go u.keepalive(be.Keepalive)
 	}
 	return u, nil
 }
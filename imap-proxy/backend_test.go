@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+)
+
+// testServer is an upstream server on the loopback interface. It serves
+// go-imap's memory backend, which knows the user "username" with the password
+// "password" and has one message in INBOX.
+type testServer struct {
+	*server.Server
+	l *faultListener
+}
+
+func newTestServer(t *testing.T, be backend.Backend, extensions ...server.Extension) *testServer {
+	if be == nil {
+		be = memory.New()
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testServer{server.New(be), &faultListener{Listener: l}}
+	s.AllowInsecureAuth = true
+	s.ErrorLog = nopLogger{}
+	s.Enable(extensions...)
+	go s.Serve(s.l)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// login logs into the server through a new proxy backend.
+func (s *testServer) login(t *testing.T) (*Backend, backend.User) {
+	be := NewNoTLS(s.l.Addr().String())
+	u, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { u.Logout() })
+	return be, u
+}
+
+// faultListener makes the server drop a connection in the middle of a
+// command, as if the network failed.
+type faultListener struct {
+	net.Listener
+
+	mutex sync.Mutex
+	// The connection is dropped, once the client sent a command containing
+	// onRead, or once the server sent a response containing onWrite.
+	onRead  string
+	onWrite string
+}
+
+func (l *faultListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &faultConn{c, l}, nil
+}
+
+// dropOnCommand arms the listener to drop the connection, that receives a
+// command containing s. Only one connection is dropped.
+func (l *faultListener) dropOnCommand(s string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.onRead = s
+}
+
+// dropOnResponse arms the listener to drop the connection, that sends a
+// response containing s. Only one connection is dropped.
+func (l *faultListener) dropOnResponse(s string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.onWrite = s
+}
+
+// trigger disarms s and returns the end of it in b, if b contains it, or -1.
+func (l *faultListener) trigger(s *string, b []byte) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if *s == "" {
+		return -1
+	}
+	i := bytes.Index(b, []byte(*s))
+	if i < 0 {
+		return -1
+	}
+	i += len(*s)
+	*s = ""
+	return i
+}
+
+type faultConn struct {
+	net.Conn
+	l *faultListener
+}
+
+func (c *faultConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && c.l.trigger(&c.l.onRead, b[:n]) >= 0 {
+		c.Conn.Close()
+		return 0, io.EOF
+	}
+	return n, err
+}
+
+func (c *faultConn) Write(b []byte) (int, error) {
+	if i := c.l.trigger(&c.l.onWrite, b); i >= 0 {
+		// The line with the response still gets through.
+		if j := bytes.IndexByte(b[i:], '\n'); j >= 0 {
+			c.Conn.Write(b[:i+j+1])
+		}
+		c.Conn.Close()
+		return 0, io.ErrClosedPipe
+	}
+	return c.Conn.Write(b)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Printf(format string, v ...interface{}) {}
+func (nopLogger) Println(v ...interface{})               {}
+
+func TestLogin(t *testing.T) {
+	s := newTestServer(t, nil)
+	be := NewNoTLS(s.l.Addr().String())
+
+	if _, err := be.Login(nil, "username", "wrong"); err == nil {
+		t.Error("Login with a wrong password succeeded")
+	}
+
+	u, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Username() != "username" {
+		t.Errorf("Username() = %q", u.Username())
+	}
+
+	mailboxes, err := u.ListMailboxes(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, m := range mailboxes {
+		names = append(names, m.Name())
+	}
+	if strings.Join(names, ",") != "INBOX" {
+		t.Errorf("ListMailboxes() = %v", names)
+	}
+
+	if err := u.Logout(); err != nil {
+		t.Error(err)
+	}
+	// The server calls Logout again, when the client disconnects.
+	if err := u.Logout(); err != nil {
+		t.Error(err)
+	}
+
+	// Nothing logs in again, once the user logged out.
+	if _, err := u.ListMailboxes(false); err != errLoggedOut {
+		t.Errorf("ListMailboxes() after Logout = %v", err)
+	}
+}
@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// conn is one upstream connection of a user. It is re-established
+// transparently, if the server drops it.
+type conn struct {
+	mutex sync.Mutex
+	c *client.Client
+	lastUse time.Time
+
+	// The mailbox, that is (or is about to be) selected on this connection.
+	// Guarded by the user's mutex. Only a hint for pick.
+	selected string
+
+	// The mailbox, that is actually selected. Read by the update forwarder,
+	// which must not take the mutex.
+	current atomic.Value
+
+	// Set while the connection IDLEs.
+	idleStop chan struct{}
+	idleDone chan error
+}
+
+// broken reports, whether the connection has been closed by the server or
+// the network.
+func (cn *conn) broken() bool {
+	if cn.c == nil {
+		return false
+	}
+	select {
+	case <-cn.c.LoggedOut():
+		return true
+	default:
+		return cn.c.State() == imap.LogoutState
+	}
+}
+
+func (cn *conn) close() {
+	cn.stopIdle()
+	if cn.c != nil {
+		cn.c.Terminate()
+		cn.c = nil
+	}
+	cn.current.Store("")
+}
+
+// mailbox returns the mailbox, that is selected on the connection.
+func (cn *conn) mailbox() string {
+	name, _ := cn.current.Load().(string)
+	return name
+}
+
+// startIdle lets the connection IDLE, so that it receives updates of the
+// selected mailbox.
+func (cn *conn) startIdle(u *user) {
+	if out, _ := u.be.updateChan(); cn.c == nil || cn.idleStop != nil || cn.mailbox() == "" || out == nil {
+		return
+	}
+
+	stop, done := make(chan struct{}), make(chan error, 1)
+	cn.idleStop, cn.idleDone = stop, done
+	go func(c *client.Client) {
+		done <- c.Idle(stop, &client.IdleOptions{PollInterval: u.be.PollInterval})
+	}(cn.c)
+}
+
+// stopIdle ends IDLE, so that the connection can be used for commands.
+func (cn *conn) stopIdle() error {
+	if cn.idleStop == nil {
+		return nil
+	}
+	close(cn.idleStop)
+	err := <-cn.idleDone
+	cn.idleStop, cn.idleDone = nil, nil
+	return err
+}
+
+// prepare (re-)connects and selects the mailbox, if not empty.
+func (cn *conn) prepare(u *user, mailbox string) error {
+	if cn.broken() {
+		cn.close()
+	}
+	if cn.c == nil {
+		c, err := u.be.login(u.username, u.password)
+		if err != nil {
+			return err
+		}
+		cn.c = c
+		u.attach(cn, c)
+	}
+
+	if mailbox == "" {
+		return nil
+	}
+	if mbox := cn.c.Mailbox(); mbox != nil && mbox.Name == mailbox {
+		return nil
+	}
+	if cn.mailbox() != "" {
+		cn.current.Store("")
+		u.be.release(cn)
+	}
+	if _, err := cn.c.Select(mailbox, false); err != nil {
+		return err
+	}
+	cn.current.Store(mailbox)
+	return nil
+}
+
+// pick chooses the connection for a command on the given mailbox ("" for
+// commands, that don't need a selected mailbox): A connection, that has the
+// mailbox selected, a new one, if the pool is not full yet, or the least
+// recently used one.
+func (u *user) pick(mailbox string) *conn {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	var cn *conn
+	if mailbox != "" {
+		for _, c := range u.conns {
+			if c.selected == mailbox {
+				cn = c
+				break
+			}
+		}
+	}
+	if cn == nil && (len(u.conns) == 0 || (mailbox != "" && len(u.conns) < u.be.poolSize())) {
+		cn = new(conn)
+		u.conns = append(u.conns, cn)
+	}
+	if cn == nil {
+		cn = u.conns[0]
+		for _, c := range u.conns[1:] {
+			if c.lastUse.Before(cn.lastUse) {
+				cn = c
+			}
+		}
+	}
+
+	if mailbox != "" {
+		cn.selected = mailbox
+	}
+	cn.lastUse = time.Now()
+	return cn
+}
+
+var errLoggedOut = errors.New("proxy: user logged out")
+
+// sentError wraps the error of a command, that already passed results on to
+// the client. Such a command isn't retried, the results would be repeated.
+type sentError struct {
+	error
+}
+
+// do runs f on an upstream connection, that has the mailbox selected. If the
+// connection turns out to be dead and retry is set, f is run once more on a
+// new connection. retry must not be set for commands, that aren't idempotent,
+// or that address messages by sequence number: The numbers may refer to other
+// messages on the new connection. f returns a sentError, if it can't be
+// repeated any more.
+func (u *user) do(mailbox string, retry bool, f func(c *client.Client) error) error {
+	cn := u.pick(mailbox)
+
+	cn.mutex.Lock()
+	defer cn.mutex.Unlock()
+
+	// Logout logs out every connection, once it's no longer in use.
+	if atomic.LoadInt32(&u.closed) != 0 {
+		return errLoggedOut
+	}
+
+	// IDLE is resumed, after f is done.
+	cn.stopIdle()
+	defer cn.startIdle(u)
+
+	for i := 0; ; i++ {
+		err := cn.prepare(u, mailbox)
+		if err == nil {
+			err = f(cn.c)
+		}
+		if sent, ok := err.(sentError); ok {
+			return sent.error
+		}
+		if err == nil || i > 0 || !retry || !cn.broken() {
+			return err
+		}
+		cn.close()
+	}
+}
+
+// keepalive sends a NOOP on every connection, that has been idle for d,
+// until the user logs out. Connections, that IDLE, are reconnected, if the
+// server dropped them.
+func (u *user) keepalive(d time.Duration) {
+	t := time.NewTicker(d)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-u.stop:
+			return
+		case <-t.C:
+		}
+
+		u.mutex.Lock()
+		conns := append([]*conn(nil), u.conns...)
+		u.mutex.Unlock()
+
+		for _, cn := range conns {
+			u.mutex.Lock()
+			idle := time.Since(cn.lastUse) >= d
+			u.mutex.Unlock()
+			if !idle {
+				continue
+			}
+
+			cn.mutex.Lock()
+			if cn.idleStop != nil {
+				if cn.broken() {
+					name := cn.mailbox()
+					cn.close()
+					if cn.prepare(u, name) == nil {
+						cn.startIdle(u)
+					}
+				}
+			} else if cn.c != nil && cn.c.Noop() != nil && cn.broken() {
+				cn.close()
+			}
+			cn.mutex.Unlock()
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/server"
+)
+
+func fetchUids(t *testing.T, mbox backend.Mailbox, uid bool) ([]uint32, error) {
+	t.Helper()
+	seqset := new(imap.SeqSet)
+	seqset.AddRange(1, 0)
+	ch := make(chan *imap.Message, 16)
+	err := mbox.ListMessages(uid, seqset, []imap.FetchItem{imap.FetchUid}, ch)
+
+	var uids []uint32
+	for msg := range ch {
+		uids = append(uids, msg.Uid)
+	}
+	return uids, err
+}
+
+func TestReconnect(t *testing.T) {
+	s := newTestServer(t, nil)
+	_, u := s.login(t)
+
+	mbox, err := u.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.ForEachConn(func(c server.Conn) {
+		c.Close()
+	})
+
+	uids, err := fetchUids(t, mbox, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uids) != 1 {
+		t.Errorf("got %v after reconnecting, want one message", uids)
+	}
+	if _, err := u.ListMailboxes(false); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	s := newTestServer(t, nil)
+	_, u := s.login(t)
+
+	mbox, err := u.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString("Subject: x\r\n\r\nHi\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// UID FETCH is run again on a new connection.
+	s.l.dropOnCommand("UID FETCH")
+	uids, err := fetchUids(t, mbox, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uids) != 2 {
+		t.Errorf("UID FETCH returned %v, want two messages", uids)
+	}
+
+	// The sequence numbers might address other messages after reconnecting.
+	s.l.dropOnCommand(" FETCH")
+	if uids, err := fetchUids(t, mbox, false); err == nil {
+		t.Errorf("FETCH was retried, returned %v", uids)
+	}
+	s.l.dropOnCommand("SEARCH")
+	if _, err := mbox.SearchMessages(false, imap.NewSearchCriteria()); err == nil {
+		t.Error("SEARCH was retried")
+	}
+	s.l.dropOnCommand("UID SEARCH")
+	if ids, err := mbox.SearchMessages(true, imap.NewSearchCriteria()); err != nil || len(ids) != 2 {
+		t.Errorf("UID SEARCH returned %v, %v", ids, err)
+	}
+
+	// Messages, that have been passed on, would be passed on twice.
+	s.l.dropOnResponse("* 1 FETCH")
+	uids, err = fetchUids(t, mbox, true)
+	if err == nil {
+		t.Error("UID FETCH was retried after a message was returned")
+	}
+	if len(uids) != 1 {
+		t.Errorf("UID FETCH returned %v, want the first message only", uids)
+	}
+
+	// The next command reconnects.
+	if uids, err := fetchUids(t, mbox, false); err != nil || len(uids) != 2 {
+		t.Errorf("FETCH returned %v, %v", uids, err)
+	}
+}
@@ -4,8 +4,12 @@ import (
 	"time"
 
 	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/client"
 )
 
+var _ backend.MoveMailbox = (*mailbox)(nil)
+
 type mailbox struct {
 	u    *user
 	name string
@@ -13,12 +17,9 @@ type mailbox struct {
 }
 
 func (m *mailbox) ensureSelected() error {
-	if m.u.c.Mailbox() != nil && m.u.c.Mailbox().Name == m.name {
+	return m.u.do(m.name, true, func(c *client.Client) error {
 		return nil
-	}
-
-	_, err := m.u.c.Select(m.name, false)
-	return err
+	})
 }
 
 func (m *mailbox) Name() string {
@@ -30,100 +31,158 @@ func (m *mailbox) Info() (*imap.MailboxInfo, error) {
 }
 
 func (m *mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
-	if m.u.c.Mailbox() != nil && m.u.c.Mailbox().Name == m.name {
-		mbox := *m.u.c.Mailbox()
-		return &mbox, nil
+	var status *imap.MailboxStatus
+	err := m.u.do("", true, func(c *client.Client) error {
+		var err error
+		status, err = c.Status(m.name, items)
+		if err == nil || c.State() != imap.SelectedState || c.Mailbox().Name != m.name {
+			return err
+		}
+
+		// Some servers refuse STATUS on the selected mailbox.
+		status, err = selectStatus(c, m.name, items)
+		return err
+	})
+	return status, err
+}
+
+// selectStatus gets the status of the mailbox, that is selected on c, by
+// selecting it again. UNSEEN is counted by a search, the SELECT response only
+// carries the first unseen message.
+func selectStatus(c *client.Client, name string, items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	mbox, err := c.Select(name, c.Mailbox().ReadOnly)
+	if err != nil {
+		return nil, err
 	}
 
-	return m.u.c.Status(m.name, items)
+	status := imap.NewMailboxStatus(name, items)
+	for _, item := range items {
+		switch item {
+		case imap.StatusMessages:
+			status.Messages = mbox.Messages
+		case imap.StatusRecent:
+			status.Recent = mbox.Recent
+		case imap.StatusUidNext:
+			status.UidNext = mbox.UidNext
+		case imap.StatusUidValidity:
+			status.UidValidity = mbox.UidValidity
+		case imap.StatusUnseen:
+			criteria := imap.NewSearchCriteria()
+			criteria.WithoutFlags = []string{imap.SeenFlag}
+			ids, err := c.Search(criteria)
+			if err != nil {
+				return nil, err
+			}
+			status.Unseen = uint32(len(ids))
+		default:
+			delete(status.Items, item)
+		}
+	}
+	return status, nil
 }
 
 func (m *mailbox) SetSubscribed(subscribe bool) error {
-	if subscribe {
-		return m.u.c.Subscribe(m.name)
-	} else {
-		return m.u.c.Unsubscribe(m.name)
-	}
+	return m.u.do("", true, func(c *client.Client) error {
+		if subscribe {
+			return c.Subscribe(m.name)
+		} else {
+			return c.Unsubscribe(m.name)
+		}
+	})
 }
 
 func (m *mailbox) Check() error {
-	if err := m.ensureSelected(); err != nil {
-		return err
-	}
-
-	return m.u.c.Check()
+	return m.u.do(m.name, true, func(c *client.Client) error {
+		return c.Check()
+	})
 }
 
 func (m *mailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
 	defer close(ch)
 
-	if err := m.ensureSelected(); err != nil {
-		return err
-	}
-
-	messages := make(chan *imap.Message)
-	done := make(chan error, 1)
-	go func() {
-		if uid {
-			done <- m.u.c.UidFetch(seqset, items, messages)
-		} else {
-			done <- m.u.c.Fetch(seqset, items, messages)
+	// Only UID FETCH is retried, and only, if no message has been passed on.
+	return m.u.do(m.name, uid, func(c *client.Client) error {
+		messages := make(chan *imap.Message)
+		done := make(chan error, 1)
+		go func() {
+			if uid {
+				done <- c.UidFetch(seqset, items, messages)
+			} else {
+				done <- c.Fetch(seqset, items, messages)
+			}
+		}()
+
+		sent := false
+		for msg := range messages {
+			ch <- msg
+			sent = true
 		}
-	}()
-
-	for msg := range messages {
-		ch <- msg
-	}
 
-	return <-done
+		err := <-done
+		if err != nil && sent {
+			return sentError{err}
+		}
+		return err
+	})
 }
 
 func (m *mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
-	if err := m.ensureSelected(); err != nil {
-		return nil, err
-	}
-
-	if uid {
-		return m.u.c.UidSearch(criteria)
-	} else {
-		return m.u.c.Search(criteria)
-	}
+	var ids []uint32
+	err := m.u.do(m.name, uid, func(c *client.Client) error {
+		var err error
+		if uid {
+			ids, err = c.UidSearch(criteria)
+		} else {
+			ids, err = c.Search(criteria)
+		}
+		return err
+	})
+	return ids, err
 }
 
 func (m *mailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
-	return m.u.c.Append(m.name, flags, date, body)
+	// Not retried, the message might have been appended already.
+	return m.u.do("", false, func(c *client.Client) error {
+		return c.Append(m.name, flags, date, body)
+	})
 }
 
 func (m *mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation imap.FlagsOp, flags []string) error {
-	if err := m.ensureSelected(); err != nil {
-		return err
-	}
-
 	flagsInterface := imap.FormatStringList(flags)
 
-	if uid {
-		return m.u.c.UidStore(seqset, imap.StoreItem(operation), flagsInterface, nil)
-	} else {
-		return m.u.c.Store(seqset, imap.StoreItem(operation), flagsInterface, nil)
-	}
+	return m.u.do(m.name, uid, func(c *client.Client) error {
+		if uid {
+			return c.UidStore(seqset, imap.StoreItem(operation), flagsInterface, nil)
+		} else {
+			return c.Store(seqset, imap.StoreItem(operation), flagsInterface, nil)
+		}
+	})
 }
 
 func (m *mailbox) CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error {
-	if err := m.ensureSelected(); err != nil {
-		return err
-	}
+	return m.u.do(m.name, false, func(c *client.Client) error {
+		if uid {
+			return c.UidCopy(seqset, dest)
+		} else {
+			return c.Copy(seqset, dest)
+		}
+	})
+}
 
-	if uid {
-		return m.u.c.UidCopy(seqset, dest)
-	} else {
-		return m.u.c.Copy(seqset, dest)
-	}
+func (m *mailbox) MoveMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	// Falls back to COPY, STORE and EXPUNGE, if the server doesn't support
+	// MOVE. Not retried, like COPY.
+	return m.u.do(m.name, false, func(c *client.Client) error {
+		if uid {
+			return c.UidMove(seqset, dest)
+		} else {
+			return c.Move(seqset, dest)
+		}
+	})
 }
 
 func (m *mailbox) Expunge() error {
-	if err := m.ensureSelected(); err != nil {
-		return err
-	}
-
-	return m.u.c.Expunge(nil)
+	return m.u.do(m.name, true, func(c *client.Client) error {
+		return c.Expunge(nil)
+	})
 }
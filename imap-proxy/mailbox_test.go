@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+)
+
+// strictStatus makes the server refuse STATUS on the selected mailbox, like
+// some servers do.
+type strictStatus struct {
+	refused int32
+}
+
+func (e *strictStatus) Capabilities(c server.Conn) []string {
+	return nil
+}
+
+func (e *strictStatus) Command(name string) server.HandlerFactory {
+	if name != "STATUS" {
+		return nil
+	}
+	return func() server.Handler {
+		return &strictStatusCmd{e: e}
+	}
+}
+
+type strictStatusCmd struct {
+	server.Status
+	e *strictStatus
+}
+
+func (cmd *strictStatusCmd) Handle(conn server.Conn) error {
+	if mbox := conn.Context().Mailbox; mbox != nil && mbox.Name() == cmd.Mailbox {
+		atomic.AddInt32(&cmd.e.refused, 1)
+		return errors.New("STATUS on the selected mailbox")
+	}
+	return cmd.Status.Handle(conn)
+}
+
+var allStatusItems = []imap.StatusItem{
+	imap.StatusMessages,
+	imap.StatusRecent,
+	imap.StatusUidNext,
+	imap.StatusUidValidity,
+	imap.StatusUnseen,
+}
+
+func checkStatus(t *testing.T, got, want *imap.MailboxStatus) {
+	t.Helper()
+	if len(got.Items) != len(want.Items) {
+		t.Errorf("%v: items %v, want %v", got.Name, got.Items, want.Items)
+	}
+	if got.Messages != want.Messages || got.Recent != want.Recent || got.Unseen != want.Unseen ||
+		got.UidNext != want.UidNext || got.UidValidity != want.UidValidity {
+		t.Errorf("%v: status %+v, want %+v", got.Name, got, want)
+	}
+}
+
+func TestMailboxStatus(t *testing.T) {
+	upstream := memory.New()
+	ext := new(strictStatus)
+	s := newTestServer(t, upstream, ext)
+	_, u := s.login(t)
+
+	if err := u.CreateMailbox("Archive"); err != nil {
+		t.Fatal(err)
+	}
+	inbox, err := u.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Selects Archive on the only upstream connection.
+	archive, err := u.GetMailbox("Archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, flags := range [][]string{{imap.SeenFlag}, nil, nil} {
+		if err := archive.CreateMessage(flags, time.Now(), bytes.NewBufferString("Subject: x\r\n\r\nHi\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	uu, err := upstream.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := func(name string, items []imap.StatusItem) *imap.MailboxStatus {
+		m, err := uu.GetMailbox(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := m.Status(items)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for item := range status.Items {
+			status.Items[item] = nil
+		}
+
+		// The memory backend reports the first unseen message.
+		if _, ok := status.Items[imap.StatusUnseen]; ok {
+			criteria := imap.NewSearchCriteria()
+			criteria.WithoutFlags = []string{imap.SeenFlag}
+			unseen, err := m.SearchMessages(false, criteria)
+			if err != nil {
+				t.Fatal(err)
+			}
+			status.Unseen = uint32(len(unseen))
+		}
+		return status
+	}
+
+	// INBOX isn't selected, STATUS works.
+	status, err := inbox.Status(allStatusItems)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStatus(t, status, want("INBOX", allStatusItems))
+	if n := atomic.LoadInt32(&ext.refused); n != 0 {
+		t.Fatalf("STATUS refused %v times", n)
+	}
+
+	// Archive is, the status is taken from SELECT.
+	status, err = archive.Status(allStatusItems)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStatus(t, status, want("Archive", allStatusItems))
+	if status.Unseen != 2 {
+		t.Errorf("Unseen = %v, want 2", status.Unseen)
+	}
+	if n := atomic.LoadInt32(&ext.refused); n != 1 {
+		t.Fatalf("STATUS refused %v times, want 1", n)
+	}
+
+	// Only the requested items are returned.
+	items := []imap.StatusItem{imap.StatusMessages}
+	status, err = archive.Status(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStatus(t, status, want("Archive", items))
+}
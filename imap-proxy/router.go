@@ -0,0 +1,433 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+// ErrNoUpstream is returned by resolvers, if they don't know the domain.
+var ErrNoUpstream = errors.New("proxy: no upstream server for domain")
+
+// How long SRVResolver and AutoconfigResolver wait for an answer.
+const resolveTimeout = 10 * time.Second
+
+// Upstream describes the upstream server of a domain.
+type Upstream struct {
+	Addr string
+	Security Security
+	TLSConfig *tls.Config
+}
+
+// Resolver finds the upstream server of a domain.
+type Resolver interface {
+	Resolve(domain string) (*Upstream, error)
+}
+
+// ResolverFunc is a function, that implements Resolver.
+type ResolverFunc func(domain string) (*Upstream, error)
+
+func (f ResolverFunc) Resolve(domain string) (*Upstream, error) {
+	return f(domain)
+}
+
+// StaticResolver maps (lower case) domains to upstream servers. The key "*"
+// matches all other domains.
+type StaticResolver map[string]*Upstream
+
+func (r StaticResolver) Resolve(domain string) (*Upstream, error) {
+	if up, ok := r[domain]; ok {
+		return up, nil
+	}
+	if up, ok := r["*"]; ok {
+		return up, nil
+	}
+	return nil, ErrNoUpstream
+}
+
+// ChainResolver asks each resolver in turn, until one knows the domain.
+type ChainResolver []Resolver
+
+func (r ChainResolver) Resolve(domain string) (*Upstream, error) {
+	for _, res := range r {
+		up, err := res.Resolve(domain)
+		if err != ErrNoUpstream {
+			return up, err
+		}
+	}
+	return nil, ErrNoUpstream
+}
+
+// SRVResolver looks up the _imaps._tcp and _imap._tcp SRV records of the
+// domain (RFC 6186). IMAP on the _imap service is secured with STARTTLS.
+//
+// The SRV records are not authenticated: Unless the target is within the
+// domain, the server's certificate must be valid for the domain itself (RFC
+// 6186, section 6).
+type SRVResolver struct{}
+
+func (SRVResolver) Resolve(domain string) (*Upstream, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+
+	for _, service := range []string{"imaps", "imap"} {
+		_, addrs, err := net.DefaultResolver.LookupSRV(ctx, service, "tcp", domain)
+		if err != nil || len(addrs) == 0 {
+			continue
+		}
+		if up := srvUpstream(domain, service, addrs[0]); up != nil {
+			return up, nil
+		}
+	}
+	return nil, ErrNoUpstream
+}
+
+// srvUpstream returns the upstream server for the SRV record of the service,
+// or nil, if the service is not available.
+func srvUpstream(domain, service string, addr *net.SRV) *Upstream {
+	// A target of "." means, that the service is not available.
+	host := strings.TrimSuffix(addr.Target, ".")
+	if host == "" {
+		return nil
+	}
+
+	name := domain
+	if h := strings.ToLower(host); h == domain || strings.HasSuffix(h, "."+domain) {
+		name = host
+	}
+
+	up := &Upstream{
+		Addr: net.JoinHostPort(host, strconv.Itoa(int(addr.Port))),
+		Security: SecuritySTARTTLS,
+		TLSConfig: &tls.Config{ServerName: name},
+	}
+	if service == "imaps" {
+		up.Security = SecurityTLS
+	}
+	return up
+}
+
+// AutoconfigResolver fetches the Thunderbird autoconfig file of the domain
+// from https://autoconfig.<domain>/mail/config-v1.1.xml and uses the first
+// IMAP server in it.
+type AutoconfigResolver struct {
+	// The HTTP client. Defaults to a client, that gives up after ten seconds.
+	Client *http.Client
+}
+
+var autoconfigClient = &http.Client{Timeout: resolveTimeout}
+
+type autoconfig struct {
+	Servers []struct {
+		Type string `xml:"type,attr"`
+		Hostname string `xml:"hostname"`
+		Port int `xml:"port"`
+		SocketType string `xml:"socketType"`
+	} `xml:"emailProvider>incomingServer"`
+}
+
+func (r *AutoconfigResolver) Resolve(domain string) (*Upstream, error) {
+	c := r.Client
+	if c == nil {
+		c = autoconfigClient
+	}
+
+	resp, err := c.Get("https://autoconfig." + domain + "/mail/config-v1.1.xml?emailaddress=user@" + domain)
+	if err != nil {
+		return nil, ErrNoUpstream
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, ErrNoUpstream
+	}
+
+	var config autoconfig
+	if err := xml.NewDecoder(resp.Body).Decode(&config); err != nil {
+		return nil, fmt.Errorf("proxy: autoconfig of %s: %v", domain, err)
+	}
+	for _, s := range config.Servers {
+		if s.Type != "imap" || s.Hostname == "" {
+			continue
+		}
+
+		up := &Upstream{
+			Addr: net.JoinHostPort(s.Hostname, strconv.Itoa(s.Port)),
+			TLSConfig: &tls.Config{ServerName: s.Hostname},
+		}
+		switch strings.ToUpper(s.SocketType) {
+		case "SSL":
+			up.Security = SecurityTLS
+		case "STARTTLS":
+			up.Security = SecuritySTARTTLS
+		default:
+			// Never send passwords in clear text to a server found this way.
+			continue
+		}
+		return up, nil
+	}
+	return nil, ErrNoUpstream
+}
+
+// Router is a backend, that serves each user by the upstream server of the
+// domain of the username (the part after the last "@").
+type Router struct {
+	Resolver Resolver
+
+	// Called on each new per-domain backend, to set options like PoolSize or
+	// Auth. May be nil.
+	Configure func(be *Backend)
+
+	// How long a domain is served by the upstream server, it was resolved to.
+	// Defaults to one hour.
+	TTL time.Duration
+
+	// How long a domain without an upstream server is rejected, before it is
+	// resolved again. Defaults to one minute.
+	NegativeTTL time.Duration
+
+	// The maximum number of domains, that are remembered (each, those with and
+	// those without an upstream server). Defaults to 1000.
+	MaxDomains int
+
+	mutex sync.Mutex
+	routes map[string]*route
+	unknown map[string]time.Time
+	pending map[string]*resolution
+	updates chan backend.Update
+}
+
+// route is a resolved domain.
+type route struct {
+	be *Backend
+	expires time.Time
+}
+
+// resolution is a domain, that is being resolved. Logins to the domain wait
+// for it, instead of resolving the domain once more.
+type resolution struct {
+	done chan struct{}
+	be *Backend
+	err error
+}
+
+var _ backend.BackendUpdater = (*Router)(nil)
+
+func NewRouter(r Resolver) *Router {
+	return &Router{Resolver: r}
+}
+
+func (r *Router) ttl() time.Duration {
+	if r.TTL <= 0 {
+		return time.Hour
+	}
+	return r.TTL
+}
+
+func (r *Router) negativeTTL() time.Duration {
+	if r.NegativeTTL <= 0 {
+		return time.Minute
+	}
+	return r.NegativeTTL
+}
+
+func (r *Router) maxDomains() int {
+	if r.MaxDomains < 1 {
+		return 1000
+	}
+	return r.MaxDomains
+}
+
+// backend returns the backend for the domain. Domains are resolved again,
+// once the TTL expired. The backend is kept, if the upstream server is still
+// the same. The mutex is not held while resolving, a slow domain holds up
+// only the logins to it.
+func (r *Router) backend(domain string) (*Backend, error) {
+	r.mutex.Lock()
+
+	now := time.Now()
+	if rt, ok := r.routes[domain]; ok && now.Before(rt.expires) {
+		r.mutex.Unlock()
+		return rt.be, nil
+	}
+	if expires, ok := r.unknown[domain]; ok {
+		if now.Before(expires) {
+			r.mutex.Unlock()
+			return nil, ErrNoUpstream
+		}
+		delete(r.unknown, domain)
+	}
+	if res, ok := r.pending[domain]; ok {
+		r.mutex.Unlock()
+		<-res.done
+		return res.be, res.err
+	}
+
+	res := &resolution{done: make(chan struct{})}
+	if r.pending == nil {
+		r.pending = make(map[string]*resolution)
+	}
+	r.pending[domain] = res
+	r.mutex.Unlock()
+
+	up, err := r.Resolver.Resolve(domain)
+
+	r.mutex.Lock()
+	delete(r.pending, domain)
+	res.be, res.err = r.resolved(domain, up, err)
+	r.mutex.Unlock()
+
+	close(res.done)
+	return res.be, res.err
+}
+
+// resolved records the upstream server of the domain. The mutex must be
+// held.
+func (r *Router) resolved(domain string, up *Upstream, err error) (*Backend, error) {
+	now := time.Now()
+	rt, ok := r.routes[domain]
+
+	if err == ErrNoUpstream {
+		if ok {
+			r.forget(domain)
+		}
+		if r.unknown == nil {
+			r.unknown = make(map[string]time.Time)
+		}
+		if len(r.unknown) >= r.maxDomains() {
+			delete(r.unknown, oldestUnknown(r.unknown))
+		}
+		r.unknown[domain] = now.Add(r.negativeTTL())
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+
+	if ok && sameUpstream(rt.be, up) {
+		rt.expires = now.Add(r.ttl())
+		return rt.be, nil
+	}
+
+	be := &Backend{
+		Addr: up.Addr,
+		Security: up.Security,
+		TLSConfig: up.TLSConfig,
+	}
+	if r.Configure != nil {
+		r.Configure(be)
+	}
+	if r.updates != nil {
+		forwardUpdates(be, r.updates)
+	}
+
+	if ok {
+		r.forget(domain)
+	} else if len(r.routes) >= r.maxDomains() {
+		r.forget(oldestRoute(r.routes))
+	}
+	if r.routes == nil {
+		r.routes = make(map[string]*route)
+	}
+	r.routes[domain] = &route{be, now.Add(r.ttl())}
+	return be, nil
+}
+
+// forget removes the route of the domain. The sessions, that its backend
+// still serves, no longer receive updates.
+func (r *Router) forget(domain string) {
+	if rt, ok := r.routes[domain]; ok {
+		rt.be.stopUpdates()
+		delete(r.routes, domain)
+	}
+}
+
+// sameUpstream reports, whether be serves the upstream server up.
+func sameUpstream(be *Backend, up *Upstream) bool {
+	if be.Addr != up.Addr || be.Security != up.Security {
+		return false
+	}
+	if be.TLSConfig == up.TLSConfig {
+		return true
+	}
+	return be.TLSConfig != nil && up.TLSConfig != nil && be.TLSConfig.ServerName == up.TLSConfig.ServerName
+}
+
+func oldestRoute(routes map[string]*route) string {
+	var oldest string
+	for domain, rt := range routes {
+		if oldest == "" || rt.expires.Before(routes[oldest].expires) {
+			oldest = domain
+		}
+	}
+	return oldest
+}
+
+func oldestUnknown(unknown map[string]time.Time) string {
+	var oldest string
+	for domain, expires := range unknown {
+		if oldest == "" || expires.Before(unknown[oldest]) {
+			oldest = domain
+		}
+	}
+	return oldest
+}
+
+func (r *Router) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	i := strings.LastIndex(username, "@")
+	if i < 0 {
+		return nil, backend.ErrInvalidCredentials
+	}
+
+	be, err := r.backend(strings.ToLower(username[i+1:]))
+	if err == ErrNoUpstream {
+		return nil, backend.ErrInvalidCredentials
+	} else if err != nil {
+		return nil, err
+	}
+	return be.Login(connInfo, username, password)
+}
+
+// Updates merges the updates of all per-domain backends.
+func (r *Router) Updates() <-chan backend.Update {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.updates == nil {
+		r.updates = make(chan backend.Update, 16)
+		for _, rt := range r.routes {
+			forwardUpdates(rt.be, r.updates)
+		}
+	}
+	return r.updates
+}
+
+// forwardUpdates passes the updates of be on in the background, until its
+// route is forgotten.
+func forwardUpdates(be *Backend, out chan<- backend.Update) {
+	in := be.Updates()
+	_, stop := be.updateChan()
+	go func() {
+		for {
+			select {
+			case upd := <-in:
+				select {
+				case out <- upd:
+				case <-stop:
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
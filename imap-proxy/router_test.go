@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSRVUpstream(t *testing.T) {
+	tests := []struct {
+		service, target string
+		addr, name      string
+		security        Security
+	}{
+		{"imaps", "imap.example.org.", "imap.example.org:993", "imap.example.org", SecurityTLS},
+		{"imap", "example.org.", "example.org:993", "example.org", SecuritySTARTTLS},
+		{"imaps", "IMAP.Example.org.", "IMAP.Example.org:993", "IMAP.Example.org", SecurityTLS},
+		// Outside of the domain, the certificate must be valid for the domain.
+		{"imaps", "mail.hoster.net.", "mail.hoster.net:993", "example.org", SecurityTLS},
+		{"imaps", "evilexample.org.", "evilexample.org:993", "example.org", SecurityTLS},
+	}
+	for _, test := range tests {
+		up := srvUpstream("example.org", test.service, &net.SRV{Target: test.target, Port: 993})
+		if up == nil {
+			t.Errorf("%v: no upstream", test.target)
+			continue
+		}
+		if up.Addr != test.addr || up.TLSConfig.ServerName != test.name || up.Security != test.security {
+			t.Errorf("%v: got %v, %v, %v", test.target, up.Addr, up.TLSConfig.ServerName, up.Security)
+		}
+	}
+
+	if up := srvUpstream("example.org", "imaps", &net.SRV{Target: ".", Port: 0}); up != nil {
+		t.Errorf("got %v for an unavailable service", up.Addr)
+	}
+}
+
+func TestRouterCache(t *testing.T) {
+	lookups := make(map[string]int)
+	addrs := map[string]string{"a.org": "imap.a.org:993", "b.org": "imap.b.org:993", "c.org": "imap.c.org:993"}
+	r := NewRouter(ResolverFunc(func(domain string) (*Upstream, error) {
+		lookups[domain]++
+		if addr, ok := addrs[domain]; ok {
+			return &Upstream{Addr: addr, Security: SecurityTLS}, nil
+		}
+		return nil, ErrNoUpstream
+	}))
+	r.TTL = 50 * time.Millisecond
+	r.NegativeTTL = 50 * time.Millisecond
+	r.MaxDomains = 2
+
+	a, err := r.backend("a.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if be, _ := r.backend("a.org"); be != a || lookups["a.org"] != 1 {
+		t.Errorf("a.org resolved %v times", lookups["a.org"])
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := r.backend("x.org"); err != ErrNoUpstream {
+			t.Errorf("x.org: %v", err)
+		}
+	}
+	if lookups["x.org"] != 1 {
+		t.Errorf("x.org resolved %v times", lookups["x.org"])
+	}
+
+	// After the TTL, the domain is resolved again. The backend stays, if the
+	// server didn't change.
+	time.Sleep(60 * time.Millisecond)
+	if be, _ := r.backend("a.org"); be != a || lookups["a.org"] != 2 {
+		t.Errorf("a.org resolved %v times, same backend %v", lookups["a.org"], be == a)
+	}
+	addrs["a.org"] = "mail.a.org:993"
+	time.Sleep(60 * time.Millisecond)
+	if be, _ := r.backend("a.org"); be == a || be.Addr != "mail.a.org:993" {
+		t.Errorf("a.org still served by %v", be.Addr)
+	}
+	if _, err := r.backend("x.org"); err != ErrNoUpstream || lookups["x.org"] != 2 {
+		t.Errorf("x.org resolved %v times: %v", lookups["x.org"], err)
+	}
+
+	// The domain, that expires first, is forgotten.
+	r.backend("a.org")
+	r.backend("b.org")
+	r.backend("c.org")
+	if len(r.routes) != 2 || r.routes["a.org"] != nil {
+		t.Errorf("routes: %v", r.routes)
+	}
+	for _, domain := range []string{"y.org", "z.org"} {
+		r.backend(domain)
+	}
+	if len(r.unknown) != 2 {
+		t.Errorf("unknown domains: %v", r.unknown)
+	}
+}
+
+func TestRouterResolveOnce(t *testing.T) {
+	var mutex sync.Mutex
+	lookups := make(map[string]int)
+	release := make(chan struct{})
+	r := NewRouter(ResolverFunc(func(domain string) (*Upstream, error) {
+		mutex.Lock()
+		lookups[domain]++
+		mutex.Unlock()
+		if domain == "slow.org" {
+			<-release
+		}
+		return &Upstream{Addr: "imap." + domain + ":993", Security: SecurityTLS}, nil
+	}))
+
+	var wg sync.WaitGroup
+	bes := make([]*Backend, 2)
+	for i := range bes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			bes[i], _ = r.backend("slow.org")
+		}(i)
+	}
+
+	// Other domains don't wait for slow.org.
+	done := make(chan struct{})
+	go func() {
+		r.backend("fast.org")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("fast.org waited for slow.org")
+	}
+
+	close(release)
+	wg.Wait()
+	if bes[0] == nil || bes[0] != bes[1] || lookups["slow.org"] != 1 {
+		t.Errorf("slow.org resolved %v times", lookups["slow.org"])
+	}
+}
+
+func TestRouterStopUpdates(t *testing.T) {
+	addr := "imap.a.org:993"
+	r := NewRouter(ResolverFunc(func(domain string) (*Upstream, error) {
+		return &Upstream{Addr: addr, Security: SecurityTLS}, nil
+	}))
+	r.TTL = time.Millisecond
+	r.Updates()
+
+	a, err := r.backend("a.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, stop := a.updateChan(); stop == nil {
+		t.Fatal("the updates of a.org are not forwarded")
+	}
+
+	addr = "mail.a.org:993"
+	time.Sleep(10 * time.Millisecond)
+	if be, _ := r.backend("a.org"); be == a {
+		t.Fatal("a.org still served by the old backend")
+	}
+	_, stop := a.updateChan()
+	select {
+	case <-stop:
+	default:
+		t.Error("the updates of the old backend are still forwarded")
+	}
+}
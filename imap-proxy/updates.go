@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/client"
+)
+
+var _ backend.BackendUpdater = (*Backend)(nil)
+
+// Updates implements backend.BackendUpdater. Once it has been called, the
+// upstream connections IDLE (or poll with NOOP, if the server doesn't support
+// IDLE) while they are not in use, and the unsolicited responses they receive
+// are forwarded on the returned channel.
+func (be *Backend) Updates() <-chan backend.Update {
+	be.updatesMutex.Lock()
+	defer be.updatesMutex.Unlock()
+
+	if be.updates == nil {
+		be.updates = make(chan backend.Update, 16)
+		be.updatesStop = make(chan struct{})
+	}
+	return be.updates
+}
+
+// updateChan returns the channel, that Updates returned, or nil, and a
+// channel, that is closed, once nobody reads it any more.
+func (be *Backend) updateChan() (chan backend.Update, <-chan struct{}) {
+	be.updatesMutex.Lock()
+	defer be.updatesMutex.Unlock()
+	return be.updates, be.updatesStop
+}
+
+// stopUpdates drops all further updates, because the channel, that Updates
+// returned, is no longer read.
+func (be *Backend) stopUpdates() {
+	be.updatesMutex.Lock()
+	defer be.updatesMutex.Unlock()
+
+	if be.updatesStop == nil {
+		return
+	}
+	select {
+	case <-be.updatesStop:
+	default:
+		close(be.updatesStop)
+	}
+}
+
+// claim makes cn the connection, that forwards the updates of the user's
+// mailbox, unless another connection already does. Every session has it's
+// own upstream connections, which all receive the same updates, but the
+// server broadcasts each update to all sessions.
+func (be *Backend) claim(username, mailbox string, cn *conn) bool {
+	be.updatesMutex.Lock()
+	defer be.updatesMutex.Unlock()
+
+	key := username + "\x00" + mailbox
+	if l, ok := be.leaders[key]; ok && l != cn {
+		return false
+	}
+	if be.leaders == nil {
+		be.leaders = make(map[string]*conn)
+	}
+	be.leaders[key] = cn
+	return true
+}
+
+// release gives up all mailboxes claimed by cn.
+func (be *Backend) release(cn *conn) {
+	be.updatesMutex.Lock()
+	defer be.updatesMutex.Unlock()
+
+	for key, l := range be.leaders {
+		if l == cn {
+			delete(be.leaders, key)
+		}
+	}
+}
+
+// attach makes c (the client of cn) report it's updates, if anyone is
+// interested in them.
+func (u *user) attach(cn *conn, c *client.Client) {
+	out, stop := u.be.updateChan()
+	if out == nil {
+		return
+	}
+
+	// The client reports EXISTS and RECENT with the status of the selected
+	// mailbox, which it goes on changing, while the forwarder reads it. The
+	// values are taken from the responses instead, as they are received.
+	counts := &counter{cn: cn}
+	c.SetDebug(imap.NewDebugWriter(nil, counts))
+
+	in := make(chan client.Update)
+	c.Updates = in
+	go u.forward(cn, c, counts, in, out, stop)
+}
+
+// forward translates the updates of c into backend updates until c is logged
+// out. Updates, that arrive while a mailbox is being selected, are dropped,
+// they are part of the SELECT response.
+func (u *user) forward(cn *conn, c *client.Client, counts *counter, in <-chan client.Update, out chan<- backend.Update, stop <-chan struct{}) {
+	defer u.be.release(cn)
+
+	for {
+		var upd client.Update
+		select {
+		case upd = <-in:
+		case <-c.LoggedOut():
+			return
+		}
+
+		name := cn.mailbox()
+		var bu backend.Update
+		switch upd := upd.(type) {
+		case *client.MailboxUpdate:
+			// The mailbox, that was selected, when the response arrived.
+			count, ok := counts.next()
+			name = count.mailbox
+			if !ok || name == "" || upd.Mailbox.Name != name {
+				continue
+			}
+			status := imap.NewMailboxStatus(name, []imap.StatusItem{count.item})
+			if count.item == imap.StatusMessages {
+				status.Messages = count.n
+			} else {
+				status.Recent = count.n
+			}
+			bu = &backend.MailboxUpdate{Update: backend.NewUpdate(u.username, name), MailboxStatus: status}
+		case *client.ExpungeUpdate:
+			bu = &backend.ExpungeUpdate{Update: backend.NewUpdate(u.username, name), SeqNum: upd.SeqNum}
+		case *client.MessageUpdate:
+			bu = &backend.MessageUpdate{Update: backend.NewUpdate(u.username, name), Message: upd.Message}
+		default:
+			continue
+		}
+		if name == "" {
+			continue
+		}
+
+		if u.be.claim(u.username, name, cn) {
+			select {
+			case out <- bu:
+			case <-stop:
+			}
+		}
+	}
+}
+
+type statusCount struct {
+	mailbox string
+	item imap.StatusItem
+	n uint32
+}
+
+// counter reads the responses of the server, before the client parses them,
+// and queues the values of EXISTS and RECENT. The client reports each of them
+// as a MailboxUpdate in the same order, as long as a mailbox is selected,
+// which is the only time, servers send them.
+type counter struct {
+	cn *conn
+
+	mutex sync.Mutex
+	line []byte
+
+	// The rest of a literal, that is skipped, and whether the line after it
+	// continues the response.
+	literal int
+	cont bool
+
+	counts []statusCount
+}
+
+func (cs *counter) Write(b []byte) (int, error) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	n := len(b)
+	for len(b) > 0 {
+		if cs.literal > 0 {
+			k := cs.literal
+			if k > len(b) {
+				k = len(b)
+			}
+			cs.literal -= k
+			b = b[k:]
+			continue
+		}
+
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			cs.line = append(cs.line, b...)
+			break
+		}
+		cs.line = append(cs.line, b[:i+1]...)
+		b = b[i+1:]
+		cs.parse(bytes.TrimRight(cs.line, "\r\n"))
+		if cap(cs.line) > 4096 {
+			cs.line = nil
+		} else {
+			cs.line = cs.line[:0]
+		}
+	}
+	return n, nil
+}
+
+func (cs *counter) parse(line []byte) {
+	start := !cs.cont
+	cs.cont = false
+	if i := bytes.LastIndexByte(line, '{'); i >= 0 && bytes.HasSuffix(line, []byte("}")) {
+		if n, err := strconv.Atoi(strings.TrimSuffix(string(line[i+1:len(line)-1]), "+")); err == nil && n >= 0 {
+			cs.literal, cs.cont = n, true
+		}
+	}
+	if !start {
+		return
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) != 3 || fields[0] != "*" {
+		return
+	}
+	var item imap.StatusItem
+	switch strings.ToUpper(fields[2]) {
+	case "EXISTS":
+		item = imap.StatusMessages
+	case "RECENT":
+		item = imap.StatusRecent
+	default:
+		return
+	}
+	// The client reports it, even if the number is invalid.
+	n, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil {
+		item = ""
+	}
+	cs.counts = append(cs.counts, statusCount{cs.cn.mailbox(), item, uint32(n)})
+}
+
+// next returns the value of the oldest EXISTS or RECENT, that hasn't been
+// reported yet, or false, if it isn't valid.
+func (cs *counter) next() (statusCount, bool) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	if len(cs.counts) == 0 {
+		return statusCount{}, false
+	}
+	count := cs.counts[0]
+	cs.counts = cs.counts[1:]
+	return count, count.item != ""
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+)
+
+// updater lets the test send updates to the clients of the upstream server.
+type updater struct {
+	*memory.Backend
+	updates chan backend.Update
+}
+
+func (be *updater) Updates() <-chan backend.Update {
+	return be.updates
+}
+
+func TestUpdates(t *testing.T) {
+	upstream := &updater{memory.New(), make(chan backend.Update, 2)}
+	s := newTestServer(t, upstream)
+	be := NewNoTLS(s.l.Addr().String())
+	updates := be.Updates()
+
+	login := func() backend.Mailbox {
+		u, err := be.Login(nil, "username", "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { u.Logout() })
+		mbox, err := u.GetMailbox("INBOX")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mbox
+	}
+	receive := func(n int) []backend.Update {
+		var got []backend.Update
+		timeout := time.After(5 * time.Second)
+		for len(got) < n {
+			select {
+			case upd := <-updates:
+				if upd.Username() != "username" || upd.Mailbox() != "INBOX" {
+					t.Errorf("update for %v/%v", upd.Username(), upd.Mailbox())
+				}
+				got = append(got, upd)
+			case <-timeout:
+				t.Fatalf("got %v updates, want %v", len(got), n)
+			}
+		}
+		select {
+		case upd := <-updates:
+			t.Fatalf("unexpected update %#v", upd)
+		case <-time.After(100 * time.Millisecond):
+		}
+		return got
+	}
+
+	mbox := login()
+	upstream.updates <- &backend.ExpungeUpdate{Update: backend.NewUpdate("username", "INBOX"), SeqNum: 1}
+	if upd, ok := receive(1)[0].(*backend.ExpungeUpdate); !ok || upd.SeqNum != 1 {
+		t.Errorf("got %+v, want an ExpungeUpdate of message 1", upd)
+	}
+
+	// Every session gets the updates from upstream, but they are forwarded
+	// once.
+	login()
+	for _, n := range []uint32{5, 6} {
+		status := imap.NewMailboxStatus("INBOX", []imap.StatusItem{imap.StatusMessages})
+		status.Messages = n
+		upd := &backend.MailboxUpdate{Update: backend.NewUpdate("username", "INBOX"), MailboxStatus: status}
+		// The server sends the updates in the background.
+		done := upd.Done()
+		upstream.updates <- upd
+		<-done
+	}
+	for i, upd := range receive(2) {
+		if upd, ok := upd.(*backend.MailboxUpdate); !ok || upd.Messages != uint32(5+i) || len(upd.Items) != 1 {
+			t.Errorf("got %+v, want a MailboxUpdate with %v messages", upd, 5+i)
+		}
+	}
+
+	// The IDLEing connection still takes commands.
+	if _, err := mbox.Status([]imap.StatusItem{imap.StatusMessages}); err != nil {
+		t.Error(err)
+	}
+}
@@ -2,6 +2,10 @@ package proxy
 
 import (
 	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend"
@@ -10,8 +14,18 @@ import (
 
 type user struct {
 	be *Backend
-	c *client.Client
 	username string
+
+	// Kept to re-login after the upstream connection dropped.
+	password string
+
+	mutex sync.Mutex
+	conns []*conn
+	stop chan struct{}
+	stopOnce sync.Once
+
+	// Set by Logout. Commands fail afterwards, instead of logging in again.
+	closed int32
 }
 
 func (u *user) Username() string {
@@ -19,22 +33,26 @@ func (u *user) Username() string {
 }
 
 func (u *user) listMailboxes(subscribed bool, name string) ([]backend.Mailbox, error) {
-	mailboxes := make(chan *imap.MailboxInfo)
-	done := make(chan error, 1)
-	go func () {
-		if subscribed {
-			done <- u.c.Lsub("", name, mailboxes)
-		} else {
-			done <- u.c.List("", name, mailboxes)
-		}
-	}()
-
 	var list []backend.Mailbox
-	for m := range mailboxes {
-		list = append(list, &mailbox{u: u, name: m.Name, info: m})
-	}
+	err := u.do("", true, func(c *client.Client) error {
+		mailboxes := make(chan *imap.MailboxInfo)
+		done := make(chan error, 1)
+		go func () {
+			if subscribed {
+				done <- c.Lsub("", name, mailboxes)
+			} else {
+				done <- c.List("", name, mailboxes)
+			}
+		}()
 
-	return list, <-done
+		list = list[:0]
+		for m := range mailboxes {
+			list = append(list, &mailbox{u: u, name: m.Name, info: m})
+		}
+		return <-done
+	})
+
+	return list, err
 }
 
 func (u *user) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
@@ -59,17 +77,71 @@ func (u *user) GetMailbox(name string) (backend.Mailbox, error) {
 }
 
 func (u *user) CreateMailbox(name string) error {
-	return u.c.Create(name)
+	return u.do("", false, func(c *client.Client) error {
+		return c.Create(name)
+	})
 }
 
 func (u *user) DeleteMailbox(name string) error {
-	return u.c.Delete(name)
+	return u.do("", false, func(c *client.Client) error {
+		return c.Delete(name)
+	})
 }
 
 func (u *user) RenameMailbox(existingName, newName string) error {
-		return u.c.Rename(existingName, newName)
+	return u.do("", false, func(c *client.Client) error {
+		return c.Rename(existingName, newName)
+	})
+}
+
+var _ backend.AppendLimitUser = (*user)(nil)
+
+// CreateMessageLimit returns the APPENDLIMIT (RFC 7889) of the server, or nil,
+// if it has none.
+func (u *user) CreateMessageLimit() *uint32 {
+	var caps map[string]bool
+	err := u.do("", true, func(c *client.Client) error {
+		var err error
+		caps, err = c.Capability()
+		return err
+	})
+	if err != nil {
+		return nil
+	}
+
+	for cap := range caps {
+		if !strings.HasPrefix(cap, "APPENDLIMIT=") {
+			continue
+		}
+		if limit, err := strconv.ParseUint(cap[len("APPENDLIMIT="):], 10, 32); err == nil {
+			l := uint32(limit)
+			return &l
+		}
+	}
+	return nil
 }
 
 func (u *user) Logout() error {
-	return u.c.Logout()
+	atomic.StoreInt32(&u.closed, 1)
+	u.stopOnce.Do(func() {
+		close(u.stop)
+	})
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	var err error
+	for _, cn := range u.conns {
+		cn.mutex.Lock()
+		cn.stopIdle()
+		if cn.c != nil {
+			if err2 := cn.c.Logout(); err == nil {
+				err = err2
+			}
+			cn.c = nil
+		}
+		cn.mutex.Unlock()
+	}
+	u.conns = nil
+	return err
 }
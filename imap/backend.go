@@ -30,16 +30,20 @@ import (
 	"github.com/emersion/go-imap/backend"
 
 	pgpmail "github.com/mad-day/gaw-mail/legacy"
+	"github.com/mad-day/gaw-mail/policy"
 )
 
 type Backend struct {
 	backend.Backend
 
 	unlock pgpmail.UnlockFunction
+
+	// Policy selects the mailboxes, that are encrypted. May be nil.
+	Policy *policy.Policy
 }
 
 func New(be backend.Backend, unlock pgpmail.UnlockFunction) *Backend {
-	return &Backend{be, unlock}
+	return &Backend{be, unlock, nil}
 }
 
 func (be *Backend) Login(conn *imap.ConnInfo,username, password string) (backend.User, error) {
@@ -48,6 +52,15 @@ func (be *Backend) Login(conn *imap.ConnInfo,username, password string) (backend
 	} else if kr, err := be.unlock(username, password); err != nil {
 		return nil, err
 	} else {
-		return &user{u, kr}, nil
+		return &user{u, kr, be.Policy}, nil
+	}
+}
+
+// Updates returns the updates of the underlying backend, or nil, if it doesn't
+// implement backend.BackendUpdater.
+func (be *Backend) Updates() <-chan backend.Update {
+	if bu,ok := be.Backend.(backend.BackendUpdater); ok {
+		return bu.Updates()
 	}
+	return nil
 }
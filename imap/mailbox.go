@@ -25,11 +25,15 @@ package imap
 
 import (
 	"bytes"
+	"errors"
 	"log"
 	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend"
+
+	"github.com/mad-day/gaw-mail/format"
+	"github.com/mad-day/gaw-mail/policy"
 )
 
 type mailbox struct {
@@ -53,6 +57,10 @@ func (m *mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.Fetch
 	if !needsDecryption {
 		return m.Mailbox.ListMessages(uid, seqSet, items, ch)
 	}
+	rule := m.u.p.Lookup(m.Mailbox)
+	if rule.Action == policy.Untouched {
+		return m.Mailbox.ListMessages(uid, seqSet, items, ch)
+	}
 
 	messages := make(chan *imap.Message)
 	go func() {
@@ -64,7 +72,14 @@ func (m *mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.Fetch
 					continue
 				}
 
-				r, err := decryptMessage(m.u.kr, literal)
+				// Mailboxes with their own format may hold any format.
+				var r *bytes.Buffer
+				var err error
+				if rule.Format != format.Default {
+					r, err = decryptAuto(m.u.kr, literal)
+				} else {
+					r, err = decryptMessage(m.u.kr, literal)
+				}
 				if err != nil {
 					log.Println("WARN: cannot decrypt part:", err)
 					continue
@@ -82,9 +97,40 @@ func (m *mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.Fetch
 }
 
 func (m *mailbox) CreateMessage(flags []string, date time.Time, r imap.Literal) error {
+	rule := m.u.p.Lookup(m.Mailbox)
+	switch rule.Action {
+	case policy.Plain, policy.Untouched:
+		return m.Mailbox.CreateMessage(flags, date, r)
+	case policy.ReadOnly:
+		return policy.ErrReadOnly
+	}
+
 	b := new(bytes.Buffer)
-	if err := encryptMessage(m.u.kr, b, r); err != nil {
+	if rule.Format != format.Default {
+		if err := encryptFormat(rule.Format, m.u.kr, b, r); err != nil {
+			return err
+		}
+	} else if err := encryptMessage(m.u.kr, b, r); err != nil {
 		return err
 	}
 	return m.Mailbox.CreateMessage(flags, date, b)
 }
+
+// CopyMessages refuses to copy into read-only mailboxes.
+func (m *mailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, dest string) error {
+	if err := m.u.p.Writable(m.u.User, dest); err != nil {
+		return err
+	}
+	return m.Mailbox.CopyMessages(uid, seqSet, dest)
+}
+
+// MoveMessages passes MOVE through, if the underlying mailbox supports it.
+func (m *mailbox) MoveMessages(uid bool, seqSet *imap.SeqSet, dest string) error {
+	if err := m.u.p.Writable(m.u.User, dest); err != nil {
+		return err
+	}
+	if mm, ok := m.Mailbox.(backend.MoveMailbox); ok {
+		return mm.MoveMessages(uid, seqSet, dest)
+	}
+	return errors.New("MOVE extension not supported")
+}
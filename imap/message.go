@@ -26,10 +26,13 @@ package imap
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
 
 	"golang.org/x/crypto/openpgp"
 
 	"github.com/emersion/go-pgpmail/pgpmessage"
+
+	"github.com/mad-day/gaw-mail/format"
 )
 
 func decryptMessage(kr openpgp.KeyRing, r io.Reader) (*bytes.Buffer, error) {
@@ -43,3 +46,25 @@ func decryptMessage(kr openpgp.KeyRing, r io.Reader) (*bytes.Buffer, error) {
 func encryptMessage(kr openpgp.EntityList, w io.Writer, r io.Reader) error {
 	return pgpmessage.Encrypt(w, r, kr, kr[0])
 }
+
+// decryptAuto detects the format of the message, see format.Decrypt.
+func decryptAuto(kr openpgp.KeyRing, r io.Reader) (*bytes.Buffer, error) {
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	b := new(bytes.Buffer)
+	if _, err := format.Decrypt(b, raw, kr); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func encryptFormat(f format.Format, kr openpgp.EntityList, w io.Writer, r io.Reader) error {
+	msg, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	t := &format.Target{Format: f, To: kr, Signed: kr[0]}
+	return t.Encrypt(w, msg)
+}
@@ -27,12 +27,15 @@ import (
 	"github.com/emersion/go-imap/backend"
 
 	"golang.org/x/crypto/openpgp"
+
+	"github.com/mad-day/gaw-mail/policy"
 )
 
 type user struct {
 	backend.User
 
 	kr openpgp.EntityList
+	p  *policy.Policy
 }
 
 func (u *user) getMailbox(m backend.Mailbox) *mailbox {
@@ -57,3 +60,15 @@ func (u *user) GetMailbox(name string) (backend.Mailbox, error) {
 		return u.getMailbox(m), nil
 	}
 }
+
+// CreateMessageLimit returns the limit of the underlying user, reduced by the
+// expansion of the message by the ASCII armor.
+func (u *user) CreateMessageLimit() *uint32 {
+	if lu, ok := u.User.(backend.AppendLimitUser); ok {
+		if limit := lu.CreateMessageLimit(); limit != nil {
+			l := *limit/4*3
+			return &l
+		}
+	}
+	return nil
+}
@@ -0,0 +1,570 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package jmap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+	
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-message"
+	_ "github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/textproto"
+)
+
+/* IMAP system flags and their JMAP keywords. \Recent and \Deleted are not exposed. */
+var keywords = map[string]string{
+	imap.SeenFlag: "$seen",
+	imap.FlaggedFlag: "$flagged",
+	imap.AnsweredFlag: "$answered",
+	imap.DraftFlag: "$draft",
+}
+
+func flagKeyword(flag string) (string,bool) {
+	if k,ok := keywords[flag]; ok { return k,true }
+	if strings.HasPrefix(flag,"\\") { return "",false }
+	return strings.ToLower(flag),true
+}
+
+func keywordFlag(k string) string {
+	k = strings.ToLower(k)
+	for f,kw := range keywords {
+		if kw==k { return f }
+	}
+	return k
+}
+
+var emailProperties = map[string]bool{
+	"id": true, "blobId": true, "threadId": true, "mailboxIds": true, "keywords": true, "size": true,
+	"receivedAt": true, "messageId": true, "inReplyTo": true, "references": true, "sender": true,
+	"from": true, "to": true, "cc": true, "bcc": true, "replyTo": true, "subject": true,
+	"sentAt": true, "hasAttachment": true, "preview": true, "bodyValues": true, "textBody": true,
+	"htmlBody": true, "attachments": true, "bodyStructure": true,
+}
+
+var defaultEmailProperties = []string{
+	"id", "blobId", "threadId", "mailboxIds", "keywords", "size", "receivedAt", "messageId",
+	"inReplyTo", "references", "sender", "from", "to", "cc", "bcc", "replyTo", "subject", "sentAt",
+	"hasAttachment", "preview", "bodyValues", "textBody", "htmlBody", "attachments",
+}
+
+var bodyProperties = map[string]bool{
+	"partId": true, "blobId": true, "size": true, "name": true, "type": true, "charset": true,
+	"disposition": true, "cid": true, "language": true, "location": true, "subParts": true,
+}
+
+var defaultBodyProperties = []string{
+	"partId", "blobId", "size", "name", "type", "charset", "disposition", "cid", "language", "location",
+}
+
+type emailGetArgs struct {
+	AccountID string `json:"accountId"`
+	IDs *[]string `json:"ids"`
+	Properties []string `json:"properties"`
+	BodyProperties []string `json:"bodyProperties"`
+	FetchTextBodyValues bool `json:"fetchTextBodyValues"`
+	FetchHTMLBodyValues bool `json:"fetchHTMLBodyValues"`
+	FetchAllBodyValues bool `json:"fetchAllBodyValues"`
+	MaxBodyValueBytes int `json:"maxBodyValueBytes"`
+}
+
+/* A leaf or multipart part of a message, as described by it's BODYSTRUCTURE. */
+type bodyPart struct {
+	partID string
+	bs *imap.BodyStructure
+	sub []*bodyPart
+}
+
+func (p *bodyPart) typ() string {
+	return strings.ToLower(p.bs.MIMEType+"/"+p.bs.MIMESubType)
+}
+
+func (p *bodyPart) isMultipart() bool {
+	return strings.EqualFold(p.bs.MIMEType,"multipart")
+}
+
+func (p *bodyPart) name() string {
+	if n := p.bs.DispositionParams["filename"]; n!="" { return n }
+	return p.bs.Params["name"]
+}
+
+func (p *bodyPart) charset() string {
+	if cs := p.bs.Params["charset"]; cs!="" { return cs }
+	if strings.EqualFold(p.bs.MIMEType,"text") { return "us-ascii" }
+	return ""
+}
+
+/* Builds the part tree. Parts are numbered like IMAP body sections. */
+func newBodyPart(bs *imap.BodyStructure, path string) *bodyPart {
+	p := &bodyPart{bs: bs}
+	if !strings.EqualFold(bs.MIMEType,"multipart") {
+		p.partID = path
+		if p.partID=="" { p.partID = "1" }
+		return p
+	}
+	for i,sub := range bs.Parts {
+		sp := fmt.Sprint(i+1)
+		if path!="" { sp = path+"."+sp }
+		p.sub = append(p.sub,newBodyPart(sub,sp))
+	}
+	return p
+}
+
+func isInlineMedia(t string) bool {
+	return strings.HasPrefix(t,"image/") || strings.HasPrefix(t,"audio/") || strings.HasPrefix(t,"video/")
+}
+
+/* Sorts the parts into textBody, htmlBody and attachments, as in RFC 8621, section 4.1.4. */
+func parseStructure(parts []*bodyPart, multipartType string, inAlternative bool, html, text, attachments *[]*bodyPart) {
+	textLength,htmlLength := -1,-1
+	if text!=nil { textLength = len(*text) }
+	if html!=nil { htmlLength = len(*html) }
+	
+	for i,part := range parts {
+		t := part.typ()
+		isImage := strings.HasPrefix(t,"image/")
+		isInline := !strings.EqualFold(part.bs.Disposition,"attachment") &&
+			(t=="text/plain" || t=="text/html" || isImage) &&
+			(i==0 || (multipartType!="related" && (isImage || part.name()=="")))
+		
+		switch {
+		case part.isMultipart():
+			sub := strings.ToLower(part.bs.MIMESubType)
+			parseStructure(part.sub,sub,inAlternative || sub=="alternative",html,text,attachments)
+		case isInline:
+			if multipartType=="alternative" {
+				switch t {
+				case "text/plain": *text = append(*text,part)
+				case "text/html": *html = append(*html,part)
+				default: *attachments = append(*attachments,part)
+				}
+				continue
+			} else if inAlternative {
+				if t=="text/plain" { html = nil }
+				if t=="text/html" { text = nil }
+			}
+			if text!=nil { *text = append(*text,part) }
+			if html!=nil { *html = append(*html,part) }
+			if (text==nil || html==nil) && isInlineMedia(t) { *attachments = append(*attachments,part) }
+		default:
+			*attachments = append(*attachments,part)
+		}
+	}
+	
+	if multipartType=="alternative" && text!=nil && html!=nil {
+		/* Only an HTML part was found, or only a plain text part. */
+		if textLength==len(*text) && htmlLength!=len(*html) {
+			*text = append(*text,(*html)[htmlLength:]...)
+		}
+		if htmlLength==len(*html) && textLength!=len(*text) {
+			*html = append(*html,(*text)[textLength:]...)
+		}
+	}
+}
+
+func stripBrackets(id string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(id),"<"),">")
+}
+
+func (c *call) partObject(ref emailRef, p *bodyPart, props []string) map[string]interface{} {
+	obj := map[string]interface{}{}
+	for _,prop := range props {
+		var v interface{}
+		switch prop {
+		case "partId":
+			if p.partID!="" { v = p.partID }
+		case "blobId":
+			if p.partID!="" {
+				r := ref
+				r.part = p.partID
+				v = r.blobID()
+			}
+		case "size":
+			v = p.bs.Size
+		case "name":
+			if n := p.name(); n!="" { v = n }
+		case "type":
+			v = p.typ()
+		case "charset":
+			if cs := p.charset(); cs!="" { v = cs }
+		case "disposition":
+			if p.bs.Disposition!="" { v = strings.ToLower(p.bs.Disposition) }
+		case "cid":
+			if p.bs.Id!="" { v = stripBrackets(p.bs.Id) }
+		case "language":
+			if len(p.bs.Language)>0 { v = p.bs.Language }
+		case "location":
+			if len(p.bs.Location)>0 { v = p.bs.Location[0] }
+		case "subParts":
+			if p.isMultipart() {
+				sub := []interface{}{}
+				for _,sp := range p.sub { sub = append(sub,c.partObject(ref,sp,props)) }
+				v = sub
+			}
+		}
+		obj[prop] = v
+	}
+	return obj
+}
+
+func addresses(list []*imap.Address) interface{} {
+	if len(list)==0 { return nil }
+	out := make([]map[string]interface{},0,len(list))
+	for _,a := range list {
+		var name interface{}
+		if a.PersonalName!="" { name = a.PersonalName }
+		out = append(out,map[string]interface{}{"name": name, "email": a.Address()})
+	}
+	return out
+}
+
+var msgIDPattern = regexp.MustCompile(`<[^<>]*>`)
+
+func msgIDs(s string) interface{} {
+	var ids []string
+	for _,id := range msgIDPattern.FindAllString(s,-1) { ids = append(ids,stripBrackets(id)) }
+	if len(ids)==0 { return nil }
+	return ids
+}
+
+/* What Email/get needs to fetch. */
+type emailNeeds struct {
+	structure bool
+	references bool
+	text, html, all bool
+	preview bool
+	maxBytes int
+}
+
+var referencesSection = &imap.BodySectionName{
+	BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier, Fields: []string{"References"}},
+	Peek: true,
+}
+
+func partSection(partID string) *imap.BodySectionName {
+	s,_ := imap.ParseBodySectionName(imap.FetchItem("BODY.PEEK["+partID+"]"))
+	return s
+}
+
+func listMessages(mbox backend.Mailbox, seq *imap.SeqSet, items []imap.FetchItem) ([]*imap.Message,error) {
+	ch := make(chan *imap.Message,16)
+	done := make(chan error,1)
+	go func() { done <- mbox.ListMessages(true,seq,items,ch) }()
+	var msgs []*imap.Message
+	for msg := range ch { msgs = append(msgs,msg) }
+	return msgs,<-done
+}
+
+/* Returns the literal of the section, backends differ in whether the key has Peek set. */
+func bodySection(msg *imap.Message, section *imap.BodySectionName) imap.Literal {
+	for s,l := range msg.Body {
+		if s.Specifier==section.Specifier && fmt.Sprint(s.Path)==fmt.Sprint(section.Path) && strings.EqualFold(strings.Join(s.Fields,","),strings.Join(section.Fields,",")) {
+			return l
+		}
+	}
+	return nil
+}
+
+/*
+Decodes the content of a part (with the Content-Transfer-Encoding and charset from the body
+structure) to UTF-8.
+*/
+func decodePart(bs *imap.BodyStructure, raw []byte, charset bool) ([]byte,bool) {
+	var h message.Header
+	if bs.Encoding!="" { h.Set("Content-Transfer-Encoding",bs.Encoding) }
+	if charset && bs.Params["charset"]!="" {
+		h.SetContentType("text/plain",map[string]string{"charset": bs.Params["charset"]})
+	}
+	e,err := message.New(h,bytes.NewReader(raw))
+	problem := err!=nil
+	if e==nil { return raw,true }
+	b,err := ioutil.ReadAll(e.Body)
+	if err!=nil { problem = true }
+	if charset && !utf8.Valid(b) {
+		b,problem = bytes.ToValidUTF8(b,[]byte("�")),true
+	}
+	return b,problem
+}
+
+/* Cuts s to at most n bytes, at a character boundary. */
+func truncate(s string, n int) (string,bool) {
+	if n<=0 || len(s)<=n { return s,false }
+	for n>0 && !utf8.RuneStart(s[n]) { n-- }
+	return s[:n],true
+}
+
+var (
+	tagPattern = regexp.MustCompile(`(?s)<(script|style)[^>]*>.*?</(script|style)>|<[^>]*>`)
+	spacePattern = regexp.MustCompile(`\s+`)
+)
+
+func preview(text string, html bool) string {
+	if html { text = tagPattern.ReplaceAllString(text," ") }
+	text = strings.TrimSpace(spacePattern.ReplaceAllString(text," "))
+	if utf8.RuneCountInString(text)>256 { text = string([]rune(text)[:256]) }
+	return text
+}
+
+func (c *call) emailGet(args json.RawMessage) (interface{},error) {
+	var a emailGetArgs
+	if err := decodeArgs(args,&a); err!=nil { return nil,err }
+	if err := c.account(a.AccountID); err!=nil { return nil,err }
+	if a.Properties==nil { a.Properties = defaultEmailProperties }
+	if a.BodyProperties==nil { a.BodyProperties = defaultBodyProperties }
+	if err := checkProperties(a.Properties,emailProperties); err!=nil { return nil,err }
+	if err := checkProperties(a.BodyProperties,bodyProperties); err!=nil { return nil,err }
+	if a.IDs==nil || len(*a.IDs)>maxObjects { return nil,&methodError{"requestTooLarge","ids must be given"} }
+	
+	props := make(map[string]bool)
+	for _,p := range a.Properties { props[p] = true }
+	nd := emailNeeds{
+		references: props["references"],
+		text: a.FetchTextBodyValues && props["bodyValues"],
+		html: a.FetchHTMLBodyValues && props["bodyValues"],
+		all: a.FetchAllBodyValues && props["bodyValues"],
+		preview: props["preview"],
+		maxBytes: a.MaxBodyValueBytes,
+	}
+	nd.structure = nd.text || nd.html || nd.all || nd.preview
+	for _,p := range []string{"textBody","htmlBody","attachments","hasAttachment","bodyStructure"} {
+		if props[p] { nd.structure = true }
+	}
+	
+	state,err := c.currentEmailState()
+	if err!=nil { return nil,err }
+	
+	/* Group the ids by mailbox, to fetch each mailbox at once. */
+	var order []string
+	byMailbox := make(map[string][]emailRef)
+	notFound := []string{}
+	for _,id := range *a.IDs {
+		ref,ok := parseEmailID(c.resolveID(id))
+		if !ok {
+			notFound = append(notFound,id)
+			continue
+		}
+		if _,ok := byMailbox[ref.mailbox]; !ok { order = append(order,ref.mailbox) }
+		byMailbox[ref.mailbox] = append(byMailbox[ref.mailbox],ref)
+	}
+	
+	objs := make(map[string]map[string]interface{})
+	for _,name := range order {
+		if err := c.getEmails(name,byMailbox[name],&nd,a,objs); err!=nil { return nil,err }
+	}
+	
+	list := []interface{}{}
+	for _,id := range *a.IDs {
+		if obj,ok := objs[c.resolveID(id)]; ok {
+			list = append(list,obj)
+		} else if _,ok := parseEmailID(c.resolveID(id)); ok {
+			notFound = append(notFound,id)
+		}
+	}
+	return map[string]interface{}{
+		"accountId": a.AccountID,
+		"state": state,
+		"list": list,
+		"notFound": notFound,
+	},nil
+}
+
+/* Fetches the emails of one mailbox into objs, by id. Missing emails are skipped. */
+func (c *call) getEmails(name string, refs []emailRef, nd *emailNeeds, a emailGetArgs, objs map[string]map[string]interface{}) error {
+	mbox,err := c.user.GetMailbox(name)
+	if err!=nil { return nil }
+	st,err := mbox.Status([]imap.StatusItem{imap.StatusUidValidity})
+	if err!=nil { return err }
+	
+	seq := new(imap.SeqSet)
+	for _,r := range refs {
+		if r.uidValidity==st.UidValidity { seq.AddNum(r.uid) }
+	}
+	if seq.Empty() { return nil }
+	
+	items := []imap.FetchItem{imap.FetchUid,imap.FetchFlags,imap.FetchInternalDate,imap.FetchRFC822Size,imap.FetchEnvelope}
+	if nd.structure { items = append(items,imap.FetchBodyStructure) }
+	if nd.references { items = append(items,referencesSection.FetchItem()) }
+	msgs,err := listMessages(mbox,seq,items)
+	if err!=nil { return err }
+	
+	/* Part contents are fetched afterwards, the backend might not allow nested commands. */
+	for _,msg := range msgs {
+		ref := emailRef{mailbox: name, uidValidity: st.UidValidity, uid: msg.Uid}
+		obj,err := c.emailObject(mbox,ref,msg,nd,a)
+		if err!=nil { return err }
+		if obj!=nil { objs[ref.id()] = obj }
+	}
+	return nil
+}
+
+func (c *call) emailObject(mbox backend.Mailbox, ref emailRef, msg *imap.Message, nd *emailNeeds, a emailGetArgs) (map[string]interface{},error) {
+	env := msg.Envelope
+	if env==nil { env = new(imap.Envelope) }
+	
+	var root *bodyPart
+	var text,html,attachments []*bodyPart
+	if nd.structure {
+		/* The backend skipped the message, e.g. as it could not be decrypted. */
+		if msg.BodyStructure==nil { return nil,nil }
+		root = newBodyPart(msg.BodyStructure,"")
+		text,html,attachments = []*bodyPart{},[]*bodyPart{},[]*bodyPart{}
+		parseStructure([]*bodyPart{root},"mixed",false,&html,&text,&attachments)
+	}
+	
+	/* The text parts, that values are needed of. */
+	want := make(map[string]*bodyPart)
+	if nd.text || nd.preview { for _,p := range text { want[p.partID] = p } }
+	if nd.html { for _,p := range html { want[p.partID] = p } }
+	if nd.all {
+		var walk func(p *bodyPart)
+		walk = func(p *bodyPart) {
+			for _,sp := range p.sub { walk(sp) }
+			if !p.isMultipart() && strings.EqualFold(p.bs.MIMEType,"text") { want[p.partID] = p }
+		}
+		walk(root)
+	}
+	for id,p := range want {
+		if !strings.EqualFold(p.bs.MIMEType,"text") { delete(want,id) }
+	}
+	values,err := c.bodyValues(mbox,ref.uid,want)
+	if err!=nil { return nil,err }
+	
+	keywords := map[string]bool{}
+	for _,f := range msg.Flags {
+		if k,ok := flagKeyword(f); ok { keywords[k] = true }
+	}
+	
+	/* ENVELOPE fills Sender and Reply-To with From, if the fields are missing. */
+	var sender,replyTo interface{}
+	from := fmt.Sprint(addresses(env.From))
+	if len(env.Sender)>0 && fmt.Sprint(addresses(env.Sender))!=from { sender = addresses(env.Sender) }
+	if len(env.ReplyTo)>0 && fmt.Sprint(addresses(env.ReplyTo))!=from { replyTo = addresses(env.ReplyTo) }
+	var sentAt,subject interface{}
+	if !env.Date.IsZero() { sentAt = env.Date.Format(time.RFC3339) }
+	if env.Subject!="" { subject = env.Subject }
+	var references interface{}
+	if nd.references {
+		if l := bodySection(msg,referencesSection); l!=nil {
+			if h,err := textproto.ReadHeader(bufio.NewReader(l)); err==nil { references = msgIDs(h.Get("References")) }
+		}
+	}
+	
+	whole := ref
+	whole.part = ""
+	obj := map[string]interface{}{
+		"id": ref.id(),
+		"blobId": whole.blobID(),
+		"threadId": "t"+ref.id()[1:],
+		"mailboxIds": map[string]bool{mailboxID(ref.mailbox): true},
+		"keywords": keywords,
+		"size": msg.Size,
+		"receivedAt": msg.InternalDate.UTC().Format(time.RFC3339),
+		"messageId": msgIDs(env.MessageId),
+		"inReplyTo": msgIDs(env.InReplyTo),
+		"references": references,
+		"sender": sender,
+		"from": addresses(env.From),
+		"to": addresses(env.To),
+		"cc": addresses(env.Cc),
+		"bcc": addresses(env.Bcc),
+		"replyTo": replyTo,
+		"subject": subject,
+		"sentAt": sentAt,
+	}
+	if !nd.structure { return pick(obj,a.Properties),nil }
+	
+	parts := func(list []*bodyPart) []interface{} {
+		out := []interface{}{}
+		for _,p := range list { out = append(out,c.partObject(ref,p,a.BodyProperties)) }
+		return out
+	}
+	obj["bodyStructure"] = c.partObject(ref,root,append(a.BodyProperties,"subParts"))
+	obj["textBody"] = parts(text)
+	obj["htmlBody"] = parts(html)
+	obj["attachments"] = parts(attachments)
+	obj["hasAttachment"] = len(attachments)>0
+	
+	obj["preview"] = ""
+	for _,p := range text {
+		if v,ok := values[p.partID]; ok {
+			obj["preview"] = preview(v.value,p.typ()=="text/html")
+			break
+		}
+	}
+	
+	bv := map[string]interface{}{}
+	for id,v := range values {
+		if !nd.all && !(nd.text && contains(text,id)) && !(nd.html && contains(html,id)) { continue }
+		s,cut := truncate(v.value,nd.maxBytes)
+		bv[id] = map[string]interface{}{"value": s, "isEncodingProblem": v.problem, "isTruncated": cut}
+	}
+	obj["bodyValues"] = bv
+	return pick(obj,a.Properties),nil
+}
+
+func contains(list []*bodyPart, id string) bool {
+	for _,p := range list {
+		if p.partID==id { return true }
+	}
+	return false
+}
+
+type bodyValue struct {
+	value string
+	problem bool
+}
+
+/* Fetches and decodes the text parts. */
+func (c *call) bodyValues(mbox backend.Mailbox, uid uint32, parts map[string]*bodyPart) (map[string]bodyValue,error) {
+	values := make(map[string]bodyValue)
+	if len(parts)==0 { return values,nil }
+	
+	items := []imap.FetchItem{imap.FetchUid}
+	for id := range parts { items = append(items,partSection(id).FetchItem()) }
+	seq := new(imap.SeqSet)
+	seq.AddNum(uid)
+	msgs,err := listMessages(mbox,seq,items)
+	if err!=nil { return nil,err }
+	
+	for _,msg := range msgs {
+		for id,p := range parts {
+			l := bodySection(msg,partSection(id))
+			if l==nil { continue }
+			raw,err := ioutil.ReadAll(l)
+			if err!=nil { return nil,err }
+			b,problem := decodePart(p.bs,raw,true)
+			values[id] = bodyValue{string(b),problem}
+		}
+	}
+	return values,nil
+}
@@ -0,0 +1,101 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package jmap
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+JMAP ids may only contain letters, digits, "-" and "_". The ids encode everything needed to
+find the object in the backend, so no state is kept on the server:
+
+	account: "a" + base64url(username)
+	mailbox: "m" + base64url(name)
+	email:   "e" + base64url(uidValidity NUL uid NUL mailbox)
+	blob:    "b" + base64url(uidValidity NUL uid NUL part NUL mailbox)
+
+As an email is identified by it's UID, it gets a new id, when it is moved to another mailbox.
+*/
+
+var idEncoding = base64.RawURLEncoding
+
+func accountID(username string) string {
+	return "a"+idEncoding.EncodeToString([]byte(username))
+}
+
+func mailboxID(name string) string {
+	return "m"+idEncoding.EncodeToString([]byte(name))
+}
+
+func parseMailboxID(id string) (string,bool) {
+	if !strings.HasPrefix(id,"m") { return "",false }
+	b,err := idEncoding.DecodeString(id[1:])
+	if err!=nil { return "",false }
+	return string(b),true
+}
+
+/* The location of a message, or of one of it's parts, in the backend. */
+type emailRef struct {
+	mailbox string
+	uidValidity uint32
+	uid uint32
+	
+	/* The IMAP section of the part ("1.2"), or "" for the whole message. */
+	part string
+}
+
+func (e emailRef) id() string {
+	return "e"+idEncoding.EncodeToString([]byte(fmt.Sprintf("%d\x00%d\x00%s",e.uidValidity,e.uid,e.mailbox)))
+}
+
+func (e emailRef) blobID() string {
+	return "b"+idEncoding.EncodeToString([]byte(fmt.Sprintf("%d\x00%d\x00%s\x00%s",e.uidValidity,e.uid,e.part,e.mailbox)))
+}
+
+func parseRef(id string, blob bool) (e emailRef, ok bool) {
+	prefix,n := "e",3
+	if blob { prefix,n = "b",4 }
+	if !strings.HasPrefix(id,prefix) { return }
+	b,err := idEncoding.DecodeString(id[1:])
+	if err!=nil { return }
+	fields := strings.SplitN(string(b),"\x00",n)
+	if len(fields)!=n { return }
+	
+	uv,err := strconv.ParseUint(fields[0],10,32)
+	if err!=nil { return }
+	uid,err := strconv.ParseUint(fields[1],10,32)
+	if err!=nil { return }
+	e.uidValidity,e.uid = uint32(uv),uint32(uid)
+	if blob { e.part = fields[2] }
+	e.mailbox = fields[n-1]
+	return e,true
+}
+
+func parseEmailID(id string) (emailRef,bool) { return parseRef(id,false) }
+func parseBlobID(id string) (emailRef,bool) { return parseRef(id,true) }
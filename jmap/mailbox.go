@@ -0,0 +1,234 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package jmap
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+/* SPECIAL-USE attributes (RFC 6154) and their JMAP roles. */
+var roles = map[string]string{
+	imap.AllAttr: "all",
+	imap.ArchiveAttr: "archive",
+	imap.DraftsAttr: "drafts",
+	imap.FlaggedAttr: "flagged",
+	imap.JunkAttr: "junk",
+	imap.SentAttr: "sent",
+	imap.TrashAttr: "trash",
+	imap.ImportantAttr: "important",
+}
+
+func role(info *imap.MailboxInfo) interface{} {
+	if strings.EqualFold(info.Name,"INBOX") { return "inbox" }
+	for _,a := range info.Attributes {
+		if r,ok := roles[a]; ok { return r }
+	}
+	return nil
+}
+
+func selectable(info *imap.MailboxInfo) bool {
+	for _,a := range info.Attributes {
+		if a==imap.NoSelectAttr { return false }
+	}
+	return true
+}
+
+type mailboxEntry struct {
+	mbox backend.Mailbox
+	info *imap.MailboxInfo
+	status *imap.MailboxStatus
+}
+
+var statusItems = []imap.StatusItem{imap.StatusMessages,imap.StatusUnseen,imap.StatusUidNext,imap.StatusUidValidity}
+
+/* Lists all mailboxes, sorted by name, with their status. */
+func (c *call) mailboxes() ([]*mailboxEntry,error) {
+	list,err := c.user.ListMailboxes(false)
+	if err!=nil { return nil,err }
+	
+	var out []*mailboxEntry
+	for _,m := range list {
+		info,err := m.Info()
+		if err!=nil { return nil,err }
+		e := &mailboxEntry{mbox: m, info: info}
+		if selectable(info) {
+			if e.status,err = m.Status(statusItems); err!=nil { return nil,err }
+		}
+		out = append(out,e)
+	}
+	sort.Slice(out,func(i,j int) bool { return out[i].info.Name<out[j].info.Name })
+	return out,nil
+}
+
+/*
+The state of all emails. There is no modification sequence in the backend interface, so it is
+derived from the counters of the mailboxes. Flag changes on messages, that stay unseen or seen, are
+not noticed.
+*/
+func emailState(list []*mailboxEntry) string {
+	h := sha256.New()
+	for _,e := range list {
+		if e.status==nil { continue }
+		fmt.Fprintf(h,"%s\x00%d %d %d %d\x00",e.info.Name,e.status.UidValidity,e.status.UidNext,e.status.Messages,e.status.Unseen)
+	}
+	return fmt.Sprintf("%x",h.Sum(nil)[:8])
+}
+
+func mailboxState(list []*mailboxEntry) string {
+	h := sha256.New()
+	for _,e := range list {
+		fmt.Fprintf(h,"%s\x00",e.info.Name)
+		if e.status!=nil { fmt.Fprintf(h,"%d %d\x00",e.status.Messages,e.status.Unseen) }
+	}
+	return fmt.Sprintf("%x",h.Sum(nil)[:8])
+}
+
+func (c *call) currentEmailState() (string,error) {
+	list,err := c.mailboxes()
+	if err!=nil { return "",err }
+	return emailState(list),nil
+}
+
+/* Returns the object with only the given properties, and the id. */
+func pick(obj map[string]interface{}, props []string) map[string]interface{} {
+	if props==nil { return obj }
+	out := map[string]interface{}{"id": obj["id"]}
+	for _,p := range props {
+		if v,ok := obj[p]; ok { out[p] = v }
+	}
+	return out
+}
+
+func checkProperties(props []string, known map[string]bool) error {
+	for _,p := range props {
+		if !known[p] { return errInvalidArguments("unknown property %q",p) }
+	}
+	return nil
+}
+
+var mailboxProperties = map[string]bool{
+	"id": true, "name": true, "parentId": true, "role": true, "sortOrder": true,
+	"totalEmails": true, "unreadEmails": true, "totalThreads": true, "unreadThreads": true,
+	"myRights": true, "isSubscribed": true,
+}
+
+type getArgs struct {
+	AccountID string `json:"accountId"`
+	IDs *[]string `json:"ids"`
+	Properties []string `json:"properties"`
+}
+
+func (c *call) mailboxGet(args json.RawMessage) (interface{},error) {
+	var a getArgs
+	if err := decodeArgs(args,&a); err!=nil { return nil,err }
+	if err := c.account(a.AccountID); err!=nil { return nil,err }
+	if err := checkProperties(a.Properties,mailboxProperties); err!=nil { return nil,err }
+	
+	list,err := c.mailboxes()
+	if err!=nil { return nil,err }
+	subscribed := make(map[string]bool)
+	if subs,err := c.user.ListMailboxes(true); err==nil {
+		for _,m := range subs { subscribed[m.Name()] = true }
+	}
+	
+	byID := make(map[string]map[string]interface{})
+	var all []string
+	for _,e := range list {
+		obj := c.mailboxObject(e,list,subscribed[e.info.Name])
+		id := obj["id"].(string)
+		byID[id] = obj
+		all = append(all,id)
+	}
+	
+	ids := all
+	if a.IDs!=nil {
+		ids = *a.IDs
+		if len(ids)>maxObjects { return nil,&methodError{"requestTooLarge",""} }
+	}
+	found := []interface{}{}
+	notFound := []string{}
+	for _,id := range ids {
+		if obj,ok := byID[c.resolveID(id)]; ok {
+			found = append(found,pick(obj,a.Properties))
+		} else {
+			notFound = append(notFound,id)
+		}
+	}
+	return map[string]interface{}{
+		"accountId": a.AccountID,
+		"state": mailboxState(list),
+		"list": found,
+		"notFound": notFound,
+	},nil
+}
+
+func (c *call) mailboxObject(e *mailboxEntry, list []*mailboxEntry, subscribed bool) map[string]interface{} {
+	name := e.info.Name
+	var parent interface{}
+	if d := e.info.Delimiter; d!="" {
+		if i := strings.LastIndex(name,d); i>0 {
+			/* The parent might not exist, or be invisible to the user. */
+			for _,p := range list {
+				if p.info.Name==name[:i] { parent = mailboxID(p.info.Name) }
+			}
+			if parent!=nil { name = name[i+len(d):] }
+		}
+	}
+	
+	var total,unread uint32
+	if e.status!=nil { total,unread = e.status.Messages,e.status.Unseen }
+	canRead := e.status!=nil
+	return map[string]interface{}{
+		"id": mailboxID(e.info.Name),
+		"name": name,
+		"parentId": parent,
+		"role": role(e.info),
+		"sortOrder": 0,
+		"totalEmails": total,
+		"unreadEmails": unread,
+		/* Every email is a thread of it's own. */
+		"totalThreads": total,
+		"unreadThreads": unread,
+		"myRights": map[string]bool{
+			"mayReadItems": canRead,
+			"mayAddItems": canRead,
+			"mayRemoveItems": canRead,
+			"maySetSeen": canRead,
+			"maySetKeywords": canRead,
+			"mayCreateChild": false,
+			"mayRename": false,
+			"mayDelete": false,
+			"maySubmit": false,
+		},
+		"isSubscribed": subscribed,
+	}
+}
@@ -0,0 +1,256 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package jmap
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+	
+	"github.com/emersion/go-imap"
+)
+
+type emailQueryArgs struct {
+	AccountID string `json:"accountId"`
+	Filter json.RawMessage `json:"filter"`
+	Sort []struct {
+		Property string `json:"property"`
+		IsAscending *bool `json:"isAscending"`
+		Collation string `json:"collation"`
+	} `json:"sort"`
+	Position int `json:"position"`
+	Anchor *string `json:"anchor"`
+	AnchorOffset int `json:"anchorOffset"`
+	Limit *int `json:"limit"`
+	CalculateTotal bool `json:"calculateTotal"`
+	CollapseThreads bool `json:"collapseThreads"`
+}
+
+type filterCondition struct {
+	InMailbox *string `json:"inMailbox"`
+	InMailboxOtherThan []string `json:"inMailboxOtherThan"`
+	Before *time.Time `json:"before"`
+	After *time.Time `json:"after"`
+	MinSize *uint32 `json:"minSize"`
+	MaxSize *uint32 `json:"maxSize"`
+	HasKeyword *string `json:"hasKeyword"`
+	NotKeyword *string `json:"notKeyword"`
+	HasAttachment *bool `json:"hasAttachment"`
+	Text *string `json:"text"`
+	From *string `json:"from"`
+	To *string `json:"to"`
+	Cc *string `json:"cc"`
+	Bcc *string `json:"bcc"`
+	Subject *string `json:"subject"`
+	Body *string `json:"body"`
+	Header []string `json:"header"`
+}
+
+type filterOperator struct {
+	Operator string `json:"operator"`
+	Conditions []json.RawMessage `json:"conditions"`
+}
+
+func unsupportedFilter(d string) *methodError {
+	return &methodError{"unsupportedFilter",d}
+}
+
+/* The mailboxes, that a query searches. */
+type mailboxFilter struct {
+	in *string
+	notIn map[string]bool
+}
+
+/* Merges the criteria of src into dst, so both must match. */
+func mergeCriteria(dst, src *imap.SearchCriteria) {
+	if src.Since.After(dst.Since) { dst.Since = src.Since }
+	if !src.Before.IsZero() && (dst.Before.IsZero() || src.Before.Before(dst.Before)) { dst.Before = src.Before }
+	if src.SentSince.After(dst.SentSince) { dst.SentSince = src.SentSince }
+	if !src.SentBefore.IsZero() && (dst.SentBefore.IsZero() || src.SentBefore.Before(dst.SentBefore)) { dst.SentBefore = src.SentBefore }
+	for k,v := range src.Header {
+		if dst.Header==nil { dst.Header = make(map[string][]string) }
+		dst.Header[k] = append(dst.Header[k],v...)
+	}
+	dst.Body = append(dst.Body,src.Body...)
+	dst.Text = append(dst.Text,src.Text...)
+	dst.WithFlags = append(dst.WithFlags,src.WithFlags...)
+	dst.WithoutFlags = append(dst.WithoutFlags,src.WithoutFlags...)
+	if src.Larger>dst.Larger { dst.Larger = src.Larger }
+	if src.Smaller!=0 && (dst.Smaller==0 || src.Smaller<dst.Smaller) { dst.Smaller = src.Smaller }
+	dst.Not = append(dst.Not,src.Not...)
+	dst.Or = append(dst.Or,src.Or...)
+}
+
+/*
+Translates a filter into IMAP search criteria. inMailbox and inMailboxOtherThan are only
+understood at the top level (or in a top level AND), mf receives them; it is nil elsewhere.
+*/
+func translateFilter(raw json.RawMessage, mf *mailboxFilter) (*imap.SearchCriteria,error) {
+	crit := imap.NewSearchCriteria()
+	if len(raw)==0 || string(raw)=="null" { return crit,nil }
+	
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(raw,&probe); err!=nil { return nil,errInvalidArguments("filter: %v",err) }
+	if _,ok := probe["operator"]; ok {
+		var op filterOperator
+		if err := decodeArgs(raw,&op); err!=nil { return nil,err }
+		var subs []*imap.SearchCriteria
+		for _,cond := range op.Conditions {
+			var sub *mailboxFilter
+			if op.Operator=="AND" { sub = mf }
+			c,err := translateFilter(cond,sub)
+			if err!=nil { return nil,err }
+			subs = append(subs,c)
+		}
+		switch op.Operator {
+		case "AND":
+			for _,c := range subs { mergeCriteria(crit,c) }
+		case "OR":
+			if len(subs)==0 { return nil,errInvalidArguments("OR without conditions") }
+			or := subs[0]
+			for _,c := range subs[1:] { or = &imap.SearchCriteria{Or: [][2]*imap.SearchCriteria{{or,c}}} }
+			mergeCriteria(crit,or)
+		case "NOT":
+			crit.Not = subs
+		default:
+			return nil,errInvalidArguments("unknown operator %q",op.Operator)
+		}
+		return crit,nil
+	}
+	
+	var f filterCondition
+	if err := decodeArgs(raw,&f); err!=nil { return nil,unsupportedFilter(err.(*methodError).Description) }
+	if f.InMailbox!=nil || f.InMailboxOtherThan!=nil {
+		if mf==nil { return nil,unsupportedFilter("inMailbox is only supported at the top level") }
+		if f.InMailbox!=nil {
+			/* Two different inMailbox conditions in an AND match nothing. */
+			if mf.in!=nil && *mf.in!=*f.InMailbox { mf.in = new(string) }
+			if mf.in==nil { mf.in = f.InMailbox }
+		}
+		for _,id := range f.InMailboxOtherThan { mf.notIn[id] = true }
+	}
+	if f.Before!=nil { crit.Before = *f.Before }
+	if f.After!=nil { crit.Since = *f.After }
+	if f.MinSize!=nil && *f.MinSize>0 { crit.Larger = *f.MinSize-1 }
+	if f.MaxSize!=nil { crit.Smaller = *f.MaxSize }
+	if f.HasKeyword!=nil { crit.WithFlags = append(crit.WithFlags,keywordFlag(*f.HasKeyword)) }
+	if f.NotKeyword!=nil { crit.WithoutFlags = append(crit.WithoutFlags,keywordFlag(*f.NotKeyword)) }
+	if f.HasAttachment!=nil { return nil,unsupportedFilter("hasAttachment") }
+	if f.Text!=nil { crit.Text = append(crit.Text,*f.Text) }
+	if f.Body!=nil { crit.Body = append(crit.Body,*f.Body) }
+	for k,v := range map[string]*string{"From": f.From, "To": f.To, "Cc": f.Cc, "Bcc": f.Bcc, "Subject": f.Subject} {
+		if v!=nil { crit.Header.Add(k,*v) }
+	}
+	switch len(f.Header) {
+	case 0:
+	case 1: crit.Header.Add(f.Header[0],"")
+	case 2: crit.Header.Add(f.Header[0],f.Header[1])
+	default: return nil,unsupportedFilter("header")
+	}
+	return crit,nil
+}
+
+type queryEntry struct {
+	id string
+	date time.Time
+	size uint32
+}
+
+func (c *call) emailQuery(args json.RawMessage) (interface{},error) {
+	var a emailQueryArgs
+	if err := decodeArgs(args,&a); err!=nil { return nil,err }
+	if err := c.account(a.AccountID); err!=nil { return nil,err }
+	
+	mf := &mailboxFilter{notIn: make(map[string]bool)}
+	crit,err := translateFilter(a.Filter,mf)
+	if err!=nil { return nil,err }
+	
+	less := func(x,y *queryEntry) bool { return x.date.After(y.date) }
+	if len(a.Sort)>0 {
+		asc := a.Sort[0].IsAscending==nil || *a.Sort[0].IsAscending
+		switch a.Sort[0].Property {
+		case "receivedAt":
+			less = func(x,y *queryEntry) bool { return x.date.Before(y.date)==asc && !x.date.Equal(y.date) }
+		case "size":
+			less = func(x,y *queryEntry) bool { return (x.size<y.size)==asc && x.size!=y.size }
+		default:
+			return nil,&methodError{"unsupportedSort",a.Sort[0].Property}
+		}
+	}
+	
+	list,err := c.mailboxes()
+	if err!=nil { return nil,err }
+	var entries []*queryEntry
+	for _,e := range list {
+		id := mailboxID(e.info.Name)
+		if e.status==nil || mf.notIn[id] { continue }
+		if mf.in!=nil && *mf.in!=id { continue }
+		
+		uids,err := e.mbox.SearchMessages(true,crit)
+		if err!=nil { return nil,err }
+		if len(uids)==0 { continue }
+		seq := new(imap.SeqSet)
+		seq.AddNum(uids...)
+		msgs,err := listMessages(e.mbox,seq,[]imap.FetchItem{imap.FetchUid,imap.FetchInternalDate,imap.FetchRFC822Size})
+		if err!=nil { return nil,err }
+		for _,msg := range msgs {
+			ref := emailRef{mailbox: e.info.Name, uidValidity: e.status.UidValidity, uid: msg.Uid}
+			entries = append(entries,&queryEntry{ref.id(),msg.InternalDate,msg.Size})
+		}
+	}
+	sort.SliceStable(entries,func(i,j int) bool { return less(entries[i],entries[j]) })
+	
+	total := len(entries)
+	pos := a.Position
+	if a.Anchor!=nil {
+		found := -1
+		for i,e := range entries {
+			if e.id==*a.Anchor { found = i }
+		}
+		if found<0 { return nil,&methodError{"anchorNotFound",""} }
+		pos = found+a.AnchorOffset
+	} else if pos<0 {
+		pos += total
+	}
+	if pos<0 { pos = 0 }
+	if pos>total { pos = total }
+	end := total
+	if a.Limit!=nil {
+		if *a.Limit<0 { return nil,errInvalidArguments("negative limit") }
+		if pos+*a.Limit<end { end = pos+*a.Limit }
+	}
+	
+	ids := []string{}
+	for _,e := range entries[pos:end] { ids = append(ids,e.id) }
+	res := map[string]interface{}{
+		"accountId": a.AccountID,
+		"queryState": emailState(list),
+		"canCalculateChanges": false,
+		"position": pos,
+		"ids": ids,
+	}
+	if a.CalculateTotal { res["total"] = total }
+	return res,nil
+}
@@ -0,0 +1,302 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package jmap
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	
+	"github.com/emersion/go-imap/backend"
+)
+
+const (
+	maxRequestSize = 10<<20
+	maxCalls = 64
+	maxObjects = 500
+)
+
+/* A method call or response: [name, arguments, call id]. */
+type invocation struct {
+	Name string
+	Args json.RawMessage
+	CallID string
+}
+
+func (i *invocation) UnmarshalJSON(b []byte) error {
+	var a []json.RawMessage
+	if err := json.Unmarshal(b,&a); err!=nil { return err }
+	if len(a)!=3 { return fmt.Errorf("invocation must have 3 elements") }
+	if err := json.Unmarshal(a[0],&i.Name); err!=nil { return err }
+	if err := json.Unmarshal(a[2],&i.CallID); err!=nil { return err }
+	i.Args = a[1]
+	return nil
+}
+
+func (i *invocation) MarshalJSON() ([]byte,error) {
+	return json.Marshal([]interface{}{i.Name,i.Args,i.CallID})
+}
+
+type request struct {
+	Using []string `json:"using"`
+	MethodCalls []*invocation `json:"methodCalls"`
+	CreatedIDs map[string]string `json:"createdIds,omitempty"`
+}
+
+type response struct {
+	MethodResponses []*invocation `json:"methodResponses"`
+	CreatedIDs map[string]string `json:"createdIds,omitempty"`
+	SessionState string `json:"sessionState"`
+}
+
+/* A method-level error, see RFC 8620, section 3.6.2. */
+type methodError struct {
+	Type string `json:"type"`
+	Description string `json:"description,omitempty"`
+}
+
+func (e *methodError) Error() string {
+	if e.Description=="" { return e.Type }
+	return e.Type+": "+e.Description
+}
+
+func errInvalidArguments(f string, args ...interface{}) *methodError {
+	return &methodError{"invalidArguments",fmt.Sprintf(f,args...)}
+}
+
+/* A SetError, see RFC 8620, section 5.3. */
+type setError struct {
+	Type string `json:"type"`
+	Description string `json:"description,omitempty"`
+	Properties []string `json:"properties,omitempty"`
+}
+
+/* The state of a request, shared by all of it's method calls. */
+type call struct {
+	s *Server
+	sess *session
+	user backend.User
+	createdIDs map[string]string
+	
+	/* The responses so far, decoded, for result references. */
+	results []resultEntry
+}
+
+type resultEntry struct {
+	name, callID string
+	value interface{}
+}
+
+type method struct {
+	capability string
+	fn func(c *call, args json.RawMessage) (interface{},error)
+}
+
+var methods = map[string]method{
+	"Core/echo": {capCore, func(c *call, args json.RawMessage) (interface{},error) { return args,nil }},
+	"Mailbox/get": {capMail, (*call).mailboxGet},
+	"Email/get": {capMail, (*call).emailGet},
+	"Email/query": {capMail, (*call).emailQuery},
+	"Email/set": {capMail, (*call).emailSet},
+}
+
+/* Checks the accountId argument, that all mail methods have. */
+func (c *call) account(id string) error {
+	if id!=accountID(c.sess.username) { return &methodError{"accountNotFound",""} }
+	return nil
+}
+
+/* Resolves a creation id reference ("#name"), as used in ids arguments. */
+func (c *call) resolveID(id string) string {
+	if strings.HasPrefix(id,"#") {
+		if real,ok := c.createdIDs[id[1:]]; ok { return real }
+	}
+	return id
+}
+
+func (s *Server) serveAPI(w http.ResponseWriter, r *http.Request, sess *session) {
+	body,err := ioutil.ReadAll(io.LimitReader(r.Body,maxRequestSize+1))
+	if err!=nil {
+		writeProblem(w,http.StatusBadRequest,"urn:ietf:params:jmap:error:notRequest",err.Error())
+		return
+	}
+	if len(body)>maxRequestSize {
+		writeProblem(w,http.StatusBadRequest,"urn:ietf:params:jmap:error:limit","maxSizeRequest")
+		return
+	}
+	
+	var req request
+	if !json.Valid(body) {
+		writeProblem(w,http.StatusBadRequest,"urn:ietf:params:jmap:error:notJSON","the request is not valid JSON")
+		return
+	}
+	if err = json.Unmarshal(body,&req); err!=nil {
+		writeProblem(w,http.StatusBadRequest,"urn:ietf:params:jmap:error:notRequest",err.Error())
+		return
+	}
+	if len(req.MethodCalls)>maxCalls {
+		writeProblem(w,http.StatusBadRequest,"urn:ietf:params:jmap:error:limit","maxCallsInRequest")
+		return
+	}
+	using := make(map[string]bool)
+	for _,u := range req.Using {
+		if u!=capCore && u!=capMail {
+			writeProblem(w,http.StatusBadRequest,"urn:ietf:params:jmap:error:unknownCapability",u)
+			return
+		}
+		using[u] = true
+	}
+	
+	c := &call{s: s, sess: sess, user: sess.user, createdIDs: req.CreatedIDs}
+	if c.createdIDs==nil { c.createdIDs = make(map[string]string) }
+	
+	resp := &response{SessionState: "0"}
+	for _,inv := range req.MethodCalls {
+		out := c.invoke(inv,using)
+		resp.MethodResponses = append(resp.MethodResponses,out)
+		
+		var v interface{}
+		json.Unmarshal(out.Args,&v)
+		c.results = append(c.results,resultEntry{out.Name,out.CallID,v})
+	}
+	if req.CreatedIDs!=nil { resp.CreatedIDs = c.createdIDs }
+	writeJSON(w,http.StatusOK,resp)
+}
+
+func errorInvocation(callID string, err error) *invocation {
+	me,ok := err.(*methodError)
+	if !ok { me = &methodError{"serverFail",err.Error()} }
+	b,_ := json.Marshal(me)
+	return &invocation{"error",b,callID}
+}
+
+func (c *call) invoke(inv *invocation, using map[string]bool) *invocation {
+	m,ok := methods[inv.Name]
+	if !ok || !using[m.capability] {
+		return errorInvocation(inv.CallID,&methodError{"unknownMethod",""})
+	}
+	args,err := c.resolveReferences(inv.Args)
+	if err!=nil { return errorInvocation(inv.CallID,err) }
+	
+	res,err := m.fn(c,args)
+	if err!=nil { return errorInvocation(inv.CallID,err) }
+	b,err := json.Marshal(res)
+	if err!=nil { return errorInvocation(inv.CallID,err) }
+	return &invocation{inv.Name,b,inv.CallID}
+}
+
+/* A result reference, see RFC 8620, section 3.7. */
+type resultReference struct {
+	ResultOf string `json:"resultOf"`
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+/* Replaces the arguments "#name" by the values, that they reference. */
+func (c *call) resolveReferences(args json.RawMessage) (json.RawMessage,error) {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(args,&m); err!=nil {
+		return nil,errInvalidArguments("arguments must be an object")
+	}
+	changed := false
+	for k,v := range m {
+		if !strings.HasPrefix(k,"#") { continue }
+		if _,ok := m[k[1:]]; ok { return nil,errInvalidArguments("both %s and %s given",k,k[1:]) }
+		
+		var ref resultReference
+		if err := json.Unmarshal(v,&ref); err!=nil { return nil,&methodError{"invalidResultReference",err.Error()} }
+		var value interface{}
+		found := false
+		for _,r := range c.results {
+			if r.callID!=ref.ResultOf { continue }
+			if r.name!=ref.Name { return nil,&methodError{"invalidResultReference","wrong method name"} }
+			value,found = r.value,true
+		}
+		if !found { return nil,&methodError{"invalidResultReference","no such result"} }
+		
+		value,err := evalPointer(value,ref.Path)
+		if err!=nil { return nil,&methodError{"invalidResultReference",err.Error()} }
+		b,err := json.Marshal(value)
+		if err!=nil { return nil,err }
+		delete(m,k)
+		m[k[1:]] = b
+		changed = true
+	}
+	if !changed { return args,nil }
+	return json.Marshal(m)
+}
+
+/*
+Evaluates a JSON pointer (RFC 6901) with the JMAP extension: "*" maps the rest of the pointer
+over an array, nested arrays in the result are flattened.
+*/
+func evalPointer(v interface{}, path string) (interface{},error) {
+	if path=="" { return v,nil }
+	if !strings.HasPrefix(path,"/") { return nil,fmt.Errorf("invalid path %q",path) }
+	tokens := strings.Split(path[1:],"/")
+	for i,t := range tokens {
+		t = strings.Replace(strings.Replace(t,"~1","/",-1),"~0","~",-1)
+		switch x := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v,ok = x[t]; !ok { return nil,fmt.Errorf("no %q in result",t) }
+		case []interface{}:
+			if t=="*" {
+				rest := "/"+strings.Join(tokens[i+1:],"/")
+				if i+1==len(tokens) { rest = "" }
+				out := []interface{}{}
+				for _,e := range x {
+					r,err := evalPointer(e,rest)
+					if err!=nil { return nil,err }
+					if ra,ok := r.([]interface{}); ok {
+						out = append(out,ra...)
+					} else {
+						out = append(out,r)
+					}
+				}
+				return out,nil
+			}
+			n,err := strconv.Atoi(t)
+			if err!=nil || n<0 || n>=len(x) { return nil,fmt.Errorf("invalid index %q",t) }
+			v = x[n]
+		default:
+			return nil,fmt.Errorf("can't follow %q",t)
+		}
+	}
+	return v,nil
+}
+
+/* Decodes the arguments, unknown ones are an error. */
+func decodeArgs(args json.RawMessage, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(args))
+	d.DisallowUnknownFields()
+	if err := d.Decode(v); err!=nil { return errInvalidArguments("%v",err) }
+	return nil
+}
@@ -0,0 +1,254 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+/*
+A JMAP (RFC 8620, RFC 8621) server, that serves the mailboxes of any go-imap backend.Backend.
+
+In front of a decrypting gateway (ngcrypt/imap or imap-ex), the gateway decrypts the envelope,
+the body structure and the body parts, so encrypted mail is served as plain JSON:
+
+	s := jmap.New(gateway)
+	http.Handle("/", s)
+	log.Fatal(http.ListenAndServeTLS(":443", "cert.pem", "key.pem", nil))
+
+Clients authenticate with HTTP Basic authentication, the credentials are passed to Backend.Login.
+
+Supported are Core/echo, Mailbox/get, Email/get, Email/query and Email/set, as well as downloads
+of messages and of their parts. Changes (the /changes methods), push and uploads are not.
+*/
+package jmap
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+const (
+	capCore = "urn:ietf:params:jmap:core"
+	capMail = "urn:ietf:params:jmap:mail"
+)
+
+type Server struct {
+	Backend backend.Backend
+	
+	/*
+	The URL prefix, under which the server is mounted, e.g. "https://mail.example.org". Used
+	for the URLs in the session resource. If empty, it is derived from the request.
+	*/
+	BaseURL string
+	
+	/* How long a login is kept, after the last request. Defaults to 5 minutes. */
+	SessionTimeout time.Duration
+	
+	/* Allows Basic authentication without TLS. */
+	AllowInsecureAuth bool
+	
+	mutex sync.Mutex
+	sessions map[[32]byte]*session
+}
+
+/* A logged in user. Requests of the same user are processed one after another. */
+type session struct {
+	mutex sync.Mutex
+	user backend.User
+	username string
+	lastUsed time.Time
+}
+
+func New(be backend.Backend) *Server {
+	return &Server{Backend: be}
+}
+
+func (s *Server) sessionTimeout() time.Duration {
+	if s.SessionTimeout==0 { return 5*time.Minute }
+	return s.SessionTimeout
+}
+
+/* Logs out the users, that were idle for too long. s.mutex must be held. */
+func (s *Server) expire() {
+	now := time.Now()
+	for k,sess := range s.sessions {
+		if now.Sub(sess.lastUsed)<s.sessionTimeout() { continue }
+		delete(s.sessions,k)
+		go func(sess *session) {
+			sess.mutex.Lock()
+			defer sess.mutex.Unlock()
+			sess.user.Logout()
+		}(sess)
+	}
+}
+
+/* Returns the session of the credentials, and logs in, if there is none. */
+func (s *Server) login(r *http.Request, username, password string) (*session,error) {
+	key := sha256.Sum256([]byte(username+"\x00"+password))
+	
+	s.mutex.Lock()
+	s.expire()
+	sess,ok := s.sessions[key]
+	if ok { sess.lastUsed = time.Now() }
+	s.mutex.Unlock()
+	if ok { return sess,nil }
+	
+	info := &imap.ConnInfo{TLS: r.TLS}
+	u,err := s.Backend.Login(info,username,password)
+	if err!=nil { return nil,err }
+	
+	sess = &session{user: u, username: username, lastUsed: time.Now()}
+	s.mutex.Lock()
+	if s.sessions==nil { s.sessions = make(map[[32]byte]*session) }
+	if old,ok := s.sessions[key]; ok {
+		/* Someone else was faster. */
+		s.mutex.Unlock()
+		u.Logout()
+		return old,nil
+	}
+	s.sessions[key] = sess
+	s.mutex.Unlock()
+	return sess,nil
+}
+
+/* Logs out all users. */
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for k,sess := range s.sessions {
+		delete(s.sessions,k)
+		sess.mutex.Lock()
+		sess.user.Logout()
+		sess.mutex.Unlock()
+	}
+	return nil
+}
+
+func (s *Server) baseURL(r *http.Request) string {
+	if s.BaseURL!="" { return strings.TrimSuffix(s.BaseURL,"/") }
+	scheme := "http"
+	if r.TLS!=nil { scheme = "https" }
+	return scheme+"://"+r.Host
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type","application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+/* A request-level error (RFC 7807 problem details). */
+func writeProblem(w http.ResponseWriter, status int, typ, detail string) {
+	w.Header().Set("Content-Type","application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"type": typ, "status": status, "detail": detail})
+}
+
+/*
+Serves the session resource at /.well-known/jmap and /jmap/session, the API at /jmap/api and
+downloads at /jmap/download/{accountId}/{blobId}/{name}.
+*/
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.TLS==nil && !s.AllowInsecureAuth {
+		http.Error(w,"TLS required",http.StatusForbidden)
+		return
+	}
+	username,password,ok := r.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate",`Basic realm="jmap"`)
+		http.Error(w,"authentication required",http.StatusUnauthorized)
+		return
+	}
+	sess,err := s.login(r,username,password)
+	if err!=nil {
+		w.Header().Set("WWW-Authenticate",`Basic realm="jmap"`)
+		http.Error(w,"authentication failed",http.StatusUnauthorized)
+		return
+	}
+	
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+	
+	switch path := r.URL.Path; {
+	case path=="/.well-known/jmap" || path=="/jmap/session":
+		if r.Method!=http.MethodGet {
+			http.Error(w,"method not allowed",http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w,http.StatusOK,s.sessionResource(r,sess))
+	case path=="/jmap/api":
+		if r.Method!=http.MethodPost {
+			http.Error(w,"method not allowed",http.StatusMethodNotAllowed)
+			return
+		}
+		s.serveAPI(w,r,sess)
+	case strings.HasPrefix(path,"/jmap/download/"):
+		s.serveDownload(w,r,sess,strings.TrimPrefix(path,"/jmap/download/"))
+	default:
+		http.NotFound(w,r)
+	}
+}
+
+func (s *Server) sessionResource(r *http.Request, sess *session) map[string]interface{} {
+	base := s.baseURL(r)
+	account := accountID(sess.username)
+	return map[string]interface{}{
+		"capabilities": map[string]interface{}{
+			capCore: map[string]interface{}{
+				"maxSizeRequest": maxRequestSize,
+				"maxConcurrentRequests": 4,
+				"maxCallsInRequest": maxCalls,
+				"maxObjectsInGet": maxObjects,
+				"maxObjectsInSet": maxObjects,
+				"collationAlgorithms": []string{},
+			},
+			capMail: map[string]interface{}{},
+		},
+		"accounts": map[string]interface{}{
+			account: map[string]interface{}{
+				"name": sess.username,
+				"isPersonal": true,
+				"isReadOnly": false,
+				"accountCapabilities": map[string]interface{}{
+					capMail: map[string]interface{}{
+						"maxMailboxesPerEmail": 1,
+						"maxMailboxDepth": nil,
+						"maxSizeMailboxName": 255,
+						"maxSizeAttachmentsPerEmail": 0,
+						"emailQuerySortOptions": []string{"receivedAt"},
+						"mayCreateTopLevelMailbox": false,
+					},
+				},
+			},
+		},
+		"primaryAccounts": map[string]string{capMail: account},
+		"username": sess.username,
+		"apiUrl": base+"/jmap/api",
+		"downloadUrl": base+"/jmap/download/{accountId}/{blobId}/{name}?type={type}",
+		"state": "0",
+	}
+}
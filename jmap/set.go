@@ -0,0 +1,502 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package jmap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-message/mail"
+	
+	imapexpunge "github.com/mad-day/gaw-mail/util/imap-expunge"
+)
+
+type emailSetArgs struct {
+	AccountID string `json:"accountId"`
+	IfInState *string `json:"ifInState"`
+	Create map[string]json.RawMessage `json:"create"`
+	Update map[string]map[string]json.RawMessage `json:"update"`
+	Destroy []string `json:"destroy"`
+}
+
+type emailAddress struct {
+	Name *string `json:"name"`
+	Email string `json:"email"`
+}
+
+type bodyPartRef struct {
+	PartID string `json:"partId"`
+	Type string `json:"type"`
+}
+
+/* The properties of a new email, that are supported. */
+type emailCreate struct {
+	MailboxIDs map[string]bool `json:"mailboxIds"`
+	Keywords map[string]bool `json:"keywords"`
+	ReceivedAt *time.Time `json:"receivedAt"`
+	MessageID []string `json:"messageId"`
+	InReplyTo []string `json:"inReplyTo"`
+	References []string `json:"references"`
+	Sender []emailAddress `json:"sender"`
+	From []emailAddress `json:"from"`
+	To []emailAddress `json:"to"`
+	Cc []emailAddress `json:"cc"`
+	Bcc []emailAddress `json:"bcc"`
+	ReplyTo []emailAddress `json:"replyTo"`
+	Subject *string `json:"subject"`
+	SentAt *time.Time `json:"sentAt"`
+	TextBody []bodyPartRef `json:"textBody"`
+	HTMLBody []bodyPartRef `json:"htmlBody"`
+	BodyValues map[string]struct {
+		Value string `json:"value"`
+	} `json:"bodyValues"`
+}
+
+func invalidProperties(props ...string) *setError {
+	return &setError{Type: "invalidProperties", Properties: props}
+}
+
+func mailAddresses(list []emailAddress) []*mail.Address {
+	out := make([]*mail.Address,0,len(list))
+	for _,a := range list {
+		addr := &mail.Address{Address: a.Email}
+		if a.Name!=nil { addr.Name = *a.Name }
+		out = append(out,addr)
+	}
+	return out
+}
+
+func keywordFlags(kw map[string]bool) []string {
+	var flags []string
+	for k,v := range kw {
+		if v { flags = append(flags,keywordFlag(k)) }
+	}
+	return flags
+}
+
+/* The single mailbox of a mailboxIds value. Messages are in exactly one mailbox. */
+func singleMailbox(ids map[string]bool) (string,bool) {
+	var names []string
+	for id,v := range ids {
+		if !v { continue }
+		name,ok := parseMailboxID(id)
+		if !ok { return "",false }
+		names = append(names,name)
+	}
+	if len(names)!=1 { return "",false }
+	return names[0],true
+}
+
+/* Builds the message of a new email, plain text, HTML or both as multipart/alternative. */
+func buildMessage(e *emailCreate) ([]byte,*setError) {
+	var h mail.Header
+	h.Set("MIME-Version","1.0")
+	if e.SentAt!=nil { h.SetDate(*e.SentAt) } else { h.SetDate(time.Now()) }
+	if e.Subject!=nil { h.SetSubject(*e.Subject) }
+	for k,v := range map[string][]emailAddress{"Sender": e.Sender, "From": e.From, "To": e.To, "Cc": e.Cc, "Bcc": e.Bcc, "Reply-To": e.ReplyTo} {
+		if len(v)>0 { h.SetAddressList(k,mailAddresses(v)) }
+	}
+	if len(e.MessageID)==1 {
+		h.SetMessageID(e.MessageID[0])
+	} else if err := h.GenerateMessageID(); err!=nil {
+		return nil,&setError{Type: "serverFail", Description: err.Error()}
+	}
+	if len(e.InReplyTo)>0 { h.SetMsgIDList("In-Reply-To",e.InReplyTo) }
+	if len(e.References)>0 { h.SetMsgIDList("References",e.References) }
+	
+	type part struct {
+		typ, value string
+	}
+	var parts []part
+	for prop,refs := range map[string][]bodyPartRef{"textBody": e.TextBody, "htmlBody": e.HTMLBody} {
+		if len(refs)>1 { return nil,invalidProperties(prop) }
+		for _,r := range refs {
+			v,ok := e.BodyValues[r.PartID]
+			if !ok { return nil,invalidProperties(prop,"bodyValues") }
+			t := r.Type
+			if t=="" { t = map[string]string{"textBody": "text/plain", "htmlBody": "text/html"}[prop] }
+			parts = append(parts,part{t,v.Value})
+		}
+	}
+	/* text/plain first, as the last part of multipart/alternative is the preferred one. */
+	if len(parts)==2 && parts[0].typ=="text/html" { parts[0],parts[1] = parts[1],parts[0] }
+	
+	buf := new(bytes.Buffer)
+	var err error
+	utf8 := map[string]string{"charset": "utf-8"}
+	switch len(parts) {
+	case 0:
+		h.SetContentType("text/plain",utf8)
+		err = writeSingle(buf,h,"")
+	case 1:
+		h.SetContentType(parts[0].typ,utf8)
+		err = writeSingle(buf,h,parts[0].value)
+	default:
+		var iw *mail.InlineWriter
+		if iw,err = mail.CreateInlineWriter(buf,h); err!=nil { break }
+		for _,p := range parts {
+			var w io.WriteCloser
+			var ih mail.InlineHeader
+			ih.SetContentType(p.typ,utf8)
+			if w,err = iw.CreatePart(ih); err!=nil { break }
+			io.WriteString(w,p.value)
+			w.Close()
+		}
+		if err==nil { err = iw.Close() }
+	}
+	if err!=nil { return nil,&setError{Type: "serverFail", Description: err.Error()} }
+	return buf.Bytes(),nil
+}
+
+func writeSingle(w io.Writer, h mail.Header, value string) error {
+	sw,err := mail.CreateSingleInlineWriter(w,h)
+	if err!=nil { return err }
+	if _,err = io.WriteString(sw,value); err!=nil { return err }
+	return sw.Close()
+}
+
+func (c *call) emailSet(args json.RawMessage) (interface{},error) {
+	var a emailSetArgs
+	if err := decodeArgs(args,&a); err!=nil { return nil,err }
+	if err := c.account(a.AccountID); err!=nil { return nil,err }
+	if len(a.Create)+len(a.Update)+len(a.Destroy)>maxObjects { return nil,&methodError{"requestTooLarge",""} }
+	
+	oldState,err := c.currentEmailState()
+	if err!=nil { return nil,err }
+	if a.IfInState!=nil && *a.IfInState!=oldState { return nil,&methodError{"stateMismatch",""} }
+	
+	created := map[string]interface{}{}
+	notCreated := map[string]*setError{}
+	for cid,raw := range a.Create {
+		obj,serr := c.createEmail(raw)
+		if serr!=nil {
+			notCreated[cid] = serr
+			continue
+		}
+		created[cid] = obj
+		c.createdIDs[cid] = obj["id"].(string)
+	}
+	
+	updated := map[string]interface{}{}
+	notUpdated := map[string]*setError{}
+	for id,patch := range a.Update {
+		newID,serr := c.updateEmail(c.resolveID(id),patch)
+		if serr!=nil {
+			notUpdated[id] = serr
+			continue
+		}
+		/* A moved email has got a new id. */
+		if newID!="" {
+			updated[id] = map[string]interface{}{"id": newID}
+		} else {
+			updated[id] = nil
+		}
+	}
+	
+	destroyed := []string{}
+	notDestroyed := map[string]*setError{}
+	byMailbox := make(map[string][]emailRef)
+	for _,id := range a.Destroy {
+		ref,ok := parseEmailID(c.resolveID(id))
+		if !ok {
+			notDestroyed[id] = &setError{Type: "notFound"}
+			continue
+		}
+		byMailbox[ref.mailbox] = append(byMailbox[ref.mailbox],ref)
+	}
+	for name,refs := range byMailbox {
+		mbox,seq,err := c.locate(name,refs)
+		if err==nil && !seq.Empty() { err = expungeMessages(mbox,seq) }
+		for _,r := range refs {
+			if mbox==nil || seq==nil || !seq.Contains(r.uid) {
+				notDestroyed[r.id()] = &setError{Type: "notFound"}
+			} else if err!=nil {
+				notDestroyed[r.id()] = &setError{Type: "serverFail", Description: err.Error()}
+			} else {
+				destroyed = append(destroyed,r.id())
+			}
+		}
+	}
+	
+	newState,err := c.currentEmailState()
+	if err!=nil { return nil,err }
+	res := map[string]interface{}{
+		"accountId": a.AccountID,
+		"oldState": oldState,
+		"newState": newState,
+		"created": created,
+		"updated": updated,
+		"destroyed": destroyed,
+	}
+	if len(notCreated)>0 { res["notCreated"] = notCreated }
+	if len(notUpdated)>0 { res["notUpdated"] = notUpdated }
+	if len(notDestroyed)>0 { res["notDestroyed"] = notDestroyed }
+	return res,nil
+}
+
+/*
+Returns the mailbox and the UIDs of the refs, that still exist. The mailbox is nil, if it
+doesn't exist (anymore).
+*/
+func (c *call) locate(name string, refs []emailRef) (backend.Mailbox,*imap.SeqSet,error) {
+	seq := new(imap.SeqSet)
+	mbox,err := c.user.GetMailbox(name)
+	if err!=nil { return nil,seq,nil }
+	st,err := mbox.Status([]imap.StatusItem{imap.StatusUidValidity})
+	if err!=nil { return nil,nil,err }
+	
+	want := new(imap.SeqSet)
+	for _,r := range refs {
+		if r.uidValidity==st.UidValidity { want.AddNum(r.uid) }
+	}
+	if want.Empty() { return mbox,seq,nil }
+	msgs,err := listMessages(mbox,want,[]imap.FetchItem{imap.FetchUid})
+	if err!=nil { return nil,nil,err }
+	for _,msg := range msgs { seq.AddNum(msg.Uid) }
+	return mbox,seq,nil
+}
+
+var errOtherDeleted = errors.New("other messages are flagged \\Deleted, mailbox not expunged")
+
+/*
+Flags the messages (single UIDs) as \Deleted and expunges the mailbox. If an IMAP client has
+flagged other messages as \Deleted, the mailbox is not expunged, and the flags are taken back.
+*/
+func expungeMessages(mbox backend.Mailbox, seq *imap.SeqSet) error {
+	if err := mbox.UpdateMessagesFlags(true,seq,imap.AddFlags,[]string{imap.DeletedFlag}); err!=nil { return err }
+	var uids []uint32
+	for _,r := range seq.Set {
+		for uid := r.Start; uid<=r.Stop; uid++ { uids = append(uids,uid) }
+	}
+	ok,err := imapexpunge.Only(mbox,uids)
+	if !ok {
+		mbox.UpdateMessagesFlags(true,seq,imap.RemoveFlags,[]string{imap.DeletedFlag})
+		if err==nil { err = errOtherDeleted }
+	}
+	return err
+}
+
+func (c *call) createEmail(raw json.RawMessage) (map[string]interface{},*setError) {
+	var e emailCreate
+	if err := decodeArgs(raw,&e); err!=nil {
+		return nil,&setError{Type: "invalidProperties", Description: err.(*methodError).Description}
+	}
+	name,ok := singleMailbox(e.MailboxIDs)
+	if !ok { return nil,invalidProperties("mailboxIds") }
+	msg,serr := buildMessage(&e)
+	if serr!=nil { return nil,serr }
+	
+	mbox,err := c.user.GetMailbox(name)
+	if err!=nil { return nil,invalidProperties("mailboxIds") }
+	st,err := mbox.Status([]imap.StatusItem{imap.StatusUidNext,imap.StatusUidValidity})
+	if err!=nil { return nil,&setError{Type: "serverFail", Description: err.Error()} }
+	
+	date := time.Now()
+	if e.ReceivedAt!=nil { date = *e.ReceivedAt }
+	if err = mbox.CreateMessage(keywordFlags(e.Keywords),date,bytes.NewBuffer(msg)); err!=nil {
+		return nil,&setError{Type: "serverFail", Description: err.Error()}
+	}
+	
+	/* The backend doesn't tell the UID, it's the highest one from UIDNEXT on. */
+	seq := new(imap.SeqSet)
+	seq.AddRange(st.UidNext,0)
+	msgs,err := listMessages(mbox,seq,[]imap.FetchItem{imap.FetchUid,imap.FetchRFC822Size})
+	if err!=nil { return nil,&setError{Type: "serverFail", Description: err.Error()} }
+	var last *imap.Message
+	for _,m := range msgs {
+		if m.Uid>=st.UidNext && (last==nil || m.Uid>last.Uid) { last = m }
+	}
+	if last==nil { return nil,&setError{Type: "serverFail", Description: "the new message can't be found"} }
+	
+	ref := emailRef{mailbox: name, uidValidity: st.UidValidity, uid: last.Uid}
+	return map[string]interface{}{
+		"id": ref.id(),
+		"blobId": ref.blobID(),
+		"threadId": "t"+ref.id()[1:],
+		"size": last.Size,
+	},nil
+}
+
+/* Unescapes a JSON pointer token. */
+func unescapeToken(t string) string {
+	return strings.Replace(strings.Replace(t,"~1","/",-1),"~0","~",-1)
+}
+
+/*
+Applies a patch to an email. Only keywords and mailboxIds can change. Returns the new id, if the
+email was moved.
+*/
+func (c *call) updateEmail(id string, patch map[string]json.RawMessage) (string,*setError) {
+	ref,ok := parseEmailID(id)
+	if !ok { return "",&setError{Type: "notFound"} }
+	mbox,seq,err := c.locate(ref.mailbox,[]emailRef{ref})
+	if err!=nil { return "",&setError{Type: "serverFail", Description: err.Error()} }
+	if mbox==nil || seq.Empty() { return "",&setError{Type: "notFound"} }
+	
+	var setFlags []string
+	var addFlags,removeFlags []string
+	replace := false
+	mailboxes := map[string]bool{mailboxID(ref.mailbox): true}
+	for path,raw := range patch {
+		switch {
+		case path=="keywords":
+			var kw map[string]bool
+			if err := json.Unmarshal(raw,&kw); err!=nil { return "",invalidProperties(path) }
+			setFlags,replace = keywordFlags(kw),true
+		case strings.HasPrefix(path,"keywords/"):
+			var v *bool
+			if err := json.Unmarshal(raw,&v); err!=nil { return "",invalidProperties(path) }
+			f := keywordFlag(unescapeToken(path[len("keywords/"):]))
+			if v!=nil && *v { addFlags = append(addFlags,f) } else { removeFlags = append(removeFlags,f) }
+		case path=="mailboxIds":
+			var ids map[string]bool
+			if err := json.Unmarshal(raw,&ids); err!=nil { return "",invalidProperties(path) }
+			mailboxes = ids
+		case strings.HasPrefix(path,"mailboxIds/"):
+			var v *bool
+			if err := json.Unmarshal(raw,&v); err!=nil { return "",invalidProperties(path) }
+			mailboxes[unescapeToken(path[len("mailboxIds/"):])] = v!=nil && *v
+		default:
+			return "",invalidProperties(path)
+		}
+	}
+	dest,ok := singleMailbox(mailboxes)
+	if !ok { return "",invalidProperties("mailboxIds") }
+	
+	var ferr error
+	if replace { ferr = mbox.UpdateMessagesFlags(true,seq,imap.SetFlags,setFlags) }
+	if ferr==nil && len(addFlags)>0 { ferr = mbox.UpdateMessagesFlags(true,seq,imap.AddFlags,addFlags) }
+	if ferr==nil && len(removeFlags)>0 { ferr = mbox.UpdateMessagesFlags(true,seq,imap.RemoveFlags,removeFlags) }
+	if ferr!=nil { return "",&setError{Type: "serverFail", Description: ferr.Error()} }
+	
+	if dest==ref.mailbox { return "",nil }
+	newID,err := c.moveEmail(mbox,ref,dest)
+	if err!=nil { return "",&setError{Type: "serverFail", Description: err.Error()} }
+	return newID,nil
+}
+
+/* Moves an email to another mailbox, and returns it's new id. */
+func (c *call) moveEmail(mbox backend.Mailbox, ref emailRef, dest string) (string,error) {
+	target,err := c.user.GetMailbox(dest)
+	if err!=nil { return "",err }
+	st,err := target.Status([]imap.StatusItem{imap.StatusUidNext,imap.StatusUidValidity})
+	if err!=nil { return "",err }
+	
+	seq := new(imap.SeqSet)
+	seq.AddNum(ref.uid)
+	if mm,ok := mbox.(backend.MoveMailbox); ok {
+		err = mm.MoveMessages(true,seq,dest)
+	} else if err = mbox.CopyMessages(true,seq,dest); err==nil {
+		err = expungeMessages(mbox,seq)
+	}
+	if err!=nil { return "",err }
+	
+	all := new(imap.SeqSet)
+	all.AddRange(st.UidNext,0)
+	msgs,err := listMessages(target,all,[]imap.FetchItem{imap.FetchUid})
+	if err!=nil { return "",err }
+	var uid uint32
+	for _,m := range msgs {
+		if m.Uid>=st.UidNext && m.Uid>uid { uid = m.Uid }
+	}
+	if uid==0 { return "",errors.New("the moved message can't be found") }
+	return emailRef{mailbox: dest, uidValidity: st.UidValidity, uid: uid}.id(),nil
+}
+
+/* Serves a blob: a whole message, or a part of it, with the transfer encoding removed. */
+func (s *Server) serveDownload(w http.ResponseWriter, r *http.Request, sess *session, path string) {
+	fields := strings.SplitN(path,"/",3)
+	if len(fields)!=3 || fields[0]!=accountID(sess.username) {
+		http.NotFound(w,r)
+		return
+	}
+	ref,ok := parseBlobID(fields[1])
+	if !ok {
+		http.NotFound(w,r)
+		return
+	}
+	
+	c := &call{s: s, sess: sess, user: sess.user}
+	mbox,seq,err := c.locate(ref.mailbox,[]emailRef{ref})
+	if err!=nil {
+		http.Error(w,err.Error(),http.StatusInternalServerError)
+		return
+	}
+	if mbox==nil || seq.Empty() {
+		http.NotFound(w,r)
+		return
+	}
+	
+	section := &imap.BodySectionName{Peek: true}
+	items := []imap.FetchItem{imap.FetchUid}
+	if ref.part!="" {
+		section = partSection(ref.part)
+		items = append(items,imap.FetchBodyStructure)
+	}
+	items = append(items,section.FetchItem())
+	msgs,err := listMessages(mbox,seq,items)
+	if err!=nil {
+		http.Error(w,err.Error(),http.StatusInternalServerError)
+		return
+	}
+	if len(msgs)==0 || bodySection(msgs[0],section)==nil {
+		http.NotFound(w,r)
+		return
+	}
+	msg := msgs[0]
+	
+	buf := new(bytes.Buffer)
+	buf.ReadFrom(bodySection(msg,section))
+	data := buf.Bytes()
+	if ref.part!="" && msg.BodyStructure!=nil {
+		if p := findPart(newBodyPart(msg.BodyStructure,""),ref.part); p!=nil {
+			data,_ = decodePart(p.bs,data,false)
+		}
+	}
+	
+	typ := r.URL.Query().Get("type")
+	if typ=="" { typ = "application/octet-stream" }
+	name,_ := url.PathUnescape(fields[2])
+	w.Header().Set("Content-Type",typ)
+	w.Header().Set("Content-Disposition",fmt.Sprintf("attachment; filename=%q",name))
+	w.Write(data)
+}
+
+func findPart(p *bodyPart, id string) *bodyPart {
+	if p.partID==id { return p }
+	for _,sp := range p.sub {
+		if f := findPart(sp,id); f!=nil { return f }
+	}
+	return nil
+}
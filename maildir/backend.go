@@ -0,0 +1,125 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+/*
+A go-imap backend, that stores the mailboxes of each user in a Maildir++ tree, so that small
+deployments need no upstream IMAP server. Messages are stored as they are appended; NewEncrypted
+puts the NGCRYPT gateway in front, so that they are stored encrypted.
+
+The mailboxes of a user are in the directory Root/<username>, which must exist. INBOX is the
+directory itself, other mailboxes are it's sub-directories ".Name.Sub" (the IMAP name is
+"Name/Sub"). UIDs and UIDVALIDITY are kept in the file gaw-uidlist of each mailbox, keywords in
+gaw-keywords; the system flags are in the file names, as in any Maildir.
+*/
+package maildir
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-pgpmail"
+	
+	ngimap "github.com/mad-day/gaw-mail/ngcrypt/imap"
+)
+
+type AuthFunc func(username, password string) error
+
+type Backend struct {
+	Root string
+	
+	/*
+	Checks the password. If nil, every password is accepted, which is only safe behind a gateway
+	that authenticates the user by unlocking their keys.
+	*/
+	Auth AuthFunc
+	
+	mutex sync.Mutex
+	locks map[string]*sync.Mutex
+	updates chan backend.Update
+}
+
+var _ backend.BackendUpdater = (*Backend)(nil)
+
+func New(root string, auth AuthFunc) *Backend {
+	return &Backend{Root: root, Auth: auth}
+}
+
+/*
+Returns the NGCRYPT gateway over a Maildir backend at root. The users are authenticated by
+unlock only, which must fail for a wrong password.
+*/
+func NewEncrypted(root string, unlock pgpmail.UnlockFunction) *ngimap.Backend {
+	return ngimap.New(New(root,nil),unlock)
+}
+
+func validUsername(username string) bool {
+	return username!="" && !strings.HasPrefix(username,".") && !strings.ContainsAny(username,"/\\\x00")
+}
+
+func (be *Backend) Login(conn *imap.ConnInfo, username, password string) (backend.User, error) {
+	if !validUsername(username) { return nil,backend.ErrInvalidCredentials }
+	if be.Auth!=nil {
+		if err := be.Auth(username,password); err!=nil { return nil,err }
+	}
+	
+	dir := filepath.Join(be.Root,username)
+	if fi,err := os.Stat(dir); err!=nil || !fi.IsDir() { return nil,backend.ErrInvalidCredentials }
+	if err := makeMaildir(dir); err!=nil { return nil,err }
+	return &user{be,username,dir},nil
+}
+
+/* Returns the lock of the mailbox or user directory dir, held while it's files are changed. */
+func (be *Backend) lock(dir string) *sync.Mutex {
+	be.mutex.Lock()
+	defer be.mutex.Unlock()
+	if be.locks==nil { be.locks = make(map[string]*sync.Mutex) }
+	l,ok := be.locks[dir]
+	if !ok {
+		l = new(sync.Mutex)
+		be.locks[dir] = l
+	}
+	return l
+}
+
+/* Reports new, expunged and changed messages to all sessions. */
+func (be *Backend) Updates() <-chan backend.Update {
+	be.mutex.Lock()
+	defer be.mutex.Unlock()
+	if be.updates==nil { be.updates = make(chan backend.Update,16) }
+	return be.updates
+}
+
+/* Sends the updates, unless nobody listens. Must be called without holding a mailbox lock. */
+func (be *Backend) send(updates []backend.Update) {
+	be.mutex.Lock()
+	ch := be.updates
+	be.mutex.Unlock()
+	if ch==nil { return }
+	for _,u := range updates { ch <- u }
+}
@@ -0,0 +1,358 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package maildir
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+	
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+)
+
+var _ backend.MoveMailbox = (*mailbox)(nil)
+
+type mailbox struct {
+	u *user
+	name string
+	dir string
+}
+
+/* Locks and loads the Maildir. The returned function unlocks it. */
+func (m *mailbox) open() (*store,func(),error) {
+	l := m.u.be.lock(m.dir)
+	l.Lock()
+	s,err := load(m.dir)
+	if err!=nil {
+		l.Unlock()
+		return nil,nil,err
+	}
+	return s,l.Unlock,nil
+}
+
+func (m *mailbox) update() backend.Update {
+	return backend.NewUpdate(m.u.username,m.name)
+}
+
+func (m *mailbox) Name() string {
+	return m.name
+}
+
+func (m *mailbox) Info() (*imap.MailboxInfo, error) {
+	info := &imap.MailboxInfo{Delimiter: Delimiter, Name: m.name}
+	if attr,ok := specialUse[strings.ToLower(m.name)]; ok { info.Attributes = []string{attr} }
+	return info,nil
+}
+
+func (m *mailbox) status(s *store, items []imap.StatusItem) *imap.MailboxStatus {
+	status := imap.NewMailboxStatus(m.name,items)
+	status.Flags = []string{imap.SeenFlag,imap.AnsweredFlag,imap.FlaggedFlag,imap.DeletedFlag,imap.DraftFlag}
+	status.Flags = append(status.Flags,s.keywords...)
+	status.PermanentFlags = append([]string(nil),status.Flags...)
+	if len(s.keywords)<maxKeywords { status.PermanentFlags = append(status.PermanentFlags,"\\*") }
+	
+	var unseen uint32
+	for i,f := range s.files {
+		if strings.IndexByte(f.info,'S')>=0 { continue }
+		if unseen==0 { status.UnseenSeqNum = uint32(i+1) }
+		unseen++
+	}
+	for _,item := range items {
+		switch item {
+		case imap.StatusMessages: status.Messages = uint32(len(s.files))
+		case imap.StatusUidNext: status.UidNext = s.next
+		case imap.StatusUidValidity: status.UidValidity = s.validity
+		case imap.StatusRecent: status.Recent = 0
+		case imap.StatusUnseen: status.Unseen = unseen
+		}
+	}
+	return status
+}
+
+func (m *mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	s,unlock,err := m.open()
+	if err!=nil { return nil,err }
+	defer unlock()
+	return m.status(s,items),nil
+}
+
+func (m *mailbox) SetSubscribed(subscribed bool) error {
+	return m.u.setSubscribed(m.name,subscribed)
+}
+
+func (m *mailbox) Check() error {
+	return nil
+}
+
+/* Calls fn with the sequence number of each message in seqSet. */
+func (s *store) each(uid bool, seqSet *imap.SeqSet, fn func(seqNum uint32, f *file) error) error {
+	for i,f := range s.files {
+		id := uint32(i+1)
+		if uid { id = f.uid }
+		if !seqSet.Contains(id) { continue }
+		if err := fn(uint32(i+1),f); err!=nil { return err }
+	}
+	return nil
+}
+
+func (s *store) fetch(seqNum uint32, f *file, items []imap.FetchItem) (*imap.Message,error) {
+	fetched := imap.NewMessage(seqNum,items)
+	var data []byte
+	var fi os.FileInfo
+	for _,item := range items {
+		switch item {
+		case imap.FetchUid:
+			fetched.Uid = f.uid
+			continue
+		case imap.FetchFlags:
+			fetched.Flags = s.flags(f)
+			continue
+		}
+		if data==nil {
+			var err error
+			if data,fi,err = s.read(f); err!=nil { return nil,err }
+		}
+		
+		switch item {
+		case imap.FetchInternalDate:
+			fetched.InternalDate = fi.ModTime()
+		case imap.FetchRFC822Size:
+			fetched.Size = uint32(len(data))
+		case imap.FetchEnvelope:
+			hdr,_,_ := headerAndBody(data)
+			fetched.Envelope,_ = backendutil.FetchEnvelope(hdr)
+		case imap.FetchBody,imap.FetchBodyStructure:
+			hdr,body,_ := headerAndBody(data)
+			fetched.BodyStructure,_ = backendutil.FetchBodyStructure(hdr,body,item==imap.FetchBodyStructure)
+		default:
+			section,err := imap.ParseBodySectionName(item)
+			if err!=nil { break }
+			hdr,body,err := headerAndBody(data)
+			if err!=nil { return nil,err }
+			l,_ := backendutil.FetchBodySection(hdr,body,section)
+			fetched.Body[section] = l
+		}
+	}
+	return fetched,nil
+}
+
+func headerAndBody(data []byte) (textproto.Header,*bufio.Reader,error) {
+	body := bufio.NewReader(bytes.NewReader(data))
+	hdr,err := textproto.ReadHeader(body)
+	return hdr,body,err
+}
+
+/*
+The Maildir stays locked until all messages are sent, so the receiver must not use the backend
+meanwhile.
+*/
+func (m *mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+	s,unlock,err := m.open()
+	if err!=nil { return err }
+	defer unlock()
+	
+	return s.each(uid,seqSet,func(seqNum uint32, f *file) error {
+		msg,err := s.fetch(seqNum,f,items)
+		if err!=nil { return nil }
+		ch <- msg
+		return nil
+	})
+}
+
+/* Reports, whether the criteria need the header or body of the messages. */
+func needsContent(c *imap.SearchCriteria) bool {
+	if len(c.Header)!=0 || len(c.Body)!=0 || len(c.Text)!=0 || c.Larger!=0 || c.Smaller!=0 || !c.SentBefore.IsZero() || !c.SentSince.IsZero() { return true }
+	for _,n := range c.Not {
+		if needsContent(n) { return true }
+	}
+	for _,o := range c.Or {
+		if needsContent(o[0]) || needsContent(o[1]) { return true }
+	}
+	return false
+}
+
+func (m *mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	s,unlock,err := m.open()
+	if err!=nil { return nil,err }
+	defer unlock()
+	
+	content := needsContent(criteria)
+	var ids []uint32
+	for i,f := range s.files {
+		seqNum := uint32(i+1)
+		e := new(message.Entity)
+		var date time.Time
+		if content || !criteria.Before.IsZero() || !criteria.Since.IsZero() {
+			data,fi,err := s.read(f)
+			if err!=nil { continue }
+			date = fi.ModTime()
+			if content { e,_ = message.Read(bytes.NewReader(data)) }
+			if e==nil { continue }
+		}
+		if ok,err := backendutil.Match(e,seqNum,f.uid,date,s.flags(f),criteria); err!=nil || !ok { continue }
+		
+		if uid { ids = append(ids,f.uid) } else { ids = append(ids,seqNum) }
+	}
+	return ids,nil
+}
+
+func (m *mailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	if date.IsZero() { date = time.Now() }
+	data,err := ioutil.ReadAll(body)
+	if err!=nil { return err }
+	
+	var updates []backend.Update
+	defer func() { m.u.be.send(updates) }()
+	s,unlock,err := m.open()
+	if err!=nil { return err }
+	defer unlock()
+	
+	if _,err = s.add(data,"",flags,date); err!=nil { return err }
+	updates = append(updates,&backend.MailboxUpdate{Update: m.update(), MailboxStatus: m.status(s,[]imap.StatusItem{imap.StatusMessages})})
+	return nil
+}
+
+func (m *mailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	var updates []backend.Update
+	defer func() { m.u.be.send(updates) }()
+	s,unlock,err := m.open()
+	if err!=nil { return err }
+	defer unlock()
+	
+	return s.each(uid,seqSet,func(seqNum uint32, f *file) error {
+		info,err := s.info(backendutil.UpdateFlags(s.flags(f),op,flags))
+		if err!=nil { return err }
+		if info==f.info { return nil }
+		
+		old := s.path(f)
+		f.info = info
+		if err := os.Rename(old,s.path(f)); err!=nil { return err }
+		
+		msg := imap.NewMessage(seqNum,[]imap.FetchItem{imap.FetchFlags})
+		msg.Flags = s.flags(f)
+		if uid {
+			msg.Items[imap.FetchUid] = nil
+			msg.Uid = f.uid
+		}
+		updates = append(updates,&backend.MessageUpdate{Update: m.update(), Message: msg})
+		return nil
+	})
+}
+
+type copied struct {
+	uid uint32
+	path string
+	flags []string
+	date time.Time
+}
+
+/*
+Copies the messages to dest, hard linking the files where possible. Only one Maildir is locked
+at a time, so that a mailbox can be copied into itself.
+*/
+func (m *mailbox) copy(uid bool, seqSet *imap.SeqSet, destName string, move bool) error {
+	dest,err := m.u.mailbox(destName)
+	if err!=nil { return err }
+	if _,err := os.Stat(dest.dir); err!=nil { return backend.ErrNoSuchMailbox }
+	
+	var updates []backend.Update
+	defer func() { m.u.be.send(updates) }()
+	
+	s,unlock,err := m.open()
+	if err!=nil { return err }
+	var list []copied
+	err = s.each(uid,seqSet,func(seqNum uint32, f *file) error {
+		fi,err := os.Stat(s.path(f))
+		if err!=nil { return err }
+		list = append(list,copied{f.uid,s.path(f),s.flags(f),fi.ModTime()})
+		return nil
+	})
+	unlock()
+	if err!=nil || len(list)==0 { return err }
+	
+	d,unlock,err := dest.open()
+	if err!=nil { return err }
+	for _,c := range list {
+		if _,err = d.add(nil,c.path,c.flags,c.date); err!=nil { break }
+	}
+	updates = append(updates,&backend.MailboxUpdate{Update: dest.update(), MailboxStatus: dest.status(d,[]imap.StatusItem{imap.StatusMessages})})
+	unlock()
+	if err!=nil || !move { return err }
+	
+	/* The copies are complete, now the originals are removed. */
+	s,unlock,err = m.open()
+	if err!=nil { return err }
+	defer unlock()
+	uids := make(map[uint32]bool,len(list))
+	for _,c := range list { uids[c.uid] = true }
+	var seqNums []uint32
+	for i,f := range s.files {
+		if uids[f.uid] { seqNums = append(seqNums,uint32(i+1)) }
+	}
+	return m.remove(s,seqNums,&updates)
+}
+
+func (m *mailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, destName string) error {
+	return m.copy(uid,seqSet,destName,false)
+}
+
+func (m *mailbox) MoveMessages(uid bool, seqSet *imap.SeqSet, destName string) error {
+	return m.copy(uid,seqSet,destName,true)
+}
+
+/* Removes the messages with the (ascending) sequence numbers and reports them expunged. */
+func (m *mailbox) remove(s *store, seqNums []uint32, updates *[]backend.Update) error {
+	for i := len(seqNums)-1; i>=0; i-- {
+		n := seqNums[i]
+		if err := os.Remove(s.path(s.files[n-1])); err!=nil && !os.IsNotExist(err) { return err }
+		s.files = append(s.files[:n-1],s.files[n:]...)
+		*updates = append(*updates,&backend.ExpungeUpdate{Update: m.update(), SeqNum: n})
+	}
+	return s.save()
+}
+
+func (m *mailbox) Expunge() error {
+	var updates []backend.Update
+	defer func() { m.u.be.send(updates) }()
+	s,unlock,err := m.open()
+	if err!=nil { return err }
+	defer unlock()
+	
+	var deleted []uint32
+	for i,f := range s.files {
+		if strings.IndexByte(f.info,'T')>=0 { deleted = append(deleted,uint32(i+1)) }
+	}
+	if len(deleted)==0 { return nil }
+	return m.remove(s,deleted,&updates)
+}
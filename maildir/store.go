@@ -0,0 +1,316 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package maildir
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	
+	"github.com/emersion/go-imap"
+)
+
+const (
+	uidlistFile = "gaw-uidlist"
+	keywordsFile = "gaw-keywords"
+	
+	/* Keywords are stored as the letters a-z in the file names, like Dovecot does. */
+	maxKeywords = 26
+)
+
+/* The system flags and their letters in the info part of the file names, in ASCII order. */
+var systemFlags = []struct{
+	c byte
+	flag string
+}{
+	{'D',imap.DraftFlag},
+	{'F',imap.FlaggedFlag},
+	{'R',imap.AnsweredFlag},
+	{'S',imap.SeenFlag},
+	{'T',imap.DeletedFlag},
+}
+
+func makeMaildir(dir string) error {
+	for _,sub := range []string{"cur","new","tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir,sub),0700); err!=nil { return err }
+	}
+	return nil
+}
+
+/* A message file. The name is base+":2,"+info, in the directory cur. */
+type file struct {
+	uid uint32
+	base string
+	info string
+}
+
+func splitName(name string) (base, info string) {
+	if i := strings.LastIndex(name,":2,"); i>=0 { return name[:i],name[i+3:] }
+	return name,""
+}
+
+/* The state of a Maildir, as loaded from disk. */
+type store struct {
+	dir string
+	validity uint32
+	next uint32
+	files []*file
+	keywords []string
+	
+	dirty bool
+}
+
+func (s *store) path(f *file) string {
+	return filepath.Join(s.dir,"cur",f.base+":2,"+f.info)
+}
+
+func (s *store) flags(f *file) []string {
+	var flags []string
+	for _,c := range []byte(f.info) {
+		if c>='a' && c<='z' {
+			if i := int(c-'a'); i<len(s.keywords) { flags = append(flags,s.keywords[i]) }
+			continue
+		}
+		for _,sf := range systemFlags {
+			if sf.c==c { flags = append(flags,sf.flag) }
+		}
+	}
+	return flags
+}
+
+/* Returns the info for the flags, adding unknown keywords to the mailbox. */
+func (s *store) info(flags []string) (string,error) {
+	var sys,kw []byte
+	for _,sf := range systemFlags {
+		for _,f := range flags {
+			if strings.EqualFold(f,sf.flag) { sys = append(sys,sf.c); break }
+		}
+	}
+	for _,f := range flags {
+		if strings.HasPrefix(f,"\\") { continue }
+		i := 0
+		for i<len(s.keywords) && !strings.EqualFold(s.keywords[i],f) { i++ }
+		if i==len(s.keywords) {
+			if i==maxKeywords { return "",fmt.Errorf("maildir: too many keywords") }
+			s.keywords = append(s.keywords,f)
+			if err := s.saveKeywords(); err!=nil { return "",err }
+		}
+		kw = append(kw,byte('a'+i))
+	}
+	sort.Slice(kw,func(i,j int) bool { return kw[i]<kw[j] })
+	return string(sys)+string(kw),nil
+}
+
+/*
+Loads the state of the Maildir. Messages delivered to new are moved to cur, and messages, that
+are not in the UID list yet, get the next UIDs.
+*/
+func load(dir string) (*store,error) {
+	s := &store{dir: dir}
+	if err := s.loadKeywords(); err!=nil { return nil,err }
+	known,err := s.loadUidlist()
+	if err!=nil { return nil,err }
+	
+	names,err := readdirnames(filepath.Join(dir,"new"))
+	if err!=nil { return nil,err }
+	for _,n := range names {
+		base,_ := splitName(n)
+		if err := os.Rename(filepath.Join(dir,"new",n),filepath.Join(dir,"cur",base+":2,")); err!=nil && !os.IsNotExist(err) { return nil,err }
+	}
+	
+	names,err = readdirnames(filepath.Join(dir,"cur"))
+	if err!=nil { return nil,err }
+	present := make(map[string]string,len(names))
+	for _,n := range names {
+		base,info := splitName(n)
+		present[base] = info
+	}
+	for _,f := range known {
+		info,ok := present[f.base]
+		if !ok { s.dirty = true; continue }
+		f.info = info
+		s.files = append(s.files,f)
+		delete(present,f.base)
+	}
+	
+	/* The base names start with the time of delivery, this keeps the order of arrival. */
+	var unknown []string
+	for base := range present { unknown = append(unknown,base) }
+	sort.Strings(unknown)
+	for _,base := range unknown {
+		s.files = append(s.files,&file{s.next,base,present[base]})
+		s.next++
+		s.dirty = true
+	}
+	
+	if s.dirty {
+		if err := s.save(); err!=nil { return nil,err }
+	}
+	return s,nil
+}
+
+func readdirnames(dir string) ([]string,error) {
+	f,err := os.Open(dir)
+	if err!=nil { return nil,err }
+	defer f.Close()
+	names,err := f.Readdirnames(-1)
+	if err!=nil { return nil,err }
+	list := names[:0]
+	for _,n := range names {
+		if !strings.HasPrefix(n,".") { list = append(list,n) }
+	}
+	return list,nil
+}
+
+/*
+Reads the UID list. The first line holds UIDVALIDITY and the next UID, each other line the UID
+and base name of a message, ordered by UID. If there is none, a new UIDVALIDITY is chosen.
+*/
+func (s *store) loadUidlist() ([]*file,error) {
+	data,err := ioutil.ReadFile(filepath.Join(s.dir,uidlistFile))
+	if os.IsNotExist(err) {
+		s.validity = uint32(time.Now().Unix())
+		s.next = 1
+		s.dirty = true
+		return nil,nil
+	} else if err!=nil {
+		return nil,err
+	}
+	
+	var files []*file
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for first := true; sc.Scan(); first = false {
+		fields := strings.Fields(sc.Text())
+		if len(fields)!=2 { return nil,fmt.Errorf("maildir: broken %s in %s",uidlistFile,s.dir) }
+		a,err := strconv.ParseUint(fields[0],10,32)
+		if err!=nil { return nil,err }
+		if first {
+			b,err := strconv.ParseUint(fields[1],10,32)
+			if err!=nil { return nil,err }
+			s.validity,s.next = uint32(a),uint32(b)
+			continue
+		}
+		files = append(files,&file{uid: uint32(a), base: fields[1]})
+	}
+	return files,sc.Err()
+}
+
+func (s *store) save() error {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf,"%d %d\n",s.validity,s.next)
+	for _,f := range s.files { fmt.Fprintf(buf,"%d %s\n",f.uid,f.base) }
+	s.dirty = false
+	return writeFile(filepath.Join(s.dir,uidlistFile),buf.Bytes())
+}
+
+func (s *store) loadKeywords() error {
+	data,err := ioutil.ReadFile(filepath.Join(s.dir,keywordsFile))
+	if os.IsNotExist(err) { return nil }
+	if err!=nil { return err }
+	s.keywords = strings.Fields(string(data))
+	return nil
+}
+
+func (s *store) saveKeywords() error {
+	return writeFile(filepath.Join(s.dir,keywordsFile),[]byte(strings.Join(s.keywords,"\n")+"\n"))
+}
+
+/* Replaces the file atomically. */
+func writeFile(name string, data []byte) error {
+	tmp := name+".tmp"
+	if err := ioutil.WriteFile(tmp,data,0600); err!=nil { return err }
+	return os.Rename(tmp,name)
+}
+
+var deliveries uint64
+
+/* Returns a new unique base name, as described in the Maildir specification. */
+func uniqueName() string {
+	host,err := os.Hostname()
+	if err!=nil { host = "localhost" }
+	host = strings.NewReplacer("/","\\057",":","\\072").Replace(host)
+	now := time.Now()
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s",now.Unix(),now.Nanosecond()/1000,os.Getpid(),atomic.AddUint64(&deliveries,1),host)
+}
+
+/*
+Adds a message to the Maildir. It is written to tmp, and moved to cur when complete; the
+modification time is the INTERNALDATE. If link is set, data is ignored and the file link is
+hard linked (or copied, if that fails) instead.
+*/
+func (s *store) add(data []byte, link string, flags []string, date time.Time) (*file,error) {
+	info,err := s.info(flags)
+	if err!=nil { return nil,err }
+	f := &file{s.next,uniqueName(),info}
+	
+	tmp := filepath.Join(s.dir,"tmp",f.base)
+	if link=="" || os.Link(link,tmp)!=nil {
+		if link!="" {
+			if data,err = ioutil.ReadFile(link); err!=nil { return nil,err }
+		}
+		if err = writeSync(tmp,data); err!=nil { return nil,err }
+	}
+	if err = os.Chtimes(tmp,date,date); err==nil { err = os.Rename(tmp,s.path(f)) }
+	if err!=nil {
+		os.Remove(tmp)
+		return nil,err
+	}
+	
+	s.next++
+	s.files = append(s.files,f)
+	return f,s.save()
+}
+
+func writeSync(name string, data []byte) error {
+	fd,err := os.OpenFile(name,os.O_WRONLY|os.O_CREATE|os.O_EXCL,0600)
+	if err!=nil { return err }
+	_,err = fd.Write(data)
+	if err==nil { err = fd.Sync() }
+	if e := fd.Close(); err==nil { err = e }
+	if err!=nil { os.Remove(name) }
+	return err
+}
+
+/* Reads the message, normalizing bare LF line endings of messages delivered by others. */
+func (s *store) read(f *file) ([]byte,os.FileInfo,error) {
+	name := s.path(f)
+	data,err := ioutil.ReadFile(name)
+	if err!=nil { return nil,nil,err }
+	fi,err := os.Stat(name)
+	if err!=nil { return nil,nil,err }
+	if bytes.Count(data,[]byte("\n"))!=bytes.Count(data,[]byte("\r\n")) {
+		data = bytes.ReplaceAll(bytes.ReplaceAll(data,[]byte("\r\n"),[]byte("\n")),[]byte("\n"),[]byte("\r\n"))
+	}
+	return data,fi,nil
+}
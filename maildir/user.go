@@ -0,0 +1,196 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package maildir
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+const Delimiter = "/"
+
+const subscriptionsFile = "subscriptions"
+
+var errInvalidName = errors.New("maildir: invalid mailbox name")
+
+/* '.' separates the levels of Maildir++ directory names, so it is escaped like '%'. */
+var nameEscaper = strings.NewReplacer("%","%25",".","%2E")
+var nameUnescaper = strings.NewReplacer("%25","%","%2E",".","%2e",".")
+
+/* Returns the directory name of the mailbox name, or "" for INBOX. */
+func dirName(name string) (string,error) {
+	if strings.EqualFold(name,"INBOX") { return "",nil }
+	parts := strings.Split(name,Delimiter)
+	for i,p := range parts {
+		if p=="" || strings.ContainsAny(p,"\x00\\") { return "",errInvalidName }
+		parts[i] = nameEscaper.Replace(p)
+	}
+	return "."+strings.Join(parts,"."),nil
+}
+
+func mailboxName(dirname string) string {
+	parts := strings.Split(dirname[1:],".")
+	for i,p := range parts { parts[i] = nameUnescaper.Replace(p) }
+	return strings.Join(parts,Delimiter)
+}
+
+type user struct {
+	be *Backend
+	username string
+	dir string
+}
+
+func (u *user) Username() string {
+	return u.username
+}
+
+func (u *user) mailbox(name string) (*mailbox,error) {
+	dn,err := dirName(name)
+	if err!=nil { return nil,err }
+	if dn=="" { name = "INBOX" }
+	return &mailbox{u,name,filepath.Join(u.dir,dn)},nil
+}
+
+func (u *user) subscriptions() (map[string]bool,error) {
+	data,err := ioutil.ReadFile(filepath.Join(u.dir,subscriptionsFile))
+	if err!=nil && !os.IsNotExist(err) { return nil,err }
+	subs := make(map[string]bool)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		if l := sc.Text(); l!="" { subs[l] = true }
+	}
+	return subs,sc.Err()
+}
+
+func (u *user) setSubscribed(name string, subscribed bool) error {
+	l := u.be.lock(u.dir)
+	l.Lock()
+	defer l.Unlock()
+	
+	subs,err := u.subscriptions()
+	if err!=nil { return err }
+	if subscribed { subs[name] = true } else { delete(subs,name) }
+	list := make([]string,0,len(subs))
+	for n := range subs { list = append(list,n+"\n") }
+	sort.Strings(list)
+	return writeFile(filepath.Join(u.dir,subscriptionsFile),[]byte(strings.Join(list,"")))
+}
+
+func (u *user) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	var subs map[string]bool
+	if subscribed {
+		var err error
+		if subs,err = u.subscriptions(); err!=nil { return nil,err }
+	}
+	
+	list := []string{"INBOX"}
+	entries,err := ioutil.ReadDir(u.dir)
+	if err!=nil { return nil,err }
+	for _,fi := range entries {
+		if !fi.IsDir() || !strings.HasPrefix(fi.Name(),".") || fi.Name()=="." || fi.Name()==".." { continue }
+		list = append(list,mailboxName(fi.Name()))
+	}
+	
+	var mailboxes []backend.Mailbox
+	for _,name := range list {
+		if subscribed && !subs[name] { continue }
+		m,err := u.mailbox(name)
+		if err!=nil { continue }
+		mailboxes = append(mailboxes,m)
+	}
+	return mailboxes,nil
+}
+
+func (u *user) GetMailbox(name string) (backend.Mailbox, error) {
+	m,err := u.mailbox(name)
+	if err!=nil { return nil,err }
+	if fi,err := os.Stat(filepath.Join(m.dir,"cur")); err!=nil || !fi.IsDir() { return nil,backend.ErrNoSuchMailbox }
+	return m,nil
+}
+
+func (u *user) CreateMailbox(name string) error {
+	m,err := u.mailbox(name)
+	if err!=nil { return err }
+	if _,err := os.Stat(m.dir); err==nil { return backend.ErrMailboxAlreadyExists }
+	return makeMaildir(m.dir)
+}
+
+func (u *user) DeleteMailbox(name string) error {
+	m,err := u.mailbox(name)
+	if err!=nil { return err }
+	if m.dir==u.dir { return errors.New("maildir: can't delete INBOX") }
+	if _,err := os.Stat(m.dir); err!=nil { return backend.ErrNoSuchMailbox }
+	
+	l := u.be.lock(m.dir)
+	l.Lock()
+	defer l.Unlock()
+	u.setSubscribed(m.name,false)
+	return os.RemoveAll(m.dir)
+}
+
+/* Renames the mailbox and all it's children. INBOX can't be renamed. */
+func (u *user) RenameMailbox(existingName, newName string) error {
+	from,err := u.mailbox(existingName)
+	if err!=nil { return err }
+	to,err := u.mailbox(newName)
+	if err!=nil { return err }
+	if from.dir==u.dir || to.dir==u.dir { return errors.New("maildir: can't rename INBOX") }
+	if _,err := os.Stat(from.dir); err!=nil { return backend.ErrNoSuchMailbox }
+	if _,err := os.Stat(to.dir); err==nil { return backend.ErrMailboxAlreadyExists }
+	
+	entries,err := ioutil.ReadDir(u.dir)
+	if err!=nil { return err }
+	prefix := filepath.Base(from.dir)
+	for _,fi := range entries {
+		n := fi.Name()
+		if n!=prefix && !strings.HasPrefix(n,prefix+".") { continue }
+		if err := os.Rename(filepath.Join(u.dir,n),filepath.Join(u.dir,filepath.Base(to.dir)+n[len(prefix):])); err!=nil { return err }
+	}
+	return nil
+}
+
+func (u *user) Logout() error {
+	return nil
+}
+
+/* SPECIAL-USE attributes (RFC 6154) of the top level mailboxes with the usual names. */
+var specialUse = map[string]string{
+	"archive": imap.ArchiveAttr,
+	"drafts": imap.DraftsAttr,
+	"junk": imap.JunkAttr,
+	"spam": imap.JunkAttr,
+	"sent": imap.SentAttr,
+	"trash": imap.TrashAttr,
+}
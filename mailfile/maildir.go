@@ -0,0 +1,160 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package mailfile
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+	
+	"github.com/emersion/go-imap"
+)
+
+/* The flag letters of the Maildir info ":2,<letters>", in ASCII order as required. */
+var maildirFlags = []struct{
+	c byte
+	flag string
+}{
+	{'D',imap.DraftFlag},
+	{'F',imap.FlaggedFlag},
+	{'R',imap.AnsweredFlag},
+	{'S',imap.SeenFlag},
+	{'T',imap.DeletedFlag},
+}
+
+func parseMaildirInfo(name string) (flags []string) {
+	i := strings.LastIndex(name,":2,")
+	if i<0 { return nil }
+	for _,c := range []byte(name[i+3:]) {
+		for _,f := range maildirFlags {
+			if f.c==c { flags = append(flags,f.flag) }
+		}
+	}
+	return
+}
+
+func formatMaildirInfo(flags []string) string {
+	info := ":2,"
+	for _,f := range maildirFlags {
+		for _,g := range flags {
+			if g==f.flag { info += string(f.c); break }
+		}
+	}
+	return info
+}
+
+type maildirReader struct {
+	files []string
+}
+
+/*
+Reads the messages in cur and new of a Maildir. The flags are taken from the file names,
+keywords are not supported. The date is the modification time of the file, like Dovecot does.
+*/
+func OpenMaildir(dir string) (Reader,error) {
+	r := new(maildirReader)
+	for _,sub := range []string{"cur","new"} {
+		f,err := os.Open(filepath.Join(dir,sub))
+		if err!=nil { return nil,err }
+		names,err := f.Readdirnames(-1)
+		f.Close()
+		if err!=nil { return nil,err }
+		
+		/* The names start with the delivery time, so this is about the order of arrival. */
+		sort.Strings(names)
+		for _,n := range names {
+			if strings.HasPrefix(n,".") { continue }
+			r.files = append(r.files,filepath.Join(dir,sub,n))
+		}
+	}
+	return r,nil
+}
+
+func (r *maildirReader) Next() (*Message,error) {
+	if len(r.files)==0 { return nil,io.EOF }
+	name := r.files[0]
+	r.files = r.files[1:]
+	
+	data,err := ioutil.ReadFile(name)
+	if err!=nil { return nil,err }
+	fi,err := os.Stat(name)
+	if err!=nil { return nil,err }
+	m := &Message{Date: fi.ModTime(), Body: toCRLF(data)}
+	if filepath.Base(filepath.Dir(name))=="cur" { m.Flags = parseMaildirInfo(filepath.Base(name)) }
+	return m,nil
+}
+
+func toCRLF(data []byte) []byte {
+	data = bytes.ReplaceAll(data,[]byte("\r\n"),[]byte("\n"))
+	return bytes.ReplaceAll(data,[]byte("\n"),[]byte("\r\n"))
+}
+
+type maildirWriter struct {
+	dir string
+	host string
+	seq uint64
+}
+
+/*
+Creates a Maildir (if it doesn't exist yet) and writes the messages to it's cur directory,
+with LF line endings. The modification time of each file is set to the message date.
+*/
+func CreateMaildir(dir string) (Writer,error) {
+	for _,sub := range []string{"tmp","new","cur"} {
+		if err := os.MkdirAll(filepath.Join(dir,sub),0700); err!=nil { return nil,err }
+	}
+	host,err := os.Hostname()
+	if err!=nil { host = "localhost" }
+	/* '/' and ':' would break the file name. */
+	host = strings.NewReplacer("/","\\057",":","\\072").Replace(host)
+	return &maildirWriter{dir: dir, host: host},nil
+}
+
+func (w *maildirWriter) Write(m *Message) error {
+	date := m.Date
+	if date.IsZero() { date = time.Now() }
+	now := time.Now()
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s",now.Unix(),now.Nanosecond()/1000,os.Getpid(),atomic.AddUint64(&w.seq,1),w.host)
+	
+	tmp := filepath.Join(w.dir,"tmp",name)
+	f,err := os.OpenFile(tmp,os.O_WRONLY|os.O_CREATE|os.O_EXCL,0600)
+	if err!=nil { return err }
+	_,err = f.Write(bytes.ReplaceAll(m.Body,[]byte("\r\n"),[]byte("\n")))
+	if err==nil { err = f.Sync() }
+	if e := f.Close(); err==nil { err = e }
+	if err==nil { err = os.Chtimes(tmp,date,date) }
+	if err==nil { err = os.Rename(tmp,filepath.Join(w.dir,"cur",name+formatMaildirInfo(m.Flags))) }
+	if err!=nil { os.Remove(tmp) }
+	return err
+}
+
+func (w *maildirWriter) Close() error { return nil }
@@ -0,0 +1,182 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+/*
+Reads and writes mbox files and Maildirs, and imports them into or exports them from a go-imap
+mailbox. Messages can be encrypted or decrypted on the way, in any of the formats of the format
+package, so mail can be encrypted without going through IMAP APPEND of a gateway:
+
+	r,_ := mailfile.OpenMaildir("Maildir/.Archive")
+	n,err := mailfile.Import(mbox, r, mailfile.Encrypt(&format.Target{Format: format.Ngcrypt, To: keys}))
+
+Flags and dates (INTERNALDATE) are preserved.
+*/
+package mailfile
+
+import (
+	"bytes"
+	"io"
+	"time"
+	
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"golang.org/x/crypto/openpgp"
+	
+	"github.com/mad-day/gaw-mail/format"
+)
+
+/* A message and it's IMAP flags and INTERNALDATE. */
+type Message struct {
+	Flags []string
+	Date time.Time
+	
+	/* The RFC822 message, with CRLF line endings. */
+	Body []byte
+}
+
+/* A source of messages. Next returns io.EOF after the last message. */
+type Reader interface {
+	Next() (*Message,error)
+}
+
+type Writer interface {
+	Write(m *Message) error
+	Close() error
+}
+
+/* Changes a message on it's way, e.g. encrypts it. */
+type Filter func(m *Message) error
+
+/*
+Encrypts the messages as described by t. Messages, that are already encrypted, are left alone.
+*/
+func Encrypt(t *format.Target) Filter {
+	return func(m *Message) error {
+		if format.Detect(m.Body)!=format.Plain { return nil }
+		buf := new(bytes.Buffer)
+		if err := t.Encrypt(buf,m.Body); err!=nil { return err }
+		m.Body = buf.Bytes()
+		return nil
+	}
+}
+
+/* Decrypts the messages, whatever their format is. */
+func Decrypt(kr openpgp.KeyRing) Filter {
+	return func(m *Message) error {
+		buf := new(bytes.Buffer)
+		if _,err := format.Decrypt(buf,m.Body,kr); err!=nil { return err }
+		m.Body = buf.Bytes()
+		return nil
+	}
+}
+
+/* Copies all messages from r to w, through f (which may be nil). w is not closed. */
+func Copy(w Writer, r Reader, f Filter) (n int, err error) {
+	for {
+		var m *Message
+		if m,err = r.Next(); err==io.EOF {
+			return n,nil
+		} else if err!=nil {
+			return
+		}
+		if f!=nil {
+			if err = f(m); err!=nil { return }
+		}
+		if err = w.Write(m); err!=nil { return }
+		n++
+	}
+}
+
+/* Flags, that can't be set by APPEND, or make no sense outside a session. */
+func storableFlags(flags []string) []string {
+	out := make([]string,0,len(flags))
+	for _,f := range flags {
+		if f==imap.RecentFlag { continue }
+		out = append(out,f)
+	}
+	return out
+}
+
+/*
+Appends all messages from r to the mailbox, through f (which may be nil). mbox should belong
+to the storage backend and not to a gateway, otherwise the gateway encrypts the messages again.
+*/
+func Import(mbox backend.Mailbox, r Reader, f Filter) (n int, err error) {
+	for {
+		var m *Message
+		if m,err = r.Next(); err==io.EOF {
+			return n,nil
+		} else if err!=nil {
+			return
+		}
+		if f!=nil {
+			if err = f(m); err!=nil { return }
+		}
+		date := m.Date
+		if date.IsZero() { date = time.Now() }
+		if err = mbox.CreateMessage(storableFlags(m.Flags),date,bytes.NewBuffer(m.Body)); err!=nil { return }
+		n++
+	}
+}
+
+var exportItems = []imap.FetchItem{
+	imap.FetchUid,
+	imap.FetchFlags,
+	imap.FetchInternalDate,
+	(&imap.BodySectionName{Peek: true}).FetchItem(),
+}
+
+/*
+Writes all messages of the mailbox to w, through f (which may be nil). w is not closed.
+The messages are written while they are fetched, so f must not use the backend.
+*/
+func Export(w Writer, mbox backend.Mailbox, f Filter) (n int, err error) {
+	seq := new(imap.SeqSet)
+	seq.AddRange(1,0)
+	ch := make(chan *imap.Message,16)
+	done := make(chan error,1)
+	go func() { done <- mbox.ListMessages(true,seq,exportItems,ch) }()
+	
+	/* On error, the channel is drained anyway, so ListMessages can finish. */
+	for msg := range ch {
+		if err!=nil { continue }
+		var body []byte
+		for s,l := range msg.Body {
+			if s.Specifier!=imap.EntireSpecifier || len(s.Path)!=0 || l==nil { continue }
+			buf := new(bytes.Buffer)
+			if _,err = buf.ReadFrom(l); err!=nil { break }
+			body = buf.Bytes()
+		}
+		if err!=nil || body==nil { continue }
+		
+		m := &Message{Flags: storableFlags(msg.Flags), Date: msg.InternalDate, Body: body}
+		if f!=nil {
+			if err = f(m); err!=nil { continue }
+		}
+		if err = w.Write(m); err!=nil { continue }
+		n++
+	}
+	if e := <-done; err==nil { err = e }
+	return
+}
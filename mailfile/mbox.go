@@ -0,0 +1,217 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package mailfile
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"time"
+	
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+)
+
+/* Status letters of mbox files, as written by mutt and understood by most other clients. */
+var statusFlags = map[byte]string{
+	'R': imap.SeenFlag,
+}
+var xstatusFlags = map[byte]string{
+	'A': imap.AnsweredFlag,
+	'F': imap.FlaggedFlag,
+	'T': imap.DraftFlag,
+	'D': imap.DeletedFlag,
+}
+
+/* The date formats of From_ lines. Some writers add a time zone before or after the year. */
+var fromDateLayouts = []string{
+	time.ANSIC,
+	"Mon Jan _2 15:04:05 2006 -0700",
+	"Mon Jan _2 15:04:05 MST 2006",
+	"Mon Jan _2 15:04 2006",
+}
+
+func parseFromLine(line string) time.Time {
+	f := strings.Fields(line)
+	if len(f)<3 { return time.Time{} }
+	s := strings.Join(f[2:]," ")
+	for _,l := range fromDateLayouts {
+		if t,err := time.Parse(l,s); err==nil { return t }
+	}
+	return time.Time{}
+}
+
+/* Lines like ">>From ", that need one level of quoting removed or added (mboxrd). */
+func isFromQuoted(line []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(line,">"),[]byte("From "))
+}
+
+type mboxReader struct {
+	br *bufio.Reader
+	next string
+	eof bool
+}
+
+/*
+Reads an mbox file. Quoted From_ lines are unquoted the mboxrd way. The flags are taken from
+the Status, X-Status and X-Keywords headers, which are removed, the date from the From_ line.
+*/
+func NewMboxReader(r io.Reader) Reader {
+	return &mboxReader{br: bufio.NewReader(r)}
+}
+
+func (r *mboxReader) readLine() ([]byte,error) {
+	line,err := r.br.ReadBytes('\n')
+	if err==io.EOF && len(line)>0 { err = nil }
+	return line,err
+}
+
+func (r *mboxReader) Next() (*Message,error) {
+	if r.eof { return nil,io.EOF }
+	
+	/* The From_ line of the first message. Anything before it is garbage. */
+	for r.next=="" {
+		line,err := r.readLine()
+		if err!=nil { r.eof = true; return nil,err }
+		if bytes.HasPrefix(line,[]byte("From ")) { r.next = string(line) }
+	}
+	m := &Message{Date: parseFromLine(r.next)}
+	r.next = ""
+	
+	buf := new(bytes.Buffer)
+	blank := false
+	for {
+		line,err := r.readLine()
+		if err==io.EOF {
+			r.eof = true
+			break
+		} else if err!=nil {
+			return nil,err
+		}
+		if blank && bytes.HasPrefix(line,[]byte("From ")) {
+			r.next = string(line)
+			break
+		}
+		line = bytes.TrimRight(line,"\r\n")
+		blank = len(line)==0
+		if isFromQuoted(line) && line[0]=='>' { line = line[1:] }
+		buf.Write(line)
+		buf.WriteString("\r\n")
+	}
+	
+	/* The blank line before the next From_ line is a separator. */
+	body := buf.Bytes()
+	if blank { body = body[:len(body)-2] }
+	return m,m.setBody(body)
+}
+
+/* Sets the body of a message read from an mbox and takes the flags from it's header. */
+func (m *Message) setBody(body []byte) error {
+	br := bufio.NewReader(bytes.NewReader(body))
+	h,err := textproto.ReadHeader(br)
+	if err!=nil { return err }
+	
+	for _,c := range []byte(h.Get("Status")) {
+		if f,ok := statusFlags[c]; ok { m.Flags = append(m.Flags,f) }
+	}
+	for _,c := range []byte(h.Get("X-Status")) {
+		if f,ok := xstatusFlags[c]; ok { m.Flags = append(m.Flags,f) }
+	}
+	for _,k := range strings.FieldsFunc(h.Get("X-Keywords"),func(r rune) bool { return r==',' || r==' ' }) {
+		m.Flags = append(m.Flags,k)
+	}
+	if !h.Has("Status") && !h.Has("X-Status") && !h.Has("X-Keywords") {
+		m.Body = body
+		return nil
+	}
+	h.Del("Status")
+	h.Del("X-Status")
+	h.Del("X-Keywords")
+	
+	buf := new(bytes.Buffer)
+	if err := textproto.WriteHeader(buf,h); err!=nil { return err }
+	buf.ReadFrom(br)
+	m.Body = buf.Bytes()
+	return nil
+}
+
+type mboxWriter struct {
+	w *bufio.Writer
+	c io.Closer
+}
+
+/*
+Writes an mbox file (mboxrd), with LF line endings. The flags are written to the Status,
+X-Status and X-Keywords headers. If w is an io.Closer, Close closes it.
+*/
+func NewMboxWriter(w io.Writer) Writer {
+	c,_ := w.(io.Closer)
+	return &mboxWriter{bufio.NewWriter(w),c}
+}
+
+func (w *mboxWriter) Write(m *Message) error {
+	date := m.Date
+	if date.IsZero() { date = time.Now() }
+	w.w.WriteString("From MAILER-DAEMON "+date.UTC().Format(time.ANSIC)+"\n")
+	
+	var status,xstatus,keywords []string
+	for _,f := range m.Flags {
+		switch f {
+		case imap.SeenFlag: status = append(status,"R")
+		case imap.AnsweredFlag: xstatus = append(xstatus,"A")
+		case imap.FlaggedFlag: xstatus = append(xstatus,"F")
+		case imap.DraftFlag: xstatus = append(xstatus,"T")
+		case imap.DeletedFlag: xstatus = append(xstatus,"D")
+		case imap.RecentFlag:
+		default:
+			if !strings.HasPrefix(f,"\\") { keywords = append(keywords,f) }
+		}
+	}
+	
+	/* The status headers go on top, the body is copied as it is. */
+	w.w.WriteString("Status: "+strings.Join(status,"")+"O\n")
+	if len(xstatus)!=0 { w.w.WriteString("X-Status: "+strings.Join(xstatus,"")+"\n") }
+	if len(keywords)!=0 { w.w.WriteString("X-Keywords: "+strings.Join(keywords,", ")+"\n") }
+	
+	body := bytes.NewReader(m.Body)
+	br := bufio.NewReader(body)
+	for {
+		line,err := br.ReadBytes('\n')
+		if len(line)==0 && err!=nil { break }
+		line = bytes.TrimRight(line,"\r\n")
+		if isFromQuoted(line) { w.w.WriteByte('>') }
+		w.w.Write(line)
+		w.w.WriteByte('\n')
+	}
+	w.w.WriteByte('\n')
+	return w.w.Flush()
+}
+
+func (w *mboxWriter) Close() error {
+	if err := w.w.Flush(); err!=nil { return err }
+	if w.c!=nil { return w.c.Close() }
+	return nil
+}
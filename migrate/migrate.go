@@ -0,0 +1,361 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+/*
+Re-encrypts the messages of a go-imap backend from one format into another.
+
+The Migrator walks the mailboxes of a backend.User (for example of the imap-proxy, or of any
+local backend), detects the format of each message, decrypts it and encrypts it into the target
+format. The new copy is appended with the original flags and INTERNALDATE, the original message is
+marked as \Deleted and finally expunged. The mailbox is not expunged, while other messages are
+flagged \Deleted, so those are never removed by a migration. Messages, that the user flagged
+\Deleted, are skipped until they are either expunged or no longer flagged.
+
+The user must be the one of the storage backend, and not of a decrypting gateway (like imap-ex or
+ngcrypt/imap), as the messages would otherwise be re-encrypted by the gateway.
+*/
+package migrate
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"time"
+	
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"golang.org/x/crypto/openpgp"
+	
+	"github.com/mad-day/gaw-mail/format"
+	"github.com/mad-day/gaw-mail/ngcrypt"
+	imapexpunge "github.com/mad-day/gaw-mail/util/imap-expunge"
+)
+
+type Migrator struct {
+	User backend.User
+	
+	/* The keyring used to decrypt the messages. */
+	Keys openpgp.EntityList
+	
+	/* The target format and keys. */
+	Target format.Target
+	
+	/*
+	If false, messages already in the target format are left alone.
+	If true, they are re-encrypted too (for example to change the recipient key).
+	*/
+	Force bool
+	
+	/*
+	If true, every encrypted message is re-encrypted into it's own format, and Target.Format
+	is ignored. Plain messages are left alone. See NewRotation.
+	*/
+	KeepFormat bool
+	
+	/*
+	Optional: If set, the appended copy of every re-encrypted message is fetched back,
+	decrypted using this keyring and compared to the plaintext, before the original is deleted.
+	It should contain the new keys only.
+	*/
+	Verify openpgp.KeyRing
+	
+	/* Optional: If set, the migration can be interrupted and resumed. */
+	Progress *Progress
+	
+	/* Optional: Receives a line for each message. */
+	Log *log.Logger
+}
+
+func (m *Migrator) logf(f string, args ...interface{}) {
+	if m.Log!=nil { m.Log.Printf(f,args...) }
+}
+
+func (m *Migrator) progress(name string) *MailboxProgress {
+	if m.Progress==nil { m.Progress = new(Progress) }
+	return m.Progress.Mailbox(name)
+}
+
+/*
+Migrates all mailboxes of the user.
+*/
+func (m *Migrator) MigrateAll() error {
+	mboxes,err := m.User.ListMailboxes(false)
+	if err!=nil { return err }
+	for _,mbox := range mboxes {
+		if err = m.MigrateMailbox(mbox.Name()); err!=nil { return err }
+	}
+	return nil
+}
+
+type msgInfo struct {
+	uid uint32
+	flags []string
+	date time.Time
+}
+
+func listMessages(mbox backend.Mailbox, seq *imap.SeqSet, items []imap.FetchItem) ([]*imap.Message,error) {
+	ch := make(chan *imap.Message,16)
+	done := make(chan error,1)
+	go func() { done <- mbox.ListMessages(true,seq,items,ch) }()
+	var msgs []*imap.Message
+	for msg := range ch { msgs = append(msgs,msg) }
+	return msgs,<-done
+}
+
+/*
+Migrates one mailbox.
+*/
+func (m *Migrator) MigrateMailbox(name string) error {
+	mbox,err := m.User.GetMailbox(name)
+	if err!=nil { return err }
+	
+	st,err := mbox.Status([]imap.StatusItem{imap.StatusUidValidity,imap.StatusUidNext})
+	if err!=nil { return err }
+	
+	mp := m.progress(name)
+	if mp.UidValidity!=st.UidValidity {
+		*mp = MailboxProgress{UidValidity: st.UidValidity, UidNext: st.UidNext}
+	}
+	if mp.Done {
+		m.logf("%s: already done",name)
+		return nil
+	}
+	
+	seq := new(imap.SeqSet)
+	if mp.Last+1<mp.UidNext { seq.AddRange(mp.Last+1,mp.UidNext-1) }
+	seq.AddNum(mp.Skipped...)
+	if seq.Empty() {
+		/* Nothing (left) to do */
+		return m.finish(name,mbox,mp)
+	}
+	
+	msgs,err := listMessages(mbox,seq,[]imap.FetchItem{imap.FetchUid,imap.FetchFlags,imap.FetchInternalDate})
+	if err!=nil { return err }
+	
+	skipped,present := new(imap.SeqSet),new(imap.SeqSet)
+	skipped.AddNum(mp.Skipped...)
+	infos := make([]msgInfo,0,len(msgs))
+	for _,msg := range msgs {
+		/* UID ranges are open ended on some servers. */
+		if (msg.Uid<=mp.Last && !skipped.Contains(msg.Uid)) || msg.Uid>=mp.UidNext { continue }
+		present.AddNum(msg.Uid)
+		infos = append(infos,msgInfo{msg.Uid,msg.Flags,msg.InternalDate})
+	}
+	sort.Slice(infos,func(i,j int) bool { return infos[i].uid<infos[j].uid })
+	
+	/* Skipped messages, that are gone, have been expunged by the user. */
+	mp.Skipped = filterUids(mp.Skipped,present.Contains)
+	
+	for _,info := range infos {
+		var reason string
+		if hasFlag(info.flags,imap.DeletedFlag) {
+			reason = "flagged \\Deleted"
+		} else {
+			deleted,err := m.migrateMessage(name,mbox,mp,info)
+			switch {
+			case err==errInlineParts:
+				reason = err.Error()
+			case err!=nil:
+				return fmt.Errorf("migrate: %s, UID %d: %v",name,info.uid,err)
+			default:
+				if deleted { mp.Deleted = append(mp.Deleted,info.uid) }
+				mp.Appending = nil
+				mp.Skipped = filterUids(mp.Skipped,func(uid uint32) bool { return uid!=info.uid })
+			}
+		}
+		if reason!="" && !skipped.Contains(info.uid) {
+			m.logf("%s: UID %d: skipped, %s",name,info.uid,reason)
+			mp.Skipped = append(mp.Skipped,info.uid)
+		}
+		if info.uid>mp.Last { mp.Last = info.uid }
+		if err = m.Progress.Save(); err!=nil { return err }
+	}
+	mp.Last = mp.UidNext-1
+	
+	return m.finish(name,mbox,mp)
+}
+
+func (m *Migrator) finish(name string, mbox backend.Mailbox, mp *MailboxProgress) error {
+	ok,err := imapexpunge.Only(mbox,mp.Deleted)
+	if err!=nil { return err }
+	if ok { mp.Deleted = nil }
+	if !ok || len(mp.Skipped)>0 {
+		/* Not done, the next run tries again. */
+		if !ok { m.logf("%s: not expunged, other messages are flagged \\Deleted",name) }
+		if len(mp.Skipped)>0 { m.logf("%s: not done, %d messages skipped",name,len(mp.Skipped)) }
+		return m.Progress.Save()
+	}
+	mp.Done = true
+	m.logf("%s: done",name)
+	return m.Progress.Save()
+}
+
+var sectionAll = &imap.BodySectionName{Peek: true}
+
+func (m *Migrator) fetch(mbox backend.Mailbox, uid uint32) ([]byte,error) {
+	seq := new(imap.SeqSet)
+	seq.AddNum(uid)
+	msgs,err := listMessages(mbox,seq,[]imap.FetchItem{imap.FetchUid,sectionAll.FetchItem()})
+	if err!=nil { return nil,err }
+	for _,msg := range msgs {
+		if msg.Uid!=uid { continue }
+		/* Backends differ in whether the key has Peek set. */
+		for s,l := range msg.Body {
+			if s.Specifier==imap.EntireSpecifier && len(s.Path)==0 && s.Fields==nil && l!=nil {
+				return ioutil.ReadAll(l)
+			}
+		}
+	}
+	return nil,fmt.Errorf("message disappeared")
+}
+
+/*
+Decrypts and re-encrypts a message. Returns nil (and no error), if the message needs no changes.
+The plain message and the target format are returned for the verification.
+*/
+func (m *Migrator) convert(name string, uid uint32, raw []byte) (out,plain []byte, f format.Format, err error) {
+	f = format.Detect(raw)
+	t := m.Target
+	if m.KeepFormat {
+		if f==format.Plain {
+			m.logf("%s: UID %d: not encrypted",name,uid)
+			return
+		}
+		t.Format = f
+		switch f {
+		case format.Inline:
+			if err = checkInline(raw); err!=nil { return }
+		case format.Ngcrypt:
+			if t.Options,err = ngcrypt.MessageOptions(bytes.NewReader(raw)); err!=nil { return }
+		}
+	} else if f==t.Format && !m.Force {
+		m.logf("%s: UID %d: already %v",name,uid,f)
+		return
+	}
+	
+	pb := new(bytes.Buffer)
+	if err = format.DecryptFormat(pb,raw,f,m.Keys); err!=nil { return }
+	
+	ob := new(bytes.Buffer)
+	if err = t.Encrypt(ob,pb.Bytes()); err!=nil { return }
+	
+	m.logf("%s: UID %d: %v -> %v",name,uid,f,t.Format)
+	return ob.Bytes(),pb.Bytes(),t.Format,nil
+}
+
+/* Hashes a message, ignoring the line endings, which servers may normalize. */
+func messageHash(msg []byte) string {
+	h := sha256.Sum256(bytes.Replace(msg,[]byte("\r\n"),[]byte("\n"),-1))
+	return hex.EncodeToString(h[:])
+}
+
+/*
+Looks up the copy, that has been appended to mbox, by it's hash among the messages from uidNext on,
+as other messages may have been delivered meanwhile. Returns nil, if it isn't there.
+*/
+func findAppended(mbox backend.Mailbox, uidNext uint32, hash string) ([]byte,error) {
+	seq := new(imap.SeqSet)
+	seq.AddRange(uidNext,0)
+	msgs,err := listMessages(mbox,seq,[]imap.FetchItem{imap.FetchUid,sectionAll.FetchItem()})
+	if err!=nil { return nil,err }
+	for _,msg := range msgs {
+		if msg.Uid<uidNext { continue }
+		for s,l := range msg.Body {
+			if s.Specifier!=imap.EntireSpecifier || len(s.Path)!=0 || l==nil { continue }
+			stored,err := ioutil.ReadAll(l)
+			if err!=nil { return nil,err }
+			if messageHash(stored)==hash { return stored,nil }
+		}
+	}
+	return nil,nil
+}
+
+/*
+Migrates a message. Returns true, if the original has been flagged \Deleted.
+
+The copy is recorded in mp.Appending, before it is appended. If the run is interrupted before the
+original has been flagged, the next run finds the copy and doesn't append another one.
+*/
+func (m *Migrator) migrateMessage(name string, mbox backend.Mailbox, mp *MailboxProgress, info msgInfo) (bool,error) {
+	raw,err := m.fetch(mbox,info.uid)
+	if err!=nil { return false,err }
+	
+	out,plain,f,err := m.convert(name,info.uid,raw)
+	if err!=nil || out==nil { return false,err }
+	
+	var stored []byte
+	if a := mp.Appending; a!=nil && a.Uid==info.uid {
+		if stored,err = findAppended(mbox,a.UidNext,a.Hash); err!=nil { return false,err }
+		if stored!=nil { m.logf("%s: UID %d: already appended",name,info.uid) }
+	}
+	if stored==nil {
+		st,err := mbox.Status([]imap.StatusItem{imap.StatusUidNext})
+		if err!=nil { return false,err }
+		mp.Appending = &Appending{info.uid,st.UidNext,messageHash(out)}
+		if err = m.Progress.Save(); err!=nil { return false,err }
+		
+		if err = mbox.CreateMessage(appendFlags(info.flags),info.date,bytes.NewBuffer(out)); err!=nil { return false,err }
+		if m.Verify!=nil {
+			if stored,err = findAppended(mbox,st.UidNext,mp.Appending.Hash); err!=nil { return false,err }
+			if stored==nil { return false,fmt.Errorf("verification failed: the appended copy was not found") }
+		}
+	}
+	if m.Verify!=nil {
+		if err = verify(stored,plain,f,m.Verify); err!=nil {
+			return false,fmt.Errorf("verification failed: %v",err)
+		}
+	}
+	
+	seq := new(imap.SeqSet)
+	seq.AddNum(info.uid)
+	return true,mbox.UpdateMessagesFlags(true,seq,imap.AddFlags,[]string{imap.DeletedFlag})
+}
+
+func filterUids(uids []uint32, keep func(uid uint32) bool) []uint32 {
+	var nu []uint32
+	for _,uid := range uids {
+		if keep(uid) { nu = append(nu,uid) }
+	}
+	return nu
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _,f := range flags {
+		if f==flag { return true }
+	}
+	return false
+}
+
+/* \Recent can't be set by clients. */
+func appendFlags(flags []string) []string {
+	nf := make([]string,0,len(flags))
+	for _,f := range flags {
+		if f==imap.RecentFlag { continue }
+		nf = append(nf,f)
+	}
+	return nf
+}
@@ -0,0 +1,138 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package migrate
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+/*
+The progress of one mailbox.
+*/
+type MailboxProgress struct {
+	/* The UIDVALIDITY of the mailbox. If it changes, the mailbox is started over. */
+	UidValidity uint32
+	
+	/* The UIDNEXT of the mailbox, when the migration started. Newer messages are not touched. */
+	UidNext uint32
+	
+	/* The highest UID, that has been processed. */
+	Last uint32
+	
+	/* The UIDs of the originals, that have been flagged \Deleted. Only these are expunged. */
+	Deleted []uint32 `json:",omitempty"`
+	
+	/*
+	The UIDs of the messages, that were skipped, because the user flagged them \Deleted. They
+	are looked at again by every run, until they are gone or have been migrated.
+	*/
+	Skipped []uint32 `json:",omitempty"`
+	
+	/* Set while a copy is appended. A resumed run looks for it, instead of appending another. */
+	Appending *Appending `json:",omitempty"`
+	
+	/* True, if the mailbox has been completed and expunged. */
+	Done bool
+}
+
+/*
+A copy, that is being appended.
+*/
+type Appending struct {
+	/* The UID of the original. */
+	Uid uint32
+	
+	/* The UIDNEXT of the mailbox before the copy was appended. */
+	UidNext uint32
+	
+	/* The SHA-256 of the copy, see messageHash. */
+	Hash string
+}
+
+/*
+Records the progress of a migration, so that an interrupted migration can be resumed.
+If Path is not empty, the progress is saved into that file after each message.
+*/
+type Progress struct {
+	Path string
+	Mailboxes map[string]*MailboxProgress
+	
+	mutex sync.Mutex
+}
+
+/*
+Loads the progress from the given file. A missing file yields an empty Progress.
+*/
+func LoadProgress(path string) (*Progress,error) {
+	p := &Progress{Path: path, Mailboxes: make(map[string]*MailboxProgress)}
+	if path=="" { return p,nil }
+	data,err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) { return p,nil }
+	if err!=nil { return nil,err }
+	if err = json.Unmarshal(data,&p.Mailboxes); err!=nil { return nil,err }
+	if p.Mailboxes==nil { p.Mailboxes = make(map[string]*MailboxProgress) }
+	return p,nil
+}
+
+/*
+Returns the progress of the given mailbox, creating it if necessary.
+*/
+func (p *Progress) Mailbox(name string) *MailboxProgress {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.Mailboxes==nil { p.Mailboxes = make(map[string]*MailboxProgress) }
+	mp := p.Mailboxes[name]
+	if mp==nil {
+		mp = new(MailboxProgress)
+		p.Mailboxes[name] = mp
+	}
+	return mp
+}
+
+/*
+Saves the progress into p.Path. The file is replaced atomically.
+*/
+func (p *Progress) Save() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.Path=="" { return nil }
+	data,err := json.MarshalIndent(p.Mailboxes,"","\t")
+	if err!=nil { return err }
+	tmp,err := ioutil.TempFile(filepath.Dir(p.Path),".progress")
+	if err!=nil { return err }
+	if _,err = tmp.Write(data); err!=nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err!=nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(),p.Path)
+}
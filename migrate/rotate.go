@@ -0,0 +1,125 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package migrate
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-message"
+	"golang.org/x/crypto/openpgp"
+	
+	"github.com/mad-day/gaw-mail/format"
+)
+
+/* Returned by convert for inline PGP messages, that have non-text parts. They are skipped. */
+var errInlineParts = errors.New("the non-text parts of inline PGP messages can't be re-encrypted")
+
+/*
+Inline PGP encrypts non-text parts in binary, keeping their Content-Type, and the decoder can't
+tell them from unencrypted attachments. They would stay encrypted to the old key.
+*/
+func checkInline(raw []byte) error {
+	e,err := message.Read(bytes.NewReader(raw))
+	if err!=nil && !message.IsUnknownCharset(err) { return err }
+	return e.Walk(func(path []int, p *message.Entity, err error) error {
+		if err!=nil && !message.IsUnknownCharset(err) { return err }
+		if p.MultipartReader()!=nil { return nil }
+		t,_,_ := p.Header.ContentType()
+		if t!="" && !strings.HasPrefix(strings.ToLower(t),"text/") { return errInlineParts }
+		return nil
+	})
+}
+
+/* Returns the decoded bodies of the leaf parts of msg, with LF line endings. */
+func leafBodies(msg []byte) ([][]byte,error) {
+	e,err := message.Read(bytes.NewReader(msg))
+	if err!=nil && !message.IsUnknownCharset(err) { return nil,err }
+	var bodies [][]byte
+	err = e.Walk(func(path []int, p *message.Entity, err error) error {
+		if err!=nil && !message.IsUnknownCharset(err) { return err }
+		if p.MultipartReader()!=nil { return nil }
+		b,err := ioutil.ReadAll(p.Body)
+		if err!=nil { return err }
+		bodies = append(bodies,bytes.Replace(b,[]byte("\r\n"),[]byte("\n"),-1))
+		return nil
+	})
+	return bodies,err
+}
+
+/*
+Checks, that the re-encrypted message out decrypts with kr to the plaintext plain.
+
+Every part is compared by it's decoded body, as the encoders re-serialize the headers. Some
+decoders pass parts, that they can't decrypt, through unchanged (inline PGP); these differ.
+*/
+func verify(out, plain []byte, f format.Format, kr openpgp.KeyRing) error {
+	if g := format.Detect(out); g!=f {
+		return fmt.Errorf("the message is %v instead of %v",g,f)
+	}
+	buf := new(bytes.Buffer)
+	if err := format.DecryptFormat(buf,out,f,kr); err!=nil { return err }
+	
+	got,err := leafBodies(buf.Bytes())
+	if err!=nil { return err }
+	want,err := leafBodies(plain)
+	if err!=nil { return err }
+	if len(got)!=len(want) {
+		return fmt.Errorf("the message has %d parts instead of %d",len(got),len(want))
+	}
+	for i := range got {
+		if !bytes.Equal(got[i],want[i]) { return fmt.Errorf("part %d differs",i+1) }
+	}
+	return nil
+}
+
+/*
+Creates a Migrator, that rotates the key of the user: Every encrypted message is decrypted using
+oldKeys, re-encrypted to newKeys (keeping it's format), and verified to decrypt with newKeys alone,
+before the original is deleted. If newKeys contains a private key, the messages are signed with it.
+NGCRYPT messages keep their compression and encoding (see ngcrypt.MessageOptions); their headers
+are cleaned using Target.Cleaner, which may be set afterwards.
+
+Inline PGP messages with non-text parts are skipped, as these parts would stay encrypted to the old
+key. The mailboxes holding them are not done.
+
+After the rotation, oldKeys is no longer needed to read the mailboxes.
+*/
+func NewRotation(u backend.User, oldKeys, newKeys openpgp.EntityList) *Migrator {
+	m := &Migrator{
+		User: u,
+		Keys: append(append(openpgp.EntityList{},oldKeys...),newKeys...),
+		KeepFormat: true,
+		Verify: newKeys,
+	}
+	m.Target.To = newKeys
+	for _,e := range newKeys {
+		if e.PrivateKey!=nil { m.Target.Signed = e; break }
+	}
+	return m
+}
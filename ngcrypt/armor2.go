@@ -28,6 +28,8 @@ import (
 	"io"
 	"bufio"
 	"compress/flate"
+	"fmt"
+	"strconv"
 	
 	"golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/openpgp/armor"
@@ -54,8 +56,35 @@ type wriClo struct {
 	stack
 }
 
-func encodeNgcrypt(out io.Writer, to []*openpgp.Entity, signed *openpgp.Entity, args map[string]string) (io.WriteCloser, error) {
-	aw, err := armor.Encode(out, ngcryptMessageType, args)
+/* Per-block encoding parameters. */
+type blockOptions struct {
+	c Compression
+	level int
+	binary bool
+	
+	/* The format version of the message, 0 means CurrentVersion. */
+	version int
+}
+
+func encodeNgcrypt(out io.Writer, to []*openpgp.Entity, signed *openpgp.Entity, args map[string]string, bo blockOptions) (io.WriteCloser, error) {
+	if args==nil { args = make(map[string]string) }
+	v := bo.version
+	if v==0 { v = CurrentVersion }
+	args[blockVersionHeader] = fmt.Sprint(v)
+	
+	/* Version 1 knows DEFLATE only and has no compression headers. */
+	if v>=Version2 {
+		args[compressionHeader] = bo.c.String()
+		if bo.level!=0 { args[compressionLevelHeader] = strconv.Itoa(bo.level) }
+	}
+	
+	var aw io.WriteCloser
+	var err error
+	if bo.binary {
+		aw, err = binaryEncode(out, args)
+	} else {
+		aw, err = armor.Encode(out, ngcryptMessageType, args)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -66,7 +95,7 @@ func encodeNgcrypt(out io.Writer, to []*openpgp.Entity, signed *openpgp.Entity,
 	}
 	ew2 := bufio.NewWriter(ew)
 	
-	cw,err := flate.NewWriter(ew2,1)
+	cw,err := compressWriter(ew2,bo.c,bo.level)
 	if err != nil {
 		return nil, err
 	}
@@ -79,10 +108,35 @@ func decodeNcrypt(in io.Reader, kr openpgp.KeyRing) (*openpgp.MessageDetails, er
 	return md,err
 }
 func decodeNcrypt2(in io.Reader, kr openpgp.KeyRing) (*openpgp.MessageDetails,map[string]string, error) {
-	block,err := armor.Decode(in)
+	body,hdr,err := openBlock(in)
 	if err!=nil { return nil,nil,err }
 	
-	dr,err := decrypt(block.Body,kr)
+	v,err := parseVersion(hdr[blockVersionHeader])
+	if err!=nil { return nil,hdr,err }
+	
+	dec,ok := blockDecoders[v]
+	if !ok { return nil,hdr,UnsupportedVersionError(v) }
+	
+	dr,err := dec(body,hdr,kr)
+	
+	return dr,hdr,err
+}
+
+/*
+Decodes the de-armored body of an NGCRYPT BLOCK.
+*/
+type blockDecoder func(body io.Reader, hdr map[string]string, kr openpgp.KeyRing) (*openpgp.MessageDetails, error)
+
+/* One decoder per format version. */
+var blockDecoders = map[int]blockDecoder{
+	Version1: decodeBlockV1,
+	Version2: decodeBlockV2,
+	Version3: decodeBlockV2, /* Version 3 only adds binary blocks. */
+	Version4: decodeBlockV2, /* Version 4 only changes the message layout. */
+}
+
+func decodeBlockV1(body io.Reader, hdr map[string]string, kr openpgp.KeyRing) (*openpgp.MessageDetails, error) {
+	dr,err := decrypt(body,kr)
 	
 	if err == nil {
 		/* If no error, decompress the body. */
@@ -91,5 +145,16 @@ func decodeNcrypt2(in io.Reader, kr openpgp.KeyRing) (*openpgp.MessageDetails,ma
 		dr.UnverifiedBody = uc
 	}
 	
-	return dr,block.Header,err
+	return dr,err
+}
+
+func decodeBlockV2(body io.Reader, hdr map[string]string, kr openpgp.KeyRing) (*openpgp.MessageDetails, error) {
+	dr,err := decrypt(body,kr)
+	
+	if err == nil {
+		/* If no error, decompress the body using the declared algorithm. */
+		dr.UnverifiedBody,err = decompressReader(dr.UnverifiedBody,hdr[compressionHeader])
+	}
+	
+	return dr,err
 }
@@ -0,0 +1,144 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package ngcrypt
+
+import (
+	"io"
+	"fmt"
+	"sort"
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	
+	"github.com/emersion/go-message/textproto"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+/*
+Binary NGCRYPT BLOCKs (see SPEC.md, Version 3) are stored in application/octet-stream parts.
+
+The payload of such a part is a header, in the same syntax as a RFC822 header, followed by the
+raw OpenPGP packets. The header contains the same fields, the ASCII Armor would carry, and it
+always starts with the Ngcrypt-Version field, so that blocks can be told apart.
+*/
+var binaryPrefix = []byte(blockVersionHeader+":")
+
+type binaryWriter struct {
+	io.Writer
+}
+func (binaryWriter) Close() error { return nil }
+
+func binaryEncode(out io.Writer, args map[string]string) (io.WriteCloser, error) {
+	keys := make([]string,0,len(args))
+	for k := range args {
+		if k==blockVersionHeader { continue }
+		keys = append(keys,k)
+	}
+	sort.Strings(keys)
+	
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf,"%s: %s\r\n",blockVersionHeader,args[blockVersionHeader])
+	for _,k := range keys {
+		fmt.Fprintf(buf,"%s: %s\r\n",k,args[k])
+	}
+	buf.WriteString("\r\n")
+	
+	if _,err := buf.WriteTo(out); err!=nil { return nil,err }
+	
+	return binaryWriter{out},nil
+}
+
+/* Strips all whitespace (line breaks) from a base64 stream. */
+type b64cleaner struct {
+	io.Reader
+}
+func (r b64cleaner) Read(b []byte) (n int, err error) {
+	for n==0 && err==nil {
+		var i int
+		i,err = r.Reader.Read(b)
+		for _,c := range b[:i] {
+			switch c {
+			case ' ','\t','\r','\n': continue
+			}
+			b[n] = c
+			n++
+		}
+	}
+	return
+}
+
+/*
+Opens an NGCRYPT BLOCK, that is either
+	- ASCII Armored,
+	- binary, or
+	- binary, but still Base64 encoded (as fetched from the IMAP-Server with BODY[n]).
+
+Returns the OpenPGP packets and the block header.
+*/
+func openBlock(in io.Reader) (io.Reader, map[string]string, error) {
+	return openBlock2(in,true)
+}
+
+/*
+Opens an NGCRYPT BLOCK in any encoding, without decrypting it. The OpenPGP message, that is
+returned, can be inspected for it's recipients; it's literal data is compressed as declared in the
+block header.
+*/
+func OpenBlock(in io.Reader) (io.Reader, map[string]string, error) {
+	return openBlock(in)
+}
+func openBlock2(in io.Reader, b64 bool) (io.Reader, map[string]string, error) {
+	br := bufio.NewReader(in)
+	
+	/* Skip leading whitespace. */
+	for {
+		c,err := br.ReadByte()
+		if err!=nil { return nil,nil,err }
+		switch c {
+		case ' ','\t','\r','\n': continue
+		}
+		br.UnreadByte()
+		break
+	}
+	
+	if p,_ := br.Peek(len(tagprefix)); bytes.Equal(p,tagprefix) {
+		block,err := armor.Decode(br)
+		if err!=nil { return nil,nil,err }
+		return block.Body,block.Header,nil
+	}
+	
+	if p,_ := br.Peek(len(binaryPrefix)); bytes.Equal(p,binaryPrefix) {
+		h,err := textproto.ReadHeader(br)
+		if err!=nil { return nil,nil,err }
+		hdr := make(map[string]string)
+		for f := h.Fields(); f.Next(); {
+			hdr[f.Key()] = f.Value()
+		}
+		return br,hdr,nil
+	}
+	
+	if !b64 { return nil,nil,fmt.Errorf("ngcrypt: not an NGCRYPT BLOCK") }
+	
+	return openBlock2(base64.NewDecoder(base64.StdEncoding,b64cleaner{br}),false)
+}
@@ -0,0 +1,217 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package ngcrypt
+
+import (
+	"fmt"
+	"strings"
+	"net/mail"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	
+	"github.com/emersion/go-message"
+)
+
+/*
+Header fields, commonly kept together. A field name ending with "*" matches all fields
+with that prefix.
+*/
+var (
+	DateFields = []string{"Date"}
+	ThreadingFields = []string{"Message-Id","In-Reply-To","References"}
+	ListFields = []string{"List-*"}
+	AddressFields = []string{"From","Sender","To","Cc","Bcc","Reply-To"}
+)
+
+/* The placeholder, Radical and Placeholders set in place of addresses. */
+const unknownAddress = "Unknown <unknown@none>"
+
+func matchField(patterns []string, key string) bool {
+	key = strings.ToLower(key)
+	for _,p := range patterns {
+		p = strings.ToLower(p)
+		if strings.HasSuffix(p,"*") {
+			if strings.HasPrefix(key,p[:len(p)-1]) { return true }
+		} else if key==p {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Applies all given cleaners in order.
+*/
+func Chain(cs ...Cleaner) Cleaner {
+	return func(h *message.Header) {
+		for _,c := range cs {
+			if c!=nil { c(h) }
+		}
+	}
+}
+
+/*
+Deletes all header fields, except the listed ones (and MIME-Version).
+*/
+func Allowlist(fields ...string) Cleaner {
+	fields = append([]string{"Mime-Version"},fields...)
+	return func(h *message.Header) {
+		for i := h.Fields(); i.Next(); {
+			if !matchField(fields,i.Key()) { i.Del() }
+		}
+	}
+}
+
+/*
+Deletes the listed header fields.
+*/
+func Denylist(fields ...string) Cleaner {
+	return func(h *message.Header) {
+		for i := h.Fields(); i.Next(); {
+			if matchField(fields,i.Key()) { i.Del() }
+		}
+	}
+}
+
+/*
+Sets Subject, From and To to placeholder values, if they are missing. Some servers and
+clients don't cope with messages lacking those fields.
+*/
+func Placeholders(h *message.Header) {
+	if !h.Has("Subject") { h.Set("Subject","(Deleted)") }
+	if !h.Has("From") { h.Set("From",unknownAddress) }
+	if !h.Has("To") { h.Set("To",unknownAddress) }
+}
+
+/*
+Replaces every address in the address fields (see AddressFields) by a pseudonym, that is
+derived from the address using HMAC-SHA256 with the given key. The same address always
+yields the same pseudonym, so the server can still group and filter messages by
+correspondent, without learning the addresses. Display names are dropped.
+
+Fields, that can't be parsed, are deleted.
+*/
+func HashAddresses(key []byte) Cleaner {
+	pseudonym := func(addr string) string {
+		m := hmac.New(sha256.New,key)
+		m.Write([]byte(strings.ToLower(addr)))
+		return hex.EncodeToString(m.Sum(nil)[:10])+"@hashed.invalid"
+	}
+	return func(h *message.Header) {
+		for _,k := range AddressFields {
+			/* A field may occur more than once, each is hashed on it's own. */
+			var vals []string
+			for f := h.FieldsByKey(k); f.Next(); { vals = append(vals,f.Value()) }
+			h.Del(k)
+			for _,v := range vals {
+				l,err := mail.ParseAddressList(v)
+				if err!=nil || len(l)==0 { continue }
+				s := make([]string,len(l))
+				for i,a := range l { s[i] = "<"+pseudonym(a.Address)+">" }
+				h.Add(k,strings.Join(s,", "))
+			}
+		}
+	}
+}
+
+/*
+A configurable header cleaning policy. The zero value deletes everything except MIME-Version,
+and sets placeholders for Subject, From and To.
+*/
+type CleanerConfig struct {
+	/* Keep the Date field. */
+	KeepDate bool
+	
+	/* Keep Message-ID, In-Reply-To and References, so that the server can thread messages. */
+	KeepThreading bool
+	
+	/* Keep the List-* fields, so that server-side filters on mailing lists keep working. */
+	KeepList bool
+	
+	/* Keep the address fields, but replace the addresses by pseudonyms (see HashAddresses). */
+	HashAddresses bool
+	
+	/* The key for HashAddresses. Required, if HashAddresses is set. */
+	HashKey []byte
+	
+	/* Additional fields to keep. A name ending with "*" matches a prefix. */
+	Allow []string
+}
+
+/*
+Parses a comma separated list of options into a CleanerConfig.
+
+	date             KeepDate
+	threading        KeepThreading
+	list             KeepList
+	hash-addresses   HashAddresses (the HashKey must be set separately)
+	allow=Field      Adds Field to Allow
+
+For example "date,threading,allow=X-Priority".
+*/
+func ParseCleanerConfig(spec string) (*CleanerConfig,error) {
+	c := new(CleanerConfig)
+	for _,opt := range strings.Split(spec,",") {
+		opt = strings.TrimSpace(opt)
+		switch {
+		case opt=="": continue
+		case opt=="date": c.KeepDate = true
+		case opt=="threading": c.KeepThreading = true
+		case opt=="list": c.KeepList = true
+		case opt=="hash-addresses": c.HashAddresses = true
+		case strings.HasPrefix(opt,"allow="):
+			f := strings.TrimSpace(opt[len("allow="):])
+			if f=="" { return nil,fmt.Errorf("ngcrypt: empty field in cleaner option %q",opt) }
+			c.Allow = append(c.Allow,f)
+		default:
+			return nil,fmt.Errorf("ngcrypt: unknown cleaner option %q",opt)
+		}
+	}
+	return c,nil
+}
+
+/*
+Builds the Cleaner described by the config.
+*/
+func (c *CleanerConfig) Build() (Cleaner,error) {
+	var keep []string
+	if c.KeepDate { keep = append(keep,DateFields...) }
+	if c.KeepThreading { keep = append(keep,ThreadingFields...) }
+	if c.KeepList { keep = append(keep,ListFields...) }
+	keep = append(keep,c.Allow...)
+	
+	cs := make([]Cleaner,0,3)
+	if c.HashAddresses {
+		if len(c.HashKey)==0 { return nil,fmt.Errorf("ngcrypt: hash-addresses needs a key") }
+		keep = append(keep,AddressFields...)
+		cs = append(cs,Allowlist(keep...),HashAddresses(c.HashKey))
+	} else {
+		/* Addresses are never kept in clear. */
+		cs = append(cs,Allowlist(keep...),Denylist(AddressFields...))
+	}
+	cs = append(cs,Placeholders)
+	
+	return Chain(cs...),nil
+}
@@ -0,0 +1,204 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package ngcrypt
+
+import (
+	"io"
+	"fmt"
+	"strings"
+	"compress/flate"
+	
+	"github.com/klauspost/compress/zstd"
+)
+
+/*
+The compression algorithm applied to the payload of an NGCRYPT BLOCK prior to encryption.
+
+The zero value is DEFLATE, which is what Version 1 blocks always use.
+*/
+type Compression uint
+
+const (
+	CompressionDeflate Compression = iota
+	CompressionNone
+	CompressionZstd
+)
+
+/* The armor header names, see SPEC.md */
+const (
+	compressionHeader = "Compression"
+	compressionLevelHeader = "Compression-Level"
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionDeflate: return "deflate"
+	case CompressionNone: return "none"
+	case CompressionZstd: return "zstd"
+	}
+	return fmt.Sprintf("Compression(%d)",uint(c))
+}
+
+/*
+Parses the name of a compression algorithm, as written by Compression.String().
+*/
+func ParseCompression(s string) (Compression,error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "deflate": return CompressionDeflate,nil
+	case "none": return CompressionNone,nil
+	case "zstd": return CompressionZstd,nil
+	}
+	return 0,fmt.Errorf("ngcrypt: unknown compression %q",s)
+}
+
+/*
+Options controlling the encoding of NGCRYPT messages. A nil *Options is equivalent
+to the zero value.
+*/
+type Options struct {
+	/* The compression algorithm. */
+	Compression Compression
+	
+	/*
+	The compression level. Its meaning depends on the algorithm.
+	0 selects the default level (DEFLATE: 1, zstd: 3).
+	*/
+	Level int
+	
+	/*
+	If true, the body is not compressed, if it's Content-Type indicates, that it is
+	already compressed (images, audio, video, archives, encrypted data, ...).
+	*/
+	SkipCompressed bool
+	
+	/*
+	If true, the encrypted blocks are stored as binary application/octet-stream parts
+	with Base64 transfer encoding, rather than as ASCII Armor in text/plain parts.
+	*/
+	Binary bool
+	
+	/*
+	If true, a multipart body is split into it's top-level parts, each of which is
+	encrypted into a part of it's own (see Manifest). This allows an IMAP gateway
+	to fetch only the parts, the client asked for.
+	*/
+	Split bool
+}
+
+func (o *Options) blockOptions() blockOptions {
+	if o==nil { return blockOptions{} }
+	return blockOptions{o.Compression,o.Level,o.Binary,0}
+}
+
+/* Media types, that are usually compressed already. */
+var compressedTypes = map[string]bool{
+	"application/zip": true,
+	"application/gzip": true,
+	"application/x-gzip": true,
+	"application/x-bzip2": true,
+	"application/x-xz": true,
+	"application/x-7z-compressed": true,
+	"application/x-rar-compressed": true,
+	"application/vnd.rar": true,
+	"application/zstd": true,
+	"application/pgp-encrypted": true,
+	"application/pkcs7-mime": true,
+	"image/jpeg": true,
+	"image/png": true,
+	"image/gif": true,
+	"image/webp": true,
+	"application/pdf": true,
+}
+
+func isCompressedType(mediaType string) bool {
+	mediaType = strings.ToLower(mediaType)
+	switch {
+	case compressedTypes[mediaType]: return true
+	case strings.HasPrefix(mediaType,"audio/"): return true
+	case strings.HasPrefix(mediaType,"video/"): return true
+	/* Office Open XML and OpenDocument files are ZIP containers. */
+	case strings.HasPrefix(mediaType,"application/vnd.openxmlformats-"): return true
+	case strings.HasPrefix(mediaType,"application/vnd.oasis.opendocument."): return true
+	}
+	return false
+}
+
+type nopCloser struct{ io.Writer }
+func (nopCloser) Close() error { return nil }
+
+func compressWriter(w io.Writer, c Compression, level int) (io.WriteCloser,error) {
+	switch c {
+	case CompressionNone:
+		return nopCloser{w},nil
+	case CompressionDeflate:
+		if level==0 { level = 1 }
+		return flate.NewWriter(w,level)
+	case CompressionZstd:
+		if level==0 { level = 3 }
+		return zstd.NewWriter(w,zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)),zstd.WithEncoderConcurrency(1))
+	}
+	return nil,fmt.Errorf("ngcrypt: unknown compression %v",c)
+}
+
+/*
+Wraps r into a decompressor for the given armor header value.
+An empty value means DEFLATE.
+*/
+func decompressReader(r io.Reader, name string) (io.Reader,error) {
+	c := CompressionDeflate
+	if name!="" {
+		var err error
+		c,err = ParseCompression(name)
+		if err!=nil { return nil,err }
+	}
+	switch c {
+	case CompressionNone:
+		return r,nil
+	case CompressionDeflate:
+		return flate.NewReader(readerAll{r}),nil
+	case CompressionZstd:
+		d,err := zstd.NewReader(r,zstd.WithDecoderConcurrency(1))
+		if err!=nil { return nil,err }
+		return &closeAtEnd{r: d.IOReadCloser()},nil
+	}
+	return nil,fmt.Errorf("ngcrypt: unknown compression %v",c)
+}
+
+/*
+Closes the zstd decoder, once the stream has been read to the end (or failed), so that it's
+goroutines exit. The callers only see an io.Reader and read it until EOF.
+*/
+type closeAtEnd struct {
+	r io.ReadCloser
+	err error
+}
+func (c *closeAtEnd) Read(p []byte) (int,error) {
+	if c.err!=nil { return 0,c.err }
+	n,err := c.r.Read(p)
+	if err!=nil {
+		c.err = err
+		c.r.Close()
+	}
+	return n,err
+}
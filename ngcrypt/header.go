@@ -81,13 +81,10 @@ func removeHeaderIfAny(l Literal) (nl Literal, err error) {
 	b,err = tobuf(l)
 	if err!=nil { return }
 	nl = b
-	for {
-		if bytes.HasPrefix(b.Bytes(),tagprefix) { break }
-		i := bytes.IndexByte(b.Bytes(),'\n')
-		if i<=0 { break }
-		b.Next(i)
-	}
+	/*
+	Skip anything in front of the ASCII Armor. Binary blocks are Base64 encoded,
+	and Base64 can't contain the armor tag, so they are left untouched.
+	*/
+	if i := bytes.Index(b.Bytes(),tagprefix); i>0 { b.Next(i) }
 	return
 }
-
-
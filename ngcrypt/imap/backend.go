@@ -33,10 +33,15 @@ import (
 	"github.com/emersion/go-pgpmail"
 	
 	"github.com/mad-day/gaw-mail/ngcrypt"
+	"github.com/mad-day/gaw-mail/policy"
+	"github.com/mad-day/gaw-mail/shared"
 )
 
 const (
 	FlagEnableSearch uint = 1<<iota
+	
+	/* Replaces older versions of a draft, when a new one is appended to \Drafts. See package drafts. */
+	FlagReplaceDrafts
 )
 
 type Backend struct {
@@ -44,8 +49,21 @@ type Backend struct {
 
 	Unlock pgpmail.UnlockFunction
 	
+	/* Cleans the unencrypted header. If nil, ngcrypt.Radical is used. See ngcrypt.CleanerConfig. */
 	Cleaner ngcrypt.Cleaner
 	
+	/* Encoding options for new messages, may be nil. */
+	Options *ngcrypt.Options
+	
+	/* Shared mailboxes, may be nil. */
+	Shared *shared.ACL
+	
+	/*
+	Selects the mailboxes, that are encrypted, and the format. May be nil. Messages in other
+	formats are written with format.Target, without Options.
+	*/
+	Policy *policy.Policy
+	
 	Flags uint
 }
 func (be *Backend) has(u uint) bool {
@@ -55,7 +73,7 @@ func (be *Backend) has(u uint) bool {
 var _ backend.Backend = (*Backend)(nil)
 
 func New(be backend.Backend, unlock pgpmail.UnlockFunction) *Backend {
-	return &Backend{be, unlock, nil, 0}
+	return &Backend{be, unlock, nil, nil, nil, nil, 0}
 }
 
 func (be *Backend) Login(conn *imap.ConnInfo,username, password string) (backend.User, error) {
@@ -64,6 +82,17 @@ func (be *Backend) Login(conn *imap.ConnInfo,username, password string) (backend
 	} else if kr, err := be.Unlock(username, password); err != nil {
 		return nil, err
 	} else {
-		return &user{u, kr, be}, nil
+		return &user{u, kr, be, username}, nil
+	}
+}
+
+/*
+Forwards the updates of the underlying backend, if any. Message updates carry
+the flags only, the encrypted parts are never included.
+*/
+func (be *Backend) Updates() <-chan backend.Update {
+	if bu,ok := be.Backend.(backend.BackendUpdater); ok {
+		return bu.Updates()
 	}
+	return nil
 }
@@ -21,15 +21,16 @@ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
 SOFTWARE.
 */
 
-
 package imap
 
 import (
 	"bytes"
+	"errors"
 	"time"
 	"io"
 	"bufio"
 	"fmt"
+	"io/ioutil"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend"
@@ -39,6 +40,10 @@ import (
 	"github.com/emersion/go-message/textproto"
 	
 	"github.com/mad-day/gaw-mail/ngcrypt"
+	"github.com/mad-day/gaw-mail/drafts"
+	"github.com/mad-day/gaw-mail/format"
+	"github.com/mad-day/gaw-mail/policy"
+	"github.com/mad-day/gaw-mail/shared"
 	
 	imapfetch "github.com/mad-day/gaw-mail/util/imap-fetch"
 )
@@ -49,56 +54,121 @@ type mailbox struct {
 	u *user
 }
 
-func filter(items []imap.FetchItem) (pass []imap.FetchItem, head,body,size,see bool) {
+/*
+Describes, what needs to be decrypted in order to answer a FETCH.
+*/
+type need struct {
+	head bool /* The original header (Part 1). */
+	body bool /* The complete original body. */
+	size bool /* The RFC822.SIZE */
+	see bool  /* Set the \Seen flag. */
+	
+	/* Top-level parts of the original body, that are fetched individually: BODY[n], BODY[n.MIME], BODY[n.m...] */
+	parts map[int]bool
+}
+
+func (n *need) any() bool {
+	return n.head || n.body || n.size || len(n.parts)!=0
+}
+
+/*
+Returns true, if the section can be answered from a single top-level part of a split message.
+*/
+func isPartSection(section *imap.BodySectionName) bool {
+	if len(section.Path)==0 { return false }
+	if len(section.Path)>1 { return true }
+	switch section.Specifier {
+	case imap.EntireSpecifier, imap.MIMESpecifier: return true
+	}
+	return false
+}
+
+func filter(items []imap.FetchItem) (pass []imap.FetchItem, nd need) {
 	pass = make([]imap.FetchItem,0,len(items)+2)
+	nd.parts = make(map[int]bool)
 	
 	for _,item := range items {
 		switch item {
-		case imap.FetchEnvelope: head = true
-		case imap.FetchBody, imap.FetchBodyStructure: body = true
-		case imap.FetchRFC822Size: size = true
+		case imap.FetchEnvelope: nd.head = true
+		case imap.FetchBody, imap.FetchBodyStructure: nd.body = true
+		case imap.FetchRFC822Size: nd.size = true
 		case imap.FetchFlags,imap.FetchInternalDate,imap.FetchUid:
 			pass = append(pass,item)
 		default:
 			if section, err := imap.ParseBodySectionName(item); err==nil {
-				if !section.Peek { see = true }
+				if !section.Peek { nd.see = true }
 				item2,ok := imapfetch.Shortcut(section)
-				if !ok {
-					head = true
-					body = true
+				if isPartSection(section) {
+					nd.head = true
+					nd.parts[section.Path[0]] = true
+				} else if !ok {
+					nd.head = true
+					nd.body = true
 				} else {
 					switch item2 {
 					case imap.FetchRFC822:
-						head = true
-						body = true
+						nd.head = true
+						nd.body = true
 					case imap.FetchRFC822Header:
-						head = true
+						nd.head = true
 					case imap.FetchRFC822Text:
-						body = true
+						nd.body = true
 					}
 				}
 			} else {
-				head = true
-				body = true
+				nd.head = true
+				nd.body = true
 				switch item {
-				case imap.FetchRFC822, imap.FetchRFC822Text: see = true
+				case imap.FetchRFC822, imap.FetchRFC822Text: nd.see = true
 				}
 			}
 		}
 		
 	}
 	
+	/* The body can't be decrypted without the manifest in Part 1. */
+	if nd.body { nd.head = true }
+	
+	return
+}
+
+func partItem(n int, see bool) imap.FetchItem {
+	tx := new(imap.BodySectionName)
+	tx.Path = []int{n}
+	tx.Peek = !see
+	return tx.FetchItem()
+}
+
+/*
+Returns the encrypted parts to fetch in the first round. Messages prior to Version 4
+store the whole body in Part 2, which is the first top-level part in Version 4 messages.
+Further parts exist in split messages only, which can't be told before Part 1 is decrypted.
+These are fetched in a second round by (*dmessage).fetch.
+
+The outer header is always fetched, to tell NGCRYPT messages from other formats.
+*/
+func (nd *need) sections() (items []imap.FetchItem) {
+	if nd.head {
+		items = append(items,partItem(1,nd.see))
+	}
+	if nd.body || len(nd.parts)!=0 {
+		items = append(items,partItem(2,nd.see))
+	}
+	tx := new(imap.BodySectionName)
+	tx.Specifier = imap.HeaderSpecifier
+	tx.Peek = true
+	items = append(items,tx.FetchItem())
 	return
 }
-func parts(m map[*imap.BodySectionName]imap.Literal) (m1, m2 imap.Literal) {
+
+func partsByNum(m map[*imap.BodySectionName]imap.Literal) map[int]imap.Literal {
+	r := make(map[int]imap.Literal)
 	for k,v := range m {
 		if len(k.Path)!=1 { continue }
-		switch k.Path[0] {
-		case 1: m1=v
-		case 2: m2=v
-		}
+		if k.Specifier!=imap.EntireSpecifier { continue }
+		r[k.Path[0]] = v
 	}
-	return
+	return r
 }
 func headerPart(m map[*imap.BodySectionName]imap.Literal) (hdrl imap.Literal) {
 	for k,v := range m {
@@ -109,174 +179,336 @@ func headerPart(m map[*imap.BodySectionName]imap.Literal) (hdrl imap.Literal) {
 	return
 }
 
+/*
+A message, as fetched from the underlying backend, and it's decrypted content.
+*/
+type dmessage struct {
+	m *mailbox
+	msg *imap.Message
+	
+	/* The encrypted parts by number. */
+	lits map[int]imap.Literal
+	
+	hdr message.Header
+	man *ngcrypt.Manifest
+	size int
+	
+	body []byte
+	hasBody bool
+	
+	/* The first round is still running, the underlying backend can't fetch further parts. */
+	round1 bool
+}
+
+/* Returned by (*dmessage).list in the first round. The message is completed in the second. */
+var errSecondRound = errors.New("ngcrypt/imap: the message needs a second round")
 
-type entityPop func() (*message.Entity,error)
-func epParse(b []byte) entityPop {
-	return func() (*message.Entity,error) { return message.Read(bytes.NewReader(b)) }
+func (m *mailbox) decrypted(msg *imap.Message, nd *need, round1 bool) (*dmessage,error) {
+	d := &dmessage{m:m, msg:msg, lits:partsByNum(msg.Body), round1:round1}
+	
+	hdrl := headerPart(msg.Body)
+	if hdrl==nil { return nil,io.EOF }
+	oh,err := textproto.ReadHeader(bufio.NewReader(hdrl))
+	if err!=nil { return nil,err }
+	
+	/* Messages in other formats are fetched and decrypted as a whole. */
+	if !ngcrypt.IsNgcrypt(message.Header{Header: oh}) {
+		return d,d.foreign(nd.see)
+	}
+	
+	if nd.head {
+		m1 := d.lits[1]
+		if m1==nil { return nil,io.EOF }
+		hdr,man,size,err := ngcrypt.DecryptManifest(m1,m.u.kr)
+		if err!=nil { return nil,err }
+		d.hdr,d.man,d.size = hdr,man,size
+	} else if nd.size {
+		fmt.Sscan(oh.Get("X-Ngcrypt-Size"),&d.size)
+	}
+	return d,nil
 }
-func epHead(h message.Header) entityPop {
-	r := bytes.NewReader([]byte{})
-	return func() (*message.Entity,error) { return &message.Entity{Header:h,Body:r},nil }
+
+/*
+Fetches the given items of this message from the underlying backend.
+*/
+func (d *dmessage) list(items []imap.FetchItem) ([]*imap.Message,error) {
+	if d.round1 { return nil,errSecondRound }
+	
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(d.msg.Uid)
+	
+	var list []*imap.Message
+	messages := make(chan *imap.Message)
+	done := make(chan error,1)
+	go func() { done <- d.m.Mailbox.ListMessages(true, seqset, items, messages) }()
+	
+	for msg := range messages {
+		list = append(list,msg)
+	}
+	return list,<-done
 }
-func epBody(b io.Reader) entityPop {
-	return func() (*message.Entity,error) { return &message.Entity{Body:b},nil }
+
+/*
+Fetches and decrypts a message, that is not in the NGCRYPT format (see format.Decrypt).
+*/
+func (d *dmessage) foreign(see bool) error {
+	whole := &imap.BodySectionName{Peek: !see}
+	list,err := d.list([]imap.FetchItem{imap.FetchUid,whole.FetchItem()})
+	if err!=nil { return err }
+	
+	var raw []byte
+	for _,msg := range list {
+		for k,l := range msg.Body {
+			if len(k.Path)!=0 || k.Specifier!=imap.EntireSpecifier || l==nil { continue }
+			if raw,err = ioutil.ReadAll(l); err!=nil { return err }
+		}
+	}
+	if raw==nil { return io.EOF }
+	
+	buf := new(bytes.Buffer)
+	if _,err = format.Decrypt(buf,raw,d.m.u.kr); err!=nil { return err }
+	d.size = buf.Len()
+	
+	br := bufio.NewReader(buf)
+	h,err := textproto.ReadHeader(br)
+	if err!=nil { return err }
+	body,err := ioutil.ReadAll(br)
+	if err!=nil { return err }
+	
+	d.hdr = message.Header{Header: h}
+	d.body,d.hasBody = body,true
+	return nil
 }
 
-func (m *mailbox) fetchHeadAndBody(msg *imap.Message) (entityPop,int,error) {
-	m1,m2 := parts(msg.Body)
-	if m1!=nil { return nil,0,io.EOF }
-	if m2!=nil { return nil,0,io.EOF }
-	b := new(bytes.Buffer)
-	err := ngcrypt.DecryptMessage(b,m1,m2,m.u.kr)
-	if err!=nil { return nil,0,err }
-	size := b.Len()
-	return epParse(b.Bytes()),size,nil
+/*
+Fetches the missing encrypted parts from the underlying backend.
+*/
+func (d *dmessage) fetch(nums []int) error {
+	var items []imap.FetchItem
+	for _,n := range nums {
+		if d.lits[n]!=nil { continue }
+		items = append(items,partItem(n,false))
+	}
+	if len(items)==0 { return nil }
+	
+	list,err := d.list(items)
+	for _,msg := range list {
+		for n,l := range partsByNum(msg.Body) {
+			d.lits[n] = l
+		}
+	}
+	return err
 }
-func (m *mailbox) fetchHead(msg *imap.Message) (entityPop,int,error) {
-	m1,_ := parts(msg.Body)
-	if m1!=nil { return nil,0,io.EOF }
-	hdr,size,err := ngcrypt.DecryptHeader(m1,m.u.kr)
-	if err!=nil { return nil,0,err }
-	return epHead(hdr),size,nil
+
+func (d *dmessage) decryptPart(n int) (ngcrypt.Literal,error) {
+	if d.lits[n]==nil {
+		if err := d.fetch([]int{n}); err!=nil { return nil,err }
+	}
+	if d.lits[n]==nil { return nil,io.EOF }
+	return ngcrypt.DecryptBody(d.lits[n],d.m.u.kr)
 }
-func (m *mailbox) fetchBody(msg *imap.Message) (entityPop,int,error) {
-	_,m2 := parts(msg.Body)
-	if m2!=nil { return nil,0,io.EOF }
-	body,err := ngcrypt.DecryptBody(m2,m.u.kr)
-	if err!=nil { return nil,0,err }
-	return epBody(body),-1,nil
+
+/*
+Returns the complete original body.
+*/
+func (d *dmessage) fullBody() ([]byte,error) {
+	if d.hasBody { return d.body,nil }
+	
+	nums := d.man.BodyParts()
+	if err := d.fetch(nums); err!=nil { return nil,err }
+	
+	parts := make([]ngcrypt.Literal,0,len(nums))
+	for _,n := range nums {
+		if d.lits[n]==nil {
+			if d.man.Split() { return nil,io.EOF }
+			continue /* Header-Only message. */
+		}
+		p,err := ngcrypt.DecryptBody(d.lits[n],d.m.u.kr)
+		if err!=nil { return nil,err }
+		parts = append(parts,p)
+	}
+	
+	buf := new(bytes.Buffer)
+	if err := d.man.Assemble(buf,parts); err!=nil { return nil,err }
+	
+	d.body,d.hasBody = buf.Bytes(),true
+	return d.body,nil
 }
 
-func (m *mailbox) fetchSize(msg *imap.Message) (entityPop,int,error) {
-	hdrl := headerPart(msg.Body)
-	if hdrl!=nil { return nil,0,io.EOF }
-	h,err := textproto.ReadHeader(bufio.NewReader(hdrl))
-	if err!=nil { return nil,0,err }
-	var size int
-	fmt.Sscan(h.Get("X-Ngcrypt-Size"),&size)
-	return nil,size,nil
+func (d *dmessage) entity() (*message.Entity,error) {
+	body,err := d.fullBody()
+	if err!=nil { return nil,err }
+	return message.New(d.hdr,bytes.NewReader(body))
 }
 
-func toLiteral(r io.Reader) imap.Literal {
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(r)
-	return buf
+/*
+Answers BODY[n...] from the top-level part n of a split message.
+Returns false, if the section can't be answered that way.
+*/
+func (d *dmessage) partSection(section *imap.BodySectionName) (imap.Literal,bool,error) {
+	if !d.man.Split() || !isPartSection(section) { return nil,false,nil }
+	n := section.Path[0]
+	if n<1 || n>d.man.Parts { return nil,false,nil }
+	
+	raw,err := d.decryptPart(d.man.EncryptedPart(n))
+	if err!=nil { return nil,true,err }
+	
+	br := bufio.NewReader(raw)
+	ph,err := textproto.ReadHeader(br)
+	if err!=nil { return nil,true,err }
+	
+	/* Sections within encapsulated messages are left to the general case. */
+	if t,_,_ := (&message.Header{Header: ph}).ContentType(); t=="message/rfc822" && len(section.Path)>1 { return nil,false,nil }
+	
+	sub := *section
+	sub.Path = section.Path[1:]
+	if len(sub.Path)==0 {
+		switch section.Specifier {
+		case imap.EntireSpecifier: sub.Specifier = imap.TextSpecifier /* BODY[n] is the part without MIME header. */
+		case imap.MIMESpecifier: sub.Specifier = imap.HeaderSpecifier
+		}
+	}
+	
+	l,err := backendutil.FetchBodySection(ph, br, &sub)
+	return l,true,err
+}
+
+func (d *dmessage) section(section *imap.BodySectionName) (imap.Literal,error) {
+	if l,ok,err := d.partSection(section); ok {
+		return l,err
+	}
+	
+	/* BODY[1] is not the same as BODY[TEXT] in multipart messages. */
+	item2,ok := imapfetch.Shortcut(section)
+	if ok && section.Partial==nil && len(section.Path)==0 {
+		switch item2 {
+		//case imap.FetchRFC822:
+		case imap.FetchRFC822Header:
+			return headerLiteral(d.hdr),nil
+		case imap.FetchRFC822Text:
+			body,err := d.fullBody()
+			if err!=nil { return nil,err }
+			return bytes.NewBuffer(body),nil
+		}
+	}
+	
+	body,err := d.fullBody()
+	if err!=nil { return nil,err }
+	return backendutil.FetchBodySection(d.hdr.Header, bytes.NewReader(body), section)
 }
+
 func headerLiteral(h message.Header) imap.Literal {
 	buf := new(bytes.Buffer)
 	textproto.WriteHeader(buf,h.Header)
 	return buf
 }
 
-func fetchNone(_ *imap.Message) (entityPop,int,error) { return nil,0,nil }
+func hasItem(items []imap.FetchItem, item imap.FetchItem) bool {
+	for _,i := range items {
+		if i==item { return true }
+	}
+	return false
+}
 
 func (m *mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
-	pass,head,body,hsize,see := filter(items)
+	pass,nd := filter(items)
 	
 	/* Short-Cut. */
-	if !( head||body||hsize ) {
+	if !nd.any() || m.u.be.Policy.Lookup(m.Mailbox).Action==policy.Untouched {
 		return m.Mailbox.ListMessages(uid, seqSet, items, ch)
 	}
+	defer close(ch)
+	
+	/* The UID is needed to fetch missing parts later on. */
+	if !hasItem(pass,imap.FetchUid) { pass = append(pass,imap.FetchUid) }
+	pass = append(pass,nd.sections()...)
+	
 	/*
-	 * If we fetch the Body, the step of fetching the outer header for the RFC822.SIZE is skipped.
-	 * That means, we must compensate for this!
+	 * The messages are answered, as they arrive. Messages needing further parts are completed
+	 * afterwards, as the underlying backend can't process a second command, while the first
+	 * is running. Their parts are kept, as the first attempt has read them.
 	 */
-	if hsize && body { head = true }
-	
-	var fetcher func(m *imap.Message) (entityPop,int,error)
-	
-	if head {
-		tx := new(imap.BodySectionName)
-		tx.Path = []int{1}
-		tx.Peek = !see
-		pass = append(pass,tx.FetchItem())
-	}
-	if body {
-		tx := new(imap.BodySectionName)
-		tx.Path = []int{2}
-		tx.Peek = !see
-		pass = append(pass,tx.FetchItem())
-	}
-	
-	if head && body {
-		fetcher = m.fetchHeadAndBody
-	} else if body {
-		fetcher = m.fetchBody
-	} else if head {
-		fetcher = m.fetchHead
-	} else if hsize {
-		tx := new(imap.BodySectionName)
-		tx.Specifier = imap.HeaderSpecifier
-		tx.Peek = !see
-		pass = append(pass,tx.FetchItem())
-		fetcher = m.fetchHead
-	} else {
-		fetcher = fetchNone
-	}
-	
+	var later []*imap.Message
+	var kept []map[*imap.BodySectionName][]byte
 	messages := make(chan *imap.Message)
-	go func() {
-		defer close(ch)
-		msgq:
-		for msg := range messages {
-			entPop,size,err := fetcher(msg)
-			
-			if err!=nil { continue } /* Skip on error! */
-			
-			fetched := imap.NewMessage(msg.SeqNum, items)
-			
-			for _, item := range items {
-				switch item {
-				case imap.FetchEnvelope:
-					e,err := entPop()
-					if err!=nil { continue msgq } /* Skip on error! */
-					fetched.Envelope, _ = backendutil.FetchEnvelope(e.Header)
-				case imap.FetchBody, imap.FetchBodyStructure:
-					e,err := entPop()
-					if err!=nil { continue msgq } /* Skip on error! */
-					fetched.BodyStructure, _ = backendutil.FetchBodyStructure(e, item == imap.FetchBodyStructure)
-				case imap.FetchFlags:
-					fetched.Flags = msg.Flags
-				case imap.FetchInternalDate:
-					fetched.InternalDate = msg.InternalDate
-				case imap.FetchRFC822Size:
-					fetched.Size = uint32(size)
-				case imap.FetchUid:
-					fetched.Uid = msg.Uid
-				default:
-					section, err := imap.ParseBodySectionName(item)
-					if err != nil {
-						continue msgq /* Skip on error! */
-					}
-					
-					e,err := entPop()
-					
-					if err!=nil { continue msgq } /* Skip on error! */
-					
-					item2,ok := imapfetch.Shortcut(section)
-					if ok {
-						switch item2 {
-						//case imap.FetchRFC822:
-						case imap.FetchRFC822Header:
-							fetched.Body[section] = headerLiteral(e.Header)
-							continue
-						case imap.FetchRFC822Text:
-							fetched.Body[section] = toLiteral(e.Body)
-							continue
-						}
-					}
-					
-					l, err := backendutil.FetchBodySection(e, section)
-					if err!=nil { continue msgq } /* Skip on error! */
-					fetched.Body[section] = l
-				}
-			}
-			
+	done := make(chan error,1)
+	go func() { done <- m.Mailbox.ListMessages(uid, seqSet, pass, messages) }()
+	for msg := range messages {
+		raw,err := readBody(msg)
+		if err!=nil { continue } /* Skip on error! */
+		
+		fetched,err := m.fetchMessage(msg,items,&nd,true)
+		switch {
+		case err==errSecondRound:
+			later = append(later,msg)
+			kept = append(kept,raw)
+		case err==nil:
 			ch <- fetched
 		}
-	}()
+	}
+	if err := <-done; err!=nil { return err }
+	
+	for i,msg := range later {
+		for k,b := range kept[i] { msg.Body[k] = bytes.NewReader(b) }
+		
+		fetched,err := m.fetchMessage(msg,items,&nd,false)
+		if err!=nil { continue } /* Skip on error! */
+		ch <- fetched
+	}
+	
+	return nil
+}
 
-	return m.Mailbox.ListMessages(uid, seqSet, pass, messages)
+/* Reads the fetched literals of msg into memory, so that they can be read again. */
+func readBody(msg *imap.Message) (map[*imap.BodySectionName][]byte,error) {
+	raw := make(map[*imap.BodySectionName][]byte,len(msg.Body))
+	for k,l := range msg.Body {
+		if l==nil { continue }
+		b,err := ioutil.ReadAll(l)
+		if err!=nil { return nil,err }
+		raw[k] = b
+		msg.Body[k] = bytes.NewReader(b)
+	}
+	return raw,nil
+}
+
+/*
+Answers the FETCH items of a message from the encrypted parts in msg. In the first round, it
+returns errSecondRound, if further parts are needed.
+*/
+func (m *mailbox) fetchMessage(msg *imap.Message, items []imap.FetchItem, nd *need, round1 bool) (*imap.Message,error) {
+	d,err := m.decrypted(msg,nd,round1)
+	if err!=nil { return nil,err }
+	
+	fetched := imap.NewMessage(msg.SeqNum, items)
+	
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope:
+			fetched.Envelope, _ = backendutil.FetchEnvelope(d.hdr.Header)
+		case imap.FetchBody, imap.FetchBodyStructure:
+			body,err := d.fullBody()
+			if err!=nil { return nil,err }
+			fetched.BodyStructure, _ = backendutil.FetchBodyStructure(d.hdr.Header, bytes.NewReader(body), item == imap.FetchBodyStructure)
+		case imap.FetchFlags:
+			fetched.Flags = msg.Flags
+		case imap.FetchInternalDate:
+			fetched.InternalDate = msg.InternalDate
+		case imap.FetchRFC822Size:
+			fetched.Size = uint32(d.size)
+		case imap.FetchUid:
+			fetched.Uid = msg.Uid
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil { return nil,err }
+			
+			l,err := d.section(section)
+			if err!=nil { return nil,err }
+			fetched.Body[section] = l
+		}
+	}
+	
+	return fetched,nil
 }
 
 type searchRequirement struct{
@@ -293,34 +525,19 @@ func (m *mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uin
 	/*
 	First, check if encrypted search is enabled.
 	*/
-	if !m.u.be.has(FlagEnableSearch) {
+	if !m.u.be.has(FlagEnableSearch) || m.u.be.Policy.Lookup(m.Mailbox).Action==policy.Untouched {
 		return m.Mailbox.SearchMessages(uid,criteria)
 	}
 	var sr searchRequirement
 	sr.scan(criteria)
 	
+	/* Encrypted Envelope/Header --- REQUIRED, Encrypted Body --- OPTIONAL */
+	nd := need{head:true, body:sr.body}
+	
 	pass := make([]imap.FetchItem,0,9)
 	
 	pass = append(pass,imap.FetchUid,imap.FetchInternalDate,imap.FetchFlags)
-	{ /* Encrypted Envelope/Header --- REQUIRED */
-		tx := new(imap.BodySectionName)
-		tx.Path = []int{1}
-		tx.Peek = true
-		pass = append(pass,tx.FetchItem())
-	}
-	if sr.body { /* Encrypted Body. --- OPTIONAL */
-		tx := new(imap.BodySectionName)
-		tx.Path = []int{2}
-		tx.Peek = true
-		pass = append(pass,tx.FetchItem())
-	}
-	
-	var fetcher func(m *imap.Message) (entityPop,int,error)
-	if sr.body {
-		fetcher = m.fetchHeadAndBody
-	} else {
-		fetcher = m.fetchHead
-	}
+	pass = append(pass,nd.sections()...)
 	
 	messages := make(chan *imap.Message)
 	
@@ -329,14 +546,26 @@ func (m *mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uin
 	
 	seqset := new(imap.SeqSet)
 	seqset.AddRange(1, minf.Messages)
-	go m.Mailbox.ListMessages(false, seqset, pass, messages)
+	
+	var list []*imap.Message
+	done := make(chan error,1)
+	go func() { done <- m.Mailbox.ListMessages(false, seqset, pass, messages) }()
+	for msg := range messages {
+		list = append(list,msg)
+	}
+	if err := <-done; err!=nil { return nil,err }
 	
 	u := make([]uint32,0,minf.Messages)
 	
-	for msg := range messages {
-		entPop,_,err := fetcher(msg)
+	for _,msg := range list {
+		d,err := m.decrypted(msg,&nd,false)
 		if err!=nil { continue }
-		ent,err := entPop()
+		var ent *message.Entity
+		if sr.body {
+			ent,err = d.entity()
+		} else {
+			ent,err = message.New(d.hdr,bytes.NewReader(nil))
+		}
 		if err!=nil { continue }
 		ok,err := backendutil.Match(ent, msg.SeqNum, msg.Uid, msg.InternalDate, msg.Flags, criteria)
 		if err!=nil { continue }
@@ -353,14 +582,76 @@ func (m *mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uin
 }
 
 func (m *mailbox) CreateMessage(flags []string, date time.Time, r imap.Literal) error {
+	rule := m.u.be.Policy.Lookup(m.Mailbox)
+	switch rule.Action {
+	case policy.Plain, policy.Untouched:
+		return m.Mailbox.CreateMessage(flags, date, r)
+	case policy.ReadOnly:
+		return policy.ErrReadOnly
+	}
+	
 	b := new(bytes.Buffer)
 	kr := m.u.kr
+	to,err := m.u.recipients(m.Name())
+	if err != nil {
+		return err
+	}
 	
 	clnr := m.u.be.Cleaner
 	if clnr==nil { clnr = ngcrypt.Radical }
-	if err := ngcrypt.Encrypt(b, r, kr, kr[0], clnr); err != nil {
+	encrypt := func(w io.Writer, r imap.Literal) error {
+		return ngcrypt.EncryptWithOptions(w, r, to, kr[0], clnr, m.u.be.Options)
+	}
+	if rule.Format!=format.Default && rule.Format!=format.Ngcrypt {
+		t := &format.Target{Format: rule.Format, To: to, Signed: kr[0]}
+		encrypt = func(w io.Writer, r imap.Literal) error {
+			msg, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			return t.Encrypt(w, msg)
+		}
+	}
+	if m.u.be.has(FlagReplaceDrafts) && drafts.IsDrafts(m.Mailbox) {
+		msg, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return drafts.Append(m.Mailbox, drafts.Secret(kr[0]), flags, date, msg, encrypt)
+	}
+	if err := encrypt(b, r); err != nil {
 		return err
 	}
 	return m.Mailbox.CreateMessage(flags, date, b)
 }
 
+/*
+Like MOVE, the message is copied as is, it is neither decrypted nor encrypted to the members
+of a shared destination mailbox.
+*/
+func (m *mailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, dest string) error {
+	if !m.u.allowed(dest) {
+		return shared.ErrAccessDenied
+	}
+	if err := m.u.be.Policy.Writable(m.u.User, dest); err != nil {
+		return err
+	}
+	return m.Mailbox.CopyMessages(uid, seqSet, dest)
+}
+
+/*
+Passes MOVE through, if the underlying mailbox supports it.
+*/
+func (m *mailbox) MoveMessages(uid bool, seqSet *imap.SeqSet, dest string) error {
+	if !m.u.allowed(dest) {
+		return shared.ErrAccessDenied
+	}
+	if err := m.u.be.Policy.Writable(m.u.User, dest); err != nil {
+		return err
+	}
+	mm, ok := m.Mailbox.(backend.MoveMailbox)
+	if !ok {
+		return errors.New("MOVE extension not supported")
+	}
+	return mm.MoveMessages(uid, seqSet, dest)
+}
@@ -27,6 +27,8 @@ import (
 	"github.com/emersion/go-imap/backend"
 
 	"golang.org/x/crypto/openpgp"
+	
+	"github.com/mad-day/gaw-mail/shared"
 )
 
 type user struct {
@@ -35,27 +37,67 @@ type user struct {
 	kr openpgp.EntityList
 	
 	be *Backend
+	
+	username string
 }
 
 func (u *user) getMailbox(m backend.Mailbox) *mailbox {
 	return &mailbox{m, u}
 }
 
+func (u *user) allowed(name string) bool {
+	return u.be.Shared==nil || u.be.Shared.Allowed(u.username,name)
+}
+
 func (u *user) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
 	if mailboxes, err := u.User.ListMailboxes(subscribed); err != nil {
 		return nil, err
 	} else {
-		for i, m := range mailboxes {
-			mailboxes[i] = u.getMailbox(m)
+		list := mailboxes[:0]
+		for _, m := range mailboxes {
+			if !u.allowed(m.Name()) { continue }
+			list = append(list,u.getMailbox(m))
 		}
-		return mailboxes, nil
+		return list, nil
 	}
 }
 
 func (u *user) GetMailbox(name string) (backend.Mailbox, error) {
+	if !u.allowed(name) {
+		return nil, shared.ErrAccessDenied
+	}
 	if m, err := u.User.GetMailbox(name); err != nil {
 		return nil, err
 	} else {
 		return u.getMailbox(m), nil
 	}
 }
+
+/*
+Returns the keys, that messages appended to the mailbox are encrypted to: The keys of all
+members for shared mailboxes, the user's own keys otherwise.
+*/
+func (u *user) recipients(name string) (openpgp.EntityList, error) {
+	if u.be.Shared==nil {
+		return u.kr, nil
+	}
+	if kr, err := u.be.Shared.Recipients(u.username, name); err != nil {
+		return nil, err
+	} else if kr != nil {
+		return kr, nil
+	}
+	return u.kr, nil
+}
+
+/*
+Reports the APPENDLIMIT of the underlying user, minus the Base64 overhead of the encrypted
+parts. Compression usually makes up for the OpenPGP framing.
+*/
+func (u *user) CreateMessageLimit() *uint32 {
+	lu,ok := u.User.(backend.AppendLimitUser)
+	if !ok { return nil }
+	limit := lu.CreateMessageLimit()
+	if limit==nil { return nil }
+	l := *limit/4*3
+	return &l
+}
@@ -26,10 +26,13 @@ package ngcrypt
 
 import (
 	"io"
+	"io/ioutil"
 	"log"
 	"strings"
+	"strconv"
 	"math/rand"
 	"fmt"
+	"bufio"
 
 	"bytes"
 	"github.com/emersion/go-message"
@@ -46,8 +49,18 @@ type Literal interface {
 }
 
 
+/*
+A Cleaner removes or replaces sensitive fields of the outer (unencrypted) message header.
+The complete original header is always stored encrypted in Part 1.
+
+See cleaner.go for composable cleaners and CleanerConfig.
+*/
 type Cleaner func(h *message.Header)
 
+/*
+Wipes Subject and the address fields, and replaces them with placeholders.
+All other fields (Date, Message-ID, References, List-* etc.) are left untouched.
+*/
 func Radical(h *message.Header) {
 	h.Set("Subject","(Deleted)")
 	h.Del("Sender")
@@ -74,6 +87,13 @@ This is useful for Envelope-Fetching, as the IMAP-Gateway only needs
 to fetch the first part from the server whilst delivering the Envelope to the client.
 */
 func Encrypt(w io.Writer, mail Literal, to []*openpgp.Entity, signed *openpgp.Entity, c Cleaner) error {
+	return EncryptWithOptions(w,mail,to,signed,c,nil)
+}
+
+/*
+Like Encrypt, but with Options controlling the encoding. o may be nil.
+*/
+func EncryptWithOptions(w io.Writer, mail Literal, to []*openpgp.Entity, signed *openpgp.Entity, c Cleaner, o *Options) error {
 	length := mail.Len()
 	
 	var h2 message.Header
@@ -81,6 +101,31 @@ func Encrypt(w io.Writer, mail Literal, to []*openpgp.Entity, signed *openpgp.En
 	
 	if err!=nil { return err }
 	
+	hbo := o.blockOptions()
+	bbo := hbo
+	if o!=nil && o.SkipCompressed {
+		if t,_,err := h.ContentType(); err==nil && isCompressedType(t) { bbo.c,bbo.level = CompressionNone,0 }
+	}
+	
+	/* Split the body into it's top-level parts, if requested. */
+	man := new(Manifest)
+	var split [][]byte
+	if o!=nil && o.Split {
+		if t,p,err := h.ContentType(); err==nil && strings.HasPrefix(t,"multipart/") && p["boundary"]!="" {
+			body,err := ioutil.ReadAll(b)
+			if err!=nil { return err }
+			if glue,parts,ok := splitMultipart(body,p["boundary"]); ok {
+				man.Parts,man.glue = len(parts),glue
+				split = parts
+			}
+			b = bytes.NewReader(body)
+		}
+	}
+	
+	/* Older readers can decode the message, unless it needs a newer feature. */
+	v := messageVersion([]blockOptions{hbo,bbo},man.Split())
+	hbo.version,bbo.version = v,v
+	
 	/* Store the original Mail header. */
 	header := new(bytes.Buffer)
 	if err = textproto.WriteHeader(header,h.Header); err != nil {
@@ -102,6 +147,7 @@ func Encrypt(w io.Writer, mail Literal, to []*openpgp.Entity, signed *openpgp.En
 	
 	h.SetContentType("multipart/mixed",map[string]string{"boundary":fmt.Sprintf("b_%x",rand.Int63())})
 	h.Set("X-Ngcrypt-Pgp","enabled")
+	h.Set(versionHeader,fmt.Sprint(v))
 	h.Set("X-Ngcrypt-Size",fmt.Sprint(length)) /* RFC822.SIZE */
 	
 	hdr1["Rfc822-Size"] = fmt.Sprint(length)
@@ -110,58 +156,141 @@ func Encrypt(w io.Writer, mail Literal, to []*openpgp.Entity, signed *openpgp.En
 	
 	// ----------------------------------------------------------------------------
 	
-	h2.SetContentType("text/plain",nil)
+	if hbo.binary {
+		h2.SetContentType("application/octet-stream",nil)
+		h2.Set("Content-Transfer-Encoding","base64")
+	} else {
+		h2.SetContentType("text/plain",nil)
+	}
 	h2.SetText("Subject","No Subject")
 	
 	pw,err := wr.CreatePart(h2);   if err!=nil { return err }
-	enc,err := encodeNgcrypt(pw,to,signed,hdr1);   if err!=nil { return err }
+	enc,err := encodeNgcrypt(pw,to,signed,hdr1,hbo);   if err!=nil { return err }
 	
 	_,err = header.WriteTo(enc);   if err!=nil { return err }
+	if v>=Version4 {
+		err = man.writeTo(enc);   if err!=nil { return err }
+	}
 	
 	err = enc.Close();   if err!=nil { return err }
 	err = pw.Close();   if err!=nil { return err }
 	
 	// ----------------------------------------------------------------------------
 	
-	pw,err = wr.CreatePart(h2);   if err!=nil { return err }
-	enc,err = encodeNgcrypt(pw,to,signed,nil);   if err!=nil { return err }
-	
-	_,err = io.Copy(enc,b)
-	if err!=nil { return err }
+	if !man.Split() {
+		pw,err = wr.CreatePart(h2);   if err!=nil { return err }
+		enc,err = encodeNgcrypt(pw,to,signed,nil,bbo);   if err!=nil { return err }
+		
+		_,err = io.Copy(enc,b)
+		if err!=nil { return err }
+		
+		err = enc.Close();   if err!=nil { return err }
+		err = pw.Close();   if err!=nil { return err }
+		
+		return wr.Close()
+	}
 	
-	err = enc.Close();   if err!=nil { return err }
-	err = pw.Close();   if err!=nil { return err }
+	for _,part := range split {
+		pbo := hbo
+		if o.SkipCompressed {
+			ph,_,err := parseMessageHeader(bytes.NewReader(part))
+			if err!=nil { return err }
+			if t,_,err := ph.ContentType(); err==nil && isCompressedType(t) { pbo.c,pbo.level = CompressionNone,0 }
+		}
+		
+		pw,err = wr.CreatePart(h2);   if err!=nil { return err }
+		enc,err = encodeNgcrypt(pw,to,signed,nil,pbo);   if err!=nil { return err }
+		
+		_,err = enc.Write(part)
+		if err!=nil { return err }
+		
+		err = enc.Close();   if err!=nil { return err }
+		err = pw.Close();   if err!=nil { return err }
+	}
 	
 	return wr.Close()
 }
 
+/* Reads the header including the terminating empty line, as is. */
+func readRawHeader(br *bufio.Reader) ([]byte,error) {
+	buf := new(bytes.Buffer)
+	for {
+		line,err := br.ReadBytes('\n')
+		buf.Write(line)
+		if err==io.EOF { return buf.Bytes(),nil }
+		if err!=nil { return nil,err }
+		if len(bytes.TrimRight(line,"\r\n"))==0 { return buf.Bytes(),nil }
+	}
+}
+
+/*
+Decrypts Part 1. Returns the raw original header and, since Version 4, the manifest.
+
+Signature errors are returned in sigErr, along with the decrypted data.
+*/
+func decodeHeaderPart(in io.Reader, kr openpgp.KeyRing) (raw []byte, man *Manifest, size int, sigErr error, err error) {
+	md,inh,err := decodeNcrypt2(in,kr)
+	if err!=nil { return }
+	
+	fmt.Sscan(inh["Rfc822-Size"],&size)
+	
+	br := bufio.NewReader(md.UnverifiedBody)
+	raw,err = readRawHeader(br)
+	if err!=nil { return }
+	
+	v,err := parseVersion(inh[blockVersionHeader])
+	if err!=nil { return }
+	if v>=Version4 {
+		man,err = readManifest(br)
+		if err!=nil { return }
+	}
+	
+	/* Read until EOF, so that the signature gets checked. */
+	_,err = io.Copy(ioutil.Discard,br)
+	if err!=nil { return }
+	
+	sigErr = md.SignatureError
+	return
+}
+
 /*
 Decrypt the RFC822 header using Part-1 as input.
+
+The input may be an ASCII Armored or a binary (Base64 encoded) block.
 */
 func DecryptHeader(m1 Literal, kr openpgp.KeyRing) (hdr message.Header,size int, err0 error) {
-	var rest bytes.Buffer
-	var rd io.Reader
-	var md *openpgp.MessageDetails
-	var inh map[string]string
+	hdr,_,size,err0 = DecryptManifest(m1,kr)
+	return
+}
+
+/*
+Decrypt the RFC822 header and the structure manifest using Part-1 as input.
+
+The manifest is nil for messages prior to Version 4.
+*/
+func DecryptManifest(m1 Literal, kr openpgp.KeyRing) (hdr message.Header,man *Manifest,size int, err0 error) {
+	var raw []byte
+	var sigErr error
 	m1,err0 = removeHeaderIfAny(m1)
 	if err0!=nil { return }
 	
-	md,inh,err0 = decodeNcrypt2(m1,kr)
+	raw,man,size,sigErr,err0 = decodeHeaderPart(m1,kr)
 	if err0!=nil { return }
 	
-	fmt.Sscan(inh["Rfc822-Size"],&size)
-	
-	hdr,rd,err0 = parseMessageHeader(md.UnverifiedBody)
-	
-	rest.ReadFrom(rd)
+	hdr,_,err0 = parseMessageHeader(bytes.NewReader(raw))
 	
 	/* Propagate Signature errors. */
-	if md.SignatureError!=nil && err0==nil { err0 = md.SignatureError }
+	if sigErr!=nil && err0==nil { err0 = sigErr }
 	return
 }
 
 /*
 Decrypt the RFC822 body using Part-2 as input.
+
+If the message has been split (see Manifest), the input may be any body part, and the
+result is the corresponding top-level part of the original body.
+
+The input may be an ASCII Armored or a binary (Base64 encoded) block.
 */
 func DecryptBody(m2 Literal, kr openpgp.KeyRing) (body Literal,err0 error) {
 	var md *openpgp.MessageDetails
@@ -174,6 +303,7 @@ func DecryptBody(m2 Literal, kr openpgp.KeyRing) (body Literal,err0 error) {
 	buf := new(bytes.Buffer)
 	_,err0 = buf.ReadFrom(md.UnverifiedBody)
 	if err0!=nil { return }
+	body = buf
 	
 	/* Propagate Signature errors. */
 	if md.SignatureError!=nil && err0==nil { err0 = md.SignatureError }
@@ -182,44 +312,63 @@ func DecryptBody(m2 Literal, kr openpgp.KeyRing) (body Literal,err0 error) {
 
 /*
 Decrypt the RFC822 message using Part-1 and Part-2 as input.
+
+This doesn't work for split messages, use DecryptMessageParts instead.
 */
 func DecryptMessage(w io.Writer,m1,m2 Literal, kr openpgp.KeyRing) (err0 error) {
-	var md *openpgp.MessageDetails
+	var parts []Literal
+	if m2!=nil { parts = []Literal{m2} }
+	return DecryptMessageParts(w,m1,parts,kr)
+}
+
+/*
+Decrypt the RFC822 message using Part-1 and the body parts (Part-2 to Part-n) as input.
+
+The body parts must be given in the order of Manifest.BodyParts().
+*/
+func DecryptMessageParts(w io.Writer,m1 Literal,parts []Literal, kr openpgp.KeyRing) (err0 error) {
+	var raw []byte
+	var man *Manifest
+	var sigErr error
 	m1,err0 = removeHeaderIfAny(m1)
 	if err0!=nil { return }
 	
-	md,err0 = decodeNcrypt(m1,kr)
+	raw,man,_,sigErr,err0 = decodeHeaderPart(m1,kr)
 	if err0!=nil { return }
 	
-	io.Copy(w,md.UnverifiedBody)
-	
-	
-	if m2==nil { return }
-	m2,err0 = removeHeaderIfAny(m2)
-	if m2.Len()==0 { return }
-	
-	/* Propagate Signature errors. */
-	err1 := md.SignatureError
-	
-	md,err0 = decodeNcrypt(m1,kr)
-	if err0!=nil { return }
+	if man.Split() && len(parts)!=man.Parts { return fmt.Errorf("ngcrypt: message has %d body parts",man.Parts) }
+	
+	body := make([]Literal,0,len(parts))
+	for _,p := range parts {
+		if p==nil || p.Len()==0 { continue }
+		b,err := DecryptBody(p,kr)
+		if err!=nil && b==nil { return err }
+		
+		/* Propagate Signature errors. */
+		if err!=nil && sigErr==nil { sigErr = err }
+		body = append(body,b)
+	}
 	
-	io.Copy(w,md.UnverifiedBody)
+	if _,err0 = w.Write(raw); err0!=nil { return }
+	if err0 = man.Assemble(w,body); err0!=nil { return }
 	
 	/* Propagate Signature errors. */
-	if err1!=nil && err0==nil { err0 = err1 }
-	if md.SignatureError!=nil && err0==nil { err0 = md.SignatureError }
+	err0 = sigErr
 	return
 }
 
 /*
-Decrypt the RFC822 message using Part-1 and Part-2 as input.
+Decrypt the RFC822 message given the whole NGCRYPT message as input.
 */
 func DecryptWholeMessage(w io.Writer,r io.Reader, kr openpgp.KeyRing) (err0 error) {
 	
 	msg,err := message.Read(r)
 	if err!=nil { return err }
 	
+	v,err := MessageVersion(msg.Header)
+	if err!=nil { return err }
+	if _,ok := blockDecoders[v]; !ok { return UnsupportedVersionError(v) }
+	
 	mr := msg.MultipartReader()
 	if mr==nil {
 		return fmt.Errorf("invalid ngcrypt message")
@@ -228,28 +377,86 @@ func DecryptWholeMessage(w io.Writer,r io.Reader, kr openpgp.KeyRing) (err0 erro
 	p,err := mr.NextPart()
 	if err!=nil { return err }
 	
-	md,err := decodeNcrypt(p.Body,kr)
-	if err!=nil { return err }
-	
-	_,err = io.Copy(w,md.UnverifiedBody)
+	raw,man,_,sigErr,err := decodeHeaderPart(p.Body,kr)
 	if err!=nil { return err }
 	
 	/* Propagate Signature errors. */
-	if md.SignatureError!=nil && err0==nil { err0 = md.SignatureError }
-	
-	p,err = mr.NextPart()
-	if err==io.EOF { return }
-	if err!=nil { return err }
+	err0 = sigErr
+	
+	var parts []Literal
+	for {
+		p,err = mr.NextPart()
+		if err==io.EOF { break }
+		if err!=nil { return err }
+		
+		md,err := decodeNcrypt(p.Body,kr)
+		if err!=nil { return err }
+		
+		buf := new(bytes.Buffer)
+		_,err = buf.ReadFrom(md.UnverifiedBody)
+		if err!=nil { return err }
+		parts = append(parts,buf)
+		
+		/* Propagate Signature errors. */
+		if md.SignatureError!=nil && err0==nil { err0 = md.SignatureError }
+	}
 	
-	md,err = decodeNcrypt(p.Body,kr)
+	_,err = w.Write(raw)
 	if err!=nil { return err }
 	
-	_,err = io.Copy(w,md.UnverifiedBody)
+	err = man.Assemble(w,parts)
 	if err!=nil { return err }
 	
-	/* Propagate Signature errors. */
-	if md.SignatureError!=nil && err0==nil { err0 = md.SignatureError }
-	
 	return
 }
 
+/*
+Returns the Options, the NGCRYPT message r has been encrypted with, as far as they can be told
+without decrypting it. Version 1 messages are DEFLATE compressed; the level is known, if the
+encoder wrote the Compression-Level header. SkipCompressed is reported, if a body block is
+compressed differently than the header block.
+*/
+func MessageOptions(r io.Reader) (*Options,error) {
+	msg,err := message.Read(r)
+	if err!=nil { return nil,err }
+	
+	v,err := MessageVersion(msg.Header)
+	if err!=nil { return nil,err }
+	if _,ok := blockDecoders[v]; !ok { return nil,UnsupportedVersionError(v) }
+	
+	mr := msg.MultipartReader()
+	if mr==nil {
+		return nil,fmt.Errorf("invalid ngcrypt message")
+	}
+	
+	o := new(Options)
+	n := 0
+	for ;; n++ {
+		p,err := mr.NextPart()
+		if err==io.EOF { break }
+		if err!=nil { return nil,err }
+		
+		_,hdr,err := openBlock(p.Body)
+		if err!=nil { return nil,err }
+		
+		c := CompressionDeflate
+		if s := hdr[compressionHeader]; s!="" {
+			if c,err = ParseCompression(s); err!=nil { return nil,err }
+		}
+		if n==0 {
+			t,_,_ := p.Header.ContentType()
+			o.Binary = t=="application/octet-stream"
+			o.Compression = c
+			if s := hdr[compressionLevelHeader]; s!="" {
+				if o.Level,err = strconv.Atoi(strings.TrimSpace(s)); err!=nil { return nil,err }
+			}
+		} else if c!=o.Compression {
+			o.SkipCompressed = true
+		}
+	}
+	if n<2 { return nil,fmt.Errorf("invalid ngcrypt message") }
+	
+	/* Unsplit messages have exactly one body block. */
+	o.Split = n>2
+	return o,nil
+}
@@ -0,0 +1,194 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package ngcrypt
+
+import (
+	"io"
+	"fmt"
+	"bufio"
+	"bytes"
+	"strings"
+	"strconv"
+	"encoding/base64"
+	
+	"github.com/emersion/go-message/textproto"
+)
+
+/*
+The structure manifest of a Version 4 message. It is stored encrypted in Part 1, right after
+the original header.
+
+If the original body was split, each top-level MIME part of the original body is stored
+in an encrypted part of it's own: The original part n is stored in Part n+1. The "Glue" is
+everything between these parts (the delimiter lines, the preamble and the epilogue), so that
+the original body can be restored byte by byte.
+*/
+type Manifest struct {
+	/*
+	The number of top-level parts of the original body, or 0 if the body was not split
+	and is stored as a whole in Part 2.
+	*/
+	Parts int
+	
+	glue [][]byte
+}
+
+/* The manifest header names, see SPEC.md */
+const (
+	manifestLayout = "Layout"
+	manifestParts = "Parts"
+	manifestGlue = "Glue"
+)
+
+/*
+Returns true, if the body has been split into one encrypted part per top-level MIME part.
+
+A nil manifest (messages prior to Version 4) is never split.
+*/
+func (m *Manifest) Split() bool {
+	return m!=nil && m.Parts>0
+}
+
+/*
+Returns the number of the encrypted part containing the top-level part n (starting at 1)
+of the original body. If the body is not split, this is Part 2.
+*/
+func (m *Manifest) EncryptedPart(n int) int {
+	if m.Split() { return n+1 }
+	return 2
+}
+
+/*
+Returns the numbers of all encrypted parts, that contain the original body.
+*/
+func (m *Manifest) BodyParts() []int {
+	if !m.Split() { return []int{2} }
+	l := make([]int,m.Parts)
+	for i := range l { l[i] = i+2 }
+	return l
+}
+
+/*
+Restores the original body from the decrypted parts (in order, as given by BodyParts).
+*/
+func (m *Manifest) Assemble(w io.Writer, parts []Literal) error {
+	if !m.Split() {
+		for _,p := range parts {
+			if _,err := io.Copy(w,p); err!=nil { return err }
+		}
+		return nil
+	}
+	if len(parts)!=m.Parts { return fmt.Errorf("ngcrypt: need %d parts, got %d",m.Parts,len(parts)) }
+	for i,p := range parts {
+		if _,err := w.Write(m.glue[i]); err!=nil { return err }
+		if _,err := io.Copy(w,p); err!=nil { return err }
+	}
+	_,err := w.Write(m.glue[m.Parts])
+	return err
+}
+
+func (m *Manifest) writeTo(w io.Writer) error {
+	buf := new(bytes.Buffer)
+	if !m.Split() {
+		fmt.Fprintf(buf,"%s: single\r\n",manifestLayout)
+	} else {
+		fmt.Fprintf(buf,"%s: split\r\n",manifestLayout)
+		fmt.Fprintf(buf,"%s: %d\r\n",manifestParts,m.Parts)
+		gl := make([]string,len(m.glue))
+		for i,g := range m.glue { gl[i] = base64.StdEncoding.EncodeToString(g) }
+		fmt.Fprintf(buf,"%s: %s\r\n",manifestGlue,strings.Join(gl,","))
+	}
+	buf.WriteString("\r\n")
+	_,err := buf.WriteTo(w)
+	return err
+}
+
+func readManifest(r io.Reader) (*Manifest,error) {
+	h,err := textproto.ReadHeader(bufio.NewReader(r))
+	if err!=nil { return nil,err }
+	
+	m := new(Manifest)
+	switch l := strings.TrimSpace(h.Get(manifestLayout)); l {
+	case "single": return m,nil
+	case "split":
+	default: return nil,fmt.Errorf("ngcrypt: unknown layout %q",l)
+	}
+	
+	m.Parts,err = strconv.Atoi(strings.TrimSpace(h.Get(manifestParts)))
+	if err!=nil || m.Parts<1 { return nil,fmt.Errorf("ngcrypt: invalid manifest") }
+	
+	gl := strings.Split(strings.TrimSpace(h.Get(manifestGlue)),",")
+	if len(gl)!=m.Parts+1 { return nil,fmt.Errorf("ngcrypt: invalid manifest") }
+	m.glue = make([][]byte,len(gl))
+	for i,g := range gl {
+		m.glue[i],err = base64.StdEncoding.DecodeString(g)
+		if err!=nil { return nil,err }
+	}
+	return m,nil
+}
+
+/*
+Splits a multipart body into it's top-level parts (including their MIME headers) and the glue
+in between, as described by RFC2046, section 5.1.1.
+
+Returns false, if the body is not a well-formed multipart body.
+*/
+func splitMultipart(body []byte, boundary string) (glue, parts [][]byte, ok bool) {
+	dash := []byte("--"+boundary)
+	
+	start := -1 /* Start of the current part, -1 while in the preamble. */
+	last := 0   /* Start of the current glue. */
+	
+	for pos := 0; pos<len(body); {
+		end := bytes.IndexByte(body[pos:],'\n')
+		if end<0 { end = len(body) } else { end += pos+1 }
+		line := body[pos:end]
+		
+		if bytes.HasPrefix(line,dash) {
+			rest := bytes.TrimRight(line[len(dash):]," \t\r\n")
+			isClose := bytes.Equal(rest,[]byte("--"))
+			if len(rest)==0 || isClose {
+				/* The line break in front of the delimiter belongs to the delimiter. */
+				cut := pos
+				if start>=0 {
+					if cut>start && body[cut-1]=='\n' { cut-- }
+					if cut>start && body[cut-1]=='\r' { cut-- }
+					parts = append(parts,body[start:cut])
+					glue = append(glue,body[last:start])
+					last = cut
+				}
+				if isClose {
+					if start<0 { return nil,nil,false }
+					glue = append(glue,body[last:])
+					return glue,parts,true
+				}
+				start = end
+			}
+		}
+		pos = end
+	}
+	
+	/* No close delimiter. */
+	return nil,nil,false
+}
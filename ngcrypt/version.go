@@ -0,0 +1,104 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package ngcrypt
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	
+	"github.com/emersion/go-message"
+)
+
+/*
+Format versions of the NGCRYPT message format. See SPEC.md for the definition of each version.
+
+Messages and blocks, that carry no version header at all, are treated as Version1.
+*/
+const (
+	Version1 = 1
+	Version2 = 2
+	Version3 = 3
+	Version4 = 4
+	
+	/*
+	The latest version. Encrypt writes the lowest version, that has all the features the
+	message uses, see messageVersion.
+	*/
+	CurrentVersion = Version4
+)
+
+const (
+	/* The version header of the outer (unencrypted) message header. */
+	versionHeader = "X-Ngcrypt-Version"
+	
+	/* The version header within the ASCII Armor of each NGCRYPT BLOCK. */
+	blockVersionHeader = "Ngcrypt-Version"
+)
+
+/*
+Returned, if a message or block has a version, that is not supported by this implementation.
+*/
+type UnsupportedVersionError int
+func (e UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("ngcrypt: unsupported format version %d",int(e))
+}
+
+func parseVersion(s string) (int,error) {
+	s = strings.TrimSpace(s)
+	if s=="" { return Version1,nil }
+	v,err := strconv.Atoi(s)
+	if err!=nil || v<1 { return 0,fmt.Errorf("ngcrypt: invalid format version %q",s) }
+	return v,nil
+}
+
+/*
+Returns true, if the given (outer) message header belongs to an NGCRYPT message.
+*/
+func IsNgcrypt(h message.Header) bool {
+	return strings.EqualFold(strings.TrimSpace(h.Get("X-Ngcrypt-Pgp")),"enabled")
+}
+
+/*
+Returns the format version of an NGCRYPT message, given it's outer message header.
+
+Messages without X-Ngcrypt-Version header are Version1 messages.
+*/
+func MessageVersion(h message.Header) (int,error) {
+	return parseVersion(h.Get(versionHeader))
+}
+
+/*
+Returns the lowest version, that supports the encoding of a message: Version 2 for compressions
+other than DEFLATE, Version 3 for binary blocks and Version 4 for split messages.
+*/
+func messageVersion(blocks []blockOptions, split bool) int {
+	v := Version1
+	for _,bo := range blocks {
+		if bo.c!=CompressionDeflate && v<Version2 { v = Version2 }
+		if bo.binary && v<Version3 { v = Version3 }
+	}
+	if split { v = Version4 }
+	return v
+}
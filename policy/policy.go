@@ -0,0 +1,222 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+/*
+Per-mailbox encryption policy of the gateways: Which mailboxes are encrypted, and how. By default
+every message appended through a gateway is encrypted, and every fetched message is decrypted.
+A policy can exempt mailboxes (Spam and Trash, say) from encryption, or use another format for
+some (like Sent).
+*/
+package policy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	
+	"github.com/emersion/go-imap/backend"
+	
+	"github.com/mad-day/gaw-mail/format"
+)
+
+var ErrReadOnly = errors.New("policy: mailbox is read-only")
+
+type Action uint
+
+const (
+	/* Appended messages are encrypted, fetched messages are decrypted. */
+	Encrypt Action = iota
+	
+	/* Appended messages are stored unencrypted, fetched messages are still decrypted. */
+	Plain
+	
+	/* Messages are passed through as they are, in both directions. */
+	Untouched
+	
+	/* Fetched messages are decrypted, APPEND, COPY and MOVE into it are refused with ErrReadOnly. */
+	ReadOnly
+)
+
+var actionNames = [...]string{
+	Encrypt: "encrypt",
+	Plain: "plain",
+	Untouched: "untouched",
+	ReadOnly: "read-only",
+}
+
+func (a Action) String() string {
+	if int(a)<len(actionNames) { return actionNames[a] }
+	return fmt.Sprintf("Action(%d)",uint(a))
+}
+
+func ParseAction(s string) (Action,error) {
+	for i,n := range actionNames {
+		if strings.EqualFold(s,n) { return Action(i),nil }
+	}
+	return 0,fmt.Errorf("policy: unknown action %q",s)
+}
+
+/*
+A rule applies to a mailbox (and it's sub-mailboxes) or to the mailboxes with a SPECIAL-USE
+attribute.
+*/
+type Rule struct {
+	/* The mailbox name. Empty, if the rule is for an attribute. */
+	Mailbox string
+	
+	/* The SPECIAL-USE attribute, like imap.JunkAttr. */
+	Attribute string
+	
+	Action Action
+	
+	/*
+	The format of Encrypt. format.Default means the gateway's own format. The gateways decrypt
+	messages in mailboxes with another format of any supported format.
+	*/
+	Format format.Format
+}
+
+/*
+The rules are checked in order, the first match wins. Mailboxes, that no rule matches, are
+encrypted in the gateway's own format. A nil *Policy has no rules.
+*/
+type Policy struct {
+	Rules []Rule
+	
+	/* The hierarchy delimiter. Defaults to "/". */
+	Delimiter string
+}
+
+func (p *Policy) delim() string {
+	if p.Delimiter=="" { return "/" }
+	return p.Delimiter
+}
+
+func (p *Policy) matches(r *Rule, name string, attrs []string) bool {
+	if r.Attribute!="" {
+		for _,a := range attrs {
+			if strings.EqualFold(a,r.Attribute) { return true }
+		}
+		return false
+	}
+	name,rn := p.canon(name),p.canon(r.Mailbox)
+	return name==rn || strings.HasPrefix(name,rn+p.delim())
+}
+
+/* INBOX is case-insensitive, so is the INBOX part of it's sub-mailboxes. */
+func (p *Policy) canon(name string) string {
+	if len(name)<5 || !strings.EqualFold(name[:5],"INBOX") { return name }
+	if len(name)==5 || strings.HasPrefix(name[5:],p.delim()) { return "INBOX"+name[5:] }
+	return name
+}
+
+/*
+Returns the rule of the mailbox. The attributes are only looked up, if a rule needs them.
+*/
+func (p *Policy) Lookup(m backend.Mailbox) Rule {
+	return p.lookup(m.Name(),func() []string {
+		if info,err := m.Info(); err==nil && info!=nil { return info.Attributes }
+		return nil
+	})
+}
+
+func (p *Policy) lookup(name string, attributes func() []string) Rule {
+	if p==nil { return Rule{} }
+	var attrs []string
+	fetched := false
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if r.Attribute!="" && !fetched {
+			fetched = true
+			attrs = attributes()
+		}
+		if p.matches(r,name,attrs) { return *r }
+	}
+	return Rule{}
+}
+
+/*
+Returns ErrReadOnly, if the mailbox name of u is read-only, for the destination of COPY and MOVE.
+The attributes are taken from the mailbox list, the mailbox isn't selected: On imap-proxy, that
+would deselect the source mailbox. Mailboxes, that don't exist, are left to the backend to report.
+*/
+func (p *Policy) Writable(u backend.User, name string) error {
+	if p==nil || len(p.Rules)==0 { return nil }
+	rule := p.lookup(name,func() []string {
+		mailboxes,err := u.ListMailboxes(false)
+		if err!=nil { return nil }
+		for _,m := range mailboxes {
+			if p.canon(m.Name())!=p.canon(name) { continue }
+			if info,err := m.Info(); err==nil && info!=nil { return info.Attributes }
+		}
+		return nil
+	})
+	if rule.Action==ReadOnly { return ErrReadOnly }
+	return nil
+}
+
+/*
+Parses the rules, one per line. A line is a mailbox name or a SPECIAL-USE attribute, the action
+and, for encrypt, optionally the format (see format.ParseFormat):
+
+	# comment
+	\Junk     untouched
+	\Trash    plain
+	\Sent     encrypt pgp-mime
+	Archive   read-only
+
+Mailbox names containing spaces can't be given.
+*/
+func Parse(r io.Reader) ([]Rule,error) {
+	var rules []Rule
+	s := bufio.NewScanner(r)
+	for ln := 1; s.Scan(); ln++ {
+		line := strings.TrimSpace(s.Text())
+		if line=="" || line[0]=='#' { continue }
+		f := strings.Fields(line)
+		if len(f)<2 || len(f)>3 { return nil,fmt.Errorf("policy: line %d: expected mailbox, action and format",ln) }
+		var rule Rule
+		if f[0][0]=='\\' { rule.Attribute = f[0] } else { rule.Mailbox = f[0] }
+		var err error
+		if rule.Action,err = ParseAction(f[1]); err!=nil { return nil,fmt.Errorf("policy: line %d: %v",ln,err) }
+		if len(f)==3 {
+			if rule.Action!=Encrypt { return nil,fmt.Errorf("policy: line %d: a format needs encrypt",ln) }
+			if rule.Format,err = format.ParseFormat(f[2]); err!=nil { return nil,fmt.Errorf("policy: line %d: %v",ln,err) }
+		}
+		rules = append(rules,rule)
+	}
+	return rules,s.Err()
+}
+
+/* Loads a policy from a file, see Parse. */
+func Load(fn string) (*Policy,error) {
+	f,err := os.Open(fn)
+	if err!=nil { return nil,err }
+	defer f.Close()
+	rules,err := Parse(f)
+	if err!=nil { return nil,err }
+	return &Policy{Rules: rules},nil
+}
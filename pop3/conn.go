@@ -0,0 +1,294 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package pop3
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+	
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+type conn struct {
+	s *Server
+	c net.Conn
+	r *textproto.Reader
+	w *bufio.Writer
+	
+	/* Set by USER, until PASS. */
+	username string
+	
+	/* Set in the TRANSACTION state. */
+	user backend.User
+	md *maildrop
+}
+
+func newConn(s *Server, c net.Conn) *conn {
+	cn := &conn{s: s}
+	cn.setConn(c)
+	return cn
+}
+
+func (c *conn) setConn(nc net.Conn) {
+	c.c = nc
+	c.r = textproto.NewReader(bufio.NewReader(nc))
+	c.w = bufio.NewWriter(nc)
+}
+
+func (c *conn) Close() error {
+	return c.c.Close()
+}
+
+func (c *conn) isTLS() bool {
+	_,ok := c.c.(*tls.Conn)
+	return ok
+}
+
+func (c *conn) ok(f string, args ...interface{}) error {
+	fmt.Fprintf(c.w,"+OK "+f+"\r\n",args...)
+	return c.w.Flush()
+}
+
+func (c *conn) err(f string, args ...interface{}) error {
+	fmt.Fprintf(c.w,"-ERR "+f+"\r\n",args...)
+	return c.w.Flush()
+}
+
+/* Sends a positive multi-line response, b is dot-stuffed. */
+func (c *conn) multiline(status string, b []byte) error {
+	fmt.Fprintf(c.w,"+OK %s\r\n",status)
+	dw := textproto.NewWriter(c.w).DotWriter()
+	if _,err := dw.Write(b); err!=nil { return err }
+	if err := dw.Close(); err!=nil { return err }
+	return c.w.Flush()
+}
+
+func (c *conn) serve() error {
+	defer c.Close()
+	defer func() {
+		if c.user!=nil { c.user.Logout() }
+	}()
+	
+	if err := c.ok("POP3 server ready"); err!=nil { return err }
+	for {
+		c.c.SetDeadline(time.Now().Add(c.s.timeout()))
+		line,err := c.r.ReadLine()
+		if err==io.EOF {
+			return nil
+		} else if err!=nil {
+			return err
+		}
+		
+		args := strings.Fields(line)
+		if len(args)==0 {
+			if err = c.err("empty command"); err!=nil { return err }
+			continue
+		}
+		cmd := strings.ToUpper(args[0])
+		args = args[1:]
+		
+		if cmd=="QUIT" { return c.quit() }
+		if c.user==nil {
+			err = c.authorization(cmd,args)
+		} else {
+			err = c.transaction(cmd,args)
+		}
+		if err!=nil { return err }
+	}
+}
+
+func (c *conn) capa() error {
+	caps := []string{"USER","UIDL","TOP","RESP-CODES"}
+	if c.user==nil && c.s.TLSConfig!=nil && !c.isTLS() { caps = append(caps,"STLS") }
+	return c.multiline("capability list follows",[]byte(strings.Join(caps,"\r\n")+"\r\n"))
+}
+
+/* Handles a command in the AUTHORIZATION state. */
+func (c *conn) authorization(cmd string, args []string) error {
+	switch cmd {
+	case "CAPA":
+		return c.capa()
+	case "STLS":
+		if c.s.TLSConfig==nil || c.isTLS() { return c.err("STLS not available") }
+		if err := c.ok("begin TLS negotiation"); err!=nil { return err }
+		tc := tls.Server(c.c,c.s.TLSConfig)
+		if err := tc.Handshake(); err!=nil { return err }
+		c.setConn(tc)
+		c.username = ""
+		return nil
+	case "USER":
+		if len(args)!=1 { return c.err("usage: USER name") }
+		if !c.isTLS() && !c.s.AllowInsecureAuth { return c.err("[AUTH] TLS required, use STLS") }
+		c.username = args[0]
+		return c.ok("send PASS")
+	case "PASS":
+		if c.username=="" { return c.err("send USER first") }
+		username := c.username
+		c.username = ""
+		/* The password may contain spaces. */
+		if len(args)==0 { return c.err("usage: PASS password") }
+		return c.login(username,strings.Join(args," "))
+	}
+	return c.err("unknown command or wrong state")
+}
+
+func (c *conn) login(username, password string) error {
+	info := &imap.ConnInfo{RemoteAddr: c.c.RemoteAddr(), LocalAddr: c.c.LocalAddr()}
+	if tc,ok := c.c.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		info.TLS = &state
+	}
+	
+	u,err := c.s.Backend.Login(info,username,password)
+	if err!=nil {
+		/* Backends don't agree on the error for bad credentials. */
+		if err!=backend.ErrInvalidCredentials { c.s.logf("login of %s: %v",username,err) }
+		return c.err("[AUTH] authentication failed")
+	}
+	
+	md,err := openMaildrop(u,c.s.mailbox())
+	if err!=nil {
+		u.Logout()
+		c.s.logf("mailbox of %s: %v",username,err)
+		return c.err("[SYS/TEMP] cannot open mailbox")
+	}
+	c.user,c.md = u,md
+	
+	/* The sizes are counted on STAT or LIST only. */
+	return c.ok("%d messages",len(md.msgs))
+}
+
+/* Handles a command in the TRANSACTION state. */
+func (c *conn) transaction(cmd string, args []string) error {
+	md := c.md
+	switch cmd {
+	case "CAPA":
+		return c.capa()
+	case "NOOP":
+		return c.ok("")
+	case "STAT":
+		n,size,err := md.stat()
+		if err!=nil { return c.sysErr(err) }
+		return c.ok("%d %d",n,size)
+	case "RSET":
+		md.reset()
+		return c.ok("%d messages",len(md.msgs))
+	case "LIST","UIDL":
+		line := func(i int, msg *message) string {
+			if cmd=="LIST" { return fmt.Sprintf("%d %d",i+1,msg.size) }
+			return fmt.Sprintf("%d %s",i+1,md.uniqueID(msg))
+		}
+		if len(args)>0 {
+			msg,err := md.get(args[0])
+			if err!=nil { return c.err("%v",err) }
+			if cmd=="LIST" {
+				if err = md.count(msg); err!=nil { return c.sysErr(err) }
+			}
+			n,_ := strconv.Atoi(args[0])
+			return c.ok("%s",line(n-1,msg))
+		}
+		if cmd=="LIST" {
+			if err := md.count(md.present()...); err!=nil { return c.sysErr(err) }
+		}
+		b := new(bytes.Buffer)
+		for i,msg := range md.msgs {
+			if msg.deleted { continue }
+			fmt.Fprintf(b,"%s\r\n",line(i,msg))
+		}
+		return c.multiline("listing follows",b.Bytes())
+	case "RETR","TOP":
+		if len(args)!=1 && !(cmd=="TOP" && len(args)==2) { return c.err("usage: RETR msg or TOP msg n") }
+		msg,err := md.get(args[0])
+		if err!=nil { return c.err("%v",err) }
+		raw,err := md.fetch(msg)
+		if err!=nil {
+			c.s.logf("fetch of UID %d: %v",msg.uid,err)
+			return c.err("[SYS/TEMP] cannot retrieve message")
+		}
+		if cmd=="TOP" {
+			n,err := strconv.Atoi(args[1])
+			if err!=nil || n<0 { return c.err("invalid number of lines") }
+			raw = top(raw,n)
+		}
+		return c.multiline(fmt.Sprintf("%d octets",len(raw)),raw)
+	case "DELE":
+		if len(args)!=1 { return c.err("usage: DELE msg") }
+		msg,err := md.get(args[0])
+		if err!=nil { return c.err("%v",err) }
+		msg.deleted = true
+		return c.ok("message deleted")
+	}
+	return c.err("unknown command or wrong state")
+}
+
+/* Ends the session. In the TRANSACTION state, the deleted messages are removed (UPDATE state). */
+func (c *conn) quit() error {
+	if c.md!=nil {
+		left,err := c.md.commit()
+		if err!=nil {
+			c.s.logf("delete: %v",err)
+			return c.err("[SYS/TEMP] some deleted messages not removed")
+		}
+		if len(left)!=0 {
+			c.s.logf("UIDs %v flagged \\Deleted, but not expunged: other messages are flagged \\Deleted",left)
+			return c.err("some deleted messages not removed, other messages are flagged \\Deleted")
+		}
+	}
+	return c.ok("bye")
+}
+
+/* Logs err, and tells the client to try again later. */
+func (c *conn) sysErr(err error) error {
+	c.s.logf("%v",err)
+	return c.err("[SYS/TEMP] cannot read mailbox")
+}
+
+/* Returns the header and the first n lines of the body. */
+func top(raw []byte, n int) []byte {
+	i := 0
+	/* Skip the header, up to and including the empty line. */
+	for i<len(raw) {
+		eol := bytes.IndexByte(raw[i:],'\n')
+		if eol<0 { return raw }
+		line := raw[i:i+eol+1]
+		i += eol+1
+		if len(bytes.TrimRight(line,"\r\n"))==0 { break }
+	}
+	for ; n>0 && i<len(raw); n-- {
+		eol := bytes.IndexByte(raw[i:],'\n')
+		if eol<0 { return raw }
+		i += eol+1
+	}
+	return raw[:i]
+}
@@ -0,0 +1,203 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package pop3
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	
+	imapexpunge "github.com/mad-day/gaw-mail/util/imap-expunge"
+)
+
+type message struct {
+	uid uint32
+	
+	/*
+	The size of the message, as retrieved. Counted, when it's first needed (see count), as a
+	decrypting gateway may report the RFC822.SIZE of the stored message. Never changed after.
+	*/
+	size uint32
+	sized bool
+	deleted bool
+}
+
+/* A snapshot of the mailbox, taken at login, as POP3 message numbers must not change. */
+type maildrop struct {
+	mbox backend.Mailbox
+	uidValidity uint32
+	msgs []*message
+}
+
+func listMessages(mbox backend.Mailbox, seq *imap.SeqSet, items []imap.FetchItem) ([]*imap.Message,error) {
+	ch := make(chan *imap.Message,16)
+	done := make(chan error,1)
+	go func() { done <- mbox.ListMessages(true,seq,items,ch) }()
+	var msgs []*imap.Message
+	for msg := range ch { msgs = append(msgs,msg) }
+	return msgs,<-done
+}
+
+func openMaildrop(u backend.User, name string) (*maildrop,error) {
+	mbox,err := u.GetMailbox(name)
+	if err!=nil { return nil,err }
+	st,err := mbox.Status([]imap.StatusItem{imap.StatusUidValidity})
+	if err!=nil { return nil,err }
+	
+	seq := new(imap.SeqSet)
+	seq.AddRange(1,0)
+	list,err := listMessages(mbox,seq,[]imap.FetchItem{imap.FetchUid})
+	if err!=nil { return nil,err }
+	
+	m := &maildrop{mbox: mbox, uidValidity: st.UidValidity}
+	for _,msg := range list {
+		m.msgs = append(m.msgs,&message{uid: msg.Uid})
+	}
+	return m,nil
+}
+
+/*
+Counts the sizes of msgs, that are not known yet. The messages are fetched, as RETR would, but
+not kept. Messages, that have disappeared meanwhile, count as empty.
+*/
+func (m *maildrop) count(msgs ...*message) error {
+	seq := new(imap.SeqSet)
+	byUid := make(map[uint32]*message)
+	for _,msg := range msgs {
+		if msg.sized { continue }
+		seq.AddNum(msg.uid)
+		byUid[msg.uid] = msg
+	}
+	if seq.Empty() { return nil }
+	
+	ch := make(chan *imap.Message,16)
+	done := make(chan error,1)
+	go func() { done <- m.mbox.ListMessages(true,seq,[]imap.FetchItem{imap.FetchUid,sectionAll.FetchItem()},ch) }()
+	
+	for l := range ch {
+		msg := byUid[l.Uid]
+		lit := entireBody(l)
+		if msg==nil || lit==nil { continue }
+		n,_ := io.Copy(ioutil.Discard,lit)
+		msg.size = uint32(n)
+	}
+	if err := <-done; err!=nil { return err }
+	for _,msg := range byUid { msg.sized = true }
+	return nil
+}
+
+var (
+	errNoSuchMessage = errors.New("no such message")
+	errDeleted = errors.New("message already deleted")
+)
+
+/* Returns the message with the number arg (counting from 1). */
+func (m *maildrop) get(arg string) (*message,error) {
+	n,err := strconv.Atoi(arg)
+	if err!=nil || n<1 || n>len(m.msgs) { return nil,errNoSuchMessage }
+	msg := m.msgs[n-1]
+	if msg.deleted { return nil,errDeleted }
+	return msg,nil
+}
+
+/* The messages, that are not deleted. */
+func (m *maildrop) present() []*message {
+	var msgs []*message
+	for _,msg := range m.msgs {
+		if !msg.deleted { msgs = append(msgs,msg) }
+	}
+	return msgs
+}
+
+/* The number and total size of the messages, that are not deleted. */
+func (m *maildrop) stat() (n int, size uint64, err error) {
+	msgs := m.present()
+	if err = m.count(msgs...); err!=nil { return }
+	for _,msg := range msgs {
+		size += uint64(msg.size)
+	}
+	return len(msgs),size,nil
+}
+
+/* Unique-ids stay the same across sessions, as long as the UIDVALIDITY does. */
+func (m *maildrop) uniqueID(msg *message) string {
+	return fmt.Sprintf("%d.%d",m.uidValidity,msg.uid)
+}
+
+var sectionAll = &imap.BodySectionName{Peek: true}
+
+/* Fetches the whole message, decrypted if the backend is a decrypting gateway. */
+func (m *maildrop) fetch(msg *message) ([]byte,error) {
+	seq := new(imap.SeqSet)
+	seq.AddNum(msg.uid)
+	list,err := listMessages(m.mbox,seq,[]imap.FetchItem{imap.FetchUid,sectionAll.FetchItem()})
+	if err!=nil { return nil,err }
+	for _,l := range list {
+		if l.Uid!=msg.uid { continue }
+		lit := entireBody(l)
+		if lit==nil { continue }
+		raw,err := ioutil.ReadAll(lit)
+		if err==nil && !msg.sized { msg.size,msg.sized = uint32(len(raw)),true }
+		return raw,err
+	}
+	return nil,errors.New("message disappeared")
+}
+
+/* The fetched sectionAll of msg, or nil. */
+func entireBody(msg *imap.Message) imap.Literal {
+	for s,lit := range msg.Body {
+		if s.Specifier==imap.EntireSpecifier && len(s.Path)==0 && s.Fields==nil && lit!=nil { return lit }
+	}
+	return nil
+}
+
+func (m *maildrop) reset() {
+	for _,msg := range m.msgs { msg.deleted = false }
+}
+
+/*
+Deletes the messages marked with DELE. They are flagged as \Deleted, and the mailbox is expunged
+unless an IMAP client has flagged other messages \Deleted, which must not be removed. In that case,
+the UIDs of the messages left behind are returned; they are removed by the next EXPUNGE.
+*/
+func (m *maildrop) commit() (left []uint32, err error) {
+	var uids []uint32
+	for _,msg := range m.msgs {
+		if msg.deleted { uids = append(uids,msg.uid) }
+	}
+	if len(uids)==0 { return nil,nil }
+	seq := new(imap.SeqSet)
+	seq.AddNum(uids...)
+	if err = m.mbox.UpdateMessagesFlags(true,seq,imap.AddFlags,[]string{imap.DeletedFlag}); err!=nil { return nil,err }
+	ok,err := imapexpunge.Only(m.mbox,uids)
+	if err!=nil { return nil,err }
+	if !ok { return uids,nil }
+	return nil,nil
+}
@@ -0,0 +1,187 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+/*
+A POP3 (RFC 1939) server, that serves the INBOX of any go-imap backend.Backend.
+
+Put in front of a decrypting gateway (imap-ex or ngcrypt/imap), it gives POP3-only clients the
+decrypted messages:
+
+	s := pop3.New(gateway)
+	s.TLSConfig = tlsConfig
+	log.Fatal(s.ListenAndServeTLS(":995"))
+
+Supported commands are USER, PASS, STAT, LIST, UIDL, RETR, TOP, DELE, NOOP, RSET, QUIT, CAPA and
+STLS (if TLSConfig is set).
+*/
+package pop3
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+	
+	"github.com/emersion/go-imap/backend"
+)
+
+var ErrServerClosed = errors.New("pop3: server closed")
+
+type Server struct {
+	Backend backend.Backend
+	
+	/* The mailbox, that is served. Defaults to "INBOX". */
+	Mailbox string
+	
+	/* Enables STLS, and is used by ListenAndServeTLS. */
+	TLSConfig *tls.Config
+	
+	/* Allows USER and PASS on connections without TLS. */
+	AllowInsecureAuth bool
+	
+	/* The idle timeout. RFC 1939 requires at least 10 minutes, which is the default. */
+	Timeout time.Duration
+	
+	/* Defaults to a logger writing to stderr. */
+	ErrorLog *log.Logger
+	
+	mutex sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns map[*conn]struct{}
+	closed bool
+}
+
+func New(be backend.Backend) *Server {
+	return &Server{Backend: be}
+}
+
+func (s *Server) mailbox() string {
+	if s.Mailbox=="" { return "INBOX" }
+	return s.Mailbox
+}
+
+func (s *Server) timeout() time.Duration {
+	if s.Timeout==0 { return 10*time.Minute }
+	return s.Timeout
+}
+
+func (s *Server) logf(f string, args ...interface{}) {
+	l := s.ErrorLog
+	if l==nil { l = log.New(os.Stderr,"pop3: ",log.LstdFlags) }
+	l.Printf(f,args...)
+}
+
+/* Accepts connections on l, until l fails or the server is closed. */
+func (s *Server) Serve(l net.Listener) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return ErrServerClosed
+	}
+	if s.listeners==nil { s.listeners = make(map[net.Listener]struct{}) }
+	s.listeners[l] = struct{}{}
+	s.mutex.Unlock()
+	
+	defer func() {
+		s.mutex.Lock()
+		delete(s.listeners,l)
+		s.mutex.Unlock()
+	}()
+	
+	for {
+		c,err := l.Accept()
+		if err!=nil {
+			s.mutex.Lock()
+			closed := s.closed
+			s.mutex.Unlock()
+			if closed { return ErrServerClosed }
+			return err
+		}
+		go s.ServeConn(c)
+	}
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	if addr=="" { addr = ":110" }
+	l,err := net.Listen("tcp",addr)
+	if err!=nil { return err }
+	return s.Serve(l)
+}
+
+/* Listens for implicit TLS connections (POP3S). */
+func (s *Server) ListenAndServeTLS(addr string) error {
+	if s.TLSConfig==nil { return errors.New("pop3: TLSConfig is not set") }
+	if addr=="" { addr = ":995" }
+	l,err := tls.Listen("tcp",addr,s.TLSConfig)
+	if err!=nil { return err }
+	return s.Serve(l)
+}
+
+/*
+Serves a single connection, and closes it when done. Useful to run the server in-process, on one
+end of a net.Pipe.
+*/
+func (s *Server) ServeConn(c net.Conn) {
+	cn := newConn(s,c)
+	
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		c.Close()
+		return
+	}
+	if s.conns==nil { s.conns = make(map[*conn]struct{}) }
+	s.conns[cn] = struct{}{}
+	s.mutex.Unlock()
+	
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns,cn)
+		s.mutex.Unlock()
+	}()
+	
+	if err := cn.serve(); err!=nil {
+		s.logf("%v: %v",c.RemoteAddr(),err)
+	}
+}
+
+/*
+Stops all listeners and closes all connections. Sessions, that did not QUIT, don't delete
+messages.
+*/
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	
+	s.closed = true
+	var err error
+	for l := range s.listeners {
+		if e := l.Close(); e!=nil && err==nil { err = e }
+	}
+	for c := range s.conns { c.Close() }
+	return err
+}
@@ -0,0 +1,257 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package pop3
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+)
+
+/*
+Serves be on the loopback interface. go-imap's memory backend knows the user "username" with the
+password "password" and has one message in INBOX.
+*/
+func newTestServer(t *testing.T, be backend.Backend) string {
+	l,err := net.Listen("tcp","127.0.0.1:0")
+	if err!=nil { t.Fatal(err) }
+	s := New(be)
+	s.AllowInsecureAuth = true
+	s.ErrorLog = log.New(ioutil.Discard,"",0)
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return l.Addr().String()
+}
+
+type testClient struct {
+	t *testing.T
+	*textproto.Conn
+}
+
+/* Connects to the server at addr and logs in. */
+func dial(t *testing.T, addr string) *testClient {
+	nc,err := net.Dial("tcp",addr)
+	if err!=nil { t.Fatal(err) }
+	c := &testClient{t,textproto.NewConn(nc)}
+	t.Cleanup(func() { c.Close() })
+	c.expect("","+OK")
+	c.expect("USER username","+OK")
+	c.expect("PASS password","+OK")
+	return c
+}
+
+/* Sends cmd (if any) and returns the response line, which must start with status. */
+func (c *testClient) expect(cmd, status string) string {
+	c.t.Helper()
+	if cmd!="" { c.PrintfLine("%s",cmd) }
+	line,err := c.ReadLine()
+	if err!=nil { c.t.Fatal(err) }
+	if !strings.HasPrefix(line,status) { c.t.Fatalf("%s: %s",cmd,line) }
+	return line
+}
+
+/* Sends cmd and returns the multi-line response. */
+func (c *testClient) multiline(cmd string) string {
+	c.t.Helper()
+	c.expect(cmd,"+OK")
+	b,err := c.ReadDotBytes()
+	if err!=nil { c.t.Fatal(err) }
+	return string(b)
+}
+
+func inbox(t *testing.T, be backend.Backend) backend.Mailbox {
+	u,err := be.Login(nil,"username","password")
+	if err!=nil { t.Fatal(err) }
+	mbox,err := u.GetMailbox("INBOX")
+	if err!=nil { t.Fatal(err) }
+	return mbox
+}
+
+func addMessage(t *testing.T, mbox backend.Mailbox, flags []string, body string) {
+	if err := mbox.CreateMessage(flags,time.Now(),bytes.NewBufferString(body)); err!=nil { t.Fatal(err) }
+}
+
+func countMessages(t *testing.T, mbox backend.Mailbox) uint32 {
+	st,err := mbox.Status([]imap.StatusItem{imap.StatusMessages})
+	if err!=nil { t.Fatal(err) }
+	return st.Messages
+}
+
+const testMessage = "From: a@example.org\r\nSubject: second\r\n\r\nline one\r\nline two\r\n"
+
+func TestSession(t *testing.T) {
+	be := memory.New()
+	mbox := inbox(t,be)
+	addMessage(t,mbox,nil,testMessage)
+	c := dial(t,newTestServer(t,be))
+	
+	if l := c.expect("STAT","+OK"); l!="+OK 2 "+itoa(len(testMessage)+firstSize(t,mbox)) {
+		t.Fatal(l)
+	}
+	if l := c.expect("LIST 2","+OK"); l!="+OK 2 "+itoa(len(testMessage)) { t.Fatal(l) }
+	if l := c.multiline("UIDL"); l!="1 1.6\n2 1.7\n" { t.Fatalf("%q",l) }
+	if l := c.multiline("RETR 2"); l!=strings.Replace(testMessage,"\r\n","\n",-1) { t.Fatalf("%q",l) }
+	if l := c.multiline("TOP 2 1"); l!="From: a@example.org\nSubject: second\n\nline one\n" { t.Fatalf("%q",l) }
+	
+	c.expect("DELE 1","+OK")
+	c.expect("DELE 1","-ERR")
+	c.expect("RETR 1","-ERR")
+	if l := c.expect("STAT","+OK"); l!="+OK 1 "+itoa(len(testMessage)) { t.Fatal(l) }
+	c.expect("RSET","+OK")
+	c.expect("STAT","+OK 2 ")
+	c.expect("DELE 2","+OK")
+	c.expect("QUIT","+OK")
+	
+	if n := countMessages(t,mbox); n!=1 { t.Fatalf("%d messages left",n) }
+}
+
+func TestQuitKeepsDeleted(t *testing.T) {
+	be := memory.New()
+	mbox := inbox(t,be)
+	addMessage(t,mbox,[]string{imap.DeletedFlag},testMessage)
+	c := dial(t,newTestServer(t,be))
+	
+	c.expect("DELE 1","+OK")
+	c.expect("QUIT","-ERR")
+	
+	/* Neither message is expunged, the one deleted with DELE stays flagged. */
+	if n := countMessages(t,mbox); n!=2 { t.Fatalf("%d messages left",n) }
+	seq := new(imap.SeqSet)
+	seq.AddNum(6)
+	list,err := listMessages(mbox,seq,[]imap.FetchItem{imap.FetchUid,imap.FetchFlags})
+	if err!=nil || len(list)!=1 { t.Fatal(list,err) }
+	if !hasDeleted(list[0].Flags) { t.Fatal(list[0].Flags) }
+}
+
+func hasDeleted(flags []string) bool {
+	for _,f := range flags {
+		if f==imap.DeletedFlag { return true }
+	}
+	return false
+}
+
+/*
+A gateway, that makes the messages longer, as decryption would, and reports the RFC822.SIZE of the
+stored message. It counts the messages fetched as a whole.
+*/
+type gatewayBackend struct {
+	backend.Backend
+	mutex sync.Mutex
+	fetched []uint32
+}
+type gatewayUser struct {
+	backend.User
+	be *gatewayBackend
+}
+type gatewayMailbox struct {
+	backend.Mailbox
+	be *gatewayBackend
+}
+
+const padding = "X-Decrypted: yes\r\n"
+
+func (be *gatewayBackend) Login(info *imap.ConnInfo, username, password string) (backend.User,error) {
+	u,err := be.Backend.Login(info,username,password)
+	if err!=nil { return nil,err }
+	return gatewayUser{u,be},nil
+}
+func (u gatewayUser) GetMailbox(name string) (backend.Mailbox,error) {
+	m,err := u.User.GetMailbox(name)
+	if err!=nil { return nil,err }
+	return gatewayMailbox{m,u.be},nil
+}
+func (m gatewayMailbox) ListMessages(uid bool, seq *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+	in := make(chan *imap.Message)
+	done := make(chan error,1)
+	go func() { done <- m.Mailbox.ListMessages(uid,seq,items,in) }()
+	for msg := range in {
+		for s,l := range msg.Body {
+			raw,_ := ioutil.ReadAll(l)
+			msg.Body[s] = bytes.NewReader(append([]byte(padding),raw...))
+			m.be.mutex.Lock()
+			m.be.fetched = append(m.be.fetched,msg.Uid)
+			m.be.mutex.Unlock()
+		}
+		ch <- msg
+	}
+	return <-done
+}
+
+func (be *gatewayBackend) takeFetched() []uint32 {
+	be.mutex.Lock()
+	defer be.mutex.Unlock()
+	f := be.fetched
+	be.fetched = nil
+	return f
+}
+
+func TestSizes(t *testing.T) {
+	mem := memory.New()
+	mbox := inbox(t,mem)
+	addMessage(t,mbox,nil,testMessage)
+	be := &gatewayBackend{Backend: mem}
+	c := dial(t,newTestServer(t,be))
+	
+	/* Nothing is fetched at login, or for UIDL. */
+	c.multiline("UIDL")
+	if f := be.takeFetched(); len(f)!=0 { t.Fatal(f) }
+	
+	size := itoa(len(padding)+len(testMessage))
+	c.multiline("RETR 2")
+	if f := be.takeFetched(); len(f)!=1 || f[0]!=7 { t.Fatal(f) }
+	if l := c.expect("LIST 2","+OK"); l!="+OK 2 "+size { t.Fatal(l) }
+	if f := be.takeFetched(); len(f)!=0 { t.Fatal(f) }
+	
+	/* STAT counts the other message once. */
+	total := itoa(2*len(padding)+len(testMessage)+firstSize(t,mbox))
+	if l := c.expect("STAT","+OK"); l!="+OK 2 "+total { t.Fatal(l) }
+	if l := c.multiline("LIST"); l!="1 "+itoa(len(padding)+firstSize(t,mbox))+"\n2 "+size+"\n" { t.Fatalf("%q",l) }
+	if f := be.takeFetched(); len(f)!=1 || f[0]!=6 { t.Fatal(f) }
+}
+
+/* The size of the message, that the memory backend starts with. */
+func firstSize(t *testing.T, mbox backend.Mailbox) int {
+	seq := new(imap.SeqSet)
+	seq.AddNum(6)
+	list,err := listMessages(mbox,seq,[]imap.FetchItem{imap.FetchUid,imap.FetchRFC822Size})
+	if err!=nil || len(list)!=1 { t.Fatal(list,err) }
+	return int(list[0].Size)
+}
+
+func itoa(n int) string {
+	return strconv.Itoa(n)
+}
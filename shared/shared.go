@@ -0,0 +1,164 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+/*
+Shared (team) mailboxes: Messages appended to a shared mailbox are encrypted to the keys of all
+it's members, so that every member can read them through the gateway.
+*/
+package shared
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	
+	"golang.org/x/crypto/openpgp"
+)
+
+var ErrAccessDenied = errors.New("shared: access denied")
+
+/*
+The access control list of the shared mailboxes.
+*/
+type ACL struct {
+	/*
+	Shared mailbox name -> usernames of the members.
+	A shared mailbox includes all it's sub-mailboxes ("Shared/Ops" includes "Shared/Ops/Alerts").
+	*/
+	Mailboxes map[string][]string
+	
+	/* Username -> public keys. */
+	Keys map[string]openpgp.EntityList
+	
+	/* The hierarchy delimiter. Defaults to "/". */
+	Delimiter string
+}
+
+func (a *ACL) delim() string {
+	if a.Delimiter=="" { return "/" }
+	return a.Delimiter
+}
+
+/*
+Returns the name of the shared mailbox, that contains mailbox. If mailbox is not shared,
+ok is false.
+*/
+func (a *ACL) Shared(mailbox string) (name string, ok bool) {
+	d := a.delim()
+	for n := range a.Mailboxes {
+		if mailbox!=n && !strings.HasPrefix(mailbox,n+d) { continue }
+		/* The longest (innermost) match wins. */
+		if len(n)>=len(name) { name,ok = n,true }
+	}
+	return
+}
+
+/*
+Returns the members of the mailbox, or nil if it is not shared.
+*/
+func (a *ACL) Members(mailbox string) []string {
+	n,ok := a.Shared(mailbox)
+	if !ok { return nil }
+	return a.Mailboxes[n]
+}
+
+/*
+Returns true, if the user may access the mailbox. Mailboxes, that are not shared, are
+accessible to everyone.
+*/
+func (a *ACL) Allowed(username, mailbox string) bool {
+	n,ok := a.Shared(mailbox)
+	if !ok { return true }
+	for _,m := range a.Mailboxes[n] {
+		if m==username { return true }
+	}
+	return false
+}
+
+/*
+Returns the keys of all members of the mailbox. If the mailbox is not shared, nil is returned,
+and the user's own keys should be used.
+*/
+func (a *ACL) Recipients(username, mailbox string) (openpgp.EntityList,error) {
+	n,ok := a.Shared(mailbox)
+	if !ok { return nil,nil }
+	if !a.Allowed(username,mailbox) { return nil,ErrAccessDenied }
+	
+	var kr openpgp.EntityList
+	seen := make(map[uint64]bool)
+	for _,m := range a.Mailboxes[n] {
+		keys := a.Keys[m]
+		if len(keys)==0 { return nil,fmt.Errorf("shared: no keys for member %q of %q",m,n) }
+		for _,e := range keys {
+			if seen[e.PrimaryKey.KeyId] { continue }
+			seen[e.PrimaryKey.KeyId] = true
+			kr = append(kr,e)
+		}
+	}
+	return kr,nil
+}
+
+/*
+Parses the shared mailboxes, one per line:
+
+	# comment
+	Shared/Ops: alice bob carol
+	Shared/Sales: dave, erin
+*/
+func ParseMailboxes(r io.Reader) (map[string][]string,error) {
+	m := make(map[string][]string)
+	s := bufio.NewScanner(r)
+	for ln := 1; s.Scan(); ln++ {
+		line := strings.TrimSpace(s.Text())
+		if line=="" || line[0]=='#' { continue }
+		i := strings.LastIndex(line,":")
+		if i<1 { return nil,fmt.Errorf("shared: line %d: missing ':'",ln) }
+		name := strings.TrimSpace(line[:i])
+		members := strings.FieldsFunc(line[i+1:],func(c rune) bool { return c==',' || c==' ' || c=='\t' })
+		m[name] = append(m[name],members...)
+	}
+	return m,s.Err()
+}
+
+/*
+Loads the public keys of the members from a directory, that contains one armored keyring
+per user, named "<username>.asc".
+*/
+func LoadKeyDir(dir string) (map[string]openpgp.EntityList,error) {
+	files,err := filepath.Glob(filepath.Join(dir,"*.asc"))
+	if err!=nil { return nil,err }
+	keys := make(map[string]openpgp.EntityList)
+	for _,fn := range files {
+		f,err := os.Open(fn)
+		if err!=nil { return nil,err }
+		kr,err := openpgp.ReadArmoredKeyRing(f)
+		f.Close()
+		if err!=nil { return nil,fmt.Errorf("shared: %s: %v",fn,err) }
+		keys[strings.TrimSuffix(filepath.Base(fn),".asc")] = kr
+	}
+	return keys,nil
+}
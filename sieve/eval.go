@@ -0,0 +1,364 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package sieve
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	
+	"github.com/emersion/go-message"
+	_ "github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+)
+
+/* The extensions, that may be required. */
+var extensions = map[string]bool{
+	"fileinto": true,
+	"imap4flags": true,
+	"body": true,
+}
+
+/* The comparator, match type and address part of a test, and it's positional string lists. */
+type matchSpec struct {
+	comparator string
+	match string
+	part string
+	size string
+	lists [][]string
+	num int64
+	isNum bool
+}
+
+func parseArgs(args []argument, line int) (m matchSpec, err error) {
+	m.comparator,m.match,m.part = "i;ascii-casemap",":is",":all"
+	for i := 0; i<len(args); i++ {
+		a := args[i]
+		switch {
+		case a.isNum:
+			m.num,m.isNum = a.num,true
+		case a.tag=="":
+			m.lists = append(m.lists,a.strs)
+		case a.tag=="comparator":
+			i++
+			if i==len(args) || len(args[i].strs)!=1 { return m,fmt.Errorf("sieve: line %d: :comparator needs a string",line) }
+			m.comparator = args[i].strs[0]
+			if m.comparator!="i;ascii-casemap" && m.comparator!="i;octet" { return m,fmt.Errorf("sieve: line %d: unsupported comparator %q",line,m.comparator) }
+		case a.tag=="is" || a.tag=="contains" || a.tag=="matches":
+			m.match = ":"+a.tag
+		case a.tag=="all" || a.tag=="localpart" || a.tag=="domain":
+			m.part = ":"+a.tag
+		case a.tag=="over" || a.tag=="under":
+			m.size = ":"+a.tag
+		case a.tag=="text":
+		default:
+			return m,fmt.Errorf("sieve: line %d: unsupported tag :%s",line,a.tag)
+		}
+	}
+	return
+}
+
+func lineErr(line int, format string, args ...interface{}) error {
+	return fmt.Errorf("sieve: line %d: %s",line,fmt.Sprintf(format,args...))
+}
+
+/* Checks the commands and tests and their arguments, so that scripts fail when they are parsed. */
+func validate(cmds []*command, required map[string]bool, top bool) error {
+	prev := ""
+	for _,c := range cmds {
+		needsBlock := false
+		m,err := parseArgs(c.args,c.line)
+		if err!=nil { return err }
+		switch c.name {
+		case "require":
+			if !top || len(m.lists)!=1 || len(c.tests)!=0 { return lineErr(c.line,"bad require") }
+			for _,ext := range m.lists[0] {
+				if !extensions[ext] { return lineErr(c.line,"unsupported extension %q",ext) }
+				required[ext] = true
+			}
+		case "if","elsif":
+			if c.name=="elsif" && prev!="if" && prev!="elsif" { return lineErr(c.line,"elsif without if") }
+			if len(c.tests)!=1 || len(c.args)!=0 { return lineErr(c.line,"%s needs one test",c.name) }
+			if err := validateTest(c.tests[0],required); err!=nil { return err }
+			needsBlock = true
+		case "else":
+			if prev!="if" && prev!="elsif" { return lineErr(c.line,"else without if") }
+			if len(c.tests)!=0 || len(c.args)!=0 { return lineErr(c.line,"else takes no arguments") }
+			needsBlock = true
+		case "stop","keep","discard":
+			if len(c.tests)!=0 || len(c.args)!=0 { return lineErr(c.line,"%s takes no arguments",c.name) }
+		case "fileinto":
+			if !required["fileinto"] { return lineErr(c.line,"fileinto is not required") }
+			if len(m.lists)!=1 || len(m.lists[0])!=1 || len(c.tests)!=0 { return lineErr(c.line,"fileinto needs a mailbox") }
+		case "addflag":
+			if !required["imap4flags"] { return lineErr(c.line,"imap4flags is not required") }
+			if len(m.lists)!=1 || len(c.tests)!=0 { return lineErr(c.line,"addflag needs a list of flags") }
+		default:
+			return lineErr(c.line,"unsupported command %q",c.name)
+		}
+		if needsBlock!=c.hasBlock {
+			if needsBlock { return lineErr(c.line,"%s needs a block",c.name) }
+			return lineErr(c.line,"unexpected block")
+		}
+		if c.hasBlock {
+			if err := validate(c.block,required,false); err!=nil { return err }
+		}
+		prev = c.name
+	}
+	return nil
+}
+
+func validateTest(t *test, required map[string]bool) error {
+	m,err := parseArgs(t.args,t.line)
+	if err!=nil { return err }
+	lists,tests := len(m.lists),len(t.tests)
+	switch t.name {
+	case "header","address":
+		if lists!=2 || tests!=0 { return lineErr(t.line,"%s needs a header list and a key list",t.name) }
+	case "exists":
+		if lists!=1 || tests!=0 { return lineErr(t.line,"exists needs a header list") }
+	case "size":
+		if m.size=="" || !m.isNum || lists!=0 || tests!=0 { return lineErr(t.line,"size needs :over or :under and a number") }
+	case "body":
+		if !required["body"] { return lineErr(t.line,"body is not required") }
+		if lists!=1 || tests!=0 { return lineErr(t.line,"body needs a key list") }
+	case "true","false":
+		if len(t.args)!=0 || tests!=0 { return lineErr(t.line,"%s takes no arguments",t.name) }
+	case "not":
+		if len(t.args)!=0 || tests!=1 { return lineErr(t.line,"not needs one test") }
+	case "allof","anyof":
+		if len(t.args)!=0 || tests==0 { return lineErr(t.line,"%s needs a test list",t.name) }
+	default:
+		return lineErr(t.line,"unsupported test %q",t.name)
+	}
+	for _,sub := range t.tests {
+		if err := validateTest(sub,required); err!=nil { return err }
+	}
+	return nil
+}
+
+/* The outcome of a script. */
+type Result struct {
+	/* The message stays in INBOX, either explicitly or implicitly. */
+	Keep bool
+	
+	/* Copies of the message go into these mailboxes. */
+	FileInto []string
+	
+	/* The flags (and keywords), that are added to the message. */
+	Flags []string
+	
+	/* The message is discarded, unless Keep or FileInto are set. */
+	Discard bool
+}
+
+type env struct {
+	raw []byte
+	h mail.Header
+	body *string
+	res *Result
+	keep bool
+}
+
+/*
+Runs the script on the (decrypted) message. The message is not changed, the actions are returned.
+*/
+func (s *Script) Execute(msg []byte) (*Result,error) {
+	h,err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(msg)))
+	if err!=nil { return nil,err }
+	e := &env{raw: msg, h: mail.Header{Header: message.Header{Header: h}}, res: new(Result)}
+	if _,err := e.run(s.commands); err!=nil { return nil,err }
+	
+	/* The implicit keep is cancelled by fileinto and discard. */
+	e.res.Keep = e.keep || (len(e.res.FileInto)==0 && !e.res.Discard)
+	return e.res,nil
+}
+
+func (e *env) run(cmds []*command) (stop bool, err error) {
+	done := false
+	for _,c := range cmds {
+		m,_ := parseArgs(c.args,c.line)
+		switch c.name {
+		case "if","elsif","else":
+			if c.name=="if" { done = false }
+			if done { continue }
+			ok := true
+			if c.name!="else" {
+				if ok,err = e.test(c.tests[0]); err!=nil { return }
+			}
+			if !ok { continue }
+			done = true
+			if stop,err = e.run(c.block); stop || err!=nil { return }
+		case "stop":
+			return true,nil
+		case "keep":
+			e.keep = true
+		case "discard":
+			e.res.Discard = true
+		case "fileinto":
+			e.res.FileInto = appendNew(e.res.FileInto,m.lists[0][0])
+		case "addflag":
+			for _,s := range m.lists[0] {
+				for _,f := range strings.Fields(s) { e.res.Flags = appendNew(e.res.Flags,f) }
+			}
+		}
+	}
+	return false,nil
+}
+
+func appendNew(list []string, s string) []string {
+	for _,x := range list {
+		if x==s { return list }
+	}
+	return append(list,s)
+}
+
+func (e *env) test(t *test) (bool,error) {
+	m,_ := parseArgs(t.args,t.line)
+	switch t.name {
+	case "true": return true,nil
+	case "false": return false,nil
+	case "not":
+		ok,err := e.test(t.tests[0])
+		return !ok,err
+	case "allof","anyof":
+		all := t.name=="allof"
+		for _,sub := range t.tests {
+			ok,err := e.test(sub)
+			if err!=nil { return false,err }
+			if ok!=all { return ok,nil }
+		}
+		return all,nil
+	case "exists":
+		for _,name := range m.lists[0] {
+			if !e.h.Has(name) { return false,nil }
+		}
+		return true,nil
+	case "size":
+		if m.size==":over" { return int64(len(e.raw))>m.num,nil }
+		return int64(len(e.raw))<m.num,nil
+	case "header":
+		for _,name := range m.lists[0] {
+			for f := e.h.FieldsByKey(name); f.Next(); {
+				v,err := f.Text()
+				if err!=nil { v = f.Value() }
+				if m.matchAny(v,m.lists[1]) { return true,nil }
+			}
+		}
+		return false,nil
+	case "address":
+		for _,name := range m.lists[0] {
+			addrs,err := e.h.AddressList(name)
+			if err!=nil { continue }
+			for _,a := range addrs {
+				if m.matchAny(addressPart(a.Address,m.part),m.lists[1]) { return true,nil }
+			}
+		}
+		return false,nil
+	case "body":
+		return m.matchAny(e.text(),m.lists[0]),nil
+	}
+	return false,fmt.Errorf("sieve: unsupported test %q",t.name)
+}
+
+func addressPart(addr, part string) string {
+	i := strings.LastIndexByte(addr,'@')
+	switch {
+	case part==":localpart" && i>=0: return addr[:i]
+	case part==":domain" && i>=0: return addr[i+1:]
+	case part==":domain": return ""
+	}
+	return addr
+}
+
+/* Returns the decoded text parts of the message, for the body test. */
+func (e *env) text() string {
+	if e.body!=nil { return *e.body }
+	var parts []string
+	ent,err := message.Read(bytes.NewReader(e.raw))
+	if ent!=nil && (err==nil || message.IsUnknownCharset(err)) {
+		ent.Walk(func(path []int, part *message.Entity, err error) error {
+			if err!=nil { return nil }
+			t,_,_ := part.Header.ContentType()
+			if part.MultipartReader()!=nil || (t!="" && !strings.HasPrefix(t,"text/")) { return nil }
+			if b,err := ioutil.ReadAll(part.Body); err==nil { parts = append(parts,string(b)) }
+			return nil
+		})
+	}
+	s := strings.Join(parts,"\n")
+	e.body = &s
+	return s
+}
+
+func (m *matchSpec) matchAny(value string, keys []string) bool {
+	for _,k := range keys {
+		if m.matchOne(value,k) { return true }
+	}
+	return false
+}
+
+func (m *matchSpec) matchOne(value, key string) bool {
+	if m.comparator=="i;ascii-casemap" {
+		value,key = asciiLower(value),asciiLower(key)
+	}
+	switch m.match {
+	case ":contains": return strings.Contains(value,key)
+	case ":matches": return wildcard([]rune(value),[]rune(key))
+	}
+	return value==key
+}
+
+func asciiLower(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r>='A' && r<='Z' { return r+'a'-'A' }
+		return r
+	},s)
+}
+
+/* Matches the pattern, with '*', '?' and '\' escapes, against the whole value. */
+func wildcard(value, pattern []rune) bool {
+	for len(pattern)!=0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(value); i>=0; i-- {
+				if wildcard(value[i:],pattern[1:]) { return true }
+			}
+			return false
+		case '?':
+			if len(value)==0 { return false }
+		case '\\':
+			if len(pattern)>1 { pattern = pattern[1:] }
+			fallthrough
+		default:
+			if len(value)==0 || value[0]!=pattern[0] { return false }
+		}
+		value,pattern = value[1:],pattern[1:]
+	}
+	return len(value)==0
+}
@@ -0,0 +1,302 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package sieve
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	
+	imapexpunge "github.com/mad-day/gaw-mail/util/imap-expunge"
+)
+
+/* The keyword, that Filter adds to the messages it has seen, by default. */
+const FilteredKeyword = "$Filtered"
+
+/*
+Runs the users' scripts on the new messages in INBOX. Run is called, when INBOX is selected (see
+Extension), with the gateway's own (decrypting) view of the mailbox, so the scripts see the
+plain messages, while the upstream server only sees the placeholder headers.
+
+Each user has a high-water mark, the UIDVALIDITY and UIDNEXT of INBOX after the last run. Only
+messages above it are filtered. The first run only sets the mark, messages, that were there
+before the filter was enabled, are not filtered. Filtered messages are also marked with a
+keyword, if the server allows it. Discarded messages are flagged \Deleted, and expunged only if
+no other message in INBOX is.
+*/
+type Filter struct {
+	/* Returns the script of the user, or nil if the user has none. */
+	Script func(username string) (*Script,error)
+	
+	/* The marker keyword. If empty, FilteredKeyword is used. */
+	Keyword string
+	
+	/*
+	The directory, in which the high-water marks are saved, as <username>.mark. If empty, the
+	marks are kept in memory only, and the first run after a restart only sets them again.
+	*/
+	MarkDir string
+	
+	/* Logs messages, that could not be filtered. If nil, the standard logger is used. */
+	Log *log.Logger
+	
+	mutex sync.Mutex
+	running map[string]*sync.Mutex
+	marks map[string]*waterMark
+}
+
+/* The high-water mark of a user's INBOX: Messages with a UID below UidNext have been filtered. */
+type waterMark struct {
+	UidValidity uint32
+	UidNext uint32
+}
+
+/* Reports, whether the username can be used as a file name. */
+func validName(username string) bool {
+	return username!="" && !strings.ContainsAny(username,"/\\") && !strings.HasPrefix(username,".")
+}
+
+/*
+Returns a function for Filter.Script, that reads the scripts from <dir>/<username>.sieve. Users
+without a file have no script.
+*/
+func Dir(dir string) func(username string) (*Script,error) {
+	return func(username string) (*Script,error) {
+		if !validName(username) { return nil,nil }
+		data,err := ioutil.ReadFile(filepath.Join(dir,username+".sieve"))
+		if os.IsNotExist(err) { return nil,nil }
+		if err!=nil { return nil,err }
+		return Parse(string(data))
+	}
+}
+
+func (f *Filter) keyword() string {
+	if f.Keyword=="" { return FilteredKeyword }
+	return f.Keyword
+}
+
+func (f *Filter) logf(format string, args ...interface{}) {
+	if f.Log!=nil {
+		f.Log.Printf(format,args...)
+	} else {
+		log.Printf(format,args...)
+	}
+}
+
+/* Returns the lock, that keeps two sessions of a user from filtering the same messages. */
+func (f *Filter) lock(username string) *sync.Mutex {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.running==nil { f.running = make(map[string]*sync.Mutex) }
+	l,ok := f.running[username]
+	if !ok {
+		l = new(sync.Mutex)
+		f.running[username] = l
+	}
+	return l
+}
+
+/* Returns the mark of the user, or nil, if there is none yet. */
+func (f *Filter) loadMark(username string) (*waterMark,error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if m,ok := f.marks[username]; ok { return m,nil }
+	if f.MarkDir=="" || !validName(username) { return nil,nil }
+	data,err := ioutil.ReadFile(filepath.Join(f.MarkDir,username+".mark"))
+	if os.IsNotExist(err) { return nil,nil }
+	if err!=nil { return nil,err }
+	m := new(waterMark)
+	if err = json.Unmarshal(data,m); err!=nil { return nil,err }
+	return m,nil
+}
+
+/* Sets the mark of the user, and saves it into MarkDir. The file is replaced atomically. */
+func (f *Filter) saveMark(username string, m *waterMark) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.marks==nil { f.marks = make(map[string]*waterMark) }
+	f.marks[username] = m
+	if f.MarkDir=="" || !validName(username) { return nil }
+	data,err := json.Marshal(m)
+	if err!=nil { return err }
+	tmp,err := ioutil.TempFile(f.MarkDir,".mark")
+	if err!=nil { return err }
+	if _,err = tmp.Write(data); err!=nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err!=nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(),filepath.Join(f.MarkDir,username+".mark"))
+}
+
+type fetched struct {
+	uid uint32
+	body []byte
+}
+
+/*
+Filters the messages in inbox above the user's mark, and moves the mark up to the UIDNEXT of
+inbox. u is used to find the mailboxes of fileinto. Messages, that can't be fetched or filtered,
+are left in INBOX.
+*/
+func (f *Filter) Run(u backend.User, inbox backend.Mailbox) error {
+	s,err := f.Script(u.Username())
+	if err!=nil || s==nil { return err }
+	
+	l := f.lock(u.Username())
+	l.Lock()
+	defer l.Unlock()
+	
+	st,err := inbox.Status([]imap.StatusItem{imap.StatusUidValidity,imap.StatusUidNext})
+	if err!=nil { return err }
+	mark,err := f.loadMark(u.Username())
+	if err!=nil { return err }
+	next := &waterMark{st.UidValidity,st.UidNext}
+	if mark==nil || mark.UidValidity!=st.UidValidity { return f.saveMark(u.Username(),next) }
+	if st.UidNext<=mark.UidNext { return nil }
+	
+	/*
+	The keyword protects against filtering a message twice, if the mark could not be saved. Newer
+	messages, that arrive meanwhile, get a UID above st.UidNext, and are filtered on the next run.
+	*/
+	criteria := imap.NewSearchCriteria()
+	criteria.Uid = new(imap.SeqSet)
+	criteria.Uid.AddRange(mark.UidNext,st.UidNext-1)
+	criteria.WithoutFlags = []string{f.keyword()}
+	uids,err := inbox.SearchMessages(true,criteria)
+	if err!=nil { return err }
+	if len(uids)==0 { return f.saveMark(u.Username(),next) }
+	
+	/* The messages are collected first, the backend can't run other commands meanwhile. */
+	seq := new(imap.SeqSet)
+	seq.AddNum(uids...)
+	section := &imap.BodySectionName{Peek: true}
+	ch := make(chan *imap.Message)
+	done := make(chan error,1)
+	go func() { done <- inbox.ListMessages(true,seq,[]imap.FetchItem{imap.FetchUid,section.FetchItem()},ch) }()
+	var msgs []fetched
+	for msg := range ch {
+		/* The backends key the body by the requested section, so GetBody doesn't find it. */
+		var body []byte
+		for s,l := range msg.Body {
+			if s.Specifier!=imap.EntireSpecifier || len(s.Path)!=0 || l==nil { continue }
+			body,_ = ioutil.ReadAll(l)
+		}
+		msgs = append(msgs,fetched{msg.Uid,body})
+	}
+	if err = <-done; err!=nil { return err }
+	
+	/* Servers may refuse the keyword, the mark is enough. */
+	if err := inbox.UpdateMessagesFlags(true,seq,imap.AddFlags,[]string{f.keyword()}); err!=nil {
+		f.logf("sieve: %s: keyword %s: %v",u.Username(),f.keyword(),err)
+	}
+	
+	var deleted []uint32
+	for _,m := range msgs {
+		res := &Result{Keep: true}
+		if m.body!=nil {
+			if res,err = s.Execute(m.body); err!=nil {
+				f.logf("sieve: %s: message %d: %v",u.Username(),m.uid,err)
+				res = &Result{Keep: true}
+			}
+		}
+		if f.apply(u,inbox,m.uid,res) { deleted = append(deleted,m.uid) }
+	}
+	if err = f.saveMark(u.Username(),next); err!=nil { return err }
+	
+	ok,err := imapexpunge.Only(inbox,deleted)
+	if err==nil && !ok { f.logf("sieve: %s: INBOX not expunged, other messages are flagged \\Deleted",u.Username()) }
+	return err
+}
+
+/*
+Flags the message and files it. Failures are logged, the message then stays in INBOX. Returns
+true, if the message has been flagged \Deleted.
+*/
+func (f *Filter) apply(u backend.User, inbox backend.Mailbox, uid uint32, res *Result) bool {
+	seq := new(imap.SeqSet)
+	seq.AddNum(uid)
+	
+	/* fileinto "INBOX" is the same as keep. */
+	var into []string
+	for _,name := range res.FileInto {
+		if strings.EqualFold(name,"INBOX") { res.Keep = true } else { into = append(into,name) }
+	}
+	res.FileInto = into
+	remove := !res.Keep
+	flags := res.Flags
+	if remove && len(res.FileInto)==0 { flags = append(flags,imap.DeletedFlag) }
+	if len(flags)>0 {
+		if err := inbox.UpdateMessagesFlags(true,seq,imap.AddFlags,flags); err!=nil {
+			f.logf("sieve: %s: message %d: %v",u.Username(),uid,err)
+			return false
+		}
+	}
+	if len(res.FileInto)==0 { return remove }
+	
+	for _,name := range res.FileInto {
+		if _,err := u.GetMailbox(name); err!=nil {
+			f.logf("sieve: %s: fileinto %q: %v",u.Username(),name,err)
+			return false
+		}
+	}
+	
+	/*
+	A copy goes into each mailbox but the last, where the message is moved, unless it is kept.
+	The gateways implement MoveMailbox even if the upstream server has no MOVE, so a failed
+	move falls back to a copy, too.
+	*/
+	copies := res.FileInto[:len(res.FileInto)-1]
+	last := res.FileInto[len(res.FileInto)-1]
+	for _,name := range copies {
+		if err := inbox.CopyMessages(true,seq,name); err!=nil {
+			f.logf("sieve: %s: fileinto %q: %v",u.Username(),name,err)
+			return false
+		}
+	}
+	if mm,ok := inbox.(backend.MoveMailbox); ok && remove {
+		if mm.MoveMessages(true,seq,last)==nil { return false }
+	}
+	if err := inbox.CopyMessages(true,seq,last); err!=nil {
+		f.logf("sieve: %s: fileinto %q: %v",u.Username(),last,err)
+		return false
+	}
+	if !remove { return false }
+	
+	/* Without MOVE, the original is deleted like a discarded message. */
+	return inbox.UpdateMessagesFlags(true,seq,imap.AddFlags,[]string{imap.DeletedFlag})==nil
+}
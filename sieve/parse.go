@@ -0,0 +1,322 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+/*
+A subset of the Sieve mail filtering language (RFC 5228), that the gateways run on the decrypted
+messages arriving in INBOX, see Filter.
+
+Supported are the control commands require, if/elsif/else and stop, the actions keep, discard,
+fileinto (RFC 5228) and addflag (RFC 5232, without variables), and the tests header, address,
+exists, size, allof, anyof, not, true, false and body (RFC 5173, :text only). The comparators are
+"i;ascii-casemap" (the default) and "i;octet", the match types :is, :contains and :matches.
+*/
+package sieve
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tEOF tokenKind = iota
+	tIdent
+	tTag
+	tString
+	tNumber
+	tPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	num int64
+	line int
+}
+
+type lexer struct {
+	src string
+	pos int
+	line int
+}
+
+func (l *lexer) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("sieve: line %d: %s",l.line,fmt.Sprintf(format,args...))
+}
+
+/* Skips white space and comments. */
+func (l *lexer) skip() error {
+	for l.pos<len(l.src) {
+		switch c := l.src[l.pos]; {
+		case c=='\n':
+			l.line++
+			l.pos++
+		case c==' ' || c=='\t' || c=='\r':
+			l.pos++
+		case c=='#':
+			for l.pos<len(l.src) && l.src[l.pos]!='\n' { l.pos++ }
+		case strings.HasPrefix(l.src[l.pos:],"/*"):
+			end := strings.Index(l.src[l.pos+2:],"*/")
+			if end<0 { return l.errorf("unterminated comment") }
+			l.line += strings.Count(l.src[l.pos:l.pos+2+end],"\n")
+			l.pos += end+4
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func isIdentChar(c byte, first bool) bool {
+	return c=='_' || (c>='a' && c<='z') || (c>='A' && c<='Z') || (!first && c>='0' && c<='9')
+}
+
+func (l *lexer) next() (token,error) {
+	if err := l.skip(); err!=nil { return token{},err }
+	t := token{line: l.line}
+	if l.pos>=len(l.src) { return t,nil }
+	
+	start := l.pos
+	c := l.src[l.pos]
+	switch {
+	case c==':':
+		l.pos++
+		for l.pos<len(l.src) && isIdentChar(l.src[l.pos],l.pos==start+1) { l.pos++ }
+		if l.pos==start+1 { return t,l.errorf("empty tag") }
+		t.kind,t.text = tTag,strings.ToLower(l.src[start+1:l.pos])
+	case c>='0' && c<='9':
+		for l.pos<len(l.src) && l.src[l.pos]>='0' && l.src[l.pos]<='9' { l.pos++ }
+		n,err := strconv.ParseInt(l.src[start:l.pos],10,64)
+		if err!=nil { return t,l.errorf("bad number") }
+		if l.pos<len(l.src) {
+			switch l.src[l.pos] {
+			case 'K','k': n <<= 10; l.pos++
+			case 'M','m': n <<= 20; l.pos++
+			case 'G','g': n <<= 30; l.pos++
+			}
+		}
+		t.kind,t.num = tNumber,n
+	case c=='"':
+		s,err := l.quoted()
+		if err!=nil { return t,err }
+		t.kind,t.text = tString,s
+	case isIdentChar(c,true):
+		for l.pos<len(l.src) && isIdentChar(l.src[l.pos],false) { l.pos++ }
+		t.kind,t.text = tIdent,strings.ToLower(l.src[start:l.pos])
+		if t.text=="text" && l.pos<len(l.src) && l.src[l.pos]==':' {
+			l.pos++
+			s,err := l.multiline()
+			if err!=nil { return t,err }
+			t.kind,t.text = tString,s
+		}
+	case strings.IndexByte("[](){},;",c)>=0:
+		l.pos++
+		t.kind,t.text = tPunct,string(c)
+	default:
+		return t,l.errorf("unexpected %q",c)
+	}
+	return t,nil
+}
+
+func (l *lexer) quoted() (string,error) {
+	var b strings.Builder
+	for l.pos++; l.pos<len(l.src); l.pos++ {
+		c := l.src[l.pos]
+		switch c {
+		case '"':
+			l.pos++
+			return b.String(),nil
+		case '\\':
+			l.pos++
+			if l.pos==len(l.src) { break }
+			c = l.src[l.pos]
+		case '\n':
+			l.line++
+		}
+		b.WriteByte(c)
+	}
+	return "",l.errorf("unterminated string")
+}
+
+/* Reads a multi-line string after "text:", up to the line with a single ".". */
+func (l *lexer) multiline() (string,error) {
+	nl := strings.IndexByte(l.src[l.pos:],'\n')
+	if nl<0 { return "",l.errorf("unterminated text") }
+	l.pos += nl+1
+	l.line++
+	var b strings.Builder
+	for l.pos<len(l.src) {
+		end := strings.IndexByte(l.src[l.pos:],'\n')
+		if end<0 { end = len(l.src)-l.pos }
+		line := strings.TrimSuffix(l.src[l.pos:l.pos+end],"\r")
+		l.pos += end+1
+		l.line++
+		if line=="." { return b.String(),nil }
+		if strings.HasPrefix(line,"..") { line = line[1:] }
+		b.WriteString(line+"\r\n")
+	}
+	return "",l.errorf("unterminated text")
+}
+
+/* An argument is a tag, a number or a string list. */
+type argument struct {
+	tag string
+	num int64
+	isNum bool
+	strs []string
+}
+
+type test struct {
+	name string
+	args []argument
+	tests []*test
+	line int
+}
+
+type command struct {
+	name string
+	args []argument
+	tests []*test
+	block []*command
+	hasBlock bool
+	line int
+}
+
+/* A parsed Sieve script. */
+type Script struct {
+	commands []*command
+}
+
+type parser struct {
+	l *lexer
+	tok token
+}
+
+func (p *parser) advance() error {
+	t,err := p.l.next()
+	p.tok = t
+	return err
+}
+
+func (p *parser) is(punct string) bool {
+	return p.tok.kind==tPunct && p.tok.text==punct
+}
+
+func (p *parser) expect(punct string) error {
+	if !p.is(punct) { return p.l.errorf("expected %q",punct) }
+	return p.advance()
+}
+
+func Parse(src string) (*Script,error) {
+	p := &parser{l: &lexer{src: src, line: 1}}
+	if err := p.advance(); err!=nil { return nil,err }
+	cmds,err := p.commands()
+	if err!=nil { return nil,err }
+	if p.tok.kind!=tEOF { return nil,p.l.errorf("unexpected %q",p.tok.text) }
+	
+	s := &Script{cmds}
+	if err := validate(cmds,map[string]bool{},true); err!=nil { return nil,err }
+	return s,nil
+}
+
+func (p *parser) commands() ([]*command,error) {
+	var cmds []*command
+	for p.tok.kind==tIdent {
+		c := &command{name: p.tok.text, line: p.tok.line}
+		if err := p.advance(); err!=nil { return nil,err }
+		var err error
+		if c.args,c.tests,err = p.arguments(); err!=nil { return nil,err }
+		if p.is("{") {
+			if err := p.advance(); err!=nil { return nil,err }
+			c.hasBlock = true
+			if c.block,err = p.commands(); err!=nil { return nil,err }
+			if err := p.expect("}"); err!=nil { return nil,err }
+		} else if err := p.expect(";"); err!=nil {
+			return nil,err
+		}
+		cmds = append(cmds,c)
+	}
+	return cmds,nil
+}
+
+func (p *parser) arguments() (args []argument, tests []*test, err error) {
+	for {
+		switch {
+		case p.tok.kind==tTag:
+			args = append(args,argument{tag: p.tok.text})
+		case p.tok.kind==tNumber:
+			args = append(args,argument{num: p.tok.num, isNum: true})
+		case p.tok.kind==tString:
+			args = append(args,argument{strs: []string{p.tok.text}})
+		case p.is("["):
+			var list []string
+			for {
+				if err = p.advance(); err!=nil { return }
+				if p.tok.kind!=tString { return nil,nil,p.l.errorf("expected a string") }
+				list = append(list,p.tok.text)
+				if err = p.advance(); err!=nil { return }
+				if p.is("]") { break }
+				if !p.is(",") { return nil,nil,p.l.errorf("expected \",\" or \"]\"") }
+			}
+			args = append(args,argument{strs: list})
+		default:
+			/* The optional test or test list ends the arguments. */
+			switch {
+			case p.tok.kind==tIdent:
+				var t *test
+				if t,err = p.test(); err!=nil { return }
+				tests = []*test{t}
+			case p.is("("):
+				if tests,err = p.testList(); err!=nil { return }
+			}
+			return
+		}
+		if err = p.advance(); err!=nil { return }
+	}
+}
+
+func (p *parser) test() (*test,error) {
+	t := &test{name: p.tok.text, line: p.tok.line}
+	if err := p.advance(); err!=nil { return nil,err }
+	var err error
+	t.args,t.tests,err = p.arguments()
+	return t,err
+}
+
+func (p *parser) testList() ([]*test,error) {
+	var tests []*test
+	for {
+		if err := p.advance(); err!=nil { return nil,err }
+		if p.tok.kind!=tIdent { return nil,p.l.errorf("expected a test") }
+		t,err := p.test()
+		if err!=nil { return nil,err }
+		tests = append(tests,t)
+		if p.is(")") { break }
+		if !p.is(",") { return nil,p.l.errorf("expected \",\" or \")\"") }
+	}
+	return tests,p.advance()
+}
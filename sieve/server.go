@@ -0,0 +1,77 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package sieve
+
+import (
+	"strings"
+	
+	"github.com/emersion/go-imap/server"
+)
+
+/*
+Returns a server extension, that runs the filter on INBOX, before it is selected.
+The server must serve the gateway, so that the filter sees the decrypted messages:
+
+	s := server.New(gateway)
+	s.Enable(filter.Extension())
+
+Other commands, like EXAMINE, STATUS or APPEND, don't run the filter, as they must not change the
+mailbox.
+*/
+func (f *Filter) Extension() server.Extension {
+	return extension{f}
+}
+
+type extension struct {
+	f *Filter
+}
+
+func (extension) Capabilities(c server.Conn) []string { return nil }
+
+func (e extension) Command(name string) server.HandlerFactory {
+	switch name {
+	case "SELECT":
+		return func() server.Handler { return &selectCmd{f: e.f} }
+	}
+	return nil
+}
+
+type selectCmd struct {
+	server.Select
+	f *Filter
+}
+
+func (cmd *selectCmd) Handle(conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.User!=nil && strings.EqualFold(cmd.Mailbox,"INBOX") {
+		if mbox,err := ctx.User.GetMailbox(cmd.Mailbox); err==nil {
+			if err = cmd.f.Run(ctx.User,mbox); err!=nil {
+				cmd.f.logf("sieve: %s: cannot filter INBOX: %v",ctx.User.Username(),err)
+			}
+		}
+	}
+	return cmd.Select.Handle(conn)
+}
@@ -0,0 +1,121 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package smime
+
+import (
+	"errors"
+	
+	"golang.org/x/crypto/cryptobyte"
+	cbasn1 "golang.org/x/crypto/cryptobyte/asn1"
+)
+
+var errBER = errors.New("smime: malformed BER")
+
+func appendDER(out, id, content []byte) []byte {
+	out = append(out,id...)
+	n := len(content)
+	switch {
+	case n<0x80: out = append(out,byte(n))
+	case n<0x100: out = append(out,0x81,byte(n))
+	case n<0x10000: out = append(out,0x82,byte(n>>8),byte(n))
+	case n<0x1000000: out = append(out,0x83,byte(n>>16),byte(n>>8),byte(n))
+	default: out = append(out,0x84,byte(n>>24),byte(n>>16),byte(n>>8),byte(n))
+	}
+	return append(out,content...)
+}
+
+/*
+Converts one BER element to DER and returns the rest of the input. Indefinite lengths are
+replaced by definite ones and constructed OCTET STRINGs are merged. This is what OpenSSL and
+others write, and what cryptobyte needs to read it. The order of SET elements is kept.
+*/
+func berElement(b []byte, depth int) (der, rest []byte, err error) {
+	if depth>32 || len(b)<2 { return nil,nil,errBER }
+	
+	i := 1
+	if b[0]&0x1f == 0x1f {
+		for i<len(b) && b[i]&0x80!=0 { i++ }
+		i++
+	}
+	if i>=len(b) { return nil,nil,errBER }
+	id := b[:i]
+	constructed := b[0]&0x20!=0
+	
+	var content []byte
+	indefinite := false
+	l := int(b[i]); i++
+	if l==0x80 {
+		if !constructed { return nil,nil,errBER }
+		indefinite = true
+		content = b[i:]
+	} else {
+		if l>0x80 {
+			n := l&0x7f
+			if n>4 || i+n>len(b) { return nil,nil,errBER }
+			l = 0
+			for _,c := range b[i:i+n] { l = l<<8|int(c) }
+			i += n
+		}
+		if l<0 || i+l>len(b) { return nil,nil,errBER }
+		content,rest = b[i:i+l],b[i+l:]
+	}
+	
+	if !constructed { return appendDER(nil,id,content),rest,nil }
+	
+	var children []byte
+	for {
+		if indefinite {
+			if len(content)>=2 && content[0]==0 && content[1]==0 {
+				rest = content[2:]
+				break
+			}
+		} else if len(content)==0 {
+			break
+		}
+		var child []byte
+		child,content,err = berElement(content,depth+1)
+		if err!=nil { return nil,nil,err }
+		children = append(children,child...)
+	}
+	
+	/* A constructed OCTET STRING, the chunks are OCTET STRINGs themselves. */
+	if len(id)==1 && id[0]==0x24 {
+		s := cryptobyte.String(children)
+		var merged []byte
+		for !s.Empty() {
+			var chunk []byte
+			if !s.ReadASN1Bytes(&chunk,cbasn1.OCTET_STRING) { return nil,nil,errBER }
+			merged = append(merged,chunk...)
+		}
+		return appendDER(nil,[]byte{0x04},merged),rest,nil
+	}
+	return appendDER(nil,id,children),rest,nil
+}
+
+/* Converts BER to DER. Trailing garbage (like line breaks after a PEM block) is ignored. */
+func ber2der(ber []byte) ([]byte,error) {
+	der,_,err := berElement(ber,0)
+	return der,err
+}
@@ -0,0 +1,515 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package smime
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+	
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	
+	"golang.org/x/crypto/cryptobyte"
+	cbasn1 "golang.org/x/crypto/cryptobyte/asn1"
+)
+
+/*
+The parts of CMS (RFC 5652), that S/MIME needs: enveloped-data with RSA key transport and
+signed-data.
+*/
+
+var (
+	oidData = asn1.ObjectIdentifier{1,2,840,113549,1,7,1}
+	oidSignedData = asn1.ObjectIdentifier{1,2,840,113549,1,7,2}
+	oidEnvelopedData = asn1.ObjectIdentifier{1,2,840,113549,1,7,3}
+	
+	oidAttrContentType = asn1.ObjectIdentifier{1,2,840,113549,1,9,3}
+	oidAttrMessageDigest = asn1.ObjectIdentifier{1,2,840,113549,1,9,4}
+	oidAttrSigningTime = asn1.ObjectIdentifier{1,2,840,113549,1,9,5}
+	
+	oidRSA = asn1.ObjectIdentifier{1,2,840,113549,1,1,1}
+	oidRSAOAEP = asn1.ObjectIdentifier{1,2,840,113549,1,1,7}
+	oidRSAPSS = asn1.ObjectIdentifier{1,2,840,113549,1,1,10}
+	oidECDSASHA256 = asn1.ObjectIdentifier{1,2,840,10045,4,3,2}
+	
+	oidAES128CBC = asn1.ObjectIdentifier{2,16,840,1,101,3,4,1,2}
+	oidAES192CBC = asn1.ObjectIdentifier{2,16,840,1,101,3,4,1,22}
+	oidAES256CBC = asn1.ObjectIdentifier{2,16,840,1,101,3,4,1,42}
+	oidDESEDE3CBC = asn1.ObjectIdentifier{1,2,840,113549,3,7}
+)
+
+var digestOIDs = map[string]crypto.Hash{
+	"1.3.14.3.2.26": crypto.SHA1,
+	"2.16.840.1.101.3.4.2.1": crypto.SHA256,
+	"2.16.840.1.101.3.4.2.2": crypto.SHA384,
+	"2.16.840.1.101.3.4.2.3": crypto.SHA512,
+}
+
+var oidSHA256 = asn1.ObjectIdentifier{2,16,840,1,101,3,4,2,1}
+
+var (
+	ErrNoKey = errors.New("smime: no key to decrypt the message")
+	ErrNoSignature = errors.New("smime: message has no signature")
+	errMalformed = errors.New("smime: malformed CMS structure")
+	errUnsupportedKey = errors.New("smime: only RSA recipients are supported")
+)
+
+var (
+	tagExplicit0 = cbasn1.Tag(0).ContextSpecific().Constructed()
+	tagImplicit0 = cbasn1.Tag(0).ContextSpecific()
+	tagExplicit1 = cbasn1.Tag(1).ContextSpecific().Constructed()
+)
+
+/* Parses a ContentInfo and returns the content type and the content. */
+func parseContentInfo(der []byte) (asn1.ObjectIdentifier,cryptobyte.String,error) {
+	s := cryptobyte.String(der)
+	var ci,content cryptobyte.String
+	var oid asn1.ObjectIdentifier
+	if !s.ReadASN1(&ci,cbasn1.SEQUENCE) || !ci.ReadASN1ObjectIdentifier(&oid) || !ci.ReadASN1(&content,tagExplicit0) {
+		return nil,nil,errMalformed
+	}
+	return oid,content,nil
+}
+
+func addAlgorithm(b *cryptobyte.Builder, oid asn1.ObjectIdentifier, null bool) {
+	b.AddASN1(cbasn1.SEQUENCE,func(b *cryptobyte.Builder) {
+		b.AddASN1ObjectIdentifier(oid)
+		if null { b.AddASN1NULL() }
+	})
+}
+
+func addIssuerAndSerial(b *cryptobyte.Builder, c *x509.Certificate) {
+	b.AddASN1(cbasn1.SEQUENCE,func(b *cryptobyte.Builder) {
+		b.AddBytes(c.RawIssuer)
+		b.AddASN1BigInt(c.SerialNumber)
+	})
+}
+
+/*
+Tells, whether the signer or recipient identifier (IssuerAndSerialNumber or
+[0] SubjectKeyIdentifier) refers to the certificate.
+*/
+func matchID(id cryptobyte.String, tag cbasn1.Tag, c *x509.Certificate) bool {
+	switch tag {
+	case cbasn1.SEQUENCE:
+		var ias,issuer cryptobyte.String
+		serial := new(big.Int)
+		if !id.ReadASN1(&ias,cbasn1.SEQUENCE) || !ias.ReadASN1Element(&issuer,cbasn1.SEQUENCE) || !ias.ReadASN1Integer(serial) { return false }
+		return bytes.Equal(issuer,c.RawIssuer) && serial.Cmp(c.SerialNumber)==0
+	case tagImplicit0:
+		var ski []byte
+		if !id.ReadASN1Bytes(&ski,tagImplicit0) { return false }
+		return len(c.SubjectKeyId)>0 && bytes.Equal(ski,c.SubjectKeyId)
+	}
+	return false
+}
+
+func pad(b []byte, size int) []byte {
+	n := size-len(b)%size
+	return append(b,bytes.Repeat([]byte{byte(n)},n)...)
+}
+
+func unpad(b []byte, size int) ([]byte,error) {
+	if len(b)==0 || len(b)%size!=0 { return nil,errMalformed }
+	n := int(b[len(b)-1])
+	if n==0 || n>size || n>len(b) { return nil,errMalformed }
+	for _,c := range b[len(b)-n:] {
+		if int(c)!=n { return nil,errMalformed }
+	}
+	return b[:len(b)-n],nil
+}
+
+/* Encrypts the content to the certificates as enveloped-data, with AES-256-CBC. */
+func encryptEnveloped(content []byte, to []*x509.Certificate) ([]byte,error) {
+	if len(to)==0 { return nil,errors.New("smime: no recipients") }
+	
+	key := make([]byte,32)
+	iv := make([]byte,aes.BlockSize)
+	if _,err := rand.Read(key); err!=nil { return nil,err }
+	if _,err := rand.Read(iv); err!=nil { return nil,err }
+	block,err := aes.NewCipher(key)
+	if err!=nil { return nil,err }
+	ct := pad(append([]byte(nil),content...),aes.BlockSize)
+	cipher.NewCBCEncrypter(block,iv).CryptBlocks(ct,ct)
+	
+	var b cryptobyte.Builder
+	b.AddASN1(cbasn1.SEQUENCE,func(b *cryptobyte.Builder) {
+		b.AddASN1ObjectIdentifier(oidEnvelopedData)
+		b.AddASN1(tagExplicit0,func(b *cryptobyte.Builder) {
+			b.AddASN1(cbasn1.SEQUENCE,func(b *cryptobyte.Builder) {
+				b.AddASN1Int64(0)
+				b.AddASN1(cbasn1.SET,func(b *cryptobyte.Builder) {
+					for _,c := range to {
+						pub,ok := c.PublicKey.(*rsa.PublicKey)
+						if !ok { b.SetError(errUnsupportedKey); return }
+						ek,err := rsa.EncryptPKCS1v15(rand.Reader,pub,key)
+						if err!=nil { b.SetError(err); return }
+						b.AddASN1(cbasn1.SEQUENCE,func(b *cryptobyte.Builder) {
+							b.AddASN1Int64(0)
+							addIssuerAndSerial(b,c)
+							addAlgorithm(b,oidRSA,true)
+							b.AddASN1OctetString(ek)
+						})
+					}
+				})
+				b.AddASN1(cbasn1.SEQUENCE,func(b *cryptobyte.Builder) {
+					b.AddASN1ObjectIdentifier(oidData)
+					b.AddASN1(cbasn1.SEQUENCE,func(b *cryptobyte.Builder) {
+						b.AddASN1ObjectIdentifier(oidAES256CBC)
+						b.AddASN1OctetString(iv)
+					})
+					b.AddASN1(tagImplicit0,func(b *cryptobyte.Builder) { b.AddBytes(ct) })
+				})
+			})
+		})
+	})
+	return b.Bytes()
+}
+
+/* Decrypts the content encryption key with the identity's private key. */
+func decryptKey(id *Identity, alg asn1.ObjectIdentifier, params cryptobyte.String, ek []byte) ([]byte,error) {
+	priv,ok := id.Key.(*rsa.PrivateKey)
+	if !ok { return nil,errUnsupportedKey }
+	switch {
+	case alg.Equal(oidRSA):
+		return rsa.DecryptPKCS1v15(nil,priv,ek)
+	case alg.Equal(oidRSAOAEP):
+		/* RSAES-OAEP-params, only the hash is honored, the MGF uses the same one. */
+		h := crypto.SHA1
+		var seq,hashAlg,ha cryptobyte.String
+		var hoid asn1.ObjectIdentifier
+		var present bool
+		if params.ReadASN1(&seq,cbasn1.SEQUENCE) && seq.ReadOptionalASN1(&hashAlg,&present,tagExplicit0) && present &&
+			hashAlg.ReadASN1(&ha,cbasn1.SEQUENCE) && ha.ReadASN1ObjectIdentifier(&hoid) {
+			if h,ok = digestOIDs[hoid.String()]; !ok { return nil,fmt.Errorf("smime: unsupported OAEP hash %v",hoid) }
+		}
+		if h==crypto.SHA1 { return rsa.DecryptOAEP(sha1.New(),nil,priv,ek,nil) }
+		return rsa.DecryptOAEP(h.New(),nil,priv,ek,nil)
+	}
+	return nil,fmt.Errorf("smime: unsupported key encryption algorithm %v",alg)
+}
+
+/* Decrypts enveloped-data with the first identity, that it is encrypted to. */
+func decryptEnveloped(content cryptobyte.String, ids []*Identity) ([]byte,error) {
+	var ed,ris,eci cryptobyte.String
+	var version int
+	if !content.ReadASN1(&ed,cbasn1.SEQUENCE) || !ed.ReadASN1Integer(&version) ||
+		!ed.SkipOptionalASN1(tagExplicit0) || !ed.ReadASN1(&ris,cbasn1.SET) || !ed.ReadASN1(&eci,cbasn1.SEQUENCE) {
+		return nil,errMalformed
+	}
+	
+	var key []byte
+	for !ris.Empty() && key==nil {
+		var ri cryptobyte.String
+		var tag cbasn1.Tag
+		if !ris.ReadAnyASN1(&ri,&tag) { return nil,errMalformed }
+		/* Only KeyTransRecipientInfo is untagged. */
+		if tag!=cbasn1.SEQUENCE { continue }
+		
+		var rid,alg cryptobyte.String
+		var ridTag cbasn1.Tag
+		var aoid asn1.ObjectIdentifier
+		var ek []byte
+		if !ri.ReadASN1Integer(&version) || !ri.ReadAnyASN1Element(&rid,&ridTag) || !ri.ReadASN1(&alg,cbasn1.SEQUENCE) ||
+			!alg.ReadASN1ObjectIdentifier(&aoid) || !ri.ReadASN1Bytes(&ek,cbasn1.OCTET_STRING) {
+			return nil,errMalformed
+		}
+		for _,id := range ids {
+			if !matchID(rid,ridTag,id.Certificate) { continue }
+			k,err := decryptKey(id,aoid,alg,ek)
+			if err!=nil { return nil,err }
+			key = k
+			break
+		}
+	}
+	if key==nil { return nil,ErrNoKey }
+	
+	var ctype,calg asn1.ObjectIdentifier
+	var alg cryptobyte.String
+	if !eci.ReadASN1ObjectIdentifier(&ctype) || !eci.ReadASN1(&alg,cbasn1.SEQUENCE) || !alg.ReadASN1ObjectIdentifier(&calg) {
+		return nil,errMalformed
+	}
+	var iv []byte
+	if !alg.ReadASN1Bytes(&iv,cbasn1.OCTET_STRING) { return nil,errMalformed }
+	
+	/* [0] IMPLICIT OCTET STRING, constructed, if it was chunked. */
+	var ct []byte
+	var ec cryptobyte.String
+	switch {
+	case eci.ReadASN1(&ec,tagImplicit0):
+		ct = ec
+	case eci.ReadASN1(&ec,tagExplicit0):
+		for !ec.Empty() {
+			var chunk []byte
+			if !ec.ReadASN1Bytes(&chunk,cbasn1.OCTET_STRING) { return nil,errMalformed }
+			ct = append(ct,chunk...)
+		}
+	default:
+		return nil,errors.New("smime: detached encrypted content")
+	}
+	
+	var block cipher.Block
+	var err error
+	switch {
+	case calg.Equal(oidAES128CBC),calg.Equal(oidAES192CBC),calg.Equal(oidAES256CBC):
+		block,err = aes.NewCipher(key)
+	case calg.Equal(oidDESEDE3CBC):
+		block,err = des.NewTripleDESCipher(key)
+	default:
+		return nil,fmt.Errorf("smime: unsupported content encryption algorithm %v",calg)
+	}
+	if err!=nil { return nil,err }
+	if len(iv)!=block.BlockSize() || len(ct)%block.BlockSize()!=0 { return nil,errMalformed }
+	
+	plain := make([]byte,len(ct))
+	cipher.NewCBCDecrypter(block,iv).CryptBlocks(plain,ct)
+	return unpad(plain,block.BlockSize())
+}
+
+func addAttribute(b *cryptobyte.Builder, oid asn1.ObjectIdentifier, value func(b *cryptobyte.Builder)) {
+	b.AddASN1(cbasn1.SEQUENCE,func(b *cryptobyte.Builder) {
+		b.AddASN1ObjectIdentifier(oid)
+		b.AddASN1(cbasn1.SET,value)
+	})
+}
+
+/*
+Signs the content as signed-data with SHA-256. The content is only included, if detached is
+false. The signer's certificate and chain are always included.
+*/
+func signData(content []byte, id *Identity, detached bool) ([]byte,error) {
+	signer,ok := id.Key.(crypto.Signer)
+	if !ok { return nil,errors.New("smime: private key can't sign") }
+	
+	var sigAlg asn1.ObjectIdentifier
+	switch signer.Public().(type) {
+	case *rsa.PublicKey: sigAlg = oidRSA
+	case *ecdsa.PublicKey: sigAlg = oidECDSASHA256
+	default: return nil,errors.New("smime: only RSA and ECDSA keys can sign")
+	}
+	
+	h := crypto.SHA256.New()
+	h.Write(content)
+	digest := h.Sum(nil)
+	
+	/* The signed attributes, sorted by their encoding, as DER requires for SET OF. */
+	var attrs [][]byte
+	for _,add := range []func(b *cryptobyte.Builder){
+		func(b *cryptobyte.Builder) { addAttribute(b,oidAttrContentType,func(b *cryptobyte.Builder) { b.AddASN1ObjectIdentifier(oidData) }) },
+		func(b *cryptobyte.Builder) { addAttribute(b,oidAttrSigningTime,func(b *cryptobyte.Builder) { b.AddASN1UTCTime(time.Now().UTC()) }) },
+		func(b *cryptobyte.Builder) { addAttribute(b,oidAttrMessageDigest,func(b *cryptobyte.Builder) { b.AddASN1OctetString(digest) }) },
+	} {
+		var b cryptobyte.Builder
+		add(&b)
+		attr,err := b.Bytes()
+		if err!=nil { return nil,err }
+		attrs = append(attrs,attr)
+	}
+	sort.Slice(attrs,func(i,j int) bool { return bytes.Compare(attrs[i],attrs[j])<0 })
+	
+	/* The signature covers the attributes as an explicit SET OF. */
+	var sb cryptobyte.Builder
+	sb.AddASN1(cbasn1.SET,func(b *cryptobyte.Builder) {
+		for _,a := range attrs { b.AddBytes(a) }
+	})
+	set,err := sb.Bytes()
+	if err!=nil { return nil,err }
+	h = crypto.SHA256.New()
+	h.Write(set)
+	sig,err := signer.Sign(rand.Reader,h.Sum(nil),crypto.SHA256)
+	if err!=nil { return nil,err }
+	
+	var b cryptobyte.Builder
+	b.AddASN1(cbasn1.SEQUENCE,func(b *cryptobyte.Builder) {
+		b.AddASN1ObjectIdentifier(oidSignedData)
+		b.AddASN1(tagExplicit0,func(b *cryptobyte.Builder) {
+			b.AddASN1(cbasn1.SEQUENCE,func(b *cryptobyte.Builder) {
+				b.AddASN1Int64(1)
+				b.AddASN1(cbasn1.SET,func(b *cryptobyte.Builder) { addAlgorithm(b,oidSHA256,false) })
+				b.AddASN1(cbasn1.SEQUENCE,func(b *cryptobyte.Builder) {
+					b.AddASN1ObjectIdentifier(oidData)
+					if !detached {
+						b.AddASN1(tagExplicit0,func(b *cryptobyte.Builder) { b.AddASN1OctetString(content) })
+					}
+				})
+				b.AddASN1(tagExplicit0,func(b *cryptobyte.Builder) {
+					b.AddBytes(id.Certificate.Raw)
+					for _,c := range id.Chain { b.AddBytes(c.Raw) }
+				})
+				b.AddASN1(cbasn1.SET,func(b *cryptobyte.Builder) {
+					b.AddASN1(cbasn1.SEQUENCE,func(b *cryptobyte.Builder) {
+						b.AddASN1Int64(1)
+						addIssuerAndSerial(b,id.Certificate)
+						addAlgorithm(b,oidSHA256,false)
+						b.AddASN1(tagExplicit0,func(b *cryptobyte.Builder) {
+							for _,a := range attrs { b.AddBytes(a) }
+						})
+						addAlgorithm(b,sigAlg,sigAlg.Equal(oidRSA))
+						b.AddASN1OctetString(sig)
+					})
+				})
+			})
+		})
+	})
+	return b.Bytes()
+}
+
+func verifySignature(pub crypto.PublicKey, alg asn1.ObjectIdentifier, h crypto.Hash, digest, sig []byte) error {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		if alg.Equal(oidRSAPSS) { return rsa.VerifyPSS(pub,h,digest,sig,nil) }
+		return rsa.VerifyPKCS1v15(pub,h,digest,sig)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub,digest,sig) { return errors.New("smime: ECDSA verification failure") }
+		return nil
+	}
+	return errors.New("smime: unsupported signature key")
+}
+
+/* Finds the message digest in the signed attributes. */
+func messageDigest(attrs cryptobyte.String) ([]byte,error) {
+	for !attrs.Empty() {
+		var attr,values cryptobyte.String
+		var oid asn1.ObjectIdentifier
+		if !attrs.ReadASN1(&attr,cbasn1.SEQUENCE) || !attr.ReadASN1ObjectIdentifier(&oid) || !attr.ReadASN1(&values,cbasn1.SET) {
+			return nil,errMalformed
+		}
+		if !oid.Equal(oidAttrMessageDigest) { continue }
+		var md []byte
+		if !values.ReadASN1Bytes(&md,cbasn1.OCTET_STRING) { return nil,errMalformed }
+		return md,nil
+	}
+	return nil,errors.New("smime: signed attributes without message digest")
+}
+
+/*
+Verifies all signatures of signed-data. detached is the content of a detached signature, nil
+otherwise. Returns the content and the signers' certificates. If roots is not nil, the signers'
+certificates must chain up to one of them.
+*/
+func verifySigned(content cryptobyte.String, detached []byte, roots *x509.CertPool) ([]byte,[]*x509.Certificate,error) {
+	var sd,digestAlgs,eci,rawCerts,sis cryptobyte.String
+	var version int
+	var ctype asn1.ObjectIdentifier
+	var hasCerts bool
+	if !content.ReadASN1(&sd,cbasn1.SEQUENCE) || !sd.ReadASN1Integer(&version) || !sd.ReadASN1(&digestAlgs,cbasn1.SET) ||
+		!sd.ReadASN1(&eci,cbasn1.SEQUENCE) || !eci.ReadASN1ObjectIdentifier(&ctype) ||
+		!sd.ReadOptionalASN1(&rawCerts,&hasCerts,tagExplicit0) || !sd.SkipOptionalASN1(tagExplicit1) ||
+		!sd.ReadASN1(&sis,cbasn1.SET) {
+		return nil,nil,errMalformed
+	}
+	
+	data := detached
+	var ec cryptobyte.String
+	var hasContent bool
+	if !eci.ReadOptionalASN1(&ec,&hasContent,tagExplicit0) { return nil,nil,errMalformed }
+	if hasContent {
+		if !ec.ReadASN1Bytes(&data,cbasn1.OCTET_STRING) { return nil,nil,errMalformed }
+	}
+	if data==nil { return nil,nil,errors.New("smime: signed-data without content") }
+	
+	var certs []*x509.Certificate
+	for !rawCerts.Empty() {
+		var raw cryptobyte.String
+		var tag cbasn1.Tag
+		if !rawCerts.ReadAnyASN1Element(&raw,&tag) { return nil,nil,errMalformed }
+		if tag!=cbasn1.SEQUENCE { continue }
+		c,err := x509.ParseCertificate(raw)
+		if err!=nil { return nil,nil,err }
+		certs = append(certs,c)
+	}
+	intermediates := x509.NewCertPool()
+	for _,c := range certs { intermediates.AddCert(c) }
+	
+	var signers []*x509.Certificate
+	for !sis.Empty() {
+		var si,sid,dalg,salg,attrs cryptobyte.String
+		var sidTag cbasn1.Tag
+		var doid,soid asn1.ObjectIdentifier
+		var sig []byte
+		if !sis.ReadASN1(&si,cbasn1.SEQUENCE) || !si.ReadASN1Integer(&version) || !si.ReadAnyASN1Element(&sid,&sidTag) ||
+			!si.ReadASN1(&dalg,cbasn1.SEQUENCE) || !dalg.ReadASN1ObjectIdentifier(&doid) {
+			return nil,nil,errMalformed
+		}
+		hasAttrs := si.PeekASN1Tag(tagExplicit0)
+		if hasAttrs && !si.ReadASN1Element(&attrs,tagExplicit0) { return nil,nil,errMalformed }
+		if !si.ReadASN1(&salg,cbasn1.SEQUENCE) || !salg.ReadASN1ObjectIdentifier(&soid) || !si.ReadASN1Bytes(&sig,cbasn1.OCTET_STRING) {
+			return nil,nil,errMalformed
+		}
+		
+		var cert *x509.Certificate
+		for _,c := range certs {
+			if matchID(sid,sidTag,c) { cert = c; break }
+		}
+		if cert==nil { return nil,nil,errors.New("smime: signer's certificate is missing") }
+		
+		h,ok := digestOIDs[doid.String()]
+		if !ok || !h.Available() { return nil,nil,fmt.Errorf("smime: unsupported digest algorithm %v",doid) }
+		hash := h.New()
+		hash.Write(data)
+		digest := hash.Sum(nil)
+		
+		if hasAttrs {
+			/* The signature covers the attributes, with the tag of an explicit SET OF. */
+			set := append([]byte(nil),attrs...)
+			set[0] = 0x31
+			var inner cryptobyte.String
+			if !attrs.ReadASN1(&inner,tagExplicit0) { return nil,nil,errMalformed }
+			md,err := messageDigest(inner)
+			if err!=nil { return nil,nil,err }
+			if !bytes.Equal(md,digest) { return nil,nil,errors.New("smime: message digest mismatch") }
+			hash = h.New()
+			hash.Write(set)
+			digest = hash.Sum(nil)
+		}
+		if err := verifySignature(cert.PublicKey,soid,h,digest,sig); err!=nil { return nil,nil,err }
+		
+		if roots!=nil {
+			opts := x509.VerifyOptions{
+				Roots: roots,
+				Intermediates: intermediates,
+				KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+			}
+			if _,err := cert.Verify(opts); err!=nil { return nil,nil,err }
+		}
+		signers = append(signers,cert)
+	}
+	if len(signers)==0 { return nil,nil,ErrNoSignature }
+	return data,signers,nil
+}
@@ -0,0 +1,421 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+/*
+Encrypts, signs and decrypts mails with S/MIME (RFC 8551), like epgpmessage does it with
+PGP/MIME.
+*/
+package smime
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+)
+
+/* A certificate with its private key. */
+type Identity struct {
+	Certificate *x509.Certificate
+	
+	/* Intermediate certificates, that are sent along with signatures. */
+	Chain []*x509.Certificate
+	
+	/* A *rsa.PrivateKey or, for signing only, an *ecdsa.PrivateKey. */
+	Key crypto.PrivateKey
+}
+
+/* The keys to decrypt messages with, and the certificates to trust signatures from. */
+type KeyRing struct {
+	Identities []*Identity
+	
+	/*
+	If nil, signatures are checked against the certificate included in the message, but the
+	certificate itself is not verified (see Details.Verified).
+	*/
+	Roots *x509.CertPool
+}
+
+/* What Decrypt found out about a message. */
+type Details struct {
+	Encrypted bool
+	Signed bool
+	
+	/* The certificates of the signers, if Signed. */
+	Signers []*x509.Certificate
+	
+	/*
+	True, if the certificates of all signers have been verified against KeyRing.Roots. Otherwise,
+	the signers are just the certificates included in the message, which anyone can create.
+	*/
+	Verified bool
+}
+
+/* Parses PEM encoded certificates, or DER encoded ones, if data is not PEM. */
+func ParseCertificates(data []byte) ([]*x509.Certificate, error) {
+	if !bytes.Contains(data,[]byte("-----BEGIN")) {
+		return x509.ParseCertificates(data)
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block,data = pem.Decode(data)
+		if block==nil { break }
+		if block.Type!="CERTIFICATE" { continue }
+		c,err := x509.ParseCertificate(block.Bytes)
+		if err!=nil { return nil,err }
+		certs = append(certs,c)
+	}
+	if len(certs)==0 { return nil,errors.New("smime: no certificate found") }
+	return certs,nil
+}
+
+/* Parses a PKCS#8 private key, PEM or DER encoded. */
+func ParsePrivateKey(data []byte) (crypto.PrivateKey, error) {
+	if block,_ := pem.Decode(data); block!=nil {
+		if block.Type!="PRIVATE KEY" {
+			return nil,fmt.Errorf("smime: expected a PKCS#8 private key, got %q",block.Type)
+		}
+		data = block.Bytes
+	}
+	return x509.ParsePKCS8PrivateKey(data)
+}
+
+/*
+Loads an identity from a certificate file (the user's certificate first, followed by the
+intermediates) and a PKCS#8 key file.
+*/
+func LoadIdentity(certFile, keyFile string) (*Identity, error) {
+	data,err := ioutil.ReadFile(certFile)
+	if err!=nil { return nil,err }
+	certs,err := ParseCertificates(data)
+	if err!=nil { return nil,err }
+	if len(certs)==0 { return nil,errors.New("smime: no certificate found") }
+	
+	data,err = ioutil.ReadFile(keyFile)
+	if err!=nil { return nil,err }
+	key,err := ParsePrivateKey(data)
+	if err!=nil { return nil,err }
+	
+	if priv,ok := key.(crypto.Signer); !ok {
+		return nil,errors.New("smime: unsupported private key")
+	} else if pub,ok := priv.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(certs[0].PublicKey) {
+		return nil,errors.New("smime: private key doesn't match the certificate")
+	}
+	return &Identity{certs[0],certs[1:],key},nil
+}
+
+func isContentField(k string) bool {
+	return strings.HasPrefix(strings.ToLower(k),"content-")
+}
+
+func filterHeader(h textproto.Header, del func(k string) bool) textproto.Header {
+	h = h.Copy()
+	for i := h.Fields(); i.Next(); {
+		if del(i.Key()) { i.Del() }
+	}
+	return h
+}
+
+/*
+Sets the fields of src in dst, replacing fields of dst with the same key. The order of src is
+kept.
+*/
+func mergeHeader(dst *textproto.Header, src textproto.Header) {
+	var keys, values []string
+	for i := src.Fields(); i.Next(); {
+		keys = append(keys,i.Key())
+		values = append(values,i.Value())
+	}
+	for _,k := range keys { dst.Del(k) }
+	/* Add() puts the field in front, so add them backwards. */
+	for i := len(keys)-1; i>=0; i-- { dst.Add(keys[i],values[i]) }
+}
+
+/* Converts all line endings to CRLF, as signatures are made over the canonical form. */
+func canonicalize(b []byte) []byte {
+	out := make([]byte,0,len(b)+len(b)/32)
+	for i,c := range b {
+		if c=='\n' && (i==0 || b[i-1]!='\r') { out = append(out,'\r') }
+		out = append(out,c)
+	}
+	return out
+}
+
+/* Splits a message into the header and the rest. */
+func readMessage(r io.Reader) (textproto.Header, []byte, error) {
+	br := bufio.NewReader(r)
+	h,err := textproto.ReadHeader(br)
+	if err!=nil { return textproto.Header{},nil,err }
+	body,err := ioutil.ReadAll(br)
+	return h,body,err
+}
+
+/* Serializes a MIME entity, in canonical form. */
+func entityBytes(h textproto.Header, body []byte) ([]byte,error) {
+	buf := new(bytes.Buffer)
+	if err := textproto.WriteHeader(buf,h); err!=nil { return nil,err }
+	buf.Write(body)
+	return canonicalize(buf.Bytes()),nil
+}
+
+/* Writes b as Base64, in lines of 76 characters. */
+func writeBase64(w io.Writer, b []byte) error {
+	s := base64.StdEncoding.EncodeToString(b)
+	for len(s)>0 {
+		n := 76
+		if n>len(s) { n = len(s) }
+		if _,err := io.WriteString(w,s[:n]+"\r\n"); err!=nil { return err }
+		s = s[n:]
+	}
+	return nil
+}
+
+func writePKCS7(w io.Writer, h textproto.Header, smimeType string, der []byte) error {
+	mh := message.Header{Header: h}
+	mh.SetContentType("application/pkcs7-mime",map[string]string{"smime-type":smimeType,"name":"smime.p7m"})
+	mh.SetContentDisposition("attachment",map[string]string{"filename":"smime.p7m"})
+	mh.Set("Content-Transfer-Encoding","base64")
+	if err := textproto.WriteHeader(w,mh.Header); err!=nil { return err }
+	return writeBase64(w,der)
+}
+
+func randomBoundary() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return "----smime-"+hex.EncodeToString(b[:])
+}
+
+/* Writes a multipart/signed entity (with the header h), that carries content and its signature. */
+func writeSigned(w io.Writer, h textproto.Header, content []byte, id *Identity) error {
+	sig,err := signData(content,id,true)
+	if err!=nil { return err }
+	
+	boundary := randomBoundary()
+	mh := message.Header{Header: h}
+	mh.SetContentType("multipart/signed",map[string]string{
+		"protocol": "application/pkcs7-signature",
+		"micalg": "sha-256",
+		"boundary": boundary,
+	})
+	if err = textproto.WriteHeader(w,mh.Header); err!=nil { return err }
+	
+	var sh textproto.Header
+	/* In reverse, Add() puts the field in front. */
+	sh.Add("Content-Disposition","attachment; filename=smime.p7s")
+	sh.Add("Content-Transfer-Encoding","base64")
+	sh.Add("Content-Type","application/pkcs7-signature; name=smime.p7s")
+	
+	if _,err = io.WriteString(w,"--"+boundary+"\r\n"); err!=nil { return err }
+	if _,err = w.Write(content); err!=nil { return err }
+	if _,err = io.WriteString(w,"\r\n--"+boundary+"\r\n"); err!=nil { return err }
+	if err = textproto.WriteHeader(w,sh); err!=nil { return err }
+	if err = writeBase64(w,sig); err!=nil { return err }
+	_,err = io.WriteString(w,"--"+boundary+"--\r\n")
+	return err
+}
+
+/*
+Signs a message as multipart/signed with a detached signature, so it stays readable for clients
+without S/MIME support.
+*/
+func Sign(w io.Writer, r io.Reader, signer *Identity) error {
+	h,body,err := readMessage(r)
+	if err!=nil { return err }
+	content,err := entityBytes(filterHeader(h,func(k string) bool { return !isContentField(k) }),body)
+	if err!=nil { return err }
+	return writeSigned(w,filterHeader(h,isContentField),content,signer)
+}
+
+/* Signs a message as application/pkcs7-mime signed-data, the content is inside the signature. */
+func SignOpaque(w io.Writer, r io.Reader, signer *Identity) error {
+	h,body,err := readMessage(r)
+	if err!=nil { return err }
+	content,err := entityBytes(filterHeader(h,func(k string) bool { return !isContentField(k) }),body)
+	if err!=nil { return err }
+	der,err := signData(content,signer,false)
+	if err!=nil { return err }
+	return writePKCS7(w,filterHeader(h,isContentField),"signed-data",der)
+}
+
+/*
+Encrypts a message as application/pkcs7-mime enveloped-data. The header, except for the
+Content-* fields, stays in the clear, as S/MIME doesn't protect it. If signed is not nil, the
+message is signed (as multipart/signed) before it is encrypted.
+*/
+func Encrypt(w io.Writer, r io.Reader, to []*x509.Certificate, signed *Identity) error {
+	h,body,err := readMessage(r)
+	if err!=nil { return err }
+	content,err := entityBytes(filterHeader(h,func(k string) bool { return !isContentField(k) }),body)
+	if err!=nil { return err }
+	if signed!=nil {
+		buf := new(bytes.Buffer)
+		if err = writeSigned(buf,textproto.Header{},content,signed); err!=nil { return err }
+		content = buf.Bytes()
+	}
+	der,err := encryptEnveloped(content,to)
+	if err!=nil { return err }
+	return writePKCS7(w,filterHeader(h,isContentField),"enveloped-data",der)
+}
+
+func isPKCS7(t string) bool {
+	return t=="application/pkcs7-mime" || t=="application/x-pkcs7-mime"
+}
+
+func isPKCS7Signature(t string) bool {
+	return t=="application/pkcs7-signature" || t=="application/x-pkcs7-signature"
+}
+
+/* Returns true, if the message is encrypted or signed with S/MIME. */
+func IsSMIME(h message.Header) bool {
+	t,m,err := h.ContentType()
+	if err!=nil { return false }
+	return isPKCS7(t) || (t=="multipart/signed" && isPKCS7Signature(strings.ToLower(m["protocol"])))
+}
+
+/* Decodes the (Base64 or binary) body of an application/pkcs7-* entity to DER. */
+func decodePKCS7(h textproto.Header, body []byte) ([]byte,error) {
+	e,err := message.New(message.Header{Header: h},bytes.NewReader(body))
+	if err!=nil && !message.IsUnknownCharset(err) { return nil,err }
+	ber,err := ioutil.ReadAll(e.Body)
+	if err!=nil { return nil,err }
+	return ber2der(ber)
+}
+
+/*
+Splits the body of a multipart/signed entity into the signed content (exactly as it was signed)
+and the signature part.
+*/
+func splitSigned(body []byte, boundary string) (content, sig []byte, err error) {
+	body = append([]byte("\r\n"),canonicalize(body)...)
+	delim := []byte("\r\n--"+boundary)
+	
+	var parts [][]byte
+	start := -1
+	for {
+		i := bytes.Index(body,delim)
+		if i<0 { break }
+		if start>=0 { parts = append(parts,body[:i]) }
+		body = body[i+len(delim):]
+		if bytes.HasPrefix(body,[]byte("--")) { start = -2; break }
+		/* Skip transport padding */
+		eol := bytes.Index(body,[]byte("\r\n"))
+		if eol<0 { break }
+		body = body[eol+2:]
+		start = 0
+	}
+	if start!=-2 || len(parts)!=2 {
+		return nil,nil,errors.New("smime: malformed multipart/signed")
+	}
+	return parts[0],parts[1],nil
+}
+
+/* The maximum number of nested S/MIME layers, that are unwrapped. */
+const maxDepth = 8
+
+/*
+Decrypts and verifies a message, like Decrypt, and tells what was found. Nested layers
+(e.g. signed, then encrypted) are all removed.
+*/
+func DecryptDetails(w io.Writer, r io.Reader, kr *KeyRing) (*Details, error) {
+	if kr==nil { kr = new(KeyRing) }
+	h,body,err := readMessage(r)
+	if err!=nil { return nil,err }
+	
+	/* The resulting header: the outer header, with the fields of the innermost entity applied. */
+	rh := h.Copy()
+	d := new(Details)
+	for depth := 0; ; depth++ {
+		t,m,err := (&message.Header{Header: h}).ContentType()
+		if err!=nil || !IsSMIME(message.Header{Header: h}) { break }
+		if depth>=maxDepth { return nil,errors.New("smime: too many nested layers") }
+		
+		var inner []byte
+		if isPKCS7(t) {
+			der,err := decodePKCS7(h,body)
+			if err!=nil { return nil,err }
+			ctype,content,err := parseContentInfo(der)
+			if err!=nil { return nil,err }
+			switch {
+			case ctype.Equal(oidEnvelopedData):
+				if inner,err = decryptEnveloped(content,kr.Identities); err!=nil { return nil,err }
+				d.Encrypted = true
+			case ctype.Equal(oidSignedData):
+				var signers []*x509.Certificate
+				if inner,signers,err = verifySigned(content,nil,kr.Roots); err!=nil { return nil,err }
+				d.Signed = true
+				d.Signers = append(d.Signers,signers...)
+			default:
+				return nil,fmt.Errorf("smime: unsupported content type %v",ctype)
+			}
+		} else {
+			content,sigPart,err := splitSigned(body,m["boundary"])
+			if err!=nil { return nil,err }
+			sh,sb,err := readMessage(bytes.NewReader(sigPart))
+			if err!=nil { return nil,err }
+			der,err := decodePKCS7(sh,sb)
+			if err!=nil { return nil,err }
+			ctype,sd,err := parseContentInfo(der)
+			if err!=nil { return nil,err }
+			if !ctype.Equal(oidSignedData) { return nil,ErrNoSignature }
+			_,signers,err := verifySigned(sd,content,kr.Roots)
+			if err!=nil { return nil,err }
+			d.Signed = true
+			d.Signers = append(d.Signers,signers...)
+			inner = content
+		}
+		
+		if h,body,err = readMessage(bytes.NewReader(inner)); err!=nil { return nil,err }
+		rh = filterHeader(rh,isContentField)
+		mergeHeader(&rh,h)
+	}
+	
+	/* verifySigned fails on certificates, that don't chain to the roots. */
+	d.Verified = d.Signed && kr.Roots!=nil
+	
+	if err = textproto.WriteHeader(w,rh); err!=nil { return nil,err }
+	_,err = w.Write(body)
+	return d,err
+}
+
+/*
+Decrypts a message encrypted with S/MIME and verifies its signatures, if any. A bad signature is
+an error. Messages, that are not S/MIME, are written unchanged.
+*/
+func Decrypt(w io.Writer, r io.Reader, kr *KeyRing) error {
+	_,err := DecryptDetails(w,r,kr)
+	return err
+}
@@ -0,0 +1,52 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+/*
+Expunges messages, without taking away the ones the user flagged \Deleted. go-imap backends
+have no UID EXPUNGE, so the mailbox is only expunged, if all the \Deleted messages are known.
+*/
+package imapexpunge
+
+import (
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+/*
+Expunges mbox, if no message other than those in uids is flagged \Deleted. Returns false, if
+the mailbox has not been expunged because of other \Deleted messages.
+*/
+func Only(mbox backend.Mailbox, uids []uint32) (bool,error) {
+	if len(uids)==0 { return true,nil }
+	ours := new(imap.SeqSet)
+	ours.AddNum(uids...)
+	
+	criteria := imap.NewSearchCriteria()
+	criteria.WithFlags = []string{imap.DeletedFlag}
+	all,err := mbox.SearchMessages(true,criteria)
+	if err!=nil { return false,err }
+	for _,uid := range all {
+		if !ours.Contains(uid) { return false,nil }
+	}
+	return true,mbox.Expunge()
+}